@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+
+	common "github.com/yago-123/galelb/config"
 	lbConfig "github.com/yago-123/galelb/config/lb"
 
 	"github.com/sirupsen/logrus"
@@ -9,14 +12,34 @@ import (
 
 var rootCmd = &cobra.Command{
 	Use: "gale-lb",
-	Run: func(cmd *cobra.Command, _ []string) {
-		cfg = lbConfig.InitConfig(cmd)
+	// Errors are logged by Execute, the usage is only printed on demand
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		var err error
+		cfg, err = lbConfig.InitConfig(cmd)
+		if err != nil {
+			return fmt.Errorf("failed to initialize configuration: %w", err)
+		}
+
+		run(cmd)
+
+		return nil
 	},
 }
 
 func Execute(logger *logrus.Logger) {
 	lbConfig.AddConfigFlags(rootCmd)
 
+	addExplainFlags(explainCmd)
+	rootCmd.AddCommand(explainCmd)
+	rootCmd.AddCommand(common.NewValidateConfigCommand(lbConfig.DefaultConfigFile, lbConfig.ValidateFile))
+	rootCmd.AddCommand(common.NewPrintConfigCommand(lbConfig.DefaultConfigFile, lbConfig.EnvPrefix,
+		func(layers common.Layers) (any, common.Loaded, error) {
+			return lbConfig.Load(layers)
+		},
+	))
+
 	if err := rootCmd.Execute(); err != nil {
 		logger.Fatalf("error executing command: %v", err)
 	}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yago-123/galelb/pkg/auth"
+)
+
+const (
+	KeyExplainAPI     = "api"
+	KeyExplainIP      = "ip"
+	KeyExplainPort    = "port"
+	KeyExplainService = "service"
+	KeyExplainToken   = "token"
+	KeyExplainCACert  = "ca-cert"
+	KeyExplainCert    = "cert"
+	KeyExplainKey     = "key"
+
+	DefaultExplainAPI     = "127.0.0.1:5555"
+	DefaultExplainService = "default"
+
+	ExplainRequestTimeout = 5 * time.Second
+	ExplainRoutingPath    = "/routing/explain"
+)
+
+var explainCmd = &cobra.Command{
+	Use:   "explain",
+	Short: "Explain which backend will serve a client connection",
+	Long: "Query the API of a running load balancer for the backend that will serve a client connection, the " +
+		"position of the client in the ring, the fallback backends and whether the affinity table overrides the ring",
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		api, _ := cmd.Flags().GetString(KeyExplainAPI)
+		ip, _ := cmd.Flags().GetString(KeyExplainIP)
+		port, _ := cmd.Flags().GetUint16(KeyExplainPort)
+		service, _ := cmd.Flags().GetString(KeyExplainService)
+
+		client, err := newAPIClient(cmd)
+		if err != nil {
+			return err
+		}
+
+		return explainRouting(cmd.Context(), client, api, ip, port, service)
+	},
+}
+
+// apiClient contains the parameters for connecting to the load balancer API
+type apiClient struct {
+	http   *http.Client
+	scheme string
+	token  string
+}
+
+// newAPIClient creates the client for the load balancer API. HTTPS is used if a CA or a client certificate is given
+func newAPIClient(cmd *cobra.Command) (*apiClient, error) {
+	token, _ := cmd.Flags().GetString(KeyExplainToken)
+	caCert, _ := cmd.Flags().GetString(KeyExplainCACert)
+	cert, _ := cmd.Flags().GetString(KeyExplainCert)
+	key, _ := cmd.Flags().GetString(KeyExplainKey)
+
+	client := &apiClient{http: http.DefaultClient, scheme: "http", token: token}
+	if caCert == "" && cert == "" {
+		return client, nil
+	}
+
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caCert != "" {
+		pool, err := auth.LoadCertPool(caCert)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cert != "" {
+		keyPair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{keyPair}
+	}
+
+	client.http = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+	client.scheme = "https"
+
+	return client, nil
+}
+
+func addExplainFlags(cmd *cobra.Command) {
+	cmd.Flags().String(KeyExplainAPI, DefaultExplainAPI, "Address of the load balancer API")
+	cmd.Flags().String(KeyExplainIP, "", "IP of the client")
+	cmd.Flags().Uint16(KeyExplainPort, 0, "Port of the client")
+	cmd.Flags().String(KeyExplainService, DefaultExplainService, "Name or port of the service")
+	cmd.Flags().String(KeyExplainToken, "", "Bearer token for the load balancer API")
+	cmd.Flags().String(KeyExplainCACert, "", "CA certificate for verifying the load balancer API (enables HTTPS)")
+	cmd.Flags().String(KeyExplainCert, "", "Client certificate for the load balancer API (enables HTTPS)")
+	cmd.Flags().String(KeyExplainKey, "", "Key of the client certificate")
+
+	_ = cmd.MarkFlagRequired(KeyExplainIP)
+	_ = cmd.MarkFlagRequired(KeyExplainPort)
+}
+
+// explainRouting queries the load balancer API and prints the explanation
+func explainRouting(ctx context.Context, client *apiClient, api, ip string, port uint16, service string) error {
+	ctx, cancel := context.WithTimeout(ctx, ExplainRequestTimeout)
+	defer cancel()
+
+	query := url.Values{}
+	query.Set(KeyExplainIP, ip)
+	query.Set(KeyExplainPort, strconv.Itoa(int(port)))
+	query.Set(KeyExplainService, service)
+
+	endpoint := url.URL{Scheme: client.scheme, Host: api, Path: ExplainRoutingPath, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if client.token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.token)
+	}
+
+	resp, err := client.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to query load balancer API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var out bytes.Buffer
+	if err = json.Indent(&out, body, "", "  "); err != nil {
+		out.Reset()
+		out.Write(body)
+	}
+	out.WriteString("\n")
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("load balancer API returned %s: %s", resp.Status, out.String())
+	}
+
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
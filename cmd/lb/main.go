@@ -1,39 +1,102 @@
 package main
 
 import (
+	"context"
+	"net/netip"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	lbAPIV1 "github.com/yago-123/galelb/pkg/lbnetwork/api/v1"
 	"github.com/yago-123/galelb/pkg/lbnetwork/nodemanager"
 	"github.com/yago-123/galelb/pkg/registry"
+	"github.com/yago-123/galelb/pkg/routing"
+	"github.com/yago-123/galelb/pkg/tracing"
+	"github.com/yago-123/galelb/pkg/util"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	common "github.com/yago-123/galelb/config"
 	lbConfig "github.com/yago-123/galelb/config/lb"
 )
 
+const (
+	TracingServiceName     = "gale-lb"
+	TracingShutdownTimeout = 5 * time.Second
+)
+
 var cfg *lbConfig.Config
 
 func main() {
 	// Execute the root command
 	Execute(logrus.New())
+}
 
+// run starts the load balancer, invoked once the root command has loaded the configuration
+func run(cmd *cobra.Command) {
 	cfg.Logger.SetLevel(logrus.DebugLevel)
 
-	cfg.Logger.Infof("starting load balancer with config: %v", cfg)
+	cfg.Logger.Infof("starting load balancer with config: %s", common.FormatParameters(cfg))
+
+	// Export traces of node registrations and routing changes
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, TracingServiceName)
+	if err != nil {
+		cfg.Logger.Fatalf("failed to set up tracing: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), TracingShutdownTimeout)
+		defer cancel()
+
+		if errTracing := shutdownTracing(ctx); errTracing != nil {
+			cfg.Logger.Errorf("failed to flush traces: %v", errTracing)
+		}
+	}()
 
 	// Create routing mechanism with consistent hashing (5 virtual nodes per real node)
-	// router, err := routing.New(cfg, 5)
-	// if err != nil {
-	// 	cfg.Logger.Fatalf("failed to create router: %s", err)
-	// }
+	router, err := routing.New(cfg, 5)
+	if err != nil {
+		cfg.Logger.Fatalf("failed to create router: %s", err)
+	}
 
 	// Create registry for managing nodes
-	nodeRegistry := registry.New(cfg.Logger)
+	nodeRegistry := registry.New(cfg)
 
-	// Create API for querying load balancer
-	lbAPI := lbAPIV1.New(cfg, nodeRegistry)
+	// Keep the routing rings in sync with the nodes eligible for routing
+	nodeRegistry.Subscribe(func(ctx context.Context, eligible []netip.Addr) {
+		if errSync := router.SyncEligibleNodes(ctx, eligible); errSync != nil {
+			cfg.Logger.Errorf("failed to sync routing with eligible nodes: %v", errSync)
+		}
+	})
+	// Draining nodes are drained once the clients kept on them by the affinity table and their connections are gone
+	nodeRegistry.SetDrainChecker(router.ServesClients)
 
 	// Create gRPC server for managing nodes
 	server := nodemanager.New(cfg, nodeRegistry)
-	server.Start()
+
+	// Reload the configuration on SIGHUP or through the API, applying the changes that are safe to apply live
+	reloader := lbConfig.NewReloader(cfg, func() (*lbConfig.Config, error) {
+		return lbConfig.LoadConfig(cmd)
+	})
+	reloader.Subscribe(lbConfig.ReloadListener{Apply: nodeRegistry.ApplyConfig})
+	reloader.Subscribe(lbConfig.ReloadListener{Validate: server.ValidateConfig, Apply: server.ApplyConfig})
+	reloader.Subscribe(lbConfig.ReloadListener{Validate: router.ValidateConfig, Apply: router.ApplyConfig})
+	go reloadOnSignal(reloader)
+
+	// Collect the metrics exposed by the API
+	metricsRegistry := prometheus.NewRegistry()
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		nodeRegistry.Collector(),
+		server.Collector(),
+		router.Collector(),
+	)
+
+	// Create API for querying load balancer
+	lbAPI := lbAPIV1.New(cfg, nodeRegistry, router, reloader, server, nodemanager.NewEventStreamer(nodeRegistry, cfg.Logger), metricsRegistry)
 
 	// Start the load balancer API
 	go func() {
@@ -47,13 +110,50 @@ func main() {
 		}
 	}()
 
-	// Add some nodes
-	// router.AddNode(common.AddrKey{}, "192.168.1.2", 9091)
-	// router.AddNode(common.AddrKey{}, "192.168.1.3", 9091)
-	// router.AddNode(common.AddrKey{}, "192.168.1.4", 9091)
+	// Announce the load balancer via multicast DNS, so that nodes can find it as <hostname>.local or by browsing the
+	// service
+	if cfg.MDNS.Enabled {
+		responder, errMDNS := util.NewMulticastDNSResponder(cfg.Logger, cfg.PrivateInterface.NetIfacePrivate, cfg.MDNS.Hostname, cfg.PrivateInterface.NodePort)
+		if errMDNS != nil {
+			cfg.Logger.Fatalf("failed to start mDNS responder: %v", errMDNS)
+		}
+
+		go func() {
+			if errResponder := responder.Start(); errResponder != nil {
+				cfg.Logger.Errorf("mDNS responder stopped: %v", errResponder)
+			}
+		}()
+		defer func() {
+			if errResponder := responder.Stop(); errResponder != nil {
+				cfg.Logger.Errorf("failed to stop mDNS responder: %v", errResponder)
+			}
+		}()
+	}
+
+	// Serve the nodes in a BLOCKING manner
+	server.Start()
+}
 
-	// Hash the IP of a request
-	// for i := 0; i < 15; i++ {
-	// 	cfg.Logger.Infof("request from IP will be routed to %s\n", router.GetNode([]byte(fmt.Sprintf("113.168.1.1%d", i))))
-	// }
+// reloadOnSignal reloads the configuration each time that the process receives a SIGHUP
+func reloadOnSignal(reloader *lbConfig.Reloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		cfg.Logger.Infof("received SIGHUP, reloading configuration")
+
+		report, err := reloader.Reload()
+		for _, change := range report.Refused {
+			cfg.Logger.Errorf("configuration change requires a restart: %s", change)
+		}
+		if err != nil {
+			cfg.Logger.Errorf("failed to reload configuration: %v", err)
+			continue
+		}
+
+		for _, change := range report.Applied {
+			cfg.Logger.Infof("applied configuration change: %s", change)
+		}
+		cfg.Logger.Infof("configuration reloaded with %d changes", len(report.Applied))
+	}
 }
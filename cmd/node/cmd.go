@@ -1,21 +1,42 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	common "github.com/yago-123/galelb/config"
 	nodeConfig "github.com/yago-123/galelb/config/node"
 )
 
 var rootCmd = &cobra.Command{
 	Use: "gale-node",
-	Run: func(cmd *cobra.Command, _ []string) {
-		cfg = nodeConfig.InitConfig(cmd)
+	// Errors are logged by Execute, the usage is only printed on demand
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		var err error
+		cfg, err = nodeConfig.InitConfig(cmd)
+		if err != nil {
+			return fmt.Errorf("failed to initialize configuration: %w", err)
+		}
+
+		run()
+
+		return nil
 	},
 }
 
 func Execute(logger *logrus.Logger) {
 	nodeConfig.AddConfigFlags(rootCmd)
 
+	rootCmd.AddCommand(common.NewValidateConfigCommand(nodeConfig.DefaultConfigFile, nodeConfig.ValidateFile))
+	rootCmd.AddCommand(common.NewPrintConfigCommand(nodeConfig.DefaultConfigFile, nodeConfig.EnvPrefix,
+		func(layers common.Layers) (any, common.Loaded, error) {
+			return nodeConfig.Load(layers)
+		},
+	))
+
 	if err := rootCmd.Execute(); err != nil {
 		logger.Fatalf("error executing command: %v", err)
 	}
@@ -2,56 +2,98 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"net"
 	"time"
 
 	nodeAPIV1 "github.com/yago-123/galelb/pkg/nodenetwork/api/v1"
 
-	"github.com/yago-123/galelb/pkg/util"
-
+	common "github.com/yago-123/galelb/config"
 	nodeConfig "github.com/yago-123/galelb/config/node"
 	nodeNet "github.com/yago-123/galelb/pkg/nodenetwork"
+	"github.com/yago-123/galelb/pkg/tracing"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	HostnameResolveTimeout = 5 * time.Second
+	TracingServiceName     = "gale-node"
+	TracingShutdownTimeout = 5 * time.Second
 )
 
 var cfg *nodeConfig.Config
 
 func main() {
+	// Execute the root command
 	Execute(logrus.New())
+}
 
+// run starts the node, invoked once the root command has loaded the configuration
+func run() {
 	cfg.Logger.SetLevel(logrus.DebugLevel)
 
-	cfg.Logger.Infof("starting node with config: %v", cfg)
+	cfg.Logger.Infof("starting node with config: %s", common.FormatParameters(cfg))
 
-	targets, err := retrieveIPAndPorts(cfg)
+	// Export traces of the health reports sent to the load balancers
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, TracingServiceName)
 	if err != nil {
-		cfg.Logger.Fatalf("failed to retrieve IP and ports: %v", err)
+		cfg.Logger.Fatalf("failed to set up tracing: %v", err)
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), TracingShutdownTimeout)
+		defer cancel()
 
-	// Create dispatcher for managing requests towards the load balancers
-	dispatcher := nodeNet.NewDispatcher(cfg, targets)
-
-	// Create API for querying the node
-	nodeAPI := nodeAPIV1.New(cfg, dispatcher)
-
-	// Start the node API
-	go func() {
-		if errAPI := nodeAPI.Start(); errAPI != nil {
-			cfg.Logger.Errorf("failed to start node API: %v", errAPI)
+		if errTracing := shutdownTracing(ctx); errTracing != nil {
+			cfg.Logger.Errorf("failed to flush traces: %v", errTracing)
 		}
 	}()
 
-	defer func() {
-		if errAPI := nodeAPI.Stop(); errAPI != nil {
-			cfg.Logger.Errorf("failed to stop node API: %v", errAPI)
-		}
-	}()
+	// Resolve the load balancers, the ones discovered via SRV records or multicast DNS are resolved again periodically
+	resolver := nodeNet.NewResolver(cfg)
+	targets, err := resolver.Resolve(context.Background())
+	if err != nil {
+		// The addresses that failed are resolved again on the next discovery
+		cfg.Logger.Errorf("failed to resolve some load balancer addresses: %v", err)
+	}
+	for key := range targets {
+		cfg.Logger.Debugf("resolved load balancer %s", key)
+	}
+
+	// Create the checker of the local services, which determines the health status reported to the load balancers
+	checker, err := nodeNet.NewChecker(cfg.HealthChecks)
+	if err != nil {
+		cfg.Logger.Fatalf("failed to configure health checks: %v", err)
+	}
+
+	// Create dispatcher for managing requests towards the load balancers
+	dispatcher := nodeNet.NewDispatcher(cfg, targets, checker)
+	dispatcher.Discover(resolver)
+
+	// Collect the metrics exposed by the API
+	metricsRegistry := prometheus.NewRegistry()
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		dispatcher.Collector(),
+	)
+
+	// Create API for querying the node, unless disabled
+	if cfg.API.Enabled {
+		nodeAPI := nodeAPIV1.New(cfg, dispatcher, metricsRegistry)
+
+		// Start the node API
+		go func() {
+			if errAPI := nodeAPI.Start(); errAPI != nil {
+				cfg.Logger.Errorf("failed to start node API: %v", errAPI)
+			}
+		}()
+
+		defer func() {
+			if errAPI := nodeAPI.Stop(); errAPI != nil {
+				cfg.Logger.Errorf("failed to stop node API: %v", errAPI)
+			}
+		}()
+	}
 
 	if errDisp := dispatcher.Start(); errDisp != nil {
 		cfg.Logger.Errorf("failed running dispatcher: %v", errDisp)
@@ -65,67 +107,3 @@ func main() {
 
 	// todo(); add some logic for stopping the node in here
 }
-
-// retrieveIPAndPorts retrieves the IP addresses and ports from the configuration file and returns a map of targets. It
-// also does basic checking and hostname resolution if the IP is not set.
-func retrieveIPAndPorts(cfg *nodeConfig.Config) (map[string]nodeNet.Target, error) {
-	targets := make(map[string]nodeNet.Target)
-
-	for idx, address := range cfg.LoadBalancer.Addresses {
-		if address.Port == 0 {
-			return nil, fmt.Errorf("port at config index %d is not set", idx)
-		}
-
-		if address.IP == "" && address.Hostname == "" {
-			return nil, fmt.Errorf("invalid address configuration, IP nor hostname is defined for index %d", idx)
-		}
-
-		// If the IP is not set, resolve the hostname via multicast DNS or regular DNS
-		if address.IP == "" && address.Hostname != "" {
-			ctx, cancel := context.WithTimeout(context.Background(), HostnameResolveTimeout)
-			defer cancel()
-
-			ips, err := resolveHostname(ctx, address.Hostname)
-			if err != nil {
-				return nil, fmt.Errorf("failed to resolve hostname %s: %w", address.Hostname, err)
-			}
-			if len(ips) == 0 {
-				return nil, fmt.Errorf("no IP addresses found for hostname: %s", address.Hostname)
-			}
-
-			cfg.Logger.Debugf("resolved hostname %s to IP %s", address.Hostname, ips[0].String())
-
-			// notice this will not overwrite the original configuration
-			address.IP = ips[0].String()
-		}
-
-		target := nodeNet.Target{
-			IP:   address.IP,
-			Port: address.Port,
-		}
-
-		targets[target.String()] = target
-	}
-
-	return targets, nil
-}
-
-func resolveHostname(ctx context.Context, host string) ([]net.IP, error) {
-	var err error
-	ips := []net.IP{}
-
-	if util.IsMultiCastDNS(host) {
-		ips, err = util.ResolveMulticastDNS(ctx, host)
-		if err != nil {
-			return nil, fmt.Errorf("failed to resolve multicast DNS %s: %w", host, err)
-		}
-	} else if !util.IsMultiCastDNS(host) {
-		// todo(): modify this to use the DNS server from the configuration
-		ips, err = util.ResolveDNS(ctx, host, "127.0.0.1:53")
-		if err != nil {
-			return nil, fmt.Errorf("failed to resolve hostname from configuration %s: %w", host, err)
-		}
-	}
-
-	return ips, nil
-}
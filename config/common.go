@@ -9,27 +9,68 @@ import (
 )
 
 const (
-	KeyConfigFile = "config"
+	KeyConfigFile     = "config"
+	KeyConfigDir      = "config-dir"
+	KeySkipHostChecks = "skip-host-checks"
+
+	DefaultTracingSampleRatio = 1.0
 )
 
-// LoadConfig loads the configuration from the specified path
-func LoadConfig[V any](path string, cfg *V) (*V, error) {
-	if path == "" {
-		return nil, errors.New("config path not specified")
-	}
+// APIAuth configures the authentication of an HTTP API. The API is left open if neither tokens nor client
+// certificates are configured
+type APIAuth struct {
+	// Tokens contains the bearer tokens accepted by the API along with the role granted to them
+	Tokens []APIToken `mapstructure:"tokens"`
+	// TLSCertFile and TLSKeyFile enable HTTPS in the API. Strongly recommended when using tokens
+	TLSCertFile string `mapstructure:"tls_cert_file"`
+	TLSKeyFile  string `mapstructure:"tls_key_file"`
+	// ClientCAFile enables client certificate authentication, certificates must be signed by this CA and their common
+	// name must be listed in ClientCertificates
+	ClientCAFile       string                 `mapstructure:"client_ca_file"`
+	ClientCertificates []APIClientCertificate `mapstructure:"client_certificates"`
+}
 
-	viper.SetConfigFile(path)
-	viper.AutomaticEnv()
+// APIToken is a bearer token accepted by the API. Role is either "read_only" (GET requests) or "admin"
+type APIToken struct {
+	Token string `mapstructure:"token"`
+	Role  string `mapstructure:"role"`
+}
 
-	if err := viper.ReadInConfig(); err != nil {
-		return nil, fmt.Errorf("failed to load config file: %w", err)
-	}
+// APIClientCertificate grants a role to the client certificates with the given common name
+type APIClientCertificate struct {
+	CommonName string `mapstructure:"common_name"`
+	Role       string `mapstructure:"role"`
+}
 
-	if err := viper.Unmarshal(&cfg); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
-	}
+// TLS configures the mutual TLS authentication of the channel between nodes and load balancers. Both sides present a
+// certificate signed by the CA of the other side
+type TLS struct {
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	CAFile   string `mapstructure:"ca_file"`
+	// ServerName overrides the name used to verify the certificate of the load balancer, only used by nodes
+	ServerName string `mapstructure:"server_name"`
+}
+
+// Enabled returns whether mutual TLS has been configured
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != "" || t.CAFile != ""
+}
+
+// Tracing configures the export of OpenTelemetry traces via OTLP. Tracing is disabled if no endpoint is set
+type Tracing struct {
+	// Endpoint is the address of the OTLP gRPC collector (ex: localhost:4317)
+	Endpoint string `mapstructure:"endpoint"`
+	// Insecure disables TLS towards the collector, meant for collectors running in the same host
+	Insecure bool `mapstructure:"insecure"`
+	// SampleRatio is the fraction of traces sampled, between 0 and 1. Traces started by a remote sampled parent are
+	// always sampled
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
 
-	return cfg, nil
+// Enabled returns whether traces are exported
+func (t Tracing) Enabled() bool {
+	return t.Endpoint != ""
 }
 
 // GetConfigFilePath retrieves the configuration file path from command flags
@@ -39,3 +80,103 @@ func GetConfigFilePath(cmd *cobra.Command) string {
 	}
 	return ""
 }
+
+// GetConfigDir retrieves the configuration directory from command flags
+func GetConfigDir(cmd *cobra.Command) string {
+	dir, _ := cmd.Flags().GetString(KeyConfigDir)
+	return dir
+}
+
+// AddSourceFlags defines the flags that select the configuration files, used by the commands that load the
+// configuration on their own
+func AddSourceFlags(cmd *cobra.Command, defaultConfigFile string) {
+	cmd.Flags().String(KeyConfigFile, defaultConfigFile, "config file")
+	cmd.Flags().String(KeyConfigDir, "", "directory whose *.toml files are merged on top of the config file")
+}
+
+// sourceLayers returns the configuration files selected by the flags of AddSourceFlags
+func sourceLayers(cmd *cobra.Command) Layers {
+	file, _ := cmd.Flags().GetString(KeyConfigFile)
+	return Layers{File: file, Dir: GetConfigDir(cmd)}
+}
+
+// NewValidateConfigCommand creates the command that validates a configuration file without starting the binary,
+// meant for checking configurations in CI. All the problems found are listed and make the command fail, warnings are
+// listed too but do not
+func NewValidateConfigCommand(
+	defaultConfigFile string,
+	validate func(layers Layers, checkHost bool) ([]Problem, error),
+) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "validate-config",
+		Short: "Validate a configuration file",
+		Long: "Validate a configuration file and report all the problems found. Checks that depend on the host, like " +
+			"the existence of network interfaces and files, can be skipped when validating in another machine",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			layers := sourceLayers(cmd)
+			path := layers.File
+			skipHostChecks, _ := cmd.Flags().GetBool(KeySkipHostChecks)
+
+			warnings, err := validate(layers, !skipHostChecks)
+			for _, warning := range warnings {
+				cmd.PrintErrf("warning: %s\n", warning)
+			}
+
+			var validationErr *ValidationError
+			if errors.As(err, &validationErr) {
+				for _, problem := range validationErr.Problems {
+					cmd.PrintErrf("error: %s\n", problem)
+				}
+
+				return fmt.Errorf("%s: %w, %d problems found", path, ErrInvalidConfig, len(validationErr.Problems))
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: configuration is valid\n", path)
+
+			return nil
+		},
+	}
+
+	AddSourceFlags(cmd, defaultConfigFile)
+	cmd.Flags().Bool(KeySkipHostChecks, false, "skip the checks that depend on the host (network interfaces, files)")
+
+	return cmd
+}
+
+// NewPrintConfigCommand creates the command that prints the effective configuration, merged from the configuration
+// files and the environment variables, along with the source of each parameter. Secrets are redacted
+func NewPrintConfigCommand(defaultConfigFile, envPrefix string, load func(layers Layers) (any, Loaded, error)) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "print-config",
+		Short: "Print the effective configuration and the source of each parameter",
+		Long: "Print the configuration resulting from merging the defaults, the config file, the files of the config " +
+			"directory and the " + envPrefix + "_* environment variables, along with the source of each parameter",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			layers := sourceLayers(cmd)
+			layers.EnvPrefix = envPrefix
+
+			cfg, loaded, err := load(layers)
+			if err != nil {
+				return err
+			}
+
+			for _, param := range Parameters(cfg) {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s = %s # %s\n", param.Key, FormatValue(param), loaded.Origins[param.Key])
+			}
+			for _, key := range loaded.Unknown {
+				cmd.PrintErrf("warning: %s: unknown configuration key, ignored\n", key)
+			}
+
+			return nil
+		},
+	}
+
+	AddSourceFlags(cmd, defaultConfigFile)
+
+	return cmd
+}
@@ -25,6 +25,14 @@ const (
 	KeyNodeHealthChecksTimeout       = "node_health.checks_timeout"
 	KeyNodeHealthBlackListAfterFails = "node_health.black_list_after_fails"
 	KeyNodeHealthBlackListExpiry     = "node_health.black_list_expiry"
+
+	// Node rate limit options
+	KeyNodeRateLimitRate  = "node_rate_limit.rate"
+	KeyNodeRateLimitBurst = "node_rate_limit.burst"
+
+	// Multicast DNS options
+	KeyMDNSEnabled  = "mdns.enabled"
+	KeyMDNSHostname = "mdns.hostname"
 )
 
 const (
@@ -42,13 +50,47 @@ const (
 	DefaultNodeHealthBlackListAfterFails = -1
 	DefaultNodeHealthBlackListExpiry     = 60 * time.Second
 
+	DefaultNodeRateLimitRate  = 1.0
+	DefaultNodeRateLimitBurst = 10
+
+	DefaultMDNSEnabled  = false
+	DefaultMDNSHostname = ""
+
+	DefaultServiceName            = "default"
+	DefaultServiceAffinity        = AffinitySourceIP
+	DefaultServiceAffinityTimeout = 10 * time.Minute
+	DefaultServiceFailbackDelay   = 30 * time.Second
+
 	DefaultConfigFile = "lb.toml"
+
+	// EnvPrefix prefixes the environment variables overriding the parameters (ex: GALE_LB_NODE_HEALTH_CHECKS_TIMEOUT)
+	EnvPrefix = "GALE_LB"
 )
 
+const (
+	// AffinityNone spreads the connections of the clients across the backends, the rest of the policies keep the
+	// connections from the same source IP, source IP and port or source /24 subnet on the same backend
+	AffinityNone         = "none"
+	AffinitySourceIP     = "source_ip"
+	AffinitySourceIPPort = "source_ip_port"
+	AffinitySourceSubnet = "source_subnet"
+)
+
+// MaxServices is the number of services the datapath can route, kept in sync with MAX_NUMBER_SERVICES of
+// pkg/routing/constants.h
+const MaxServices = 64
+
 type Config struct {
 	PrivateInterface PrivateInterface `mapstructure:"private_interface"`
 	PublicInterface  PublicInterface  `mapstructure:"public_interface"`
 	NodeHealth       NodeHealth       `mapstructure:"node_health"`
+	NodeRateLimit    NodeRateLimit    `mapstructure:"node_rate_limit"`
+	Services         []Service        `mapstructure:"services"`
+	APIAuth          common.APIAuth   `mapstructure:"api_auth"`
+	NodeTLS          common.TLS       `mapstructure:"node_tls"`
+	Admission        Admission        `mapstructure:"admission"`
+	Tracing          common.Tracing   `mapstructure:"tracing"`
+	MDNS             MDNS             `mapstructure:"mdns"`
 	Logger           *logrus.Logger
 }
 
@@ -83,6 +125,66 @@ type NodeHealth struct {
 	BlackListExpiry time.Duration `mapstructure:"black_list_expiry"`
 }
 
+// NodeRateLimit limits the RPCs that each node IP can open against the load balancer, so that misbehaving nodes
+// reconnecting in a loop do not exhaust its resources
+type NodeRateLimit struct {
+	// Rate is the number of RPCs per second allowed for each node IP. Zero disables the limit
+	Rate float64 `mapstructure:"rate"`
+	// Burst is the number of RPCs that can be opened at once before the rate applies
+	Burst int `mapstructure:"burst"`
+}
+
+// MDNS announces the load balancer via multicast DNS in the private interface, so that nodes can find it by hostname
+// or by browsing the _galelb._tcp.local service without running a responder such as Avahi
+type MDNS struct {
+	// Enabled answers the multicast DNS queries for Hostname and the service
+	Enabled bool `mapstructure:"enabled"`
+	// Hostname is announced with the addresses of the private interface, a single label in the .local domain (ex:
+	// "lb-0.local"). The service instance announced is named after it and points to the node port
+	Hostname string `mapstructure:"hostname"`
+}
+
+// Admission restricts which nodes can register in the load balancer. Each non-empty list must be satisfied by the
+// node, if all of them are empty any node is admitted
+type Admission struct {
+	// Tokens contains the join tokens accepted, nodes present one of them in their first health status
+	Tokens []string `mapstructure:"tokens"`
+	// AllowedCIDRs contains the networks from which nodes can connect
+	AllowedCIDRs []string `mapstructure:"allowed_cidrs"`
+	// AllowedNodeIDs contains the IDs of the nodes admitted. Only meaningful with node TLS enabled, as the ID is
+	// taken from the node certificate
+	AllowedNodeIDs []string `mapstructure:"allowed_node_ids"`
+}
+
+type Service struct {
+	// Name identifies the service
+	Name string `mapstructure:"name"`
+	// Port is the port in the public interface in which clients connect to the service
+	Port int `mapstructure:"port"`
+	// Affinity defines which part of the client connection is used for selecting the backend: "source_ip",
+	// "source_ip_port", "source_subnet" (/24) or "none"
+	Affinity string `mapstructure:"affinity"`
+	// AffinityTimeout is the time that clients are kept on the same backend since their last packet, even if the
+	// routing ring changes in the meantime. Zero disables it
+	AffinityTimeout time.Duration `mapstructure:"affinity_timeout"`
+	// Pools are the ordered backend pools of the service. If empty, all the nodes eligible for routing serve the
+	// service
+	Pools []Pool `mapstructure:"pools"`
+	// FailbackDelay is the time that a pool must remain above its minimum of healthy nodes before the traffic
+	// switches back to it from the lower priority pools
+	FailbackDelay time.Duration `mapstructure:"failback_delay"`
+}
+
+type Pool struct {
+	// Name identifies the pool
+	Name string `mapstructure:"name"`
+	// Nodes contains the CIDRs of the nodes that belong to the pool
+	Nodes []string `mapstructure:"nodes"`
+	// MinHealthy is the minimum number of nodes eligible for routing in the pool. Once the pool drops below it, the
+	// next pool is activated too
+	MinHealthy int `mapstructure:"min_healthy"`
+}
+
 func New() *Config {
 	return &Config{
 		PrivateInterface: PrivateInterface{
@@ -100,25 +202,68 @@ func New() *Config {
 			BlackListAfterFails: DefaultNodeHealthBlackListAfterFails,
 			BlackListExpiry:     DefaultNodeHealthBlackListExpiry,
 		},
+		NodeRateLimit: NodeRateLimit{
+			Rate:  DefaultNodeRateLimitRate,
+			Burst: DefaultNodeRateLimitBurst,
+		},
+		Services: []Service{
+			{
+				Name:            DefaultServiceName,
+				Port:            DefaultPublicClientsPort,
+				Affinity:        DefaultServiceAffinity,
+				AffinityTimeout: DefaultServiceAffinityTimeout,
+				Pools:           []Pool{},
+				FailbackDelay:   DefaultServiceFailbackDelay,
+			},
+		},
+		Tracing: common.Tracing{
+			SampleRatio: common.DefaultTracingSampleRatio,
+		},
+		MDNS: MDNS{
+			Enabled:  DefaultMDNSEnabled,
+			Hostname: DefaultMDNSHostname,
+		},
 		Logger: logrus.New(),
 	}
 }
 
-// InitConfig initializes the configuration for the command
-func InitConfig(cmd *cobra.Command) *Config {
-	cfg, err := common.LoadConfig(common.GetConfigFilePath(cmd), New())
+// InitConfig initializes the configuration for the command from all its sources, see common.Layers. The resulting
+// configuration must pass the validation
+func InitConfig(cmd *cobra.Command) (*Config, error) {
+	cfg, err := LoadConfig(cmd)
 	if err != nil {
-		cfg = New()
+		return nil, err
+	}
 
-		cfg.Logger.Warnf("failed to load default config: %v", err)
-		cfg.Logger.Infof("relying on default configuration")
+	cfg.Logger = logrus.New()
+
+	if err = cfg.Validate(); err != nil {
+		return nil, err
 	}
 
-	ApplyFlagsToConfig(cmd, cfg)
+	return cfg, nil
+}
 
-	cfg.Logger = logrus.New()
+// Load loads the configuration from its layers on top of the default configuration
+func Load(layers common.Layers) (*Config, common.Loaded, error) {
+	cfg := New()
 
-	return cfg
+	loaded, err := common.Load(layers, cfg)
+	if err != nil {
+		return nil, common.Loaded{}, err
+	}
+
+	return cfg, loaded, nil
+}
+
+// commandLayers returns the layers of the configuration selected by the flags of the command
+func commandLayers(cmd *cobra.Command) common.Layers {
+	return common.Layers{
+		File:      common.GetConfigFilePath(cmd),
+		Dir:       common.GetConfigDir(cmd),
+		EnvPrefix: EnvPrefix,
+		Flags:     cmd.Flags(),
+	}
 }
 
 // AddConfigFlags defines the configuration flags for the command
@@ -132,7 +277,12 @@ func AddConfigFlags(cmd *cobra.Command) {
 	cmd.Flags().Duration(KeyNodeHealthChecksTimeout, DefaultNodeHealthChecksTimeout, "Maximum time between health checks before node is considered unresponsive and traffic is re-routed")
 	cmd.Flags().Int(KeyNodeHealthBlackListAfterFails, DefaultNodeHealthBlackListAfterFails, "Number of times node can be added and disabled from routing table before is ignored by load balancer")
 	cmd.Flags().Duration(KeyNodeHealthBlackListExpiry, DefaultNodeHealthBlackListExpiry, "Duration of the black list ban after which the node will be accepted again")
+	cmd.Flags().Float64(KeyNodeRateLimitRate, DefaultNodeRateLimitRate, "RPCs per second allowed for each node IP, zero disables the limit")
+	cmd.Flags().Int(KeyNodeRateLimitBurst, DefaultNodeRateLimitBurst, "RPCs that each node IP can open at once before the rate limit applies")
+	cmd.Flags().Bool(KeyMDNSEnabled, DefaultMDNSEnabled, "Announce the load balancer via multicast DNS in the private interface")
+	cmd.Flags().String(KeyMDNSHostname, DefaultMDNSHostname, "Hostname announced via multicast DNS (ex: lb-0.local)")
 	cmd.Flags().String(common.KeyConfigFile, DefaultConfigFile, "config file (default is $PWD/config/lb.toml)")
+	cmd.Flags().String(common.KeyConfigDir, "", "directory whose *.toml files are merged on top of the config file")
 
 	_ = viper.BindPFlag(KeyPrivateNodePort, cmd.Flags().Lookup(KeyPrivateNodePort))
 	_ = viper.BindPFlag(KeyPrivateAPIPort, cmd.Flags().Lookup(KeyPrivateAPIPort))
@@ -143,6 +293,10 @@ func AddConfigFlags(cmd *cobra.Command) {
 	_ = viper.BindPFlag(KeyNodeHealthChecksTimeout, cmd.Flags().Lookup(KeyNodeHealthChecksTimeout))
 	_ = viper.BindPFlag(KeyNodeHealthBlackListAfterFails, cmd.Flags().Lookup(KeyNodeHealthBlackListAfterFails))
 	_ = viper.BindPFlag(KeyNodeHealthBlackListExpiry, cmd.Flags().Lookup(KeyNodeHealthBlackListExpiry))
+	_ = viper.BindPFlag(KeyNodeRateLimitRate, cmd.Flags().Lookup(KeyNodeRateLimitRate))
+	_ = viper.BindPFlag(KeyNodeRateLimitBurst, cmd.Flags().Lookup(KeyNodeRateLimitBurst))
+	_ = viper.BindPFlag(KeyMDNSEnabled, cmd.Flags().Lookup(KeyMDNSEnabled))
+	_ = viper.BindPFlag(KeyMDNSHostname, cmd.Flags().Lookup(KeyMDNSHostname))
 	_ = viper.BindPFlag(common.KeyConfigFile, cmd.Flags().Lookup(common.KeyConfigFile))
 }
 
@@ -174,4 +328,16 @@ func ApplyFlagsToConfig(cmd *cobra.Command, cfg *Config) {
 	if cmd.Flags().Changed(KeyNodeHealthBlackListExpiry) {
 		cfg.NodeHealth.BlackListExpiry = viper.GetDuration(KeyNodeHealthBlackListExpiry)
 	}
+	if cmd.Flags().Changed(KeyNodeRateLimitRate) {
+		cfg.NodeRateLimit.Rate = viper.GetFloat64(KeyNodeRateLimitRate)
+	}
+	if cmd.Flags().Changed(KeyNodeRateLimitBurst) {
+		cfg.NodeRateLimit.Burst = viper.GetInt(KeyNodeRateLimitBurst)
+	}
+	if cmd.Flags().Changed(KeyMDNSEnabled) {
+		cfg.MDNS.Enabled = viper.GetBool(KeyMDNSEnabled)
+	}
+	if cmd.Flags().Changed(KeyMDNSHostname) {
+		cfg.MDNS.Hostname = viper.GetString(KeyMDNSHostname)
+	}
 }
@@ -0,0 +1,188 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	common "github.com/yago-123/galelb/config"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	redacted = "<redacted>"
+)
+
+var (
+	ErrReloadRefused = errors.New("configuration changes require a restart")
+)
+
+// liveSections contains the sections of the configuration that can be changed without restarting the load balancer.
+// Changes in any other section (ex: swapping the interfaces) are refused
+var liveSections = []string{"node_health", "node_rate_limit", "admission", "services"} //nolint:gochecknoglobals // read-only
+
+// Change is a parameter of the configuration that differs between the running and the reloaded configuration
+type Change struct {
+	Key string `json:"key"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Key, c.Old, c.New)
+}
+
+// ReloadReport contains the outcome of a configuration reload
+type ReloadReport struct {
+	// Applied contains the changes applied live
+	Applied []Change `json:"applied"`
+	// Refused contains the changes that require a restart. If there is any, none of the changes are applied
+	Refused []Change `json:"refused"`
+}
+
+// ReloadListener applies the reloaded configuration to a component. Validate is optional, it must reject the
+// configurations that Apply cannot handle so that reloads are either fully applied or not at all
+type ReloadListener struct {
+	Validate func(cfg *Config) error
+	Apply    func(cfg *Config)
+}
+
+// Reloader reloads the configuration of a running load balancer, applying the changes that are safe to apply live
+type Reloader struct {
+	// current is the configuration in effect, either the initial one or the last one reloaded
+	current   *Config
+	load      func() (*Config, error)
+	listeners []ReloadListener
+	lock      sync.Mutex
+}
+
+// NewReloader creates a reloader for the running configuration, load returns the configuration from its sources
+func NewReloader(cfg *Config, load func() (*Config, error)) *Reloader {
+	return &Reloader{
+		current: cfg,
+		load:    load,
+	}
+}
+
+// Subscribe registers a component that must be updated with each configuration reloaded
+func (r *Reloader) Subscribe(listener ReloadListener) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.listeners = append(r.listeners, listener)
+}
+
+// Reload loads the configuration and applies the changes against the running one. Returns ErrReloadRefused along with
+// the report if any of the changes requires a restart, in which case nothing is applied
+func (r *Reloader) Reload() (ReloadReport, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	next, err := r.load()
+	if err != nil {
+		return ReloadReport{}, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	report := ReloadReport{Applied: []Change{}, Refused: []Change{}}
+	for _, change := range Diff(r.current, next) {
+		if isLive(change.Key) {
+			report.Applied = append(report.Applied, change)
+			continue
+		}
+		report.Refused = append(report.Refused, change)
+	}
+
+	// Nothing is applied if any of the changes requires a restart
+	if len(report.Refused) > 0 {
+		return ReloadReport{Applied: []Change{}, Refused: report.Refused}, ErrReloadRefused
+	}
+
+	// The parameters checked against the host require a restart, so they are not checked again
+	if err = next.ValidateOffline(); err != nil {
+		return ReloadReport{}, err
+	}
+
+	for _, listener := range r.listeners {
+		if listener.Validate == nil {
+			continue
+		}
+
+		if err = listener.Validate(next); err != nil {
+			return ReloadReport{}, fmt.Errorf("invalid configuration: %w", err)
+		}
+	}
+
+	// The loggers are not part of the configuration sources, the running one is kept
+	next.Logger = r.current.Logger
+	for _, listener := range r.listeners {
+		listener.Apply(next)
+	}
+
+	r.current = next
+
+	return report, nil
+}
+
+// LoadConfig loads the configuration of the command from all its sources, with the flags taking precedence. Unknown
+// keys found in the configuration files are logged. Unlike InitConfig, it leaves the validation to the caller
+func LoadConfig(cmd *cobra.Command) (*Config, error) {
+	cfg, loaded, err := Load(commandLayers(cmd))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range loaded.Unknown {
+		cfg.Logger.Warnf("ignoring unknown configuration key %s", key)
+	}
+
+	ApplyFlagsToConfig(cmd, cfg)
+
+	return cfg, nil
+}
+
+// Diff returns the parameters that differ between both configurations, identified by their configuration key
+func Diff(current, next *Config) []Change {
+	return diffValues("", reflect.ValueOf(*current), reflect.ValueOf(*next))
+}
+
+func diffValues(prefix string, current, next reflect.Value) []Change {
+	if current.Kind() != reflect.Struct {
+		if reflect.DeepEqual(current.Interface(), next.Interface()) {
+			return nil
+		}
+
+		// Secrets such as join tokens are not disclosed in the reports
+		if common.IsSecret(prefix) {
+			return []Change{{Key: prefix, Old: redacted, New: redacted}}
+		}
+
+		return []Change{{Key: prefix, Old: fmt.Sprintf("%v", current.Interface()), New: fmt.Sprintf("%v", next.Interface())}}
+	}
+
+	changes := []Change{}
+	for i := range current.NumField() {
+		// Fields without key are not loaded from the configuration sources (ex: logger)
+		key := current.Type().Field(i).Tag.Get("mapstructure")
+		if key == "" {
+			continue
+		}
+
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		changes = append(changes, diffValues(key, current.Field(i), next.Field(i))...)
+	}
+
+	return changes
+}
+
+// isLive returns whether the parameter can be changed without restarting the load balancer
+func isLive(key string) bool {
+	section, _, _ := strings.Cut(key, ".")
+	return slices.Contains(liveSections, section)
+}
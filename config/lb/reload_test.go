@@ -0,0 +1,114 @@
+package lb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	common "github.com/yago-123/galelb/config"
+)
+
+func TestReloader_reload(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(cfg *Config)
+		err     error
+		applied int
+		refused int
+	}{
+		{
+			name: "live changes are applied",
+			modify: func(cfg *Config) {
+				cfg.NodeHealth.ChecksTimeout = 5 * time.Second
+				cfg.Admission.Tokens = []string{"secret"}
+			},
+			applied: 2,
+		},
+		{
+			name: "interface swap is refused",
+			modify: func(cfg *Config) {
+				cfg.NodeHealth.ChecksTimeout = 5 * time.Second
+				cfg.PublicInterface.NetIfacePublic = "eth1"
+			},
+			err:     ErrReloadRefused,
+			refused: 1,
+		},
+		{
+			name: "invalid configuration is rejected",
+			modify: func(cfg *Config) {
+				cfg.NodeHealth.ChecksTimeout = 100 * time.Millisecond
+			},
+			err: common.ErrInvalidConfig,
+		},
+		{
+			name:   "no changes",
+			modify: func(_ *Config) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			running := newTestConfig()
+			reloader := NewReloader(running, func() (*Config, error) {
+				next := newTestConfig()
+				tt.modify(next)
+				return next, nil
+			})
+
+			var applied *Config
+			reloader.Subscribe(ReloadListener{Apply: func(cfg *Config) { applied = cfg }})
+
+			report, err := reloader.Reload()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if len(report.Applied) != tt.applied {
+				t.Fatalf("expected %d changes applied, got %v", tt.applied, report.Applied)
+			}
+			if len(report.Refused) != tt.refused {
+				t.Fatalf("expected %d changes refused, got %v", tt.refused, report.Refused)
+			}
+
+			// Refused reloads are not applied at all
+			if (applied != nil) != (tt.err == nil) {
+				t.Fatalf("expected configuration to be applied only if the reload succeeds")
+			}
+
+			for _, change := range report.Applied {
+				if change.Key == "admission.tokens" && change.New != redacted {
+					t.Fatalf("expected tokens to be redacted, got %s", change.New)
+				}
+			}
+		})
+	}
+}
+
+func TestReloader_validationFailure(t *testing.T) {
+	reloader := NewReloader(newTestConfig(), func() (*Config, error) {
+		next := newTestConfig()
+		next.NodeRateLimit.Burst = 20
+		return next, nil
+	})
+
+	applied := false
+	invalid := errors.New("invalid")
+	reloader.Subscribe(ReloadListener{Apply: func(_ *Config) { applied = true }})
+	reloader.Subscribe(ReloadListener{Validate: func(_ *Config) error { return invalid }, Apply: func(_ *Config) { applied = true }})
+
+	if _, err := reloader.Reload(); !errors.Is(err, invalid) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	if applied {
+		t.Fatalf("expected configuration not to be applied to any listener")
+	}
+}
+
+// newTestConfig returns the default configuration with the network interfaces set, as required by the validation
+func newTestConfig() *Config {
+	cfg := New()
+	cfg.PrivateInterface.NetIfacePrivate = "eth0"
+	cfg.PublicInterface.NetIfacePublic = "eth0"
+
+	return cfg
+}
@@ -0,0 +1,187 @@
+package lb
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	common "github.com/yago-123/galelb/config"
+)
+
+const (
+	// MinNodeHealthChecksTimeout is the minimum time allowed between the health checks of the nodes
+	MinNodeHealthChecksTimeout = 1 * time.Second
+
+	// BlackListDisabled disables the black list of nodes when set in black_list_after_fails
+	BlackListDisabled = -1
+
+	// MDNSTopLevelDomain is the domain of the hostnames announced via multicast DNS
+	MDNSTopLevelDomain = "local"
+)
+
+// affinities contains the affinity policies that can be configured in the services
+var affinities = []string{AffinityNone, AffinitySourceIP, AffinitySourceIPPort, AffinitySourceSubnet} //nolint:gochecknoglobals // read-only
+
+// Validate checks the whole configuration, including that the network interfaces exist in the host. Returns a
+// common.ValidationError with all the problems found
+func (c *Config) Validate() error {
+	v := common.NewValidator(true)
+	c.validate(v)
+
+	return v.Err()
+}
+
+// ValidateOffline checks the configuration skipping the checks that depend on the host, the parameters checked
+// against the host cannot be reloaded anyway
+func (c *Config) ValidateOffline() error {
+	v := common.NewValidator(false)
+	c.validate(v)
+
+	return v.Err()
+}
+
+// ValidateFile loads and checks the configuration files, the keys of the files that do not match any parameter are
+// returned as warnings. Used for validating configurations without starting the load balancer
+func ValidateFile(layers common.Layers, checkHost bool) ([]common.Problem, error) {
+	v := common.NewValidator(checkHost)
+
+	cfg, loaded, err := Load(layers)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range loaded.Unknown {
+		v.Warnf(key, "unknown configuration key, ignored")
+	}
+	cfg.validate(v)
+
+	return v.Warnings(), v.Err()
+}
+
+func (c *Config) validate(v *common.Validator) {
+	v.Port(KeyPrivateNodePort, c.PrivateInterface.NodePort)
+	v.Port(KeyPrivateAPIPort, c.PrivateInterface.APIPort)
+	if c.PrivateInterface.NodePort == c.PrivateInterface.APIPort {
+		v.Addf(KeyPrivateAPIPort, "port %d already used by %s", c.PrivateInterface.APIPort, KeyPrivateNodePort)
+	}
+	v.Interface(KeyPrivateNetIfacePrivate, c.PrivateInterface.NetIfacePrivate)
+
+	v.Port(KeyPublicClientsPort, c.PublicInterface.ClientsPort)
+	v.Interface(KeyPublicNetIfacePublic, c.PublicInterface.NetIfacePublic)
+
+	c.NodeHealth.validate(v)
+	c.NodeRateLimit.validate(v)
+	c.validateServices(v)
+	c.Admission.validate(v)
+	c.MDNS.validate(v)
+
+	c.APIAuth.Validate(v, "api_auth")
+	c.NodeTLS.Validate(v, "node_tls")
+	c.Tracing.Validate(v, "tracing")
+}
+
+func (m MDNS) validate(v *common.Validator) {
+	if !m.Enabled {
+		return
+	}
+
+	label, found := strings.CutSuffix(m.Hostname, "."+MDNSTopLevelDomain)
+	if !found || label == "" || strings.Contains(label, ".") {
+		v.Addf(KeyMDNSHostname, "hostname %q must be a single label in the .%s domain (ex: lb-0.%s)", m.Hostname, MDNSTopLevelDomain, MDNSTopLevelDomain)
+	}
+}
+
+func (h NodeHealth) validate(v *common.Validator) {
+	if h.ChecksTimeout < MinNodeHealthChecksTimeout {
+		v.Addf(KeyNodeHealthChecksTimeout, "timeout %s below the minimum of %s", h.ChecksTimeout, MinNodeHealthChecksTimeout)
+	}
+
+	if h.BlackListAfterFails < BlackListDisabled {
+		v.Addf(KeyNodeHealthBlackListAfterFails, "value %d not allowed, must be %d (disabled) or greater",
+			h.BlackListAfterFails, BlackListDisabled)
+	}
+
+	if h.BlackListAfterFails != BlackListDisabled && h.BlackListExpiry <= 0 {
+		v.Addf(KeyNodeHealthBlackListExpiry, "expiry must be positive when the black list is enabled, got %s",
+			h.BlackListExpiry)
+	}
+}
+
+func (r NodeRateLimit) validate(v *common.Validator) {
+	if r.Rate < 0 {
+		v.Addf(KeyNodeRateLimitRate, "rate %v cannot be negative, zero disables the limit", r.Rate)
+	}
+
+	if r.Rate > 0 && r.Burst < 1 {
+		v.Addf(KeyNodeRateLimitBurst, "burst must be at least 1 when the rate limit is enabled, got %d", r.Burst)
+	}
+}
+
+func (c *Config) validateServices(v *common.Validator) {
+	names := map[string]bool{}
+	ports := map[int]bool{}
+
+	if len(c.Services) > MaxServices {
+		v.Addf("services", "number of services %d cannot be greater than %d", len(c.Services), MaxServices)
+	}
+
+	for idx, svc := range c.Services {
+		key := fmt.Sprintf("services[%d]", idx)
+
+		if svc.Name == "" {
+			v.Addf(key+".name", "name not set")
+		} else if names[svc.Name] {
+			v.Addf(key+".name", "name %q used by more than one service", svc.Name)
+		}
+		names[svc.Name] = true
+
+		v.Port(key+".port", svc.Port)
+		if ports[svc.Port] {
+			v.Addf(key+".port", "port %d used by more than one service", svc.Port)
+		}
+		ports[svc.Port] = true
+
+		if !slices.Contains(affinities, svc.Affinity) {
+			v.Addf(key+".affinity", "unknown affinity %q, must be one of %v", svc.Affinity, affinities)
+		}
+		if svc.AffinityTimeout < 0 {
+			v.Addf(key+".affinity_timeout", "timeout %s cannot be negative", svc.AffinityTimeout)
+		}
+		if svc.FailbackDelay < 0 {
+			v.Addf(key+".failback_delay", "delay %s cannot be negative", svc.FailbackDelay)
+		}
+
+		pools := map[string]bool{}
+		for poolIdx, pool := range svc.Pools {
+			poolKey := fmt.Sprintf("%s.pools[%d]", key, poolIdx)
+
+			if pool.Name == "" {
+				v.Addf(poolKey+".name", "name not set")
+			} else if pools[pool.Name] {
+				v.Addf(poolKey+".name", "name %q used by more than one pool of the service", pool.Name)
+			}
+			pools[pool.Name] = true
+
+			for nodeIdx, cidr := range pool.Nodes {
+				v.CIDR(fmt.Sprintf("%s.nodes[%d]", poolKey, nodeIdx), cidr)
+			}
+
+			if pool.MinHealthy < 0 {
+				v.Addf(poolKey+".min_healthy", "minimum of healthy nodes %d cannot be negative", pool.MinHealthy)
+			}
+		}
+	}
+}
+
+func (a Admission) validate(v *common.Validator) {
+	for idx, token := range a.Tokens {
+		if token == "" {
+			v.Addf(fmt.Sprintf("admission.tokens[%d]", idx), "token cannot be empty")
+		}
+	}
+
+	for idx, cidr := range a.AllowedCIDRs {
+		v.CIDR(fmt.Sprintf("admission.allowed_cidrs[%d]", idx), cidr)
+	}
+}
@@ -0,0 +1,123 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	common "github.com/yago-123/galelb/config"
+)
+
+func TestConfig_validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(cfg *Config)
+		problems []string
+	}{
+		{
+			name:   "valid configuration",
+			modify: func(_ *Config) {},
+		},
+		{
+			name: "all problems are aggregated",
+			modify: func(cfg *Config) {
+				cfg.PrivateInterface.NodePort = 0
+				cfg.PublicInterface.NetIfacePublic = ""
+				cfg.NodeHealth.ChecksTimeout = 500 * time.Millisecond
+				cfg.NodeHealth.BlackListAfterFails = -2
+			},
+			problems: []string{
+				KeyPrivateNodePort,
+				KeyPublicNetIfacePublic,
+				KeyNodeHealthChecksTimeout,
+				KeyNodeHealthBlackListAfterFails,
+			},
+		},
+		{
+			name: "services",
+			modify: func(cfg *Config) {
+				cfg.Services = append(cfg.Services, Service{
+					Name:     DefaultServiceName,
+					Port:     DefaultPublicClientsPort,
+					Affinity: "sticky",
+					Pools:    []Pool{{Name: "primary", Nodes: []string{"10.0.0.0/33"}, MinHealthy: -1}},
+				})
+			},
+			problems: []string{
+				"services[1].name",
+				"services[1].port",
+				"services[1].affinity",
+				"services[1].pools[0].nodes[0]",
+				"services[1].pools[0].min_healthy",
+			},
+		},
+		{
+			name: "too many services",
+			modify: func(cfg *Config) {
+				cfg.Services = nil
+				for idx := range MaxServices + 1 {
+					cfg.Services = append(cfg.Services, Service{
+						Name:     fmt.Sprintf("service-%d", idx),
+						Port:     DefaultPublicClientsPort + idx,
+						Affinity: DefaultServiceAffinity,
+					})
+				}
+			},
+			problems: []string{"services"},
+		},
+		{
+			name: "multicast DNS hostname outside .local",
+			modify: func(cfg *Config) {
+				cfg.MDNS = MDNS{Enabled: true, Hostname: "lb-0.example.com"}
+			},
+			problems: []string{KeyMDNSHostname},
+		},
+		{
+			name: "multicast DNS hostname with several labels",
+			modify: func(cfg *Config) {
+				cfg.MDNS = MDNS{Enabled: true, Hostname: "lb-0.eu.local"}
+			},
+			problems: []string{KeyMDNSHostname},
+		},
+		{
+			name: "api authentication and node TLS",
+			modify: func(cfg *Config) {
+				cfg.APIAuth.Tokens = []common.APIToken{{Token: "secret", Role: "root"}}
+				cfg.APIAuth.TLSCertFile = "api.crt"
+				cfg.NodeTLS.CAFile = "ca.crt"
+			},
+			problems: []string{"api_auth.tokens[0].role", "api_auth", "node_tls"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig()
+			tt.modify(cfg)
+
+			err := cfg.ValidateOffline()
+			if len(tt.problems) == 0 {
+				if err != nil {
+					t.Fatalf("expected configuration to be valid, got %v", err)
+				}
+				return
+			}
+
+			var validationErr *common.ValidationError
+			if !errors.As(err, &validationErr) || !errors.Is(err, common.ErrInvalidConfig) {
+				t.Fatalf("expected validation error, got %v", err)
+			}
+
+			keys := []string{}
+			for _, problem := range validationErr.Problems {
+				keys = append(keys, problem.Key)
+			}
+
+			if !slices.Equal(keys, tt.problems) {
+				t.Fatalf("expected problems in %v, got %v", tt.problems, validationErr.Problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	common "github.com/yago-123/galelb/config"
+)
+
+const (
+	// AddressSchemeDNSSRV discovers the load balancers from the SRV records of a name, AddressSchemeMDNS resolves the
+	// hostname of the load balancer via multicast DNS
+	AddressSchemeDNSSRV = "dns+srv"
+	AddressSchemeMDNS   = "mdns"
+
+	// MDNSTopLevelDomain is the domain required by the hostnames resolved via multicast DNS
+	MDNSTopLevelDomain = "local"
+
+	schemeSeparator = "://"
+
+	// serviceNameMinLabels is the number of labels of the shortest service name: _service._proto.domain
+	serviceNameMinLabels = 3
+)
+
+var ErrInvalidAddress = errors.New("invalid load balancer address")
+
+// ParseAddress parses the address of a load balancer, used both by the flags and the configuration file. Accepts the
+// following formats:
+//   - host:port or ip:port (ex: "lb-0.example.com:7070", "192.168.1.2:7070")
+//   - [ipv6]:port (ex: "[fd00::2]:7070")
+//   - dns+srv://name, the load balancers are the targets of the SRV records of the name, which contain their ports
+//     (ex: "dns+srv://_galelb._tcp.example.com")
+//   - mdns://host:port, the hostname is resolved via multicast DNS (ex: "mdns://lb-0.local:7070")
+//   - mdns://_service._proto.local, the load balancers are the instances of the service browsed via multicast DNS,
+//     which announce their ports (ex: "mdns://_galelb._tcp.local")
+func ParseAddress(addr string) (Address, error) {
+	if !strings.Contains(addr, schemeSeparator) {
+		return parseHostPort(addr)
+	}
+
+	parsed, err := url.Parse(addr)
+	if err != nil {
+		return Address{}, fmt.Errorf("%w %q: %w", ErrInvalidAddress, addr, err)
+	}
+
+	if parsed.Hostname() == "" {
+		return Address{}, fmt.Errorf("%w %q: hostname not set", ErrInvalidAddress, addr)
+	}
+	if (parsed.Path != "" && parsed.Path != "/") || parsed.RawQuery != "" || parsed.User != nil {
+		return Address{}, fmt.Errorf("%w %q: only the host and port can be set", ErrInvalidAddress, addr)
+	}
+
+	switch parsed.Scheme {
+	case AddressSchemeDNSSRV:
+		if parsed.Port() != "" {
+			return Address{}, fmt.Errorf("%w %q: the ports are taken from the SRV records", ErrInvalidAddress, addr)
+		}
+
+		return Address{Discovery: AddressSchemeDNSSRV, Hostname: parsed.Hostname()}, nil
+	case AddressSchemeMDNS:
+		if !strings.HasSuffix(parsed.Hostname(), "."+MDNSTopLevelDomain) {
+			return Address{}, fmt.Errorf("%w %q: hostname must be in the .%s domain", ErrInvalidAddress, addr, MDNSTopLevelDomain)
+		}
+
+		if isServiceName(parsed.Hostname()) {
+			if parsed.Port() != "" {
+				return Address{}, fmt.Errorf("%w %q: the ports are announced by the service instances", ErrInvalidAddress, addr)
+			}
+
+			return Address{Discovery: AddressSchemeMDNS, Hostname: parsed.Hostname()}, nil
+		}
+
+		port, errPort := parsePort(parsed.Port())
+		if errPort != nil {
+			return Address{}, fmt.Errorf("%w %q: %w", ErrInvalidAddress, addr, errPort)
+		}
+
+		return Address{Discovery: AddressSchemeMDNS, Hostname: parsed.Hostname(), Port: port}, nil
+	default:
+		return Address{}, fmt.Errorf("%w %q: unsupported scheme %q, must be %q or %q",
+			ErrInvalidAddress, addr, parsed.Scheme, AddressSchemeDNSSRV, AddressSchemeMDNS)
+	}
+}
+
+// parseHostPort parses the static addresses, IPv6 addresses must be enclosed in brackets
+func parseHostPort(addr string) (Address, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Address{}, fmt.Errorf("%w %q: %w", ErrInvalidAddress, addr, err)
+	}
+	if host == "" {
+		return Address{}, fmt.Errorf("%w %q: host not set", ErrInvalidAddress, addr)
+	}
+
+	port, err := parsePort(portStr)
+	if err != nil {
+		return Address{}, fmt.Errorf("%w %q: %w", ErrInvalidAddress, addr, err)
+	}
+
+	if ip, errIP := netip.ParseAddr(host); errIP == nil {
+		return Address{IP: ip.String(), Port: port}, nil
+	}
+
+	return Address{Hostname: host, Port: port}, nil
+}
+
+func parsePort(portStr string) (int, error) {
+	if portStr == "" {
+		return 0, errors.New("port not set")
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < common.MinPort || port > common.MaxPort {
+		return 0, fmt.Errorf("port %q out of range, must be between %d and %d", portStr, common.MinPort, common.MaxPort)
+	}
+
+	return port, nil
+}
+
+// isServiceName returns whether the name identifies a service in the DNS-SD format (ex: "_galelb._tcp.local") instead
+// of a host
+func isServiceName(name string) bool {
+	labels := strings.Split(name, ".")
+	if len(labels) < serviceNameMinLabels {
+		return false
+	}
+
+	return strings.HasPrefix(labels[0], "_") && (labels[1] == "_tcp" || labels[1] == "_udp")
+}
+
+// IsService returns whether the load balancers are discovered by browsing a multicast DNS service
+func (a Address) IsService() bool {
+	return a.Discovery == AddressSchemeMDNS && isServiceName(a.Hostname)
+}
+
+// UnmarshalText allows listing the addresses as strings in the configuration file, in any of the formats accepted by
+// ParseAddress
+func (a *Address) UnmarshalText(text []byte) error {
+	addr, err := ParseAddress(string(text))
+	if err != nil {
+		return err
+	}
+
+	*a = addr
+
+	return nil
+}
+
+// String returns the address in the format accepted by ParseAddress
+func (a Address) String() string {
+	switch a.Discovery {
+	case AddressSchemeDNSSRV:
+		return AddressSchemeDNSSRV + schemeSeparator + a.Hostname
+	case AddressSchemeMDNS:
+		if a.IsService() {
+			return AddressSchemeMDNS + schemeSeparator + a.Hostname
+		}
+		return AddressSchemeMDNS + schemeSeparator + net.JoinHostPort(a.Hostname, strconv.Itoa(a.Port))
+	}
+
+	host := a.IP
+	if host == "" {
+		host = a.Hostname
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
@@ -0,0 +1,101 @@
+package node
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	common "github.com/yago-123/galelb/config"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		addr     string
+		expected Address
+		err      error
+	}{
+		{name: "hostname and port", addr: "lb-0.example.com:7070", expected: Address{Hostname: "lb-0.example.com", Port: 7070}},
+		{name: "IPv4 and port", addr: "192.168.1.2:7070", expected: Address{IP: "192.168.1.2", Port: 7070}},
+		{name: "IPv6 and port", addr: "[fd00::2]:7070", expected: Address{IP: "fd00::2", Port: 7070}},
+		{name: "multicast DNS hostname", addr: "lb-0.local:7070", expected: Address{Hostname: "lb-0.local", Port: 7070}},
+		{
+			name:     "SRV records",
+			addr:     "dns+srv://_galelb._tcp.example.com",
+			expected: Address{Discovery: AddressSchemeDNSSRV, Hostname: "_galelb._tcp.example.com"},
+		},
+		{
+			name:     "multicast DNS",
+			addr:     "mdns://lb-0.local:7070",
+			expected: Address{Discovery: AddressSchemeMDNS, Hostname: "lb-0.local", Port: 7070},
+		},
+		{
+			name:     "multicast DNS service",
+			addr:     "mdns://_galelb._tcp.local",
+			expected: Address{Discovery: AddressSchemeMDNS, Hostname: "_galelb._tcp.local"},
+		},
+		{name: "missing port", addr: "192.168.1.2", err: ErrInvalidAddress},
+		{name: "port out of range", addr: "192.168.1.2:70000", err: ErrInvalidAddress},
+		{name: "non numeric port", addr: "lb-0.example.com:http", err: ErrInvalidAddress},
+		{name: "missing host", addr: ":7070", err: ErrInvalidAddress},
+		{name: "IPv6 without brackets", addr: "fd00::2:7070", err: ErrInvalidAddress},
+		{name: "legacy hostname:ip:port format", addr: "lb-0:192.168.1.2:7070", err: ErrInvalidAddress},
+		{name: "SRV records with port", addr: "dns+srv://_galelb._tcp.example.com:7070", err: ErrInvalidAddress},
+		{name: "SRV records with path", addr: "dns+srv://_galelb._tcp.example.com/lb", err: ErrInvalidAddress},
+		{name: "multicast DNS outside .local", addr: "mdns://lb-0.example.com:7070", err: ErrInvalidAddress},
+		{name: "multicast DNS without port", addr: "mdns://lb-0.local", err: ErrInvalidAddress},
+		{name: "multicast DNS service with port", addr: "mdns://_galelb._tcp.local:7070", err: ErrInvalidAddress},
+		{name: "unsupported scheme", addr: "http://lb-0.example.com:7070", err: ErrInvalidAddress},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := ParseAddress(tt.addr)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if addr != tt.expected {
+				t.Fatalf("expected %+v, got %+v", tt.expected, addr)
+			}
+
+			// Addresses are printed in the same format that they are parsed
+			if addr.String() != tt.addr {
+				t.Fatalf("expected address to be printed as %s, got %s", tt.addr, addr.String())
+			}
+		})
+	}
+}
+
+func TestLoad_addresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.toml")
+	content := `[load_balancer]
+addresses = [
+    "[fd00::2]:7070",
+    "dns+srv://_galelb._tcp.example.com",
+    { hostname = "lb-0.local", port = 7070 },
+]
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, _, err := Load(common.Layers{File: path})
+	if err != nil {
+		t.Fatalf("failed to read config file: %v", err)
+	}
+
+	expected := []Address{
+		{IP: "fd00::2", Port: 7070},
+		{Discovery: AddressSchemeDNSSRV, Hostname: "_galelb._tcp.example.com"},
+		{Hostname: "lb-0.local", Port: 7070},
+	}
+	if !slices.Equal(cfg.LoadBalancer.Addresses, expected) {
+		t.Fatalf("expected addresses %+v, got %+v", expected, cfg.LoadBalancer.Addresses)
+	}
+}
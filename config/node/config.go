@@ -2,7 +2,7 @@ package node
 
 import (
 	"fmt"
-	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -11,93 +11,230 @@ import (
 )
 
 const (
-	KeyLoadBalancerAddresses = "load_balancer.addresses"
+	KeyLoadBalancerAddresses         = "load_balancer.addresses"
+	KeyLoadBalancerDiscoveryInterval = "load_balancer.discovery_interval"
+
+	// API options
+	KeyAPIEnabled    = "api.enabled"
+	KeyAPIBind       = "api.bind"
+	KeyAPIPort       = "api.port"
+	KeyAPIUnixSocket = "api.unix_socket"
 
 	DefaultConfigFile = "node.toml"
-)
 
-const (
-	// LoadBalancerAddressArguments is the number of arguments expected for the load balancer address configuration
-	// so far we only use the ip and port
-	LoadBalancerAddressArguments = 3
+	DefaultDiscoveryInterval = 30 * time.Second
+
+	DefaultAPIEnabled    = true
+	DefaultAPIBind       = ""
+	DefaultAPIPort       = 5555
+	DefaultAPIUnixSocket = ""
+
+	// EnvPrefix prefixes the environment variables overriding the parameters (ex: GALE_NODE_LOAD_BALANCER_JOIN_TOKEN)
+	EnvPrefix = "GALE_NODE"
+
+	// HealthCheckTypeTCP checks succeed if a connection can be opened, HealthCheckTypeHTTP checks if the response has
+	// a 2xx status code
+	HealthCheckTypeTCP  = "tcp"
+	HealthCheckTypeHTTP = "http"
+
+	DefaultHealthCheckTimeout = 2 * time.Second
 )
 
 type Config struct {
-	LoadBalancer LoadBalancer `mapstructure:"load_balancer"`
-	Logger       *logrus.Logger
+	Node            Node           `mapstructure:"node"`
+	LoadBalancer    LoadBalancer   `mapstructure:"load_balancer"`
+	LoadBalancerTLS common.TLS     `mapstructure:"load_balancer_tls"`
+	HealthChecks    []HealthCheck  `mapstructure:"health_checks"`
+	API             API            `mapstructure:"api"`
+	APIAuth         common.APIAuth `mapstructure:"api_auth"`
+	Tracing         common.Tracing `mapstructure:"tracing"`
+	Logger          *logrus.Logger
+}
+
+// Node describes the node to the load balancers when it registers
+type Node struct {
+	// Name is announced to the load balancers, the hostname if not set. Informative only, load balancers identify nodes
+	// by their certificate or their connection
+	Name string `mapstructure:"name"`
+	// ServiceEndpoint is the endpoint serving the traffic routed to the node (ex: "10.0.0.2:8080")
+	ServiceEndpoint string `mapstructure:"service_endpoint"`
+	// Weight is the relative share of traffic requested by the node, 0 if not set. Announced to the load balancers,
+	// which list it along with the node without weighting the routing
+	Weight uint32            `mapstructure:"weight"`
+	Labels map[string]string `mapstructure:"labels"`
+}
+
+// API configures the HTTP API of the node, used to query its status and scrape its metrics. HTTPS and authentication
+// are configured in APIAuth
+type API struct {
+	// Enabled serves the API, if disabled neither the port nor the unix socket are opened
+	Enabled bool `mapstructure:"enabled"`
+	// Bind is the address in which the API listens, all the addresses of the host if empty
+	Bind string `mapstructure:"bind"`
+	// Port is the TCP port of the API. Zero disables the TCP listener, so that the API is only served through the unix
+	// socket
+	Port int `mapstructure:"port"`
+	// UnixSocket is the path of a unix socket serving the API too, so that local tooling can query the node without
+	// opening a TCP port. Served without TLS, the access is restricted by the permissions of the socket
+	UnixSocket string `mapstructure:"unix_socket"`
+}
+
+// HealthCheck is a local check of the services of the node. The node is only reported as serving if all its checks
+// pass, if there are no checks it is always reported as serving
+type HealthCheck struct {
+	Name string `mapstructure:"name"`
+	// Type is either "tcp", which connects to Address, or "http", which requests URL
+	Type    string `mapstructure:"type"`
+	Address string `mapstructure:"address"`
+	URL     string `mapstructure:"url"`
+	// Timeout is the maximum time spent running the check, DefaultHealthCheckTimeout if not set
+	Timeout time.Duration `mapstructure:"timeout"`
 }
 
 // LoadBalancer contains the configuration for the remote lbs
 type LoadBalancer struct {
+	// Addresses can be listed either as tables or as strings in any of the formats accepted by ParseAddress
 	Addresses []Address `mapstructure:"addresses"`
+	// DiscoveryInterval is the period at which the addresses are resolved again, so that the load balancers added or
+	// removed from the SRV records, the multicast DNS service or the DNS records are picked up. Zero disables it
+	DiscoveryInterval time.Duration `mapstructure:"discovery_interval"`
+	// JoinToken is presented to the load balancers to be admitted, required if the load balancers restrict
+	// admission by token
+	JoinToken string `mapstructure:"join_token"`
 }
 
 // Address represents an individual address entry in the TOML
 type Address struct {
-	Hostname string `mapstructure:"hostname"`
-	IP       string `mapstructure:"ip"`
-	Port     int    `mapstructure:"port"`
+	// Discovery is either AddressSchemeDNSSRV or AddressSchemeMDNS for the addresses resolved via service discovery,
+	// empty for static addresses
+	Discovery string `mapstructure:"discovery"`
+	Hostname  string `mapstructure:"hostname"`
+	IP        string `mapstructure:"ip"`
+	Port      int    `mapstructure:"port"`
 }
 
 func New() *Config {
 	return &Config{
+		Node: Node{
+			Labels: map[string]string{},
+		},
 		LoadBalancer: LoadBalancer{
-			Addresses: []Address{},
+			Addresses:         []Address{},
+			DiscoveryInterval: DefaultDiscoveryInterval,
+		},
+		HealthChecks: []HealthCheck{},
+		API: API{
+			Enabled:    DefaultAPIEnabled,
+			Bind:       DefaultAPIBind,
+			Port:       DefaultAPIPort,
+			UnixSocket: DefaultAPIUnixSocket,
+		},
+		Tracing: common.Tracing{
+			SampleRatio: common.DefaultTracingSampleRatio,
 		},
 		// todo(): add option for passing DNS resolver address
 		Logger: logrus.New(),
 	}
 }
 
-// InitConfig initializes the configuration for the command
-func InitConfig(cmd *cobra.Command) *Config {
-	cfg, err := common.LoadConfig(common.GetConfigFilePath(cmd), New())
+// InitConfig initializes the configuration for the command from all its sources, see common.Layers. The resulting
+// configuration must pass the validation
+func InitConfig(cmd *cobra.Command) (*Config, error) {
+	cfg, loaded, err := Load(commandLayers(cmd))
 	if err != nil {
-		cfg = New()
+		return nil, err
+	}
 
-		cfg.Logger.Warnf("failed to load default config: %v", err)
-		cfg.Logger.Infof("relying on default configuration")
+	for _, key := range loaded.Unknown {
+		cfg.Logger.Warnf("ignoring unknown configuration key %s", key)
 	}
 
-	ApplyFlagsToConfig(cmd, cfg)
+	if err = ApplyFlagsToConfig(cmd, cfg); err != nil {
+		return nil, err
+	}
 
 	cfg.Logger = logrus.New()
 
-	return cfg
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Load loads the configuration from its layers on top of the default configuration
+func Load(layers common.Layers) (*Config, common.Loaded, error) {
+	cfg := New()
+
+	loaded, err := common.Load(layers, cfg)
+	if err != nil {
+		return nil, common.Loaded{}, err
+	}
+
+	return cfg, loaded, nil
+}
+
+// commandLayers returns the layers of the configuration selected by the flags of the command
+func commandLayers(cmd *cobra.Command) common.Layers {
+	return common.Layers{
+		File:      common.GetConfigFilePath(cmd),
+		Dir:       common.GetConfigDir(cmd),
+		EnvPrefix: EnvPrefix,
+		Flags:     cmd.Flags(),
+	}
 }
 
 func AddConfigFlags(cmd *cobra.Command) {
-	cmd.Flags().String(common.KeyConfigFile, DefaultConfigFile, "config file (default is $PWD/config/lb.toml)")
-	cmd.Flags().StringArray(KeyLoadBalancerAddresses, []string{}, "Load balancer addresses")
+	cmd.Flags().String(common.KeyConfigFile, DefaultConfigFile, "config file (default is $PWD/config/node.toml)")
+	cmd.Flags().String(common.KeyConfigDir, "", "directory whose *.toml files are merged on top of the config file")
+	cmd.Flags().StringArray(KeyLoadBalancerAddresses, []string{}, "Load balancer addresses (host:port, ip:port, [ipv6]:port, dns+srv://name or mdns://host:port or mdns://_service._tcp.local)")
+	cmd.Flags().Bool(KeyAPIEnabled, DefaultAPIEnabled, "Serve the node API")
+	cmd.Flags().String(KeyAPIBind, DefaultAPIBind, "Address in which the node API listens, all the addresses if empty")
+	cmd.Flags().Int(KeyAPIPort, DefaultAPIPort, "Port of the node API, zero disables the TCP listener")
+	cmd.Flags().String(KeyAPIUnixSocket, DefaultAPIUnixSocket, "Path of the unix socket serving the node API, disabled if empty")
 
 	_ = viper.BindPFlag(common.KeyConfigFile, cmd.Flags().Lookup(common.KeyConfigFile))
 	_ = viper.BindPFlag(KeyLoadBalancerAddresses, cmd.Flags().Lookup(KeyLoadBalancerAddresses))
+	_ = viper.BindPFlag(KeyAPIEnabled, cmd.Flags().Lookup(KeyAPIEnabled))
+	_ = viper.BindPFlag(KeyAPIBind, cmd.Flags().Lookup(KeyAPIBind))
+	_ = viper.BindPFlag(KeyAPIPort, cmd.Flags().Lookup(KeyAPIPort))
+	_ = viper.BindPFlag(KeyAPIUnixSocket, cmd.Flags().Lookup(KeyAPIUnixSocket))
 }
 
-func ApplyFlagsToConfig(cmd *cobra.Command, cfg *Config) {
+func ApplyFlagsToConfig(cmd *cobra.Command, cfg *Config) error {
 	if cmd.Flags().Changed(KeyLoadBalancerAddresses) {
 		addrs, err := parseLBAddresses(viper.GetStringSlice(KeyLoadBalancerAddresses))
 		if err != nil {
-			cfg.Logger.Fatalf("failed to parse load balancer addresses: %v", err)
+			return fmt.Errorf("failed to parse load balancer addresses: %w", err)
 		}
 
 		cfg.LoadBalancer.Addresses = addrs
 	}
+	if cmd.Flags().Changed(KeyAPIEnabled) {
+		cfg.API.Enabled = viper.GetBool(KeyAPIEnabled)
+	}
+	if cmd.Flags().Changed(KeyAPIBind) {
+		cfg.API.Bind = viper.GetString(KeyAPIBind)
+	}
+	if cmd.Flags().Changed(KeyAPIPort) {
+		cfg.API.Port = viper.GetInt(KeyAPIPort)
+	}
+	if cmd.Flags().Changed(KeyAPIUnixSocket) {
+		cfg.API.UnixSocket = viper.GetString(KeyAPIUnixSocket)
+	}
+
+	return nil
 }
 
 func parseLBAddresses(addrsStr []string) ([]Address, error) {
-	var addrs []Address
-	for idx, addr := range addrsStr {
-		parts := strings.SplitN(addr, ":", LoadBalancerAddressArguments)
-		if len(parts) != LoadBalancerAddressArguments {
-			return nil, fmt.Errorf("invalid load balancer address at index %d: %s", idx, addr)
+	addrs := make([]Address, 0, len(addrsStr))
+	for idx, addrStr := range addrsStr {
+		addr, err := ParseAddress(addrStr)
+		if err != nil {
+			return nil, fmt.Errorf("address at index %d: %w", idx, err)
 		}
 
-		addrs = append(addrs, Address{
-			Hostname: parts[0],
-			IP:       parts[1],
-			Port:     viper.GetInt(parts[2]),
-		})
+		addrs = append(addrs, addr)
 	}
 
 	return addrs, nil
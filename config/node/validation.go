@@ -0,0 +1,181 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	common "github.com/yago-123/galelb/config"
+)
+
+// Validate checks the whole configuration, including that the files referenced exist in the host. Returns a
+// common.ValidationError with all the problems found
+func (c *Config) Validate() error {
+	v := common.NewValidator(true)
+	c.validate(v)
+
+	return v.Err()
+}
+
+// ValidateFile loads and checks the configuration files, the keys of the files that do not match any parameter are
+// returned as warnings. Used for validating configurations without starting the node
+func ValidateFile(layers common.Layers, checkHost bool) ([]common.Problem, error) {
+	v := common.NewValidator(checkHost)
+
+	cfg, loaded, err := Load(layers)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range loaded.Unknown {
+		v.Warnf(key, "unknown configuration key, ignored")
+	}
+	cfg.validate(v)
+
+	return v.Warnings(), v.Err()
+}
+
+func (c *Config) validate(v *common.Validator) {
+	if c.Node.ServiceEndpoint != "" {
+		validateHostPort(v, "node.service_endpoint", c.Node.ServiceEndpoint)
+	}
+
+	if len(c.LoadBalancer.Addresses) == 0 {
+		v.Addf(KeyLoadBalancerAddresses, "no load balancer addresses configured")
+	}
+	for idx, addr := range c.LoadBalancer.Addresses {
+		addr.validate(v, fmt.Sprintf("%s[%d]", KeyLoadBalancerAddresses, idx))
+	}
+	if c.LoadBalancer.DiscoveryInterval < 0 {
+		v.Addf(KeyLoadBalancerDiscoveryInterval, "interval %s cannot be negative", c.LoadBalancer.DiscoveryInterval)
+	}
+
+	c.validateHealthChecks(v)
+	c.API.validate(v)
+
+	c.LoadBalancerTLS.Validate(v, "load_balancer_tls")
+	c.APIAuth.Validate(v, "api_auth")
+	c.Tracing.Validate(v, "tracing")
+}
+
+func (c *Config) validateHealthChecks(v *common.Validator) {
+	names := map[string]bool{}
+
+	for idx, check := range c.HealthChecks {
+		key := fmt.Sprintf("health_checks[%d]", idx)
+
+		if check.Name == "" {
+			v.Addf(key+".name", "name not set")
+		} else if names[check.Name] {
+			v.Addf(key+".name", "name %q used by more than one health check", check.Name)
+		}
+		names[check.Name] = true
+
+		switch check.Type {
+		case HealthCheckTypeTCP:
+			if check.Address == "" {
+				v.Addf(key+".address", "address required by %s health checks", HealthCheckTypeTCP)
+				break
+			}
+			validateHostPort(v, key+".address", check.Address)
+		case HealthCheckTypeHTTP:
+			if check.URL == "" {
+				v.Addf(key+".url", "url required by %s health checks", HealthCheckTypeHTTP)
+				break
+			}
+			if parsed, err := url.Parse(check.URL); err != nil {
+				v.Addf(key+".url", "invalid url %q: %v", check.URL, err)
+			} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+				v.Addf(key+".url", "unsupported scheme in url %q, must be http or https", check.URL)
+			}
+		default:
+			v.Addf(key+".type", "unknown type %q, must be %q or %q", check.Type, HealthCheckTypeTCP, HealthCheckTypeHTTP)
+		}
+
+		if check.Timeout < 0 {
+			v.Addf(key+".timeout", "timeout %s cannot be negative", check.Timeout)
+		}
+	}
+}
+
+func (a Address) validate(v *common.Validator, key string) {
+	switch a.Discovery {
+	case "":
+		if a.IP == "" && a.Hostname == "" {
+			v.Addf(key, "neither ip nor hostname set")
+		}
+		if a.IP != "" {
+			if _, err := netip.ParseAddr(a.IP); err != nil {
+				v.Addf(key+".ip", "invalid IP %q: %v", a.IP, err)
+			}
+		}
+		v.Port(key+".port", a.Port)
+	case AddressSchemeDNSSRV:
+		if a.Hostname == "" {
+			v.Addf(key+".hostname", "hostname required to look up the SRV records")
+		}
+		if a.IP != "" || a.Port != 0 {
+			v.Addf(key, "ip and port cannot be set with %s discovery, they are taken from the SRV records", a.Discovery)
+		}
+	case AddressSchemeMDNS:
+		if !strings.HasSuffix(a.Hostname, "."+MDNSTopLevelDomain) {
+			v.Addf(key+".hostname", "hostname %q must be in the .%s domain", a.Hostname, MDNSTopLevelDomain)
+		}
+		if a.IP != "" {
+			v.Addf(key+".ip", "ip cannot be set with %s discovery", a.Discovery)
+		}
+		if a.IsService() {
+			if a.Port != 0 {
+				v.Addf(key+".port", "port cannot be set when browsing a service, it is taken from the SRV records")
+			}
+			break
+		}
+		v.Port(key+".port", a.Port)
+	default:
+		v.Addf(key+".discovery", "unknown discovery %q, must be %q or %q", a.Discovery, AddressSchemeDNSSRV, AddressSchemeMDNS)
+	}
+}
+
+func (a API) validate(v *common.Validator) {
+	if !a.Enabled {
+		return
+	}
+
+	if a.Port == 0 && a.UnixSocket == "" {
+		v.Addf(KeyAPIPort, "the API must be served through a TCP port or a unix socket, disable it instead")
+	}
+	if a.Port != 0 {
+		v.Port(KeyAPIPort, a.Port)
+	}
+
+	if a.Bind != "" {
+		if _, err := netip.ParseAddr(a.Bind); err != nil {
+			v.Addf(KeyAPIBind, "invalid bind address %q, must be an IP: %v", a.Bind, err)
+		}
+	}
+
+	if a.UnixSocket != "" {
+		v.Dir(KeyAPIUnixSocket, filepath.Dir(a.UnixSocket))
+	}
+}
+
+// validateHostPort checks that the address is in host:port format with a valid port
+func validateHostPort(v *common.Validator, key, addr string) {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.Addf(key, "invalid address %q, must be host:port: %v", addr, err)
+		return
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		v.Addf(key, "invalid port in address %q", addr)
+		return
+	}
+
+	v.Port(key, port)
+}
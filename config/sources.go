@@ -0,0 +1,288 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const (
+	// ConfigDirExtension is the extension of the files merged from the configuration directory
+	ConfigDirExtension = ".toml"
+
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+
+	redacted = "<redacted>"
+
+	// listSeparator separates the elements of the lists written as a single string (ex: environment variables)
+	listSeparator = ","
+)
+
+// Layers are the sources from which a configuration is loaded, in increasing order of precedence: the defaults, the
+// configuration file, the files of the configuration directory, the environment variables and the flags
+type Layers struct {
+	// File is the main configuration file, the defaults are used if not set
+	File string
+	// Dir is a conf.d directory whose *.toml files are merged in lexical order on top of File. Tables are merged key
+	// by key, arrays are replaced as a whole
+	Dir string
+	// EnvPrefix enables the environment variables, named after the prefix and the key of the parameter in upper case
+	// with dots replaced by underscores (ex: GALE_LB_NODE_HEALTH_CHECKS_TIMEOUT). Disabled if not set
+	EnvPrefix string
+	// Flags are only used for tracking which parameters have been set via flags, each binary applies its own flags
+	Flags *pflag.FlagSet
+}
+
+// Loaded is the outcome of loading a configuration from its layers
+type Loaded struct {
+	// Origins contains the source of each parameter of the configuration, indexed by key (ex: "file lb.toml",
+	// "env GALE_LB_NODE_HEALTH_CHECKS_TIMEOUT")
+	Origins map[string]string
+	// Unknown contains the keys of the files that do not match any parameter, which are ignored
+	Unknown []string
+}
+
+// Parameter is a leaf of the configuration identified by its key (ex: node_health.checks_timeout)
+type Parameter struct {
+	Key   string
+	Value any
+}
+
+// EnvVar returns the name of the environment variable that overrides the parameter
+func EnvVar(prefix, key string) string {
+	return prefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// IsSecret returns whether the value of the parameter must not be disclosed (ex: join tokens)
+func IsSecret(key string) bool {
+	return strings.Contains(key, "token")
+}
+
+// Load loads the configuration from its layers on top of the defaults contained in cfg
+func Load[V any](layers Layers, cfg *V) (Loaded, error) {
+	params := Parameters(cfg)
+	loaded := Loaded{Origins: make(map[string]string, len(params)), Unknown: []string{}}
+
+	reader := viper.New()
+	keys := make([]string, 0, len(params))
+	for _, param := range params {
+		// The defaults make viper aware of every parameter, otherwise the environment variables are only considered
+		// for the parameters present in the files
+		reader.SetDefault(param.Key, param.Value)
+		loaded.Origins[param.Key] = SourceDefault
+		keys = append(keys, param.Key)
+	}
+
+	files, err := layerFiles(layers)
+	if err != nil {
+		return Loaded{}, err
+	}
+
+	for _, file := range files {
+		fileReader := viper.New()
+		fileReader.SetConfigFile(file)
+		if errRead := fileReader.ReadInConfig(); errRead != nil {
+			return Loaded{}, fmt.Errorf("failed to load config file %s: %w", file, errRead)
+		}
+
+		for _, key := range fileReader.AllKeys() {
+			param, ok := parameterOf(keys, key)
+			if !ok {
+				if !slices.Contains(loaded.Unknown, key) {
+					loaded.Unknown = append(loaded.Unknown, key)
+				}
+				continue
+			}
+			loaded.Origins[param] = SourceFile + " " + file
+		}
+
+		if errMerge := reader.MergeConfigMap(fileReader.AllSettings()); errMerge != nil {
+			return Loaded{}, fmt.Errorf("failed to merge config file %s: %w", file, errMerge)
+		}
+	}
+
+	if layers.EnvPrefix != "" {
+		reader.SetEnvPrefix(layers.EnvPrefix)
+		reader.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+		reader.AutomaticEnv()
+
+		for _, key := range keys {
+			// Empty variables are ignored by viper
+			if value, ok := os.LookupEnv(EnvVar(layers.EnvPrefix, key)); ok && value != "" {
+				loaded.Origins[key] = SourceEnv + " " + EnvVar(layers.EnvPrefix, key)
+			}
+		}
+	}
+
+	if layers.Flags != nil {
+		for _, key := range keys {
+			if layers.Flags.Changed(key) {
+				loaded.Origins[key] = SourceFlag + " --" + key
+			}
+		}
+	}
+
+	if err = reader.Unmarshal(cfg, decodeHook()); err != nil {
+		return Loaded{}, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	sort.Strings(loaded.Unknown)
+
+	return loaded, nil
+}
+
+// layerFiles returns the configuration file followed by the files of the configuration directory in lexical order
+func layerFiles(layers Layers) ([]string, error) {
+	files := []string{}
+	if layers.File != "" {
+		files = append(files, layers.File)
+	}
+
+	if layers.Dir == "" {
+		return files, nil
+	}
+
+	entries, err := os.ReadDir(layers.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config directory: %w", err)
+	}
+
+	// Entries are returned sorted by name
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ConfigDirExtension {
+			continue
+		}
+		files = append(files, filepath.Join(layers.Dir, entry.Name()))
+	}
+
+	return files, nil
+}
+
+// parameterOf returns the parameter to which a key of a file belongs. Keys of tables decoded as maps (ex: node.labels)
+// are nested below the parameter (ex: node.labels.zone)
+func parameterOf(keys []string, key string) (string, bool) {
+	for _, param := range keys {
+		if key == param || strings.HasPrefix(key, param+".") {
+			return param, true
+		}
+	}
+
+	return "", false
+}
+
+// Parameters returns the parameters of the configuration sorted by key
+func Parameters(cfg any) []Parameter {
+	params := parameters("", reflect.Indirect(reflect.ValueOf(cfg)))
+	sort.Slice(params, func(i, j int) bool {
+		return params[i].Key < params[j].Key
+	})
+
+	return params
+}
+
+func parameters(prefix string, value reflect.Value) []Parameter {
+	if value.Kind() != reflect.Struct {
+		return []Parameter{{Key: prefix, Value: value.Interface()}}
+	}
+
+	params := []Parameter{}
+	for i := range value.NumField() {
+		// Fields without key are not loaded from the configuration sources (ex: logger)
+		key := value.Type().Field(i).Tag.Get("mapstructure")
+		if key == "" {
+			continue
+		}
+
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		params = append(params, parameters(key, value.Field(i))...)
+	}
+
+	return params
+}
+
+// decodeHook extends the default decoding of viper with the types implementing encoding.TextUnmarshaler, so that
+// parameters can be written as strings in the configuration file
+func decodeHook() viper.DecoderConfigOption {
+	return viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(listSeparator),
+		stringToTextSliceHookFunc(),
+		mapstructure.TextUnmarshallerHookFunc(),
+	))
+}
+
+// stringToTextSliceHookFunc splits the strings decoded into lists of types implementing encoding.TextUnmarshaler, so
+// that lists such as the addresses of the load balancers can be set via environment variables
+func stringToTextSliceHookFunc() mapstructure.DecodeHookFuncType {
+	unmarshaler := reflect.TypeFor[encoding.TextUnmarshaler]()
+
+	return func(from reflect.Type, to reflect.Type, data any) (any, error) {
+		if from.Kind() != reflect.String || to.Kind() != reflect.Slice {
+			return data, nil
+		}
+		if !reflect.PointerTo(to.Elem()).Implements(unmarshaler) {
+			return data, nil
+		}
+
+		raw, _ := data.(string)
+		if raw == "" {
+			return []string{}, nil
+		}
+
+		return strings.Split(raw, listSeparator), nil
+	}
+}
+
+// FormatValue returns the value of the parameter as printed by the commands, secrets are redacted
+func FormatValue(param Parameter) string {
+	if IsSecret(param.Key) && !isEmpty(param.Value) {
+		return redacted
+	}
+
+	switch value := param.Value.(type) {
+	case string:
+		return strconv.Quote(value)
+	case fmt.Stringer:
+		// Durations are printed as written in the configuration (ex: "10s")
+		return strconv.Quote(value.String())
+	default:
+		return fmt.Sprintf("%+v", value)
+	}
+}
+
+// FormatParameters returns the parameters of the configuration as space separated key=value pairs, intended for
+// logging the configuration without disclosing its secrets
+func FormatParameters(cfg any) string {
+	pairs := []string{}
+	for _, param := range Parameters(cfg) {
+		pairs = append(pairs, param.Key+"="+FormatValue(param))
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+func isEmpty(value any) bool {
+	v := reflect.ValueOf(value)
+	switch v.Kind() { //nolint:exhaustive // the rest of kinds are empty if zero
+	case reflect.Slice, reflect.Map, reflect.String:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+type testSection struct {
+	Timeout time.Duration `mapstructure:"timeout"`
+	Retries int           `mapstructure:"retries"`
+	Name    string        `mapstructure:"name"`
+}
+
+type testConfig struct {
+	Section testSection       `mapstructure:"section"`
+	Labels  map[string]string `mapstructure:"labels"`
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0o700); err != nil {
+		t.Fatalf("failed to create config directory: %v", err)
+	}
+
+	file := filepath.Join(dir, "test.toml")
+	writeFile(t, file, "[section]\ntimeout = \"5s\"\nretries = 2\ntypo = true\n[labels]\nzone = \"a\"\n")
+	// Files of the directory are merged in lexical order, files with other extensions are ignored
+	writeFile(t, filepath.Join(confDir, "20-retries.toml"), "[section]\nretries = 4\n")
+	writeFile(t, filepath.Join(confDir, "10-retries.toml"), "[section]\nretries = 3\n")
+	writeFile(t, filepath.Join(confDir, "30-retries.toml.disabled"), "[section]\nretries = 5\n")
+
+	t.Setenv("GALE_TEST_SECTION_TIMEOUT", "7s")
+
+	cfg := &testConfig{Section: testSection{Timeout: time.Second, Retries: 1, Name: "default"}}
+	loaded, err := Load(Layers{File: file, Dir: confDir, EnvPrefix: "GALE_TEST"}, cfg)
+	if err != nil {
+		t.Fatalf("failed to load configuration: %v", err)
+	}
+
+	expected := testSection{Timeout: 7 * time.Second, Retries: 4, Name: "default"}
+	if cfg.Section != expected || cfg.Labels["zone"] != "a" {
+		t.Fatalf("expected %+v with zone label, got %+v", expected, cfg)
+	}
+
+	origins := map[string]string{
+		"section.timeout": SourceEnv + " GALE_TEST_SECTION_TIMEOUT",
+		"section.retries": SourceFile + " " + filepath.Join(confDir, "20-retries.toml"),
+		"section.name":    SourceDefault,
+		"labels":          SourceFile + " " + file,
+	}
+	for key, origin := range origins {
+		if loaded.Origins[key] != origin {
+			t.Fatalf("expected origin of %s to be %q, got %q", key, origin, loaded.Origins[key])
+		}
+	}
+
+	if !slices.Equal(loaded.Unknown, []string{"section.typo"}) {
+		t.Fatalf("expected unknown keys to be reported, got %v", loaded.Unknown)
+	}
+}
+
+func TestFormatParameters(t *testing.T) {
+	cfg := struct {
+		Section   testSection `mapstructure:"section"`
+		JoinToken string      `mapstructure:"join_token"`
+	}{
+		Section:   testSection{Timeout: time.Second, Retries: 1, Name: "default"},
+		JoinToken: "s3cr3t",
+	}
+
+	expected := `join_token=<redacted> section.name="default" section.retries=1 section.timeout="1s"`
+	if formatted := FormatParameters(cfg); formatted != expected {
+		t.Fatalf("expected %s, got %s", expected, formatted)
+	}
+}
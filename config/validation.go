@@ -0,0 +1,212 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+const (
+	// APIRoleReadOnly allows read requests in the API, APIRoleAdmin allows every request
+	APIRoleReadOnly = "read_only"
+	APIRoleAdmin    = "admin"
+
+	MinPort = 1
+	MaxPort = 65535
+)
+
+// ErrInvalidConfig is wrapped by the errors returned when a configuration does not pass its validation
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// Problem is an issue found in a configuration, identified by the configuration key that must be fixed
+type Problem struct {
+	Key     string
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Key, p.Message)
+}
+
+// ValidationError contains all the problems found in a configuration, so that all of them can be fixed at once
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "%v, %d problems found:", ErrInvalidConfig, len(e.Problems))
+	for _, problem := range e.Problems {
+		fmt.Fprintf(&msg, "\n  - %s", problem)
+	}
+
+	return msg.String()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidConfig
+}
+
+// Validator collects the problems found while validating a configuration, along with warnings that do not invalidate
+// it. The checks that depend on the host running the binary (ex: network interfaces, files) are skipped if host checks
+// are disabled, so that configurations can be validated in CI
+type Validator struct {
+	checkHost bool
+	problems  []Problem
+	warnings  []Problem
+}
+
+func NewValidator(checkHost bool) *Validator {
+	return &Validator{checkHost: checkHost, problems: []Problem{}, warnings: []Problem{}}
+}
+
+// Addf records a problem in the given configuration key
+func (v *Validator) Addf(key, format string, args ...any) {
+	v.problems = append(v.problems, Problem{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// Warnf records a warning in the given configuration key
+func (v *Validator) Warnf(key, format string, args ...any) {
+	v.warnings = append(v.warnings, Problem{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// Warnings returns the warnings recorded
+func (v *Validator) Warnings() []Problem {
+	return v.warnings
+}
+
+// Err returns a ValidationError with all the problems found, nil if there are none
+func (v *Validator) Err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+
+	return &ValidationError{Problems: v.problems}
+}
+
+// Port checks that the port is within the range of valid ports
+func (v *Validator) Port(key string, port int) {
+	if port < MinPort || port > MaxPort {
+		v.Addf(key, "port %d out of range, must be between %d and %d", port, MinPort, MaxPort)
+	}
+}
+
+// Interface checks that the network interface is set and exists in the host
+func (v *Validator) Interface(key, name string) {
+	if name == "" {
+		v.Addf(key, "network interface not set")
+		return
+	}
+
+	if !v.checkHost {
+		return
+	}
+
+	if _, err := net.InterfaceByName(name); err != nil {
+		v.Addf(key, "network interface %q not found in the host: %v", name, err)
+	}
+}
+
+// File checks that the file exists in the host, empty paths are not checked
+func (v *Validator) File(key, path string) {
+	if path == "" || !v.checkHost {
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		v.Addf(key, "cannot access file: %v", err)
+	}
+}
+
+// Dir checks that the directory exists in the host
+func (v *Validator) Dir(key, path string) {
+	if !v.checkHost {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		v.Addf(key, "cannot access directory: %v", err)
+		return
+	}
+	if !info.IsDir() {
+		v.Addf(key, "%s is not a directory", path)
+	}
+}
+
+// CIDR checks that the value is a valid CIDR (ex: 10.0.0.0/24)
+func (v *Validator) CIDR(key, cidr string) {
+	if _, err := netip.ParsePrefix(cidr); err != nil {
+		v.Addf(key, "invalid CIDR %q: %v", cidr, err)
+	}
+}
+
+// Validate checks the authentication of the API, prefix is the configuration key of the section
+func (a APIAuth) Validate(v *Validator, prefix string) {
+	for idx, token := range a.Tokens {
+		key := fmt.Sprintf("%s.tokens[%d]", prefix, idx)
+		if token.Token == "" {
+			v.Addf(key+".token", "token not set")
+		}
+		validateRole(v, key+".role", token.Role)
+	}
+
+	if (a.TLSCertFile == "") != (a.TLSKeyFile == "") {
+		v.Addf(prefix, "tls_cert_file and tls_key_file must be set together")
+	}
+	v.File(prefix+".tls_cert_file", a.TLSCertFile)
+	v.File(prefix+".tls_key_file", a.TLSKeyFile)
+
+	if len(a.ClientCertificates) > 0 && a.ClientCAFile == "" {
+		v.Addf(prefix+".client_ca_file", "client_ca_file must be set to authenticate client_certificates")
+	}
+	if a.ClientCAFile != "" && a.TLSCertFile == "" {
+		v.Addf(prefix+".client_ca_file", "client certificates require tls_cert_file and tls_key_file to be set")
+	}
+	v.File(prefix+".client_ca_file", a.ClientCAFile)
+
+	for idx, cert := range a.ClientCertificates {
+		key := fmt.Sprintf("%s.client_certificates[%d]", prefix, idx)
+		if cert.CommonName == "" {
+			v.Addf(key+".common_name", "common name not set")
+		}
+		validateRole(v, key+".role", cert.Role)
+	}
+}
+
+func validateRole(v *Validator, key, role string) {
+	if role != APIRoleReadOnly && role != APIRoleAdmin {
+		v.Addf(key, "unknown role %q, must be %q or %q", role, APIRoleReadOnly, APIRoleAdmin)
+	}
+}
+
+// Validate checks that mutual TLS is either disabled or fully configured, prefix is the configuration key of the
+// section
+func (t TLS) Validate(v *Validator, prefix string) {
+	if !t.Enabled() {
+		return
+	}
+
+	if t.CertFile == "" || t.KeyFile == "" || t.CAFile == "" {
+		v.Addf(prefix, "cert_file, key_file and ca_file must be set together")
+	}
+	v.File(prefix+".cert_file", t.CertFile)
+	v.File(prefix+".key_file", t.KeyFile)
+	v.File(prefix+".ca_file", t.CAFile)
+}
+
+// Validate checks the export of traces, prefix is the configuration key of the section
+func (t Tracing) Validate(v *Validator, prefix string) {
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		v.Addf(prefix+".sample_ratio", "sample ratio %v out of range, must be between 0 and 1", t.SampleRatio)
+	}
+
+	if t.Enabled() {
+		if _, _, err := net.SplitHostPort(t.Endpoint); err != nil {
+			v.Addf(prefix+".endpoint", "invalid endpoint %q, must be host:port: %v", t.Endpoint, err)
+		}
+	}
+}
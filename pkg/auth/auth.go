@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	common "github.com/yago-123/galelb/config"
+)
+
+const (
+	RoleReadOnlyName = common.APIRoleReadOnly
+	RoleAdminName    = common.APIRoleAdmin
+
+	// ContextKeyRole is the key of the gin context in which the role of the authenticated client is stored
+	ContextKeyRole = "auth_role"
+
+	bearerPrefix = "Bearer "
+)
+
+var (
+	ErrUnauthenticated = errors.New("missing or invalid credentials")
+	ErrForbidden       = errors.New("role not allowed to perform this request")
+)
+
+// Role defines what a client is allowed to do in the API, higher roles include the lower ones
+type Role int
+
+const (
+	RoleNone Role = iota
+	// RoleReadOnly allows read requests (GET, HEAD, OPTIONS)
+	RoleReadOnly
+	// RoleAdmin allows every request
+	RoleAdmin
+)
+
+// ParseRole converts the name of the role used in the configuration into a Role
+func ParseRole(name string) (Role, error) {
+	switch name {
+	case RoleReadOnlyName:
+		return RoleReadOnly, nil
+	case RoleAdminName:
+		return RoleAdmin, nil
+	default:
+		return RoleNone, fmt.Errorf("unknown role %q", name)
+	}
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleNone:
+		return "none"
+	case RoleReadOnly:
+		return RoleReadOnlyName
+	case RoleAdmin:
+		return RoleAdminName
+	default:
+		return "unknown"
+	}
+}
+
+// Authenticator authenticates the clients of an HTTP API via bearer tokens or client certificates and authorizes
+// their requests based on their role
+type Authenticator struct {
+	// tokens contains the roles indexed by the SHA-256 of the token, so that the lookup does not leak the tokens
+	tokens map[[sha256.Size]byte]Role
+	// clientCerts contains the roles indexed by the common name of the client certificate
+	clientCerts map[string]Role
+
+	logger *logrus.Logger
+}
+
+// New creates the authenticator from the configuration of the API
+func New(cfg common.APIAuth, logger *logrus.Logger) (*Authenticator, error) {
+	a := &Authenticator{
+		tokens:      map[[sha256.Size]byte]Role{},
+		clientCerts: map[string]Role{},
+		logger:      logger,
+	}
+
+	for idx, token := range cfg.Tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("token at index %d is empty", idx)
+		}
+
+		role, err := ParseRole(token.Role)
+		if err != nil {
+			return nil, fmt.Errorf("invalid role of token at index %d: %w", idx, err)
+		}
+
+		a.tokens[sha256.Sum256([]byte(token.Token))] = role
+	}
+
+	if len(cfg.ClientCertificates) > 0 && cfg.ClientCAFile == "" {
+		return nil, fmt.Errorf("client certificates require a client CA file")
+	}
+
+	for _, cert := range cfg.ClientCertificates {
+		role, err := ParseRole(cert.Role)
+		if err != nil {
+			return nil, fmt.Errorf("invalid role of client certificate %s: %w", cert.CommonName, err)
+		}
+
+		a.clientCerts[cert.CommonName] = role
+	}
+
+	if cfg.ClientCAFile != "" && cfg.TLSCertFile == "" {
+		return nil, fmt.Errorf("client certificate authentication requires TLS to be enabled")
+	}
+
+	if !a.Enabled() {
+		logger.Warnf("API authentication is disabled, any client can perform any request")
+	} else if len(a.tokens) > 0 && cfg.TLSCertFile == "" {
+		logger.Warnf("API tokens are sent in plain text, enable TLS to protect them")
+	}
+
+	return a, nil
+}
+
+// Enabled returns whether the API requires authentication
+func (a *Authenticator) Enabled() bool {
+	return len(a.tokens) > 0 || len(a.clientCerts) > 0
+}
+
+// Middleware returns the gin middleware that rejects unauthenticated clients (401) and requests not allowed by the
+// role of the client (403)
+func (a *Authenticator) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.Enabled() {
+			c.Next()
+			return
+		}
+
+		role, err := a.Authorize(c.Request, requiredRole(c.Request.Method))
+		switch {
+		case errors.Is(err, ErrUnauthenticated):
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set(ContextKeyRole, role)
+		c.Next()
+	}
+}
+
+// Authorize returns the role of the client of the request. Fails with ErrUnauthenticated if the client could not be
+// authenticated and with ErrForbidden if its role is lower than the one required. Every request is authorized if the
+// authentication is disabled
+func (a *Authenticator) Authorize(req *http.Request, required Role) (Role, error) {
+	if !a.Enabled() {
+		return RoleAdmin, nil
+	}
+
+	role := a.authenticate(req)
+	if role == RoleNone {
+		return RoleNone, ErrUnauthenticated
+	}
+
+	if role < required {
+		a.logger.Warnf("rejected %s %s from %s with role %s", req.Method, req.URL.Path, req.RemoteAddr, role)
+		return role, ErrForbidden
+	}
+
+	return role, nil
+}
+
+// authenticate returns the role of the client, RoleNone if the client could not be authenticated. Verified client
+// certificates take precedence over tokens
+func (a *Authenticator) authenticate(req *http.Request) Role {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		if role, ok := a.clientCerts[req.TLS.VerifiedChains[0][0].Subject.CommonName]; ok {
+			return role
+		}
+	}
+
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return RoleNone
+	}
+
+	if role, ok := a.tokens[sha256.Sum256([]byte(strings.TrimPrefix(header, bearerPrefix)))]; ok {
+		return role
+	}
+
+	return RoleNone
+}
+
+// requiredRole returns the minimum role allowed to perform requests with the method
+func requiredRole(method string) Role {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return RoleReadOnly
+	default:
+		return RoleAdmin
+	}
+}
+
+// ServerTLSConfig returns the TLS configuration of the API server, nil if TLS is not enabled. Client certificates
+// are verified if given, clients without certificate can still authenticate with a token
+func ServerTLSConfig(cfg common.APIAuth) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		return nil, nil //nolint:nilnil // TLS disabled
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, errPool := LoadCertPool(cfg.ClientCAFile)
+		if errPool != nil {
+			return nil, errPool
+		}
+
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsCfg, nil
+}
+
+// LoadCertPool loads the PEM encoded certificates of the file into a pool
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificates found in CA file %s", path)
+	}
+
+	return pool, nil
+}
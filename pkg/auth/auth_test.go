@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	common "github.com/yago-123/galelb/config"
+)
+
+func newTestRouter(t *testing.T, cfg common.APIAuth) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	authenticator, err := New(cfg, logrus.New())
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+
+	router := gin.New()
+	router.Use(authenticator.Middleware())
+	router.GET("/status", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/stop", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	return router
+}
+
+func TestAuth_middleware(t *testing.T) {
+	cfg := common.APIAuth{
+		Tokens: []common.APIToken{
+			{Token: "reader-token", Role: RoleReadOnlyName},
+			{Token: "admin-token", Role: RoleAdminName},
+		},
+		TLSCertFile:  "cert.pem",
+		ClientCAFile: "ca.pem",
+		ClientCertificates: []common.APIClientCertificate{
+			{CommonName: "operator", Role: RoleAdminName},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		cfg        common.APIAuth
+		method     string
+		path       string
+		token      string
+		commonName string
+		status     int
+	}{
+		{name: "disabled", cfg: common.APIAuth{}, method: http.MethodPost, path: "/stop", status: http.StatusOK},
+		{name: "missing token", cfg: cfg, method: http.MethodGet, path: "/status", status: http.StatusUnauthorized},
+		{name: "unknown token", cfg: cfg, method: http.MethodGet, path: "/status", token: "other", status: http.StatusUnauthorized},
+		{name: "read-only reads", cfg: cfg, method: http.MethodGet, path: "/status", token: "reader-token", status: http.StatusOK},
+		{name: "read-only writes", cfg: cfg, method: http.MethodPost, path: "/stop", token: "reader-token", status: http.StatusForbidden},
+		{name: "admin writes", cfg: cfg, method: http.MethodPost, path: "/stop", token: "admin-token", status: http.StatusOK},
+		{name: "client certificate", cfg: cfg, method: http.MethodPost, path: "/stop", commonName: "operator", status: http.StatusOK},
+		{name: "unknown client certificate", cfg: cfg, method: http.MethodGet, path: "/status", commonName: "intruder", status: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			// The TLS handshake verifies the chain, the middleware only maps the common name to a role
+			if tt.commonName != "" {
+				req.TLS = &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: tt.commonName}}}},
+				}
+			}
+
+			recorder := httptest.NewRecorder()
+			newTestRouter(t, tt.cfg).ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestAuth_invalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  common.APIAuth
+	}{
+		{name: "empty token", cfg: common.APIAuth{Tokens: []common.APIToken{{Role: RoleAdminName}}}},
+		{name: "unknown role", cfg: common.APIAuth{Tokens: []common.APIToken{{Token: "token", Role: "root"}}}},
+		{name: "certificates without CA", cfg: common.APIAuth{ClientCertificates: []common.APIClientCertificate{{CommonName: "operator", Role: RoleAdminName}}}},
+		{name: "CA without TLS", cfg: common.APIAuth{ClientCAFile: "ca.pem"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.cfg, logrus.New()); err == nil {
+				t.Fatalf("expected error for invalid configuration")
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	common "github.com/yago-123/galelb/config"
+)
+
+var ErrNoPeerIdentity = errors.New("peer did not present a verified certificate")
+
+// CertReloader keeps the certificate and the CA used for mutual TLS up to date with the files on disk, so that
+// certificates can be rotated without restarting. Files are checked on each handshake and reloaded once modified, if
+// the new files are invalid the previous ones are kept
+type CertReloader struct {
+	cfg common.TLS
+
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes []time.Time
+	lock     sync.Mutex
+
+	logger *logrus.Logger
+}
+
+// NewCertReloader loads the certificate, key and CA of the configuration
+func NewCertReloader(cfg common.TLS, logger *logrus.Logger) (*CertReloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" || cfg.CAFile == "" {
+		return nil, fmt.Errorf("mutual TLS requires a certificate, a key and a CA file")
+	}
+
+	r := &CertReloader{
+		cfg:    cfg,
+		logger: logger,
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// ServerConfig returns the TLS configuration for servers that require clients to present a certificate signed by
+// the CA
+func (r *CertReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			return &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				MinVersion:   tls.VersionTLS12,
+			}, nil
+		},
+	}
+}
+
+// ClientConfig returns the TLS configuration for clients that verify the server against the CA. The CA is loaded
+// once, the client certificate is reloaded on each handshake
+func (r *CertReloader) ClientConfig() *tls.Config {
+	_, pool := r.current()
+	return &tls.Config{
+		RootCAs:    pool,
+		ServerName: r.cfg.ServerName,
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+}
+
+// current returns the certificate and CA, reloading them first if the files changed
+func (r *CertReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.changed() {
+		if err := r.reload(); err != nil {
+			r.logger.Errorf("failed to reload TLS certificates, keeping previous ones: %v", err)
+		} else {
+			r.logger.Infof("reloaded TLS certificate %s", r.cfg.CertFile)
+		}
+	}
+
+	return r.cert, r.pool
+}
+
+// changed returns whether any of the files has been modified since the last load
+func (r *CertReloader) changed() bool {
+	modTimes, err := r.stat()
+	if err != nil {
+		return false
+	}
+
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reload loads the files, the lock must be held unless called from the constructor
+func (r *CertReloader) reload() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	pool, err := LoadCertPool(r.cfg.CAFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert = &cert
+	r.pool = pool
+	r.modTimes = modTimes
+
+	return nil
+}
+
+// stat returns the modification time of the files
+func (r *CertReloader) stat() ([]time.Time, error) {
+	modTimes := []time.Time{}
+	for _, path := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.CAFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+
+	return modTimes, nil
+}
+
+// PeerIdentity returns the identity of the verified certificate chains of a peer: the common name of the leaf
+// certificate or, if empty, its first DNS name
+func PeerIdentity(state tls.ConnectionState) (string, error) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", ErrNoPeerIdentity
+	}
+
+	leaf := state.VerifiedChains[0][0]
+	if leaf.Subject.CommonName != "" {
+		return leaf.Subject.CommonName, nil
+	}
+
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames[0], nil
+	}
+
+	return "", fmt.Errorf("%w: certificate has neither common name nor DNS names", ErrNoPeerIdentity)
+}
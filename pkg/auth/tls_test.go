@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	common "github.com/yago-123/galelb/config"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %v", err)
+	}
+
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writePEM(t, ca.path("ca.crt"), "CERTIFICATE", der)
+
+	return ca
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+// issue signs a certificate with the common name and writes it along with its key, returns the TLS configuration
+func (ca *testCA) issue(t *testing.T, name, commonName string, serial int64) common.TLS {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	writePEM(t, ca.path(name+".crt"), "CERTIFICATE", der)
+	writePEM(t, ca.path(name+".key"), "EC PRIVATE KEY", keyDer)
+
+	return common.TLS{
+		CertFile:   ca.path(name + ".crt"),
+		KeyFile:    ca.path(name + ".key"),
+		CAFile:     ca.path("ca.crt"),
+		ServerName: "localhost",
+	}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+// handshake connects the client to the server and returns the identity of the client seen by the server
+func handshake(t *testing.T, serverCfg, clientCfg *tls.Config) (string, error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, errDial := net.Dial("tcp", listener.Addr().String())
+		if errDial != nil {
+			return
+		}
+		defer conn.Close()
+
+		client := tls.Client(conn, clientCfg)
+		if client.Handshake() == nil {
+			// Wait for the server to verify the client certificate (TLS 1.3 verifies it after the client finishes)
+			_, _ = client.Read(make([]byte, 1))
+		}
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer conn.Close()
+
+	server := tls.Server(conn, serverCfg)
+	if err = server.Handshake(); err != nil {
+		return "", err
+	}
+
+	return PeerIdentity(server.ConnectionState())
+}
+
+func TestTLS_mutualAuthentication(t *testing.T) {
+	ca := newTestCA(t)
+
+	server, err := NewCertReloader(ca.issue(t, "lb", "lb-0", 2), logrus.New())
+	if err != nil {
+		t.Fatalf("failed to load server certificates: %v", err)
+	}
+
+	client, err := NewCertReloader(ca.issue(t, "node", "node-0", 3), logrus.New())
+	if err != nil {
+		t.Fatalf("failed to load client certificates: %v", err)
+	}
+
+	identity, err := handshake(t, server.ServerConfig(), client.ClientConfig())
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if identity != "node-0" {
+		t.Fatalf("expected identity node-0, got %s", identity)
+	}
+
+	// Clients without certificate are rejected during the handshake
+	noCertCfg := client.ClientConfig()
+	noCertCfg.GetClientCertificate = nil
+	if _, err = handshake(t, server.ServerConfig(), noCertCfg); err == nil {
+		t.Fatalf("expected handshake without client certificate to fail")
+	}
+
+	// Rotated certificates are picked up by the next handshake
+	time.Sleep(10 * time.Millisecond)
+	ca.issue(t, "node", "node-0-rotated", 4)
+
+	if identity, err = handshake(t, server.ServerConfig(), client.ClientConfig()); err != nil {
+		t.Fatalf("handshake after rotation failed: %v", err)
+	}
+	if identity != "node-0-rotated" {
+		t.Fatalf("expected rotated identity node-0-rotated, got %s", identity)
+	}
+}
+
+func TestTLS_untrustedCA(t *testing.T) {
+	server, err := NewCertReloader(newTestCA(t).issue(t, "lb", "lb-0", 2), logrus.New())
+	if err != nil {
+		t.Fatalf("failed to load server certificates: %v", err)
+	}
+
+	client, err := NewCertReloader(newTestCA(t).issue(t, "node", "node-0", 2), logrus.New())
+	if err != nil {
+		t.Fatalf("failed to load client certificates: %v", err)
+	}
+
+	if _, err = handshake(t, server.ServerConfig(), client.ClientConfig()); err == nil {
+		t.Fatalf("expected handshake between different CAs to fail")
+	}
+}
@@ -0,0 +1,31 @@
+package consensus
+
+import (
+	"slices"
+	"strings"
+)
+
+const (
+	// ProtocolVersion is the version of the protocol defined by this package
+	ProtocolVersion = 2
+
+	capabilityPrefix = "CAPABILITY_"
+)
+
+// Negotiate returns the capabilities supported by both sides of a session, in the order of the local ones.
+// Capabilities unknown to the local side are ignored, so that newer peers can announce capabilities not defined yet
+func Negotiate(local, remote []Capability) []Capability {
+	negotiated := []Capability{}
+	for _, capability := range local {
+		if capability != Capability_CAPABILITY_UNSPECIFIED && slices.Contains(remote, capability) {
+			negotiated = append(negotiated, capability)
+		}
+	}
+
+	return negotiated
+}
+
+// CapabilityName returns the name of the capability without prefix and in lower case (ex: "config_push")
+func CapabilityName(capability Capability) string {
+	return strings.ToLower(strings.TrimPrefix(capability.String(), capabilityPrefix))
+}
@@ -1,26 +1,614 @@
 package v1
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/yago-123/galelb/config/lb"
+	v1Consensus "github.com/yago-123/galelb/pkg/consensus/v1"
+	"github.com/yago-123/galelb/pkg/lbnetwork/nodemanager"
 	"github.com/yago-123/galelb/pkg/registry"
+	"github.com/yago-123/galelb/pkg/routing"
 )
 
+const (
+	// DefaultNodesLimit and MaxNodesLimit are the default and maximum number of nodes returned per page
+	DefaultNodesLimit = 100
+	MaxNodesLimit     = 1000
+
+	// ExplainRoutingFallbacks is the number of alternative backends returned when explaining the routing of a client
+	ExplainRoutingFallbacks = 2
+
+	// EventsKeepAliveInterval is the interval at which a comment is sent over idle event streams, so that proxies and
+	// clients do not close them
+	EventsKeepAliveInterval = 15 * time.Second
+
+	// LastEventIDHeader is sent by SSE clients when they reconnect, carries the resume token of the last event
+	LastEventIDHeader = "Last-Event-ID"
+)
+
+// nodeStates contains the states by which nodes can be filtered
+var nodeStates = []string{NodeStateEligible, NodeStatePending, NodeStateCordoned, NodeStateDraining, NodeStateDrained, NodeStateBlacklisted} //nolint:gochecknoglobals // read-only
+
+// Prober requests the nodes to run their local checks outside the regular health reports
+type Prober interface {
+	ProbeNode(ctx context.Context, nodeKey string) (nodemanager.ProbeResult, error)
+	ProbeNodes(ctx context.Context) []nodemanager.ProbeResult
+}
+
+// Router selects the nodes serving the clients, implemented by routing.Router
+type Router interface {
+	Explain(flow routing.Flow, maxFallbacks int) (routing.Explanation, error)
+	LookupServicePort(service string) (uint16, error)
+	PurgeAffinity(ctx context.Context, addr netip.Addr) error
+}
+
 type handler struct {
 	registry *registry.NodeRegistry
+	router   Router
+	reloader *lb.Reloader
+	prober   Prober
 }
 
-func newHandler(registry *registry.NodeRegistry) *handler {
+func newHandler(registry *registry.NodeRegistry, router Router, reloader *lb.Reloader, prober Prober) *handler {
 	return &handler{
 		registry: registry,
+		router:   router,
+		reloader: reloader,
+		prober:   prober,
 	}
 }
 
+// @Summary List nodes
+// @Description Retrieve the nodes connected to the load balancer sorted by ID, optionally filtered by state
+// @ID get-nodes
+// @Produce  json
+// @Param state query string false "Node state: eligible, pending, cordoned, draining, drained or blacklisted"
+// @Param offset query int false "Number of nodes to skip"
+// @Param limit query int false "Maximum number of nodes returned"
+// @Success 200 {object} NodesResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /nodes [get]
 func (h *handler) GetNodesStatus(c *gin.Context) {
-	c.Status(http.StatusOK)
+	state := c.Query("state")
+	if state != "" && !slices.Contains(nodeStates, state) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("state must be one of %s", strings.Join(nodeStates, ", "))})
+		return
+	}
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "offset must be a non-negative number"})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(DefaultNodesLimit)))
+	if err != nil || limit <= 0 || limit > MaxNodesLimit {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("limit must be a number between 1 and %d", MaxNodesLimit)})
+		return
+	}
+
+	nodes := []NodeResponse{}
+	for _, info := range h.registry.Nodes() {
+		node := newNodeResponse(info)
+		if state == "" || node.State == state {
+			nodes = append(nodes, node)
+		}
+	}
+
+	resp := NodesResponse{
+		Nodes:  []NodeResponse{},
+		Total:  len(nodes),
+		Offset: offset,
+		Limit:  limit,
+	}
+
+	if offset < len(nodes) {
+		resp.Nodes = nodes[offset:min(offset+limit, len(nodes))]
+	}
+
+	c.JSON(http.StatusOK, resp)
 }
 
+// @Summary Get node
+// @Description Retrieve the state of a node connected to the load balancer
+// @ID get-node
+// @Produce  json
+// @Param id path string true "Node ID"
+// @Success 200 {object} NodeResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /nodes/{id} [get]
 func (h *handler) GetNode(c *gin.Context) {
+	info, err := h.registry.Node(c.Param("id"))
+	if errors.Is(err, registry.ErrNodeNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, newNodeResponse(info))
+}
+
+// todo(): replicate the operator actions to the peer load balancers once the quorum is implemented
+
+// @Summary Cordon node
+// @Description Keep the node registered but out of the routing until it is uncordoned. Clients already kept on the
+// @Description node by the affinity table and the open connections to it are not moved
+// @ID post-node-cordon
+// @Produce  json
+// @Param id path string true "Node ID"
+// @Success 200 {object} NodeResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /nodes/{id}/cordon [post]
+func (h *handler) PostCordonNode(c *gin.Context) {
+	h.nodeAction(c, h.registry.CordonNode)
+}
+
+// @Summary Drain node
+// @Description Stop routing new clients to the node while the clients already served by it are allowed to finish, the node is drained once none is left
+// @ID post-node-drain
+// @Produce  json
+// @Param id path string true "Node ID"
+// @Success 200 {object} NodeResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /nodes/{id}/drain [post]
+func (h *handler) PostDrainNode(c *gin.Context) {
+	h.nodeAction(c, h.registry.DrainNode)
+}
+
+// @Summary Uncordon node
+// @Description Return a cordoned or drained node to the routing
+// @ID post-node-uncordon
+// @Produce  json
+// @Param id path string true "Node ID"
+// @Success 200 {object} NodeResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /nodes/{id}/uncordon [post]
+func (h *handler) PostUncordonNode(c *gin.Context) {
+	h.nodeAction(c, h.registry.UncordonNode)
+}
+
+// @Summary Evict node
+// @Description Forcibly disconnect all the connections of the node IP, move its clients to other nodes and ban it
+// @Description during the blacklist expiry
+// @ID post-node-evict
+// @Param id path string true "Node ID"
+// @Success 204
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /nodes/{id}/evict [post]
+func (h *handler) PostEvictNode(c *gin.Context) {
+	addr, err := h.registry.EvictNode(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, registry.ErrNodeNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	// Clients kept on the node by the affinity table or by their open connections must not wait for the timeouts to be
+	// moved
+	if h.router != nil {
+		if err = h.router.PurgeAffinity(c.Request.Context(), addr); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Unban node
+// @Description Lift the blacklist ban of a node IP before it expires
+// @ID delete-blacklist
+// @Param ip path string true "Node IP"
+// @Success 204
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /blacklist/{ip} [delete]
+func (h *handler) DeleteBlacklist(c *gin.Context) {
+	addr, err := netip.ParseAddr(c.Param("ip"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "ip must be a valid IP address"})
+		return
+	}
+
+	err = h.registry.UnbanNode(addr)
+	if errors.Is(err, registry.ErrNodeNotBlacklisted) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Stream node events
+// @Description Stream the transitions of the nodes (registered, eligible, ineligible, blacklisted, unbanned and
+// @Description removed) as server-sent events. Clients resume the stream after a reconnection by sending the resume
+// @Description token of the last event received, either in the Last-Event-ID header or the resume_token parameter
+// @ID get-events
+// @Produce  text/event-stream
+// @Param resume_token query string false "Resume token of the last event received"
+// @Success 200 {object} EventResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
+// @Router /events [get]
+func (h *handler) GetEvents(c *gin.Context) {
+	resumeToken := c.GetHeader(LastEventIDHeader)
+	if resumeToken == "" {
+		resumeToken = c.Query("resume_token")
+	}
+
+	watcher, err := h.registry.WatchEvents(resumeToken)
+	if errors.Is(err, registry.ErrInvalidResumeToken) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if errors.Is(err, registry.ErrResumeTokenExpired) {
+		// The client must resynchronize from the list of nodes before watching the events again
+		c.JSON(http.StatusGone, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	// The stream outlives the write timeout of the server. Not all writers support deadlines (ex: tests), in which
+	// case the timeout of the server applies
+	controller := http.NewResponseController(c.Writer)
+	_ = controller.SetWriteDeadline(time.Time{})
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
 	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	ctx := c.Request.Context()
+	for {
+		nextCtx, cancel := context.WithTimeout(ctx, EventsKeepAliveInterval)
+		events, errNext := watcher.Next(nextCtx)
+		cancel()
+
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.Is(errNext, context.DeadlineExceeded):
+			_, errNext = fmt.Fprint(c.Writer, ": keep-alive\n\n")
+		case errNext != nil:
+			// The client fell behind and missed events, it must resynchronize before watching them again
+			_ = writeEvent(c, "", "error", ErrorResponse{Error: errNext.Error()})
+			return
+		default:
+			for _, event := range events {
+				if errNext = writeEvent(c, event.ResumeToken, string(event.Type), newEventResponse(event)); errNext != nil {
+					break
+				}
+			}
+		}
+
+		if errNext != nil {
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+// writeEvent writes a server-sent event with the payload encoded as JSON
+func writeEvent(c *gin.Context, id, event string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	if id != "" {
+		if _, err = fmt.Fprintf(c.Writer, "id: %s\n", id); err != nil {
+			return fmt.Errorf("failed to write event: %w", err)
+		}
+	}
+
+	if _, err = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+
+	return nil
+}
+
+// nodeAction applies the action to the node identified in the path and returns its updated state
+func (h *handler) nodeAction(c *gin.Context, action func(ctx context.Context, nodeKey string) error) {
+	nodeKey := c.Param("id")
+	if err := action(c.Request.Context(), nodeKey); err != nil {
+		if errors.Is(err, registry.ErrNodeNotFound) {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	h.GetNode(c)
+}
+
+// @Summary Probe node
+// @Description Request the node to run its local checks right away and return their result. Nodes answering that
+// @Description they are not serving stop receiving traffic until they pass enough health checks again
+// @ID post-node-probe
+// @Produce  json
+// @Param id path string true "Node ID"
+// @Success 200 {object} ProbeResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /nodes/{id}/probe [post]
+func (h *handler) PostProbeNode(c *gin.Context) {
+	if h.prober == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "probes are not enabled in this load balancer"})
+		return
+	}
+
+	result, err := h.prober.ProbeNode(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, nodemanager.ErrNodeNotConnected):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+	case errors.Is(err, nodemanager.ErrProbesNotSupported):
+		c.JSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+	case errors.Is(err, nodemanager.ErrProbeTimeout):
+		c.JSON(http.StatusGatewayTimeout, ErrorResponse{Error: err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+	default:
+		c.JSON(http.StatusOK, newProbeResponse(result))
+	}
+}
+
+// @Summary Probe all nodes
+// @Description Request all the connected nodes to run their local checks right away and return their result. Nodes
+// @Description that fail to answer are included with the reason of the failure
+// @ID post-probes
+// @Produce  json
+// @Success 200 {object} ProbesResponse
+// @Failure 503 {object} ErrorResponse
+// @Router /probes [post]
+func (h *handler) PostProbeNodes(c *gin.Context) {
+	if h.prober == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "probes are not enabled in this load balancer"})
+		return
+	}
+
+	results := h.prober.ProbeNodes(c.Request.Context())
+
+	response := ProbesResponse{Probes: make([]ProbeResponse, 0, len(results)), Total: len(results)}
+	for _, result := range results {
+		if result.Err != nil {
+			response.Failed++
+		}
+		response.Probes = append(response.Probes, newProbeResponse(result))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// @Summary Reload configuration
+// @Description Reload the configuration of the load balancer from its sources and apply the changes that are safe to
+// @Description apply live (node health, rate limits, admission and services). If any change requires a restart (ex:
+// @Description swapping the interfaces) the reload is refused and nothing is applied
+// @ID post-config-reload
+// @Produce  json
+// @Success 200 {object} lb.ReloadReport
+// @Failure 409 {object} lb.ReloadReport
+// @Failure 422 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Router /config/reload [post]
+func (h *handler) PostReloadConfig(c *gin.Context) {
+	if h.reloader == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "configuration reload is not enabled in this load balancer"})
+		return
+	}
+
+	report, err := h.reloader.Reload()
+	if errors.Is(err, lb.ErrReloadRefused) {
+		c.JSON(http.StatusConflict, report)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// @Summary Explain routing of a client
+// @Description Retrieve the backend that will serve a client connection, its position in the ring, the fallback
+// @Description backends and whether the conntrack or affinity tables override the ring selection
+// @ID get-routing-explain
+// @Produce  json
+// @Param ip query string true "Client IP"
+// @Param port query int true "Client port"
+// @Param service query string true "Service name or port"
+// @Success 200 {object} ExplainRoutingResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Router /routing/explain [get]
+func (h *handler) GetExplainRouting(c *gin.Context) {
+	if h.router == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "routing is not enabled in this load balancer"})
+		return
+	}
+
+	ip, err := netip.ParseAddr(c.Query("ip"))
+	if err != nil || !ip.Is4() {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "ip must be a valid IPv4 address"})
+		return
+	}
+
+	port, err := strconv.ParseUint(c.Query("port"), 10, 16)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "port must be a valid port number"})
+		return
+	}
+
+	servicePort, err := h.router.LookupServicePort(c.Query("service"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	explanation, err := h.router.Explain(routing.Flow{
+		SrcIP:       ip,
+		SrcPort:     uint16(port),
+		ServicePort: servicePort,
+	}, ExplainRoutingFallbacks)
+	if errors.Is(err, routing.ErrRingEmpty) {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, newExplainRoutingResponse(explanation))
+}
+
+func newExplainRoutingResponse(explanation routing.Explanation) ExplainRoutingResponse {
+	fallbacks := make([]string, 0, len(explanation.Fallbacks))
+	for _, node := range explanation.Fallbacks {
+		fallbacks = append(fallbacks, routing.AddrKeyToAddrPort(node).String())
+	}
+
+	resp := ExplainRoutingResponse{
+		Service:           explanation.ServiceName,
+		ServicePort:       explanation.ServicePort,
+		Affinity:          explanation.Affinity.String(),
+		KeyHash:           explanation.KeyHash,
+		RingIndex:         explanation.RingIndex,
+		VirtualNodeHash:   explanation.VirtualNodeHash,
+		Fallbacks:         fallbacks,
+		RingEmpty:         explanation.RingEmpty,
+		AffinityOverride:  explanation.AffinityOverride,
+		ConntrackOverride: explanation.ConntrackOverride,
+		Backend:           routing.AddrKeyToAddrPort(explanation.Node).String(),
+	}
+
+	if !explanation.RingEmpty {
+		resp.RingBackend = routing.AddrKeyToAddrPort(explanation.RingNode).String()
+	}
+
+	if explanation.AffinityOverride {
+		resp.AffinityBackend = routing.AddrKeyToAddrPort(explanation.AffinityNode).String()
+	}
+
+	if explanation.ConntrackOverride {
+		resp.ConntrackBackend = routing.AddrKeyToAddrPort(explanation.ConntrackNode).String()
+	}
+
+	return resp
+}
+
+func newProbeResponse(result nodemanager.ProbeResult) ProbeResponse {
+	if result.Err != nil {
+		return ProbeResponse{NodeID: result.NodeID, Error: result.Err.Error()}
+	}
+
+	checks := make([]CheckResultResponse, 0, len(result.Checks))
+	for _, check := range result.Checks {
+		checks = append(checks, CheckResultResponse{
+			Name:     check.GetName(),
+			Passed:   check.GetPassed(),
+			Message:  check.GetMessage(),
+			Duration: time.Duration(check.GetDuration()),
+		})
+	}
+
+	return ProbeResponse{
+		NodeID:   result.NodeID,
+		Status:   v1Consensus.StatusString(result.Status),
+		Checks:   checks,
+		Duration: result.Duration,
+	}
+}
+
+func newEventResponse(event registry.Event) EventResponse {
+	return EventResponse{
+		ResumeToken: event.ResumeToken,
+		Type:        string(event.Type),
+		NodeID:      event.NodeID,
+		Address:     event.Addr.String(),
+		Time:        event.Time,
+	}
+}
+
+func newNodeResponse(info registry.NodeInfo) NodeResponse {
+	resp := NodeResponse{
+		ID:                     info.ID,
+		Address:                info.Addr.String(),
+		MAC:                    info.MAC,
+		State:                  NodeStatePending,
+		ContinuousHealthChecks: info.ContinuousHealthChecks,
+		Eligible:               info.Eligible,
+		Cordoned:               info.Cordoned,
+		Draining:               info.Draining,
+		Drained:                info.Drained,
+		Blacklisted:            info.Blacklisted,
+		Metrics:                info.Metrics,
+		ProtocolVersion:        info.Metadata.ProtocolVersion,
+		Name:                   info.Metadata.Name,
+		Version:                info.Metadata.Version,
+		ServiceEndpoint:        info.Metadata.ServiceEndpoint,
+		Weight:                 info.Metadata.Weight,
+		Labels:                 info.Metadata.Labels,
+		Capabilities:           info.Metadata.Capabilities,
+	}
+
+	switch {
+	case info.Blacklisted:
+		resp.State = NodeStateBlacklisted
+	case info.Drained:
+		resp.State = NodeStateDrained
+	case info.Draining:
+		resp.State = NodeStateDraining
+	case info.Cordoned:
+		resp.State = NodeStateCordoned
+	case info.Eligible:
+		resp.State = NodeStateEligible
+	}
+
+	if !info.LastHealthCheck.IsZero() {
+		lastHealthCheck := info.LastHealthCheck
+		resp.LastHealthCheck = &lastHealthCheck
+	}
+
+	if info.Draining {
+		drainingSince := info.DrainingSince
+		resp.DrainingSince = &drainingSince
+	}
+
+	if info.Blacklisted {
+		blacklistExpiry := info.BlacklistExpiry
+		resp.BlacklistExpiry = &blacklistExpiry
+	}
+
+	return resp
 }
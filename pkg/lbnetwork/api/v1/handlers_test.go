@@ -0,0 +1,483 @@
+package v1
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	common "github.com/yago-123/galelb/config"
+	lbConfig "github.com/yago-123/galelb/config/lb"
+	"github.com/yago-123/galelb/pkg/auth"
+	pkgCommon "github.com/yago-123/galelb/pkg/common"
+	"github.com/yago-123/galelb/pkg/registry"
+	"github.com/yago-123/galelb/pkg/routing"
+)
+
+func newTestRegistry() *registry.NodeRegistry {
+	cfg := &lbConfig.Config{
+		NodeHealth: lbConfig.NodeHealth{ChecksBeforeRouting: 1, BlackListExpiry: time.Hour},
+		Logger:     logrus.New(),
+	}
+
+	nodeRegistry := registry.New(cfg)
+	sessions := map[string]*registry.Session{}
+	for _, nodeKey := range []string{"10.0.0.1:4000", "10.0.0.2:4000", "10.0.0.3:4000"} {
+		sessions[nodeKey], _ = nodeRegistry.RegisterNode(context.Background(), nodeKey, netip.MustParseAddrPort(nodeKey), "02:42:ac:11:00:02", registry.Metadata{})
+	}
+
+	nodeRegistry.ReportNewHealthCheck(context.Background(), sessions["10.0.0.1:4000"], map[string]float64{"cpu": 0.5})
+	nodeRegistry.ReportNewHealthCheck(context.Background(), sessions["10.0.0.3:4000"], nil)
+
+	return nodeRegistry
+}
+
+func newTestAuthenticator(t *testing.T) *auth.Authenticator {
+	t.Helper()
+
+	authenticator, err := auth.New(common.APIAuth{}, logrus.New())
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+
+	return authenticator
+}
+
+func doRequest(t *testing.T, path string, target any) int {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	return doRequestWith(t, setupRouter(newTestRegistry(), nil, nil, nil, nil, newTestAuthenticator(t)), http.MethodGet, path, target)
+}
+
+func doRequestWith(t *testing.T, router *gin.Engine, method, path string, target any) int {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+
+	if target != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), target); err != nil {
+			t.Fatalf("failed to decode response of %s %s: %v", method, path, err)
+		}
+	}
+
+	return recorder.Code
+}
+
+func TestHandlers_getNodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		ids    []string
+		total  int
+	}{
+		{name: "all nodes", path: "/nodes", status: http.StatusOK, ids: []string{"10.0.0.1:4000", "10.0.0.2:4000", "10.0.0.3:4000"}, total: 3},
+		{name: "filter by state", path: "/nodes?state=eligible", status: http.StatusOK, ids: []string{"10.0.0.1:4000", "10.0.0.3:4000"}, total: 2},
+		{name: "paginate", path: "/nodes?offset=1&limit=1", status: http.StatusOK, ids: []string{"10.0.0.2:4000"}, total: 3},
+		{name: "offset past the end", path: "/nodes?offset=5", status: http.StatusOK, ids: []string{}, total: 3},
+		{name: "unknown state", path: "/nodes?state=unknown", status: http.StatusBadRequest},
+		{name: "invalid limit", path: "/nodes?limit=0", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp NodesResponse
+			if status := doRequest(t, tt.path, &resp); status != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, status)
+			}
+
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			if resp.Total != tt.total || len(resp.Nodes) != len(tt.ids) {
+				t.Fatalf("expected %d of %d nodes, got %d of %d", len(tt.ids), tt.total, len(resp.Nodes), resp.Total)
+			}
+
+			for i, node := range resp.Nodes {
+				if node.ID != tt.ids[i] {
+					t.Fatalf("expected node %s at position %d, got %s", tt.ids[i], i, node.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlers_getNode(t *testing.T) {
+	var node NodeResponse
+	if status := doRequest(t, "/nodes/10.0.0.1:4000", &node); status != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, status)
+	}
+
+	if node.State != NodeStateEligible || node.Metrics["cpu"] != 0.5 || node.LastHealthCheck == nil {
+		t.Fatalf("unexpected node %+v", node)
+	}
+
+	var errResp ErrorResponse
+	if status := doRequest(t, "/nodes/10.0.0.9:4000", &errResp); status != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestHandlers_operatorActions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nodeRegistry := newTestRegistry()
+	router := setupRouter(nodeRegistry, nil, nil, nil, nil, newTestAuthenticator(t))
+
+	tests := []struct {
+		name     string
+		path     string
+		state    string
+		eligible int
+	}{
+		{name: "cordon", path: "/nodes/10.0.0.1:4000/cordon", state: NodeStateCordoned, eligible: 1},
+		{name: "drain", path: "/nodes/10.0.0.1:4000/drain", state: NodeStateDraining, eligible: 1},
+		{name: "uncordon", path: "/nodes/10.0.0.1:4000/uncordon", state: NodeStateEligible, eligible: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var node NodeResponse
+			if status := doRequestWith(t, router, http.MethodPost, tt.path, &node); status != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, status)
+			}
+
+			if node.State != tt.state {
+				t.Fatalf("expected state %s, got %s", tt.state, node.State)
+			}
+
+			if eligible := len(nodeRegistry.EligibleNodes()); eligible != tt.eligible {
+				t.Fatalf("expected %d eligible nodes, got %d", tt.eligible, eligible)
+			}
+		})
+	}
+
+	// Evicted nodes are removed and banned until unbanned
+	if status := doRequestWith(t, router, http.MethodPost, "/nodes/10.0.0.1:4000/evict", nil); status != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, status)
+	}
+
+	var errResp ErrorResponse
+	if status := doRequestWith(t, router, http.MethodGet, "/nodes/10.0.0.1:4000", &errResp); status != http.StatusNotFound {
+		t.Fatalf("expected evicted node to be removed, got status %d", status)
+	}
+
+	if _, err := nodeRegistry.RegisterNode(context.Background(), "10.0.0.1:4001", netip.MustParseAddrPort("10.0.0.1:4001"), "", registry.Metadata{}); err == nil {
+		t.Fatalf("expected evicted node to be banned")
+	}
+
+	if status := doRequestWith(t, router, http.MethodDelete, "/blacklist/10.0.0.1", nil); status != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, status)
+	}
+
+	if _, err := nodeRegistry.RegisterNode(context.Background(), "10.0.0.1:4001", netip.MustParseAddrPort("10.0.0.1:4001"), "", registry.Metadata{}); err != nil {
+		t.Fatalf("expected unbanned node to register: %v", err)
+	}
+
+	if status := doRequestWith(t, router, http.MethodDelete, "/blacklist/10.0.0.1", &errResp); status != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestHandlers_getMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nodeRegistry := newTestRegistry()
+
+	gatherer := prometheus.NewRegistry()
+	gatherer.MustRegister(nodeRegistry.Collector())
+
+	recorder := httptest.NewRecorder()
+	setupRouter(nodeRegistry, nil, nil, nil, gatherer, newTestAuthenticator(t)).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	for _, sample := range []string{`galelb_nodes{state="registered"} 3`, `galelb_nodes{state="eligible"} 2`} {
+		if !strings.Contains(recorder.Body.String(), sample) {
+			t.Fatalf("expected metrics to contain %s, got:\n%s", sample, recorder.Body.String())
+		}
+	}
+}
+
+func TestHandlers_getEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nodeRegistry := newTestRegistry()
+	router := setupRouter(nodeRegistry, nil, nil, nil, nil, newTestAuthenticator(t))
+
+	watcher, err := nodeRegistry.WatchEvents("")
+	if err != nil {
+		t.Fatalf("failed to watch events: %v", err)
+	}
+
+	if err = nodeRegistry.CordonNode(context.Background(), "10.0.0.1:4000"); err != nil {
+		t.Fatalf("failed to cordon node: %v", err)
+	}
+	if err = nodeRegistry.UncordonNode(context.Background(), "10.0.0.1:4000"); err != nil {
+		t.Fatalf("failed to uncordon node: %v", err)
+	}
+
+	events, err := watcher.Next(context.Background())
+	if err != nil || len(events) != 2 {
+		t.Fatalf("expected 2 events, got %v (%v)", events, err)
+	}
+
+	// The stream resumes right after the cordon, only the uncordon is replayed
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/events", nil)
+	req.Header.Set(LastEventIDHeader, events[0].ResumeToken)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	expected := "id: " + events[1].ResumeToken + "\nevent: eligible\n"
+	if body := recorder.Body.String(); !strings.Contains(body, expected) || strings.Contains(body, "event: ineligible") {
+		t.Fatalf("expected stream to only contain the uncordon event, got:\n%s", body)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "malformed token", token: "malformed", status: http.StatusBadRequest},
+		{name: "token of a previous instance", token: "0.1", status: http.StatusGone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var errResp ErrorResponse
+			if status := doRequestWith(t, router, http.MethodGet, "/events?resume_token="+tt.token, &errResp); status != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, status)
+			}
+		})
+	}
+}
+
+func TestHandlers_postReloadConfig(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name   string
+		modify func(cfg *lbConfig.Config)
+		status int
+	}{
+		{name: "live change", modify: func(cfg *lbConfig.Config) { cfg.NodeHealth.ChecksBeforeRouting = 5 }, status: http.StatusOK},
+		{name: "interface swap", modify: func(cfg *lbConfig.Config) { cfg.PrivateInterface.NetIfacePrivate = "eth1" }, status: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Reloaded configurations must pass the validation, which requires the network interfaces
+			newConfig := func() *lbConfig.Config {
+				cfg := lbConfig.New()
+				cfg.PrivateInterface.NetIfacePrivate = "eth0"
+				cfg.PublicInterface.NetIfacePublic = "eth0"
+				return cfg
+			}
+
+			reloader := lbConfig.NewReloader(newConfig(), func() (*lbConfig.Config, error) {
+				next := newConfig()
+				tt.modify(next)
+				return next, nil
+			})
+			router := setupRouter(newTestRegistry(), nil, reloader, nil, nil, newTestAuthenticator(t))
+
+			var report lbConfig.ReloadReport
+			if status := doRequestWith(t, router, http.MethodPost, "/config/reload", &report); status != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, status)
+			}
+
+			if len(report.Applied)+len(report.Refused) != 1 {
+				t.Fatalf("expected a single change in the report, got %+v", report)
+			}
+		})
+	}
+
+	var errResp ErrorResponse
+	router := setupRouter(newTestRegistry(), nil, nil, nil, nil, newTestAuthenticator(t))
+	if status := doRequestWith(t, router, http.MethodPost, "/config/reload", &errResp); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, status)
+	}
+}
+
+// fakeRouter explains the flows of a single service, routed by the ring to the first node unless overridden
+type fakeRouter struct {
+	service     string
+	servicePort uint16
+	nodes       []string
+	override    string
+	purged      []netip.Addr
+}
+
+func (r *fakeRouter) Explain(flow routing.Flow, _ int) (routing.Explanation, error) {
+	if len(r.nodes) == 0 && r.override == "" {
+		return routing.Explanation{}, routing.ErrRingEmpty
+	}
+
+	explanation := routing.Explanation{
+		ServiceName: r.service,
+		ServicePort: flow.ServicePort,
+		Affinity:    routing.AffinitySourceIP,
+		RingEmpty:   len(r.nodes) == 0,
+	}
+	if len(r.nodes) > 0 {
+		explanation.RingNode = addrKey(r.nodes[0])
+		explanation.Node = explanation.RingNode
+	}
+	for _, node := range r.nodes[min(1, len(r.nodes)):] {
+		explanation.Fallbacks = append(explanation.Fallbacks, addrKey(node))
+	}
+
+	if r.override != "" {
+		explanation.ConntrackOverride = true
+		explanation.ConntrackNode = addrKey(r.override)
+		explanation.Node = explanation.ConntrackNode
+	}
+
+	return explanation, nil
+}
+
+func (r *fakeRouter) LookupServicePort(service string) (uint16, error) {
+	if service != r.service && service != strconv.Itoa(int(r.servicePort)) {
+		return 0, fmt.Errorf("%w: %s", routing.ErrUnknownService, service)
+	}
+
+	return r.servicePort, nil
+}
+
+func (r *fakeRouter) PurgeAffinity(_ context.Context, addr netip.Addr) error {
+	r.purged = append(r.purged, addr)
+	return nil
+}
+
+// addrKey returns the datapath representation (network byte order) of the address
+func addrKey(addr string) pkgCommon.AddrKey {
+	addrPort := netip.MustParseAddrPort(addr)
+	ip := addrPort.Addr().As4()
+
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], addrPort.Port())
+
+	return pkgCommon.AddrKey{IP: binary.NativeEndian.Uint32(ip[:]), Port: binary.NativeEndian.Uint16(port[:])}
+}
+
+func TestHandlers_getExplainRouting(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name        string
+		router      *fakeRouter
+		path        string
+		status      int
+		ringBackend string
+		backend     string
+		override    bool
+	}{
+		{
+			name:        "ring selection",
+			router:      &fakeRouter{service: "web", servicePort: 8080, nodes: []string{"10.0.0.1:8080", "10.0.0.2:8080"}},
+			path:        "/routing/explain?ip=203.0.113.7&port=40000&service=web",
+			status:      http.StatusOK,
+			ringBackend: "10.0.0.1:8080",
+			backend:     "10.0.0.1:8080",
+		},
+		{
+			name:        "conntrack override",
+			router:      &fakeRouter{service: "web", servicePort: 8080, nodes: []string{"10.0.0.1:8080"}, override: "10.0.0.3:8080"},
+			path:        "/routing/explain?ip=203.0.113.7&port=40000&service=8080",
+			status:      http.StatusOK,
+			ringBackend: "10.0.0.1:8080",
+			backend:     "10.0.0.3:8080",
+			override:    true,
+		},
+		{
+			name:     "conntrack override with empty ring",
+			router:   &fakeRouter{service: "web", servicePort: 8080, override: "10.0.0.3:8080"},
+			path:     "/routing/explain?ip=203.0.113.7&port=40000&service=web",
+			status:   http.StatusOK,
+			backend:  "10.0.0.3:8080",
+			override: true,
+		},
+		{
+			name:   "invalid ip",
+			router: &fakeRouter{service: "web", servicePort: 8080},
+			path:   "/routing/explain?ip=2001:db8::1&port=40000&service=web",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "unknown service",
+			router: &fakeRouter{service: "web", servicePort: 8080},
+			path:   "/routing/explain?ip=203.0.113.7&port=40000&service=api",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "empty ring",
+			router: &fakeRouter{service: "web", servicePort: 8080},
+			path:   "/routing/explain?ip=203.0.113.7&port=40000&service=web",
+			status: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := setupRouter(newTestRegistry(), tt.router, nil, nil, nil, newTestAuthenticator(t))
+
+			var resp ExplainRoutingResponse
+			if status := doRequestWith(t, router, http.MethodGet, tt.path, &resp); status != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			if resp.Service != "web" || resp.ServicePort != 8080 || resp.RingBackend != tt.ringBackend {
+				t.Fatalf("unexpected explanation %+v", resp)
+			}
+			if resp.RingEmpty != (tt.ringBackend == "") {
+				t.Fatalf("expected ring empty %t, got %+v", tt.ringBackend == "", resp)
+			}
+			if resp.Backend != tt.backend || resp.ConntrackOverride != tt.override {
+				t.Fatalf("expected backend %s (override %t), got %s (override %t)", tt.backend, tt.override, resp.Backend, resp.ConntrackOverride)
+			}
+		})
+	}
+
+	// Without router the routing cannot be explained
+	var errResp ErrorResponse
+	router := setupRouter(newTestRegistry(), nil, nil, nil, nil, newTestAuthenticator(t))
+	if status := doRequestWith(t, router, http.MethodGet, "/routing/explain?ip=203.0.113.7&port=40000&service=web", &errResp); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, status)
+	}
+}
+
+func TestHandlers_evictPurgesAffinity(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	routingRouter := &fakeRouter{service: "web", servicePort: 8080}
+	router := setupRouter(newTestRegistry(), routingRouter, nil, nil, nil, newTestAuthenticator(t))
+
+	if status := doRequestWith(t, router, http.MethodPost, "/nodes/10.0.0.2:4000/evict", nil); status != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, status)
+	}
+
+	if len(routingRouter.purged) != 1 || routingRouter.purged[0] != netip.MustParseAddr("10.0.0.2") {
+		t.Fatalf("expected affinity of the evicted node to be purged, got %v", routingRouter.purged)
+	}
+}
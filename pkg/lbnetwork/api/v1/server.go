@@ -5,13 +5,22 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/yago-123/galelb/pkg/auth"
 	"github.com/yago-123/galelb/pkg/util"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/yago-123/galelb/config/lb"
+	v1Consensus "github.com/yago-123/galelb/pkg/consensus/v1"
 	"github.com/yago-123/galelb/pkg/registry"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -25,19 +34,44 @@ const (
 
 type LoadBalancerAPI struct {
 	server *http.Server
+	// grpcServer serves the gRPC services along with the HTTP API, nil if there are none
+	grpcServer *grpc.Server
 
 	cfg *lb.Config
 }
 
-func New(cfg *lb.Config, registry *registry.NodeRegistry) *LoadBalancerAPI {
+// New creates the load balancer API. The router can be nil if the routing is not enabled, in which case the routing
+// endpoints are not available. The reloader, the prober, the events and the gatherer can be nil too, in which case the
+// configuration cannot be reloaded through the API, nodes cannot be probed, the events are not served over gRPC and
+// metrics are not exposed
+func New(cfg *lb.Config, registry *registry.NodeRegistry, router Router, reloader *lb.Reloader, prober Prober, events v1Consensus.LBEventsServer, gatherer prometheus.Gatherer) *LoadBalancerAPI {
 	ip, err := util.GetIPv4FromInterface(cfg.PrivateInterface.NetIfacePrivate)
 	if err != nil {
 		cfg.Logger.Fatalf("failed to get IPv4 address from interface %s: %v", cfg.PrivateInterface.NetIfacePrivate, err)
 	}
 
+	authenticator, err := auth.New(cfg.APIAuth, cfg.Logger)
+	if err != nil {
+		cfg.Logger.Fatalf("failed to configure API authentication: %v", err)
+	}
+
+	tlsCfg, err := auth.ServerTLSConfig(cfg.APIAuth)
+	if err != nil {
+		cfg.Logger.Fatalf("failed to configure API TLS: %v", err)
+	}
+
+	var grpcServer *grpc.Server
+	handler := http.Handler(setupRouter(registry, router, reloader, prober, gatherer, authenticator))
+	if events != nil {
+		grpcServer = grpc.NewServer(grpc.StatsHandler(otelgrpc.NewServerHandler()))
+		v1Consensus.RegisterLBEventsServer(grpcServer, events)
+		handler = serveGRPC(handler, grpcServer, authenticator, tlsCfg != nil)
+	}
+
 	server := &http.Server{
 		Addr:           fmt.Sprintf("%s:%d", ip, cfg.PrivateInterface.APIPort), // todo(): replace with cfg
-		Handler:        setupRouter(registry),
+		Handler:        handler,
+		TLSConfig:      tlsCfg,
 		ReadTimeout:    ServerReadTimeout,
 		WriteTimeout:   ServerWriteTimeout,
 		IdleTimeout:    ServerIdleTimeout,
@@ -45,14 +79,22 @@ func New(cfg *lb.Config, registry *registry.NodeRegistry) *LoadBalancerAPI {
 	}
 
 	return &LoadBalancerAPI{
-		cfg:    cfg,
-		server: server,
+		cfg:        cfg,
+		server:     server,
+		grpcServer: grpcServer,
 	}
 }
 
 // Start starts the HTTP API server in a BLOCKING manner
 func (n *LoadBalancerAPI) Start() error {
-	err := n.server.ListenAndServe()
+	var err error
+	if n.server.TLSConfig != nil {
+		// Certificates are already loaded into the TLS configuration
+		err = n.server.ListenAndServeTLS("", "")
+	} else {
+		err = n.server.ListenAndServe()
+	}
+
 	if errors.Is(err, http.ErrServerClosed) {
 		n.cfg.Logger.Infof("HTTP API server stopped successfully")
 		return nil
@@ -70,15 +112,89 @@ func (n *LoadBalancerAPI) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), ServerShutdownTimeout)
 	defer cancel()
 
+	// The gRPC streams never become idle, they are closed before shutting down the server
+	if n.grpcServer != nil {
+		n.grpcServer.Stop()
+	}
+
 	return n.server.Shutdown(ctx)
 }
 
-func setupRouter(registry *registry.NodeRegistry) *gin.Engine {
+// serveGRPC returns the handler serving the gRPC services along with the HTTP API on the same listener. The gRPC
+// services only watch the state of the load balancer, so they require the read-only role. Without TLS, HTTP/2 is
+// served in clear text so that gRPC clients can connect
+func serveGRPC(handler http.Handler, grpcServer *grpc.Server, authenticator *auth.Authenticator, tlsEnabled bool) http.Handler {
+	services := []string{}
+	for service := range grpcServer.GetServiceInfo() {
+		services = append(services, "/"+service+"/")
+	}
+
+	mux := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 || !hasAnyPrefix(req.URL.Path, services) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		// gRPC clients translate these statuses into Unauthenticated and PermissionDenied
+		_, err := authenticator.Authorize(req, auth.RoleReadOnly)
+		switch {
+		case errors.Is(err, auth.ErrUnauthenticated):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		// The streams outlive the write timeout of the server
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		grpcServer.ServeHTTP(w, req)
+	})
+
+	if tlsEnabled {
+		return mux
+	}
+
+	return h2c.NewHandler(mux, &http2.Server{})
+}
+
+func hasAnyPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func setupRouter(registry *registry.NodeRegistry, routingRouter Router, reloader *lb.Reloader, prober Prober, gatherer prometheus.Gatherer, authenticator *auth.Authenticator) *gin.Engine {
 	router := gin.Default() // todo(): replace with gin.New()
-	handlr := newHandler(registry)
+	handlr := newHandler(registry, routingRouter, reloader, prober)
 
+	// Read requests require at least the read-only role, the rest require the admin role
+	router.Use(authenticator.Middleware())
+
+	// GET requests
 	router.GET("/nodes", handlr.GetNodesStatus)
 	router.GET("/nodes/:id", handlr.GetNode)
+	router.GET("/routing/explain", handlr.GetExplainRouting)
+	router.GET("/events", handlr.GetEvents)
+	if gatherer != nil {
+		router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})))
+	}
+
+	// POST requests
+	router.POST("/nodes/:id/cordon", handlr.PostCordonNode)
+	router.POST("/nodes/:id/drain", handlr.PostDrainNode)
+	router.POST("/nodes/:id/uncordon", handlr.PostUncordonNode)
+	router.POST("/nodes/:id/evict", handlr.PostEvictNode)
+	router.POST("/nodes/:id/probe", handlr.PostProbeNode)
+	router.POST("/probes", handlr.PostProbeNodes)
+	router.POST("/config/reload", handlr.PostReloadConfig)
+
+	// DELETE requests
+	router.DELETE("/blacklist/:ip", handlr.DeleteBlacklist)
 
 	return router
 }
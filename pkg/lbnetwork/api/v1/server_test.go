@@ -0,0 +1,103 @@
+package v1
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	common "github.com/yago-123/galelb/config"
+	"github.com/yago-123/galelb/pkg/auth"
+	v1Consensus "github.com/yago-123/galelb/pkg/consensus/v1"
+	"github.com/yago-123/galelb/pkg/lbnetwork/nodemanager"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestLoadBalancerAPI_watchNodeEventsOverGRPC(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nodeRegistry := newTestRegistry()
+
+	authenticator, err := auth.New(common.APIAuth{Tokens: []common.APIToken{{Token: "viewer", Role: auth.RoleReadOnlyName}}}, logrus.New())
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+
+	grpcServer := grpc.NewServer()
+	v1Consensus.RegisterLBEventsServer(grpcServer, nodemanager.NewEventStreamer(nodeRegistry, logrus.New()))
+	defer grpcServer.Stop()
+
+	// The HTTP API and the gRPC services share the listener, over HTTP/2 in clear text
+	server := httptest.NewServer(serveGRPC(setupRouter(nodeRegistry, nil, nil, nil, nil, authenticator), grpcServer, authenticator, false))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/nodes", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer viewer")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to query the HTTP API: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d from the HTTP API, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(server.URL, "http://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	client := v1Consensus.NewLBEventsClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Clients without credentials are rejected
+	stream, err := client.WatchNodeEvents(ctx, &v1Consensus.WatchNodeEventsRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected unauthenticated watch to be rejected, got %v", err)
+	}
+
+	// The stream resumes right after the cordon, only the uncordon is streamed
+	watcher, err := nodeRegistry.WatchEvents("")
+	if err != nil {
+		t.Fatalf("failed to watch events: %v", err)
+	}
+	if err = nodeRegistry.CordonNode(context.Background(), "10.0.0.1:4000"); err != nil {
+		t.Fatalf("failed to cordon node: %v", err)
+	}
+	events, err := watcher.Next(ctx)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("expected the cordon event, got %v (%v)", events, err)
+	}
+	if err = nodeRegistry.UncordonNode(context.Background(), "10.0.0.1:4000"); err != nil {
+		t.Fatalf("failed to uncordon node: %v", err)
+	}
+
+	stream, err = client.WatchNodeEvents(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer viewer"),
+		&v1Consensus.WatchNodeEventsRequest{ResumeToken: events[0].ResumeToken})
+	if err != nil {
+		t.Fatalf("failed to watch events: %v", err)
+	}
+
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("failed to receive event: %v", err)
+	}
+	if event.GetType() != "eligible" || event.GetNodeId() != "10.0.0.1:4000" {
+		t.Fatalf("expected the uncordoned node to become eligible, got %v", event)
+	}
+}
@@ -1 +1,108 @@
 package v1
+
+import "time"
+
+const (
+	// NodeStateEligible nodes receive traffic, NodeStatePending nodes have not passed enough health checks yet,
+	// NodeStateCordoned, NodeStateDraining and NodeStateDrained nodes have been taken out of the routing by an
+	// operator and NodeStateBlacklisted nodes are banned until the blacklist expires
+	NodeStateEligible    = "eligible"
+	NodeStatePending     = "pending"
+	NodeStateCordoned    = "cordoned"
+	NodeStateDraining    = "draining"
+	NodeStateDrained     = "drained"
+	NodeStateBlacklisted = "blacklisted"
+)
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type ExplainRoutingResponse struct {
+	Service     string `json:"service"`
+	ServicePort uint16 `json:"service_port"`
+	Affinity    string `json:"affinity"`
+
+	KeyHash         uint32 `json:"key_hash"`
+	RingIndex       int    `json:"ring_index"`
+	VirtualNodeHash uint32 `json:"virtual_node_hash"`
+
+	RingBackend string   `json:"ring_backend,omitempty"`
+	Fallbacks   []string `json:"fallbacks"`
+	RingEmpty   bool     `json:"ring_empty"`
+
+	AffinityOverride bool   `json:"affinity_override"`
+	AffinityBackend  string `json:"affinity_backend,omitempty"`
+
+	ConntrackOverride bool   `json:"conntrack_override"`
+	ConntrackBackend  string `json:"conntrack_backend,omitempty"`
+
+	Backend string `json:"backend"`
+}
+
+type NodeResponse struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	MAC     string `json:"mac"`
+	State   string `json:"state"`
+
+	ContinuousHealthChecks uint       `json:"continuous_health_checks"`
+	LastHealthCheck        *time.Time `json:"last_health_check,omitempty"`
+	Eligible               bool       `json:"eligible"`
+
+	Cordoned      bool       `json:"cordoned"`
+	Draining      bool       `json:"draining"`
+	Drained       bool       `json:"drained"`
+	DrainingSince *time.Time `json:"draining_since,omitempty"`
+
+	Blacklisted     bool       `json:"blacklisted"`
+	BlacklistExpiry *time.Time `json:"blacklist_expiry,omitempty"`
+
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+
+	// ProtocolVersion is the version of the protocol spoken by the node, the rest of the fields are announced by the
+	// nodes speaking the second version or later
+	ProtocolVersion int               `json:"protocol_version"`
+	Name            string            `json:"name,omitempty"`
+	Version         string            `json:"version,omitempty"`
+	ServiceEndpoint string            `json:"service_endpoint,omitempty"`
+	Weight          uint32            `json:"weight,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Capabilities    []string          `json:"capabilities,omitempty"`
+}
+
+type NodesResponse struct {
+	Nodes  []NodeResponse `json:"nodes"`
+	Total  int            `json:"total"`
+	Offset int            `json:"offset"`
+	Limit  int            `json:"limit"`
+}
+
+type CheckResultResponse struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Message  string        `json:"message,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+type ProbeResponse struct {
+	NodeID   string                `json:"node_id"`
+	Status   string                `json:"status,omitempty"`
+	Checks   []CheckResultResponse `json:"checks,omitempty"`
+	Duration time.Duration         `json:"duration,omitempty"`
+	Error    string                `json:"error,omitempty"`
+}
+
+type ProbesResponse struct {
+	Probes []ProbeResponse `json:"probes"`
+	Total  int             `json:"total"`
+	Failed int             `json:"failed"`
+}
+
+type EventResponse struct {
+	ResumeToken string    `json:"resume_token"`
+	Type        string    `json:"type"`
+	NodeID      string    `json:"node_id,omitempty"`
+	Address     string    `json:"address"`
+	Time        time.Time `json:"time"`
+}
@@ -0,0 +1,93 @@
+package nodemanager
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	lbConfig "github.com/yago-123/galelb/config/lb"
+)
+
+var ErrAdmissionRejected = errors.New("node admission rejected")
+
+// admission validates that nodes are allowed to register before they are tracked in the registry
+type admission struct {
+	tokens   [][]byte
+	prefixes []netip.Prefix
+	nodeIDs  map[string]struct{}
+}
+
+func newAdmission(cfg lbConfig.Admission) (*admission, error) {
+	a := &admission{
+		tokens:   [][]byte{},
+		prefixes: []netip.Prefix{},
+		nodeIDs:  map[string]struct{}{},
+	}
+
+	for idx, token := range cfg.Tokens {
+		if token == "" {
+			return nil, fmt.Errorf("join token at index %d is empty", idx)
+		}
+		a.tokens = append(a.tokens, []byte(token))
+	}
+
+	for _, cidr := range cfg.AllowedCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed CIDR: %w", err)
+		}
+		a.prefixes = append(a.prefixes, prefix.Masked())
+	}
+
+	for _, nodeID := range cfg.AllowedNodeIDs {
+		a.nodeIDs[nodeID] = struct{}{}
+	}
+
+	return a, nil
+}
+
+// enabled returns whether any admission restriction has been configured
+func (a *admission) enabled() bool {
+	return len(a.tokens) > 0 || len(a.prefixes) > 0 || len(a.nodeIDs) > 0
+}
+
+// admit returns an error describing why the node is not allowed to register, nil if it is allowed
+func (a *admission) admit(nodeKey string, addr netip.Addr, token string) error {
+	if len(a.prefixes) > 0 && !a.allowedAddr(addr) {
+		return fmt.Errorf("%w: address %s is not in the allowed networks", ErrAdmissionRejected, addr)
+	}
+
+	if _, ok := a.nodeIDs[nodeKey]; len(a.nodeIDs) > 0 && !ok {
+		return fmt.Errorf("%w: node ID %s is not allowed", ErrAdmissionRejected, nodeKey)
+	}
+
+	if len(a.tokens) > 0 && !a.validToken(token) {
+		if token == "" {
+			return fmt.Errorf("%w: missing join token", ErrAdmissionRejected)
+		}
+		return fmt.Errorf("%w: invalid join token", ErrAdmissionRejected)
+	}
+
+	return nil
+}
+
+func (a *admission) allowedAddr(addr netip.Addr) bool {
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validToken compares the token against all the accepted tokens in constant time
+func (a *admission) validToken(token string) bool {
+	valid := 0
+	for _, accepted := range a.tokens {
+		valid |= subtle.ConstantTimeCompare(accepted, []byte(token))
+	}
+
+	return valid == 1
+}
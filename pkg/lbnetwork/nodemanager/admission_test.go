@@ -0,0 +1,48 @@
+package nodemanager
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	lbConfig "github.com/yago-123/galelb/config/lb"
+)
+
+func TestAdmission_admit(t *testing.T) {
+	restricted := lbConfig.Admission{
+		Tokens:         []string{"join-a", "join-b"},
+		AllowedCIDRs:   []string{"10.0.0.0/24"},
+		AllowedNodeIDs: []string{"node-0"},
+	}
+
+	tests := []struct {
+		name     string
+		cfg      lbConfig.Admission
+		nodeKey  string
+		addr     string
+		token    string
+		rejected bool
+	}{
+		{name: "unrestricted", cfg: lbConfig.Admission{}, nodeKey: "10.1.0.1:4000", addr: "10.1.0.1"},
+		{name: "admitted", cfg: restricted, nodeKey: "node-0", addr: "10.0.0.1", token: "join-b"},
+		{name: "address outside networks", cfg: restricted, nodeKey: "node-0", addr: "10.1.0.1", token: "join-a", rejected: true},
+		{name: "unknown node ID", cfg: restricted, nodeKey: "node-1", addr: "10.0.0.1", token: "join-a", rejected: true},
+		{name: "missing token", cfg: restricted, nodeKey: "node-0", addr: "10.0.0.1", rejected: true},
+		{name: "invalid token", cfg: restricted, nodeKey: "node-0", addr: "10.0.0.1", token: "join-c", rejected: true},
+		{name: "only tokens", cfg: lbConfig.Admission{Tokens: []string{"join-a"}}, nodeKey: "10.1.0.1:4000", addr: "10.1.0.1", token: "join-a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeAdmission, err := newAdmission(tt.cfg)
+			if err != nil {
+				t.Fatalf("failed to create admission: %v", err)
+			}
+
+			err = nodeAdmission.admit(tt.nodeKey, netip.MustParseAddr(tt.addr), tt.token)
+			if tt.rejected != errors.Is(err, ErrAdmissionRejected) {
+				t.Fatalf("expected rejected %t, got %v", tt.rejected, err)
+			}
+		})
+	}
+}
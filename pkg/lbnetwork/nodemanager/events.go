@@ -0,0 +1,76 @@
+package nodemanager
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+	v1Consensus "github.com/yago-123/galelb/pkg/consensus/v1"
+	"github.com/yago-123/galelb/pkg/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EventStreamer streams the transitions of the nodes of the registry to the integrations watching them (ex: service
+// catalogs, alerting). Served on the listener of the operator API, protected by its authentication
+type EventStreamer struct {
+	registry *registry.NodeRegistry
+
+	// Internal structure required for gRPC implementation
+	v1Consensus.UnimplementedLBEventsServer
+
+	logger *logrus.Logger
+}
+
+func NewEventStreamer(registry *registry.NodeRegistry, logger *logrus.Logger) *EventStreamer {
+	return &EventStreamer{
+		registry: registry,
+		logger:   logger,
+	}
+}
+
+// WatchNodeEvents streams the events of the registry, starting right after the resume token of the request or with
+// the next event emitted if there is no token. The stream fails with OutOfRange if the events after the token have
+// been discarded, in which case the consumer must resynchronize before watching the events again
+func (e *EventStreamer) WatchNodeEvents(req *v1Consensus.WatchNodeEventsRequest, stream grpc.ServerStreamingServer[v1Consensus.NodeEvent]) error {
+	watcher, err := e.registry.WatchEvents(req.GetResumeToken())
+	if err != nil {
+		return eventsStatus(err)
+	}
+
+	for {
+		events, errNext := watcher.Next(stream.Context())
+		if errNext != nil {
+			return eventsStatus(errNext)
+		}
+
+		for _, event := range events {
+			if errSend := stream.Send(newNodeEvent(event)); errSend != nil {
+				e.logger.Debugf("failed to send node event: %v", errSend)
+				return errSend
+			}
+		}
+	}
+}
+
+// eventsStatus translates the errors of the registry into gRPC status errors
+func eventsStatus(err error) error {
+	switch {
+	case errors.Is(err, registry.ErrInvalidResumeToken):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, registry.ErrResumeTokenExpired):
+		return status.Error(codes.OutOfRange, err.Error())
+	default:
+		return status.FromContextError(err).Err()
+	}
+}
+
+func newNodeEvent(event registry.Event) *v1Consensus.NodeEvent {
+	return &v1Consensus.NodeEvent{
+		ResumeToken: event.ResumeToken,
+		Type:        string(event.Type),
+		NodeId:      event.NodeID,
+		Address:     event.Addr.String(),
+		Timestamp:   event.Time.UnixNano(),
+	}
+}
@@ -0,0 +1,349 @@
+package nodemanager
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	lbConfig "github.com/yago-123/galelb/config/lb"
+	"github.com/yago-123/galelb/pkg/auth"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// rateLimiterIdleExpiry is the time after which the limiter of a peer that has not opened any RPC is released
+	rateLimiterIdleExpiry = 10 * time.Minute
+
+	unknownPeer = "unknown"
+)
+
+// MethodStats contains the statistics of the RPCs served for a method. For streams, the latency covers the whole
+// lifetime of the stream
+type MethodStats struct {
+	Calls         uint64
+	Errors        map[codes.Code]uint64
+	ActiveStreams int64
+	TotalLatency  time.Duration
+	MaxLatency    time.Duration
+}
+
+// rpcStats records the statistics of the RPCs served by the node manager, indexed by full method name
+type rpcStats struct {
+	methods map[string]*MethodStats
+	lock    sync.Mutex
+}
+
+func newRPCStats() *rpcStats {
+	return &rpcStats{
+		methods: map[string]*MethodStats{},
+	}
+}
+
+// method returns the statistics of the method, must be called with the lock held
+func (s *rpcStats) method(fullMethod string) *MethodStats {
+	stats, ok := s.methods[fullMethod]
+	if !ok {
+		stats = &MethodStats{Errors: map[codes.Code]uint64{}}
+		s.methods[fullMethod] = stats
+	}
+
+	return stats
+}
+
+func (s *rpcStats) streamStarted(fullMethod string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.method(fullMethod).ActiveStreams++
+}
+
+func (s *rpcStats) streamFinished(fullMethod string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.method(fullMethod).ActiveStreams--
+}
+
+func (s *rpcStats) record(fullMethod string, latency time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := s.method(fullMethod)
+	stats.Calls++
+	stats.TotalLatency += latency
+	stats.MaxLatency = max(stats.MaxLatency, latency)
+	if err != nil {
+		stats.Errors[status.Code(err)]++
+	}
+}
+
+// snapshot returns a copy of the statistics of all the methods
+func (s *rpcStats) snapshot() map[string]MethodStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	snapshot := make(map[string]MethodStats, len(s.methods))
+	for fullMethod, stats := range s.methods {
+		errs := make(map[codes.Code]uint64, len(stats.Errors))
+		for code, count := range stats.Errors {
+			errs[code] = count
+		}
+
+		snapshot[fullMethod] = MethodStats{
+			Calls:         stats.Calls,
+			Errors:        errs,
+			ActiveStreams: stats.ActiveStreams,
+			TotalLatency:  stats.TotalLatency,
+			MaxLatency:    stats.MaxLatency,
+		}
+	}
+
+	return snapshot
+}
+
+// peerLimiter limits the RPCs opened by each peer IP. Peers are limited by IP rather than identity so that the limit
+// also applies before the node has been authenticated. The limits are updated on configuration reloads
+type peerLimiter struct {
+	rate  rate.Limit
+	burst int
+
+	limiters  map[netip.Addr]*peerLimiterEntry
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+type peerLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newPeerLimiter(cfg lbConfig.NodeRateLimit) *peerLimiter {
+	return &peerLimiter{
+		rate: rate.Limit(cfg.Rate),
+		// A burst below one would reject every RPC
+		burst:     max(cfg.Burst, 1),
+		limiters:  map[netip.Addr]*peerLimiterEntry{},
+		lastSweep: time.Now(),
+	}
+}
+
+// enabled returns whether RPCs are limited at all
+func (l *peerLimiter) enabled() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.rate > 0
+}
+
+// setLimits replaces the limits of all the peers, including the ones already tracked
+func (l *peerLimiter) setLimits(cfg lbConfig.NodeRateLimit, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.rate = rate.Limit(cfg.Rate)
+	l.burst = max(cfg.Burst, 1)
+
+	for _, entry := range l.limiters {
+		entry.limiter.SetLimitAt(now, l.rate)
+		entry.limiter.SetBurstAt(now, l.burst)
+	}
+}
+
+// allow returns whether the peer can open a new RPC
+func (l *peerLimiter) allow(addr netip.Addr, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Release the limiters of the peers that are gone, so that the map does not grow with every IP seen
+	if now.Sub(l.lastSweep) >= rateLimiterIdleExpiry {
+		for peerAddr, entry := range l.limiters {
+			if now.Sub(entry.lastSeen) >= rateLimiterIdleExpiry {
+				delete(l.limiters, peerAddr)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	entry, ok := l.limiters[addr]
+	if !ok {
+		entry = &peerLimiterEntry{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.limiters[addr] = entry
+	}
+	entry.lastSeen = now
+
+	return entry.limiter.AllowN(now, 1)
+}
+
+// interceptors contains the chain of interceptors that wrap the RPCs served by the node manager. Interceptors are
+// applied in order: observe (logging and statistics), rate limiting and panic recovery
+type interceptors struct {
+	stats   *rpcStats
+	limiter *peerLimiter
+	logger  *logrus.Logger
+}
+
+// setRateLimit replaces the rate limit of the nodes
+func (i *interceptors) setRateLimit(cfg lbConfig.NodeRateLimit) {
+	i.limiter.setLimits(cfg, time.Now())
+}
+
+func newInterceptors(cfg *lbConfig.Config, stats *rpcStats) *interceptors {
+	return &interceptors{
+		stats:   stats,
+		limiter: newPeerLimiter(cfg.NodeRateLimit),
+		logger:  cfg.Logger,
+	}
+}
+
+// serverOptions returns the options that install the chain of interceptors in the gRPC server
+func (i *interceptors) serverOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(i.observeUnary, i.rateLimitUnary, i.recoverUnary),
+		grpc.ChainStreamInterceptor(i.observeStream, i.rateLimitStream, i.recoverStream),
+	}
+}
+
+func (i *interceptors) observeUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	i.observe(ctx, info.FullMethod, time.Since(start), err)
+
+	return resp, err
+}
+
+func (i *interceptors) observeStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	i.logger.Debugf("stream %s opened by %s", info.FullMethod, peerIdentity(stream.Context()))
+
+	i.stats.streamStarted(info.FullMethod)
+	defer i.stats.streamFinished(info.FullMethod)
+
+	start := time.Now()
+	err := handler(srv, stream)
+	i.observe(stream.Context(), info.FullMethod, time.Since(start), err)
+
+	return err
+}
+
+// observe records the statistics of the RPC and logs it along with the identity of the peer
+func (i *interceptors) observe(ctx context.Context, fullMethod string, latency time.Duration, err error) {
+	i.stats.record(fullMethod, latency, err)
+
+	entry := i.logger.WithFields(logrus.Fields{
+		"method":   fullMethod,
+		"peer":     peerIdentity(ctx),
+		"code":     status.Code(err).String(),
+		"duration": latency,
+	})
+	if err != nil {
+		entry.Warnf("RPC failed: %v", err)
+		return
+	}
+
+	entry.Debugf("RPC finished")
+}
+
+func (i *interceptors) rateLimitUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := i.rateLimit(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (i *interceptors) rateLimitStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := i.rateLimit(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+
+	return handler(srv, stream)
+}
+
+// rateLimit returns a ResourceExhausted error if the peer has exceeded the RPCs it is allowed to open
+func (i *interceptors) rateLimit(ctx context.Context, fullMethod string) error {
+	if !i.limiter.enabled() {
+		return nil
+	}
+
+	addr, ok := peerAddr(ctx)
+	if !ok {
+		return nil
+	}
+
+	if !i.limiter.allow(addr, time.Now()) {
+		return status.Errorf(codes.ResourceExhausted, "too many requests from %s, calling %s", addr, fullMethod)
+	}
+
+	return nil
+}
+
+func (i *interceptors) recoverUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = i.recovered(ctx, info.FullMethod, r)
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+func (i *interceptors) recoverStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = i.recovered(stream.Context(), info.FullMethod, r)
+		}
+	}()
+
+	return handler(srv, stream)
+}
+
+// recovered logs a panic raised by a handler, the peer only receives an Internal error
+func (i *interceptors) recovered(ctx context.Context, fullMethod string, r any) error {
+	i.logger.Errorf("panic serving %s for %s: %v\n%s", fullMethod, peerIdentity(ctx), r, debug.Stack())
+
+	return status.Errorf(codes.Internal, "internal error serving %s", fullMethod)
+}
+
+// peerIdentity returns the identity of the peer for logging purposes: the identity of its certificate if any,
+// otherwise its address
+func peerIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return unknownPeer
+	}
+
+	if tlsInfo, okTLS := p.AuthInfo.(credentials.TLSInfo); okTLS {
+		if identity, err := auth.PeerIdentity(tlsInfo.State); err == nil {
+			return identity
+		}
+	}
+
+	if p.Addr == nil {
+		return unknownPeer
+	}
+
+	return p.Addr.String()
+}
+
+// peerAddr returns the IP of the peer
+func peerAddr(ctx context.Context) (netip.Addr, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	tcpAddr, ok := p.Addr.(*net.TCPAddr)
+	if !ok || tcpAddr == nil {
+		return netip.Addr{}, false
+	}
+
+	return tcpAddr.AddrPort().Addr().Unmap(), true
+}
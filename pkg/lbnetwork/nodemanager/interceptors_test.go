@@ -0,0 +1,107 @@
+package nodemanager
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	lbConfig "github.com/yago-123/galelb/config/lb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testMethod     = "/consensus.v1.LBNodeManager/GetConfig"
+	testRateBurst  = 3
+	testPeerIPPort = "10.0.0.1:40000"
+)
+
+func testInterceptors(rateLimit lbConfig.NodeRateLimit) *interceptors {
+	cfg := lbConfig.New()
+	cfg.Logger = logrus.New()
+	cfg.NodeRateLimit = rateLimit
+
+	return newInterceptors(cfg, newRPCStats())
+}
+
+func testPeerContext(t *testing.T) context.Context {
+	t.Helper()
+
+	addr, err := net.ResolveTCPAddr("tcp", testPeerIPPort)
+	if err != nil {
+		t.Fatalf("failed to resolve peer address: %v", err)
+	}
+
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+}
+
+// chain invokes the handler through the whole chain of unary interceptors, in the same order as the server
+func (i *interceptors) chain(ctx context.Context, handler grpc.UnaryHandler) error {
+	info := &grpc.UnaryServerInfo{FullMethod: testMethod}
+	_, err := i.observeUnary(ctx, nil, info, func(ctx context.Context, req any) (any, error) {
+		return i.rateLimitUnary(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+			return i.recoverUnary(ctx, req, info, handler)
+		})
+	})
+
+	return err
+}
+
+func TestInterceptors_recoverAndRecord(t *testing.T) {
+	chain := testInterceptors(lbConfig.NodeRateLimit{})
+	ctx := testPeerContext(t)
+
+	err := chain.chain(ctx, func(_ context.Context, _ any) (any, error) {
+		panic("handler failure")
+	})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("expected panic to be converted into Internal, got %v", err)
+	}
+
+	errNotFound := status.Error(codes.NotFound, "not found")
+	if err = chain.chain(ctx, func(_ context.Context, _ any) (any, error) {
+		return nil, errNotFound
+	}); !errors.Is(err, errNotFound) {
+		t.Fatalf("expected handler error to be returned, got %v", err)
+	}
+
+	if err = chain.chain(ctx, func(_ context.Context, _ any) (any, error) {
+		return struct{}{}, nil
+	}); err != nil {
+		t.Fatalf("expected handler to succeed, got %v", err)
+	}
+
+	stats := chain.stats.snapshot()[testMethod]
+	if stats.Calls != 3 || stats.Errors[codes.Internal] != 1 || stats.Errors[codes.NotFound] != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestInterceptors_rateLimit(t *testing.T) {
+	chain := testInterceptors(lbConfig.NodeRateLimit{Rate: 1, Burst: testRateBurst})
+	ctx := testPeerContext(t)
+
+	handler := func(_ context.Context, _ any) (any, error) {
+		return struct{}{}, nil
+	}
+
+	for range testRateBurst {
+		if err := chain.chain(ctx, handler); err != nil {
+			t.Fatalf("expected RPC within burst to be allowed, got %v", err)
+		}
+	}
+
+	if err := chain.chain(ctx, handler); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected RPC above burst to be rejected, got %v", err)
+	}
+
+	// Other peers are not affected
+	otherAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+	if err := chain.chain(peer.NewContext(context.Background(), &peer.Peer{Addr: otherAddr}), handler); err != nil {
+		t.Fatalf("expected RPC from other peer to be allowed, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package nodemanager
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "galelb"
+	metricsSubsystem = "grpc"
+)
+
+// serverMetrics exports the statistics of the RPCs served to the nodes along with the health check timeouts
+type serverMetrics struct {
+	stats *rpcStats
+
+	healthCheckTimeouts prometheus.Counter
+
+	requests      *prometheus.Desc
+	errors        *prometheus.Desc
+	activeStreams *prometheus.Desc
+	duration      *prometheus.Desc
+}
+
+func newServerMetrics(stats *rpcStats, healthCheckTimeouts prometheus.Counter) *serverMetrics {
+	return &serverMetrics{
+		stats:               stats,
+		healthCheckTimeouts: healthCheckTimeouts,
+		requests: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "requests_total"),
+			"Number of RPCs served to the nodes, streams are counted once they finish.",
+			[]string{"method"}, nil,
+		),
+		errors: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "errors_total"),
+			"Number of RPCs served to the nodes that finished with an error.",
+			[]string{"method", "code"}, nil,
+		),
+		activeStreams: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "active_streams"),
+			"Number of streams currently open by the nodes.",
+			[]string{"method"}, nil,
+		),
+		duration: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "request_duration_seconds_total"),
+			"Total time spent serving the RPCs of the nodes, including the whole lifetime of streams.",
+			[]string{"method"}, nil,
+		),
+	}
+}
+
+func (m *serverMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.healthCheckTimeouts.Describe(ch)
+	ch <- m.requests
+	ch <- m.errors
+	ch <- m.activeStreams
+	ch <- m.duration
+}
+
+func (m *serverMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.healthCheckTimeouts.Collect(ch)
+
+	for method, stats := range m.stats.snapshot() {
+		ch <- prometheus.MustNewConstMetric(m.requests, prometheus.CounterValue, float64(stats.Calls), method)
+		ch <- prometheus.MustNewConstMetric(m.activeStreams, prometheus.GaugeValue, float64(stats.ActiveStreams), method)
+		ch <- prometheus.MustNewConstMetric(m.duration, prometheus.CounterValue, stats.TotalLatency.Seconds(), method)
+
+		for code, count := range stats.Errors {
+			ch <- prometheus.MustNewConstMetric(m.errors, prometheus.CounterValue, float64(count), method, code.String())
+		}
+	}
+}
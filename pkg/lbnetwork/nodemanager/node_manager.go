@@ -4,29 +4,46 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yago-123/galelb/pkg/auth"
 	"github.com/yago-123/galelb/pkg/registry"
 
 	"github.com/yago-123/galelb/pkg/util"
 
 	"google.golang.org/protobuf/types/known/emptypb"
 
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	lbConfig "github.com/yago-123/galelb/config/lb"
-	"google.golang.org/grpc"
 
 	v1Consensus "github.com/yago-123/galelb/pkg/consensus/v1"
+	v2Consensus "github.com/yago-123/galelb/pkg/consensus/v2"
 
 	"github.com/sirupsen/logrus"
+	"github.com/yago-123/galelb/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelCodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	ChannelBufferSize = 1
+
+	// LoadBalancerService identifies the messages sent by the load balancer over the health stream
+	LoadBalancerService = "gale-lb"
+
+	tracerName = "github.com/yago-123/galelb/pkg/lbnetwork/nodemanager"
 )
 
 // NodeManager contains the logic for synchronizing the load balancer with the NodeRegistry. It's structured as a reverse
@@ -38,7 +55,29 @@ type NodeManager struct {
 	// registry is the internal structure that keeps track of the nodes and their health status
 	registry *registry.NodeRegistry
 
-	//
+	// admission validates that nodes are allowed to register before they are tracked in the registry, health contains
+	// the health parameters served to the nodes. Both are updated on configuration reloads, protected by lock
+	admission *admission
+	health    lbConfig.NodeHealth
+	lock      sync.RWMutex
+
+	// configUpdates contains a channel per health stream through which the configuration is pushed to the node. Each
+	// channel only keeps the latest configuration not sent yet. Protected by configLock
+	configUpdates map[*registry.Session]chan *v1Consensus.ConfigResponse
+	configLock    sync.Mutex
+
+	// probeRequests contains a channel per health stream through which probes are sent to the node, pendingProbes the
+	// probes sent whose answer has not been received yet indexed by probe ID. Both protected by probeLock
+	probeRequests map[*registry.Session]chan *v1Consensus.ProbeRequest
+	pendingProbes map[uint64]pendingProbe
+	nextProbeID   atomic.Uint64
+	probeLock     sync.Mutex
+
+	// resolveMAC returns the MAC address of a node IP in the private interface
+	resolveMAC func(ip, iface string) (string, error)
+
+	// healthCheckTimeouts counts the nodes that did not report their health status in time
+	healthCheckTimeouts prometheus.Counter
 
 	// Internal structure required for gRPC implementation
 	v1Consensus.UnimplementedLBNodeManagerServer
@@ -46,133 +85,456 @@ type NodeManager struct {
 	logger *logrus.Logger
 }
 
-func NewNodeManager(cfg *lbConfig.Config, registry *registry.NodeRegistry) *NodeManager {
-	return &NodeManager{
-		cfg:      cfg,
-		registry: registry,
-		logger:   cfg.Logger,
+func NewNodeManager(cfg *lbConfig.Config, nodeRegistry *registry.NodeRegistry) (*NodeManager, error) {
+	nodeAdmission, err := newAdmission(cfg.Admission)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admission configuration: %w", err)
+	}
+
+	if !nodeAdmission.enabled() {
+		cfg.Logger.Warnf("node admission is not restricted, any node reaching the load balancer will be registered")
 	}
+
+	return &NodeManager{
+		cfg:       cfg,
+		registry:  nodeRegistry,
+		admission: nodeAdmission,
+		health:    cfg.NodeHealth,
+
+		configUpdates: map[*registry.Session]chan *v1Consensus.ConfigResponse{},
+		probeRequests: map[*registry.Session]chan *v1Consensus.ProbeRequest{},
+		pendingProbes: map[uint64]pendingProbe{},
+		resolveMAC:    lookupMAC,
+		healthCheckTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "health_check_timeouts_total",
+			Help:      "Number of times a node did not report its health status within the health check timeout.",
+		}),
+		logger: cfg.Logger,
+	}, nil
 }
 
 // GetConfig returns the current configuration of the load balancer so that nodes can adjust their parameters accordingly
 func (s *NodeManager) GetConfig(_ context.Context, _ *emptypb.Empty) (*v1Consensus.ConfigResponse, error) {
+	return newConfigResponse(s.nodeHealth()), nil
+}
+
+func newConfigResponse(health lbConfig.NodeHealth) *v1Consensus.ConfigResponse {
 	return &v1Consensus.ConfigResponse{
-		ChecksBeforeRouting: uint32(s.cfg.NodeHealth.ChecksBeforeRouting), //nolint:gosec // secure to do this uint conversion
-		HealthCheckTimeout:  s.cfg.NodeHealth.ChecksTimeout.Nanoseconds(),
-		BlackListAfterFails: int64(s.cfg.NodeHealth.BlackListAfterFails),
-		BlackListExpiry:     s.cfg.NodeHealth.BlackListExpiry.Nanoseconds(),
-	}, nil
+		ChecksBeforeRouting: uint32(health.ChecksBeforeRouting), //nolint:gosec // secure to do this uint conversion
+		HealthCheckTimeout:  health.ChecksTimeout.Nanoseconds(),
+		BlackListAfterFails: int64(health.BlackListAfterFails),
+		BlackListExpiry:     health.BlackListExpiry.Nanoseconds(),
+	}
+}
+
+// ValidateConfig checks that the admission rules of a reloaded configuration are valid
+func (s *NodeManager) ValidateConfig(cfg *lbConfig.Config) error {
+	if _, err := newAdmission(cfg.Admission); err != nil {
+		return fmt.Errorf("invalid admission configuration: %w", err)
+	}
+
+	return nil
+}
+
+// ApplyConfig applies the admission rules and health parameters of a reloaded configuration. Nodes already registered
+// are not admitted again, the new rules only apply to the next connections. The new health parameters are pushed to
+// the connected nodes
+func (s *NodeManager) ApplyConfig(cfg *lbConfig.Config) {
+	// Validated beforehand by ValidateConfig
+	nodeAdmission, err := newAdmission(cfg.Admission)
+	if err != nil {
+		s.logger.Errorf("failed to apply admission configuration: %v", err)
+		return
+	}
+
+	if !nodeAdmission.enabled() {
+		s.logger.Warnf("node admission is not restricted, any node reaching the load balancer will be registered")
+	}
+
+	s.lock.Lock()
+	changed := s.health != cfg.NodeHealth
+	s.admission = nodeAdmission
+	s.health = cfg.NodeHealth
+	s.lock.Unlock()
+
+	if changed {
+		s.pushConfig(newConfigResponse(cfg.NodeHealth))
+	}
+}
+
+// subscribeConfig returns the channel through which the configuration is pushed to the node of the session. The
+// current configuration is pushed right away, so that nodes reconnecting catch up with the changes they missed
+func (s *NodeManager) subscribeConfig(session *registry.Session) <-chan *v1Consensus.ConfigResponse {
+	updates := make(chan *v1Consensus.ConfigResponse, 1)
+	updates <- newConfigResponse(s.nodeHealth())
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	s.configUpdates[session] = updates
+
+	return updates
+}
+
+func (s *NodeManager) unsubscribeConfig(session *registry.Session) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	delete(s.configUpdates, session)
 }
 
-// ReportHealthStatus is the main loop for listening to health checks from nodes. Nodes send health checks periodically to the
-// LB to indicate their presence. If a node does not send a health check within a certain timeout, it is removed.
+// pushConfig pushes the configuration to all the connected nodes. Configurations not sent yet are replaced, nodes
+// only need the latest one
+func (s *NodeManager) pushConfig(config *v1Consensus.ConfigResponse) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	for _, updates := range s.configUpdates {
+		select {
+		case <-updates:
+		default:
+		}
+		updates <- config
+	}
+
+	s.logger.Infof("pushing configuration to %d nodes", len(s.configUpdates))
+}
+
+// nodeHealth returns the health parameters in effect
+func (s *NodeManager) nodeHealth() lbConfig.NodeHealth {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.health
+}
+
+// nodeAdmission returns the admission rules in effect
+func (s *NodeManager) nodeAdmission() *admission {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.admission
+}
+
+// ReportHealthStatus serves the health stream of the nodes speaking the first version of the protocol
 func (s *NodeManager) ReportHealthStatus(stream v1Consensus.LBNodeManager_ReportHealthStatusServer) error {
-	msgChan := make(chan *v1Consensus.HealthStatus, ChannelBufferSize)
-	errChan := make(chan error, ChannelBufferSize)
+	return s.serveNode(v1Stream{stream})
+}
 
-	defer close(msgChan)
-	defer close(errChan)
+// serveNode is the main loop for listening to health checks from nodes. Nodes send health checks periodically to the
+// LB to indicate their presence. If a node does not send a health check within a certain timeout, it is removed. The
+// first message is used for admitting the node, nodes not admitted are never tracked in the registry.
+func (s *NodeManager) serveNode(stream nodeStream) error {
+	// The channels are not closed, the listener stops once the stream context is canceled as this function returns
+	msgChan := make(chan *nodeMessage, ChannelBufferSize)
+	errChan := make(chan error, ChannelBufferSize)
 
 	// nodeKey will be used to access the node registry-related info for the node
-	tcpAddr, err := extractTCPFromConn(stream)
+	tcpAddr, err := extractTCPFromConn(stream.Context())
 	if err != nil {
 		return fmt.Errorf("failed to extract peer info from stream: %w", err)
 	}
 
-	// Try to retrieve the MAC address from the ARP cache. If it fails, try to get it via an ARP call
-	mac, err := util.GetMACFromARPCache(tcpAddr.IP.String(), s.cfg.PrivateInterface.NetIfacePrivate)
+	// Nodes are identified by their certificate if TLS is enabled, otherwise by their connection
+	nodeKey := tcpAddr.String()
+	if s.cfg.NodeTLS.Enabled() {
+		identity, errIdentity := extractIdentityFromConn(stream.Context())
+		if errIdentity != nil {
+			s.logger.Warnf("rejected unauthenticated connection from %s: %v", nodeKey, errIdentity)
+			return status.Errorf(codes.Unauthenticated, "failed to authenticate node: %v", errIdentity)
+		}
+		nodeKey = identity
+	}
+
+	// Spawn async function for listening for health checks from nodes
+	go s.listenerReportHealthStatus(nodeKey, msgChan, errChan, stream)
+
+	first, err := s.waitFirstHealthStatus(nodeKey, msgChan, errChan)
 	if err != nil {
-		s.logger.Warnf("failed to get MAC address from ARP cache: %v", err)
+		return err
+	}
 
-		mac, err = util.GetMACViaARPCall(tcpAddr.IP.String(), s.cfg.PrivateInterface.NetIfacePrivate)
-		if err != nil {
-			s.logger.Errorf("failed to get MAC address via ARP call: %v", err)
-			return fmt.Errorf("failed to get MAC address via ARP call: %w", err)
-		}
+	// Since the second version of the protocol, nodes open their session with a hello
+	if first.hello == nil && stream.protocolVersion() >= v2Consensus.ProtocolVersion {
+		return status.Errorf(codes.InvalidArgument, "node %s did not open its session with a hello", nodeKey)
 	}
 
-	// todo(): replace this
-	nodeKey := tcpAddr.String()
+	// The stream context carries the trace propagated by the node over the stream metadata
+	ctx := stream.Context()
 
-	// Register the node if it is not already present
-	s.registry.RegisterNode(nodeKey)
+	// Nodes announce a name in their hello, but the identity of their certificate prevails
+	if hello := first.hello; hello != nil && s.cfg.NodeTLS.Enabled() && hello.GetNodeId() != "" && hello.GetNodeId() != nodeKey {
+		s.logger.Warnf("node %s announced itself as %s, identifying it by its certificate", nodeKey, hello.GetNodeId())
+	}
 
-	s.logger.Debugf("registered new connection from node %s with mac %s", nodeKey, mac)
+	capabilities := negotiateCapabilities(first)
 
-	// Spawn async function for listening for health checks from nodes
-	go s.listenerReportHealthStatus(nodeKey, msgChan, errChan, stream)
+	session, err := s.registerNode(ctx, nodeKey, tcpAddr, first, newMetadata(stream.protocolVersion(), first, capabilities))
+	if err != nil {
+		return err
+	}
+	// The node is removed once the stream ends, whatever the reason. The stream context is canceled by then, only its
+	// trace is kept
+	defer s.registry.UnregisterNode(context.WithoutCancel(ctx), session)
+
+	if err = stream.welcome(capabilities, newConfigResponse(s.nodeHealth())); err != nil {
+		return fmt.Errorf("failed to welcome node %s: %w", nodeKey, err)
+	}
+
+	// The first health check counts as any other once the node has been registered, unlike the hello
+	if first.hello == nil && s.handleHealthStatus(ctx, session, first) {
+		return nil // todo(): change this return
+	}
+
+	// Receiving from nil channels blocks forever, the features not negotiated are never used in the session
+	var updates <-chan *v1Consensus.ConfigResponse
+	if slices.Contains(capabilities, v2Consensus.Capability_CAPABILITY_CONFIG_PUSH) {
+		updates = s.subscribeConfig(session)
+		defer s.unsubscribeConfig(session)
+	}
+
+	probes := s.subscribeProbes(session, slices.Contains(capabilities, v2Consensus.Capability_CAPABILITY_PROBES))
+	defer s.unsubscribeProbes(session)
 
 	// Main loop for multiplexing health checks with errors and health check timeouts. Once this function returns it
 	// means that there has been an unrecoverable error or the node has been marked as unhealthy
-	return s.multiplexHealthStatus(nodeKey, msgChan, errChan)
+	return s.multiplexHealthStatus(ctx, session, stream, msgChan, errChan, updates, probes)
+}
+
+// newMetadata returns the metadata of the node, announced in its hello by the nodes speaking the second version of the
+// protocol
+func newMetadata(protocolVersion int, first *nodeMessage, capabilities []v2Consensus.Capability) registry.Metadata {
+	metadata := registry.Metadata{
+		ProtocolVersion: protocolVersion,
+		Capabilities:    make([]string, 0, len(capabilities)),
+	}
+	for _, capability := range capabilities {
+		metadata.Capabilities = append(metadata.Capabilities, v2Consensus.CapabilityName(capability))
+	}
+
+	if hello := first.hello; hello != nil {
+		metadata.Name = hello.GetNodeId()
+		metadata.Version = hello.GetVersion()
+		metadata.ServiceEndpoint = hello.GetServiceEndpoint()
+		metadata.Weight = hello.GetWeight()
+		metadata.Labels = hello.GetLabels()
+	}
+
+	return metadata
+}
+
+// registerNode admits the node based on its first message and registers it, replacing its previous connection if any
+func (s *NodeManager) registerNode(ctx context.Context, nodeKey string, tcpAddr net.TCPAddr, first *nodeMessage, metadata registry.Metadata) (*registry.Session, error) {
+	addr := tcpAddr.AddrPort()
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "nodemanager.RegisterNode", trace.WithAttributes(
+		attribute.String(tracing.AttrNodeID, nodeKey),
+		attribute.String(tracing.AttrNodeAddr, addr.String()),
+	))
+	defer span.End()
+
+	if err := s.nodeAdmission().admit(nodeKey, addr.Addr(), first.joinToken); err != nil {
+		s.logger.Warnf("rejected node %s from %s: %v", nodeKey, addr, err)
+		span.SetStatus(otelCodes.Error, err.Error())
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	mac, err := s.resolveMAC(tcpAddr.IP.String(), s.cfg.PrivateInterface.NetIfacePrivate)
+	if err != nil {
+		s.logger.Errorf("failed to get MAC address of node %s: %v", nodeKey, err)
+		span.SetStatus(otelCodes.Error, err.Error())
+		return nil, fmt.Errorf("failed to get MAC address: %w", err)
+	}
+
+	// Register the node, replacing its previous connection if any
+	session, err := s.registry.RegisterNode(ctx, nodeKey, addr, mac, metadata)
+	if err != nil {
+		s.logger.Warnf("rejected connection from node %s: %v", nodeKey, err)
+		span.SetStatus(otelCodes.Error, err.Error())
+		return nil, status.Errorf(codes.PermissionDenied, "failed to register node: %v", err)
+	}
+
+	s.logger.Debugf("registered new connection from node %s (%s) with mac %s, protocol version %d and capabilities %v", nodeKey, tcpAddr.String(), mac, metadata.ProtocolVersion, metadata.Capabilities)
+
+	return session, nil
+}
+
+// lookupMAC retrieves the MAC address from the ARP cache. If it is not cached, it is retrieved via an ARP call
+func lookupMAC(ip, iface string) (string, error) {
+	mac, err := util.GetMACFromARPCache(ip, iface)
+	if err == nil {
+		return mac, nil
+	}
+
+	mac, errCall := util.GetMACViaARPCall(ip, iface)
+	if errCall != nil {
+		return "", fmt.Errorf("not found in ARP cache (%w) and ARP call failed: %w", err, errCall)
+	}
+
+	return mac, nil
+}
+
+// waitFirstHealthStatus waits for the first message of the node, which carries the admission parameters
+func (s *NodeManager) waitFirstHealthStatus(nodeKey string, msgChan chan *nodeMessage, errChan chan error) (*nodeMessage, error) {
+	timeout := s.nodeHealth().ChecksTimeout
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg := <-msgChan:
+			return msg, nil
+		case err := <-errChan:
+			if gRPCErrUnrecoverable(err) {
+				return nil, fmt.Errorf("unrecoverable error receiving first health status: %w", err)
+			}
+		case <-timer.C:
+			return nil, status.Errorf(codes.DeadlineExceeded, "node %s did not send its first health status within %s", nodeKey, timeout)
+		}
+	}
+}
+
+// handleHealthStatus processes a health check of the node. Returns whether the node is shutting down
+func (s *NodeManager) handleHealthStatus(ctx context.Context, session *registry.Session, msg *nodeMessage) bool {
+	// Each report starts its own trace linked to the one of the stream, as streams last as long as the node runs
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "nodemanager.HealthReport", trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(
+			attribute.String(tracing.AttrNodeID, session.Key),
+			attribute.String(tracing.AttrNodeStatus, v1Consensus.StatusString(msg.status)),
+		))
+	defer span.End()
+
+	switch msg.status {
+	case v1Consensus.NotServing:
+		// todo(): think what to do, we must re-route traffic for sure
+		return false
+	case v1Consensus.ShuttingDown:
+		// todo(): invoke quorum and re-route all traffic to other nodes
+		s.logger.Infof("node %s is shutting down", session.Key)
+		return true
+	}
+
+	// If status is v1Consensus.Serving keep running the loop
+	s.registry.ReportNewHealthCheck(ctx, session, msg.metrics)
+	return false
 }
 
 // listenerReportHealthStatus is a helper function for listening to health checks from nodes. It abstracts the listener
 // logic from the main function to make the code more readable
-func (s *NodeManager) listenerReportHealthStatus(nodeKey string, msgChan chan *v1Consensus.HealthStatus, errChan chan error, stream grpc.BidiStreamingServer[v1Consensus.HealthStatus, v1Consensus.HealthStatus]) {
+func (s *NodeManager) listenerReportHealthStatus(nodeKey string, msgChan chan *nodeMessage, errChan chan error, stream nodeStream) {
 	for {
 		// Wait for new updates from the node
-		req, errRecv := stream.Recv()
+		req, errRecv := stream.recv()
 		if gRPCErrUnrecoverable(errRecv) {
 			s.logger.Infof("stream closed by node %s", nodeKey)
-			errChan <- errRecv
+			forward(stream.Context(), errChan, errRecv)
 			return
 		}
 
-		s.logger.Infof("received health check from node %s with status %s", nodeKey, v1Consensus.StatusString(v1Consensus.ServiceStatus(req.GetStatus())))
-
 		if errRecv != nil {
-			errChan <- errRecv
+			if !forward(stream.Context(), errChan, errRecv) {
+				return
+			}
+			continue
 		}
 
-		msgChan <- req
+		s.logger.Infof("received message from node %s with status %s", nodeKey, v1Consensus.StatusString(req.status))
+
+		if !forward(stream.Context(), msgChan, req) {
+			return
+		}
+	}
+}
+
+// forward sends the value to the multiplexer unless the stream has been closed. Returns whether the value was sent
+func forward[T any](ctx context.Context, ch chan T, value T) bool {
+	select {
+	case ch <- value:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
 // multiplexHealthStatus is in charge of multiplexing health status updates from nodes. It listens for health status
 // updates and errors from the node. If a node does not send a health check within a certain timeout, it is marked as
-// unhealthy and the traffic is rerouted to other nodes
-func (s *NodeManager) multiplexHealthStatus(nodeKey string, msgChan chan *v1Consensus.HealthStatus, errChan chan error) error {
+// unhealthy and the traffic is rerouted to other nodes. The connection is closed as well once the session ends. The
+// configuration updates and the probes are sent to the node over the same stream
+func (s *NodeManager) multiplexHealthStatus(ctx context.Context, session *registry.Session, stream nodeStream, msgChan chan *nodeMessage, errChan chan error, updates <-chan *v1Consensus.ConfigResponse, probes <-chan *v1Consensus.ProbeRequest) error {
+	nodeKey := session.Key
+
 	// Set timeout for health checks. Nodes should send health checks at least once every half of this duration
-	timer := time.NewTimer(s.cfg.NodeHealth.ChecksTimeout)
+	timer := time.NewTimer(s.nodeHealth().ChecksTimeout)
 	defer timer.Stop()
 
 	for {
 		select {
 		case msg := <-msgChan:
-			if msg.GetStatus() == uint32(v1Consensus.NotServing) {
-				// todo(): think what to do, we must re-route traffic for sure
+			// Answers to probes are not health reports, they do not refresh the timeout
+			if msg.probeResponse != nil {
+				s.deliverProbeResponse(session, msg.probeResponse)
 				continue
-			} else if msg.GetStatus() == uint32(v1Consensus.ShuttingDown) {
-				// todo(): invoke quorum and re-route all traffic to other nodes
-				s.logger.Infof("node %s is shutting down", nodeKey)
-				return nil // todo(): change this return
 			}
 
-			// If status is v1Consensus.Serving keep running the loop
-			s.registry.ReportNewHealthCheck(nodeKey)
+			// Nodes only say hello once
+			if msg.hello != nil {
+				return status.Errorf(codes.InvalidArgument, "node %s sent a hello after registering", nodeKey)
+			}
+
+			if msg.status == v1Consensus.NotServing {
+				// Not serving nodes do not refresh the timeout
+				continue
+			}
+
+			if s.handleHealthStatus(ctx, session, msg) {
+				return nil // todo(): change this return
+			}
 
 			// Drain and reset the timer
 			if !timer.Stop() {
 				<-timer.C
 			}
-			timer.Reset(s.cfg.NodeHealth.ChecksTimeout)
+			timer.Reset(s.nodeHealth().ChecksTimeout)
 
 		case err := <-errChan:
 			s.logger.Errorf("error receiving health status: %v", err)
 			if gRPCErrUnrecoverable(err) {
-				s.registry.ReportNodeFailure(nodeKey)
-				// todo(): trigger action for start rerouting traffic
-				// todo(): do we really want to register/unregister or just keep a latest timestamp? s.unregisterNode(nodeKey)
+				// The stream context is already canceled, only its trace is kept
+				s.registry.ReportNodeFailure(context.WithoutCancel(ctx), session)
 				return fmt.Errorf("unrecoverable error receiving health status: %w", err)
 			}
 
 			// Do not drain the timer, as we want to stop tracking this node if it does not send health status
 			// todo(): may be worth to send (timeout/2) - 1?
+		case config := <-updates:
+			if err := stream.sendConfig(config); err != nil {
+				s.logger.Warnf("failed to push configuration to node %s: %v", nodeKey, err)
+				continue
+			}
+
+			// The node adapts its reporting period once it receives the configuration, so the new timeout starts
+			// counting from now
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(time.Duration(config.GetHealthCheckTimeout()))
+
+		case probe := <-probes:
+			// Probes that cannot be sent time out on the side of the requester
+			if err := stream.sendProbe(probe); err != nil {
+				s.logger.Warnf("failed to send probe %d to node %s: %v", probe.GetProbeId(), nodeKey, err)
+			}
+
+		case <-session.Closed():
+			// The node has been evicted or has reconnected, the registry no longer tracks this connection
+			s.logger.Infof("closing connection of node %s, session ended", nodeKey)
+			return status.Errorf(codes.Aborted, "session of node %s has ended", nodeKey)
 		case <-timer.C:
-			s.registry.ReportNodeFailure(nodeKey)
-			// todo(): trigger action for start rerouting traffic
-			// todo(): do we really want to register/unregister or just keep a latest timestamp? s.unregisterNode(nodeKey) s.unregisterNode(nodeKey)
+			s.healthCheckTimeouts.Inc()
+			s.registry.ReportNodeFailure(ctx, session)
 			return fmt.Errorf("timed out waiting for health status from %s", nodeKey)
 		}
 	}
@@ -186,8 +548,8 @@ func gRPCErrUnrecoverable(err error) bool {
 
 // extractTCPFromConn extracts the node key from the connection. Required for uniquely identifying nodes in the
 // registry
-func extractTCPFromConn(stream grpc.BidiStreamingServer[v1Consensus.HealthStatus, v1Consensus.HealthStatus]) (net.TCPAddr, error) {
-	p, ok := peer.FromContext(stream.Context())
+func extractTCPFromConn(ctx context.Context) (net.TCPAddr, error) {
+	p, ok := peer.FromContext(ctx)
 	if ok {
 		if addr, okTCP := p.Addr.(*net.TCPAddr); okTCP {
 			// Make sure that addr is not nil just in case, it should never be nil
@@ -199,3 +561,18 @@ func extractTCPFromConn(stream grpc.BidiStreamingServer[v1Consensus.HealthStatus
 
 	return net.TCPAddr{}, fmt.Errorf("failed to extract peer info from stream")
 }
+
+// extractIdentityFromConn extracts the identity of the node from the certificate verified during the TLS handshake
+func extractIdentityFromConn(ctx context.Context) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", fmt.Errorf("failed to extract peer info from stream")
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return "", auth.ErrNoPeerIdentity
+	}
+
+	return auth.PeerIdentity(tlsInfo.State)
+}
@@ -1,6 +1,7 @@
 package nodemanager
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
@@ -13,8 +14,14 @@ import (
 
 	lbConfig "github.com/yago-123/galelb/config/lb"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yago-123/galelb/pkg/auth"
 	pb "github.com/yago-123/galelb/pkg/consensus/v1"
+	pbV2 "github.com/yago-123/galelb/pkg/consensus/v2"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/reflection"
 )
@@ -33,11 +40,39 @@ const (
 type Server struct {
 	grpcNodesServer *grpc.Server
 
+	nodeManager  *NodeManager
+	interceptors *interceptors
+
+	// stats contains the statistics of the RPCs served to the nodes
+	stats   *rpcStats
+	metrics *serverMetrics
+
 	cfg *lbConfig.Config
 }
 
 func New(cfg *lbConfig.Config, registry *registry.NodeRegistry) *Server {
-	grpcServer := grpc.NewServer(
+	// Nodes must present a certificate signed by the CA, otherwise any host of the private network could register
+	// itself as backend
+	creds := insecure.NewCredentials()
+	if cfg.NodeTLS.Enabled() {
+		reloader, err := auth.NewCertReloader(cfg.NodeTLS, cfg.Logger)
+		if err != nil {
+			cfg.Logger.Fatalf("failed to configure TLS for nodes: %v", err)
+		}
+		creds = credentials.NewTLS(reloader.ServerConfig())
+	} else {
+		cfg.Logger.Warnf("TLS for nodes is disabled, any host of the private network can register as a node")
+	}
+
+	stats := newRPCStats()
+	if cfg.NodeRateLimit.Rate <= 0 {
+		cfg.Logger.Warnf("rate limit for nodes is disabled")
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.Creds(creds),
+		// Traces the RPCs, extracting the trace context propagated by the nodes over the stream metadata
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
 		grpc.MaxRecvMsgSize(MaxRecvMsgSize),
 		grpc.MaxSendMsgSize(MaxSendMsgSize),
 		grpc.KeepaliveParams(keepalive.ServerParameters{
@@ -47,18 +82,30 @@ func New(cfg *lbConfig.Config, registry *registry.NodeRegistry) *Server {
 			Time:                  KeepAliveProbeFrequency,
 			Timeout:               KeepAliveProbeTimeout,
 		}),
-		// grpc.Creds(),                            // todo
-		// grpc.UnaryInterceptor(UnaryInterceptor), // todo
-		// grpc.StreamInterceptor(),                // todo
-	)
+	}
+	chain := newInterceptors(cfg, stats)
+	opts = append(opts, chain.serverOptions()...)
 
-	pb.RegisterLBNodeManagerServer(grpcServer, NewNodeManager(cfg, registry))
+	grpcServer := grpc.NewServer(opts...)
+
+	nodeManager, err := NewNodeManager(cfg, registry)
+	if err != nil {
+		cfg.Logger.Fatalf("failed to create node manager: %v", err)
+	}
+
+	// Both versions of the protocol are served, nodes speaking the first one keep working during rolling upgrades
+	pb.RegisterLBNodeManagerServer(grpcServer, nodeManager)
+	pbV2.RegisterLBNodeManagerServer(grpcServer, NewNodeManagerV2(nodeManager))
 
 	// todo() remove once the project has been stabilized
 	reflection.Register(grpcServer)
 
 	return &Server{
 		grpcNodesServer: grpcServer,
+		nodeManager:     nodeManager,
+		interceptors:    chain,
+		stats:           stats,
+		metrics:         newServerMetrics(stats, nodeManager.healthCheckTimeouts),
 		cfg:             cfg,
 	}
 }
@@ -79,6 +126,42 @@ func (s *Server) Start() {
 	}
 }
 
+// ValidateConfig checks that the node parameters of a reloaded configuration can be applied
+func (s *Server) ValidateConfig(cfg *lbConfig.Config) error {
+	return s.nodeManager.ValidateConfig(cfg)
+}
+
+// ApplyConfig applies the node parameters of a reloaded configuration: health parameters, admission rules and rate
+// limits. Existing connections are kept
+func (s *Server) ApplyConfig(cfg *lbConfig.Config) {
+	if cfg.NodeRateLimit.Rate <= 0 {
+		s.cfg.Logger.Warnf("rate limit for nodes is disabled")
+	}
+
+	s.interceptors.setRateLimit(cfg.NodeRateLimit)
+	s.nodeManager.ApplyConfig(cfg)
+}
+
+// ProbeNode requests the node to run its local checks and waits for the result
+func (s *Server) ProbeNode(ctx context.Context, nodeKey string) (ProbeResult, error) {
+	return s.nodeManager.ProbeNode(ctx, nodeKey)
+}
+
+// ProbeNodes probes all the connected nodes concurrently
+func (s *Server) ProbeNodes(ctx context.Context) []ProbeResult {
+	return s.nodeManager.ProbeNodes(ctx)
+}
+
+// RPCStats returns the statistics of the RPCs served to the nodes, indexed by full method name
+func (s *Server) RPCStats() map[string]MethodStats {
+	return s.stats.snapshot()
+}
+
+// Collector returns the collector of the metrics of the RPCs served to the nodes
+func (s *Server) Collector() prometheus.Collector {
+	return s.metrics
+}
+
 func (s *Server) Stop() {
 
 }
@@ -0,0 +1,257 @@
+package nodemanager
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	lbConfig "github.com/yago-123/galelb/config/lb"
+	v1Consensus "github.com/yago-123/galelb/pkg/consensus/v1"
+	v2Consensus "github.com/yago-123/galelb/pkg/consensus/v2"
+	"github.com/yago-123/galelb/pkg/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestNodeManager_pushConfig(t *testing.T) {
+	cfg := lbConfig.New()
+	cfg.Logger = logrus.New()
+
+	nodeManager, err := NewNodeManager(cfg, registry.New(cfg))
+	if err != nil {
+		t.Fatalf("failed to create node manager: %v", err)
+	}
+
+	// The current configuration is pushed as soon as the node subscribes
+	session := &registry.Session{Key: "node-0"}
+	updates := nodeManager.subscribeConfig(session)
+	if config := <-updates; time.Duration(config.GetHealthCheckTimeout()) != cfg.NodeHealth.ChecksTimeout {
+		t.Fatalf("expected current timeout, got %s", time.Duration(config.GetHealthCheckTimeout()))
+	}
+
+	// Only the latest configuration not sent yet is pushed
+	for _, timeout := range []time.Duration{5 * time.Second, 3 * time.Second} {
+		reloaded := lbConfig.New()
+		reloaded.NodeHealth.ChecksTimeout = timeout
+		nodeManager.ApplyConfig(reloaded)
+	}
+
+	if config := <-updates; time.Duration(config.GetHealthCheckTimeout()) != 3*time.Second {
+		t.Fatalf("expected latest timeout, got %s", time.Duration(config.GetHealthCheckTimeout()))
+	}
+
+	// Reloads that do not change the health parameters are not pushed
+	unchanged := lbConfig.New()
+	unchanged.NodeHealth.ChecksTimeout = 3 * time.Second
+	nodeManager.ApplyConfig(unchanged)
+
+	nodeManager.unsubscribeConfig(session)
+	select {
+	case config := <-updates:
+		t.Fatalf("expected no configuration pushed, got %v", config)
+	default:
+	}
+}
+
+func TestNodeManager_probeNode(t *testing.T) {
+	cfg := lbConfig.New()
+	cfg.Logger = logrus.New()
+
+	nodeRegistry := registry.New(cfg)
+	nodeManager, err := NewNodeManager(cfg, nodeRegistry)
+	if err != nil {
+		t.Fatalf("failed to create node manager: %v", err)
+	}
+
+	if _, err = nodeManager.ProbeNode(context.Background(), "node-0"); !errors.Is(err, ErrNodeNotConnected) {
+		t.Fatalf("expected node not connected, got %v", err)
+	}
+
+	session, err := nodeRegistry.RegisterNode(context.Background(), "node-0", netip.MustParseAddrPort("10.0.0.1:4000"), "", registry.Metadata{})
+	if err != nil {
+		t.Fatalf("failed to register node: %v", err)
+	}
+	probes := nodeManager.subscribeProbes(session, true)
+
+	// Answer the probe as the node would, answers from other sessions are discarded
+	go func() {
+		probe := <-probes
+		nodeManager.deliverProbeResponse(&registry.Session{Key: "node-1"}, &v1Consensus.ProbeResponse{ProbeId: probe.GetProbeId()})
+		nodeManager.deliverProbeResponse(session, &v1Consensus.ProbeResponse{
+			ProbeId: probe.GetProbeId(),
+			Status:  uint32(v1Consensus.NotServing),
+			Checks:  []*v1Consensus.CheckResult{{Name: "http", Message: "unexpected status code 503"}},
+		})
+	}()
+
+	result, err := nodeManager.ProbeNode(context.Background(), "node-0")
+	if err != nil {
+		t.Fatalf("failed to probe node: %v", err)
+	}
+	if result.Status != v1Consensus.NotServing || len(result.Checks) != 1 {
+		t.Fatalf("expected not serving with one check, got %v", result)
+	}
+
+	if results := nodeManager.ProbeNodes(context.Background()); len(results) != 1 || !errors.Is(results[0].Err, ErrProbeTimeout) {
+		t.Fatalf("expected unanswered probe to time out, got %v", results)
+	}
+
+	nodeManager.unsubscribeProbes(session)
+	if results := nodeManager.ProbeNodes(context.Background()); len(results) != 0 {
+		t.Fatalf("expected no connected nodes, got %v", results)
+	}
+}
+
+func TestNodeManager_negotiateCapabilities(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    *nodeMessage
+		expected []string
+	}{
+		{
+			name:     "first version",
+			first:    &nodeMessage{status: v1Consensus.Serving},
+			expected: []string{"config_push", "probes", "load_metrics"},
+		},
+		{
+			name: "second version",
+			first: &nodeMessage{hello: &v2Consensus.Hello{Capabilities: []v2Consensus.Capability{
+				v2Consensus.Capability_CAPABILITY_PROBES,
+				v2Consensus.Capability_CAPABILITY_CONFIG_PUSH,
+			}}},
+			expected: []string{"config_push", "probes"},
+		},
+		{
+			name: "unknown capabilities",
+			first: &nodeMessage{hello: &v2Consensus.Hello{Capabilities: []v2Consensus.Capability{
+				v2Consensus.Capability_CAPABILITY_UNSPECIFIED,
+				v2Consensus.Capability(99),
+			}}},
+			expected: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protocolVersion := 1
+			if tt.first.hello != nil {
+				protocolVersion = v2Consensus.ProtocolVersion
+			}
+
+			metadata := newMetadata(protocolVersion, tt.first, negotiateCapabilities(tt.first))
+			if !slices.Equal(metadata.Capabilities, tt.expected) {
+				t.Fatalf("expected capabilities %v, got %v", tt.expected, metadata.Capabilities)
+			}
+			if metadata.ProtocolVersion != protocolVersion {
+				t.Fatalf("expected protocol version %d, got %d", protocolVersion, metadata.ProtocolVersion)
+			}
+		})
+	}
+}
+
+func TestNodeManager_rollingUpgrade(t *testing.T) {
+	cfg := lbConfig.New()
+	cfg.Logger = logrus.New()
+
+	nodeRegistry := registry.New(cfg)
+	nodeManager, err := NewNodeManager(cfg, nodeRegistry)
+	if err != nil {
+		t.Fatalf("failed to create node manager: %v", err)
+	}
+	nodeManager.resolveMAC = func(_, _ string) (string, error) {
+		return "02:42:ac:11:00:02", nil
+	}
+
+	// Load balancers serve both versions of the protocol
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := grpc.NewServer()
+	v1Consensus.RegisterLBNodeManagerServer(server, nodeManager)
+	v2Consensus.RegisterLBNodeManagerServer(server, NewNodeManagerV2(nodeManager))
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	// Without TLS nodes are identified by their connection, each node has its own
+	connect := func() *grpc.ClientConn {
+		conn, errConn := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if errConn != nil {
+			t.Fatalf("failed to connect: %v", errConn)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		return conn
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A node not upgraded yet registers with its first health report
+	v1Node, err := v1Consensus.NewLBNodeManagerClient(connect()).ReportHealthStatus(ctx)
+	if err != nil {
+		t.Fatalf("failed to open v1 stream: %v", err)
+	}
+	if err = v1Node.Send(&v1Consensus.HealthStatus{Status: uint32(v1Consensus.Serving)}); err != nil {
+		t.Fatalf("failed to send v1 health status: %v", err)
+	}
+
+	// Configurations are pushed to v1 nodes, as they do not announce their capabilities
+	reloaded := lbConfig.New()
+	reloaded.NodeHealth.ChecksTimeout = 3 * time.Second
+	var nodes []registry.NodeInfo
+	for nodes = nodeRegistry.Nodes(); len(nodes) == 0; nodes = nodeRegistry.Nodes() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	nodeManager.ApplyConfig(reloaded)
+
+	if metadata := nodes[0].Metadata; metadata.ProtocolVersion != 1 || !slices.Equal(metadata.Capabilities, []string{"config_push", "probes", "load_metrics"}) {
+		t.Fatalf("expected v1 node with the capabilities of the first version, got %+v", metadata)
+	}
+
+	// The configuration in effect is pushed as soon as the node subscribes, which can happen before the reload
+	for {
+		msg, errRecv := v1Node.Recv()
+		if errRecv != nil {
+			t.Fatalf("expected configuration pushed to the v1 node: %v", errRecv)
+		}
+		if time.Duration(msg.GetConfig().GetHealthCheckTimeout()) == 3*time.Second {
+			break
+		}
+	}
+
+	// An upgraded node is welcomed along with the configuration in effect
+	v2Node, err := v2Consensus.NewLBNodeManagerClient(connect()).Session(ctx)
+	if err != nil {
+		t.Fatalf("failed to open v2 session: %v", err)
+	}
+	hello := &v2Consensus.Hello{NodeId: "node-1", Capabilities: []v2Consensus.Capability{v2Consensus.Capability_CAPABILITY_PROBES}}
+	if err = v2Node.Send(&v2Consensus.NodeMessage{Payload: &v2Consensus.NodeMessage_Hello{Hello: hello}}); err != nil {
+		t.Fatalf("failed to send hello: %v", err)
+	}
+
+	reply, err := v2Node.Recv()
+	if err != nil {
+		t.Fatalf("failed to receive welcome: %v", err)
+	}
+	welcome := reply.GetWelcome()
+	if !slices.Equal(welcome.GetCapabilities(), hello.GetCapabilities()) {
+		t.Fatalf("expected only probes to be negotiated, got %v", welcome.GetCapabilities())
+	}
+	if time.Duration(welcome.GetConfig().GetHealthCheckTimeout()) != 3*time.Second {
+		t.Fatalf("expected the configuration in effect in the welcome, got %v", welcome.GetConfig())
+	}
+
+	if nodes = nodeRegistry.Nodes(); len(nodes) != 2 {
+		t.Fatalf("expected both nodes to be registered, got %+v", nodes)
+	}
+}
@@ -0,0 +1,34 @@
+package nodemanager
+
+import (
+	"context"
+
+	v2Consensus "github.com/yago-123/galelb/pkg/consensus/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// NodeManagerV2 serves the second version of the protocol to the nodes. Sessions are handled by the node manager along
+// with the ones of the nodes speaking the first version, so that nodes can be upgraded one at a time
+type NodeManagerV2 struct {
+	manager *NodeManager
+
+	// Internal structure required for gRPC implementation
+	v2Consensus.UnimplementedLBNodeManagerServer
+}
+
+func NewNodeManagerV2(manager *NodeManager) *NodeManagerV2 {
+	return &NodeManagerV2{
+		manager: manager,
+	}
+}
+
+// GetConfig returns the current configuration of the load balancer
+func (s *NodeManagerV2) GetConfig(_ context.Context, _ *emptypb.Empty) (*v2Consensus.Config, error) {
+	return toConfig(newConfigResponse(s.manager.nodeHealth())), nil
+}
+
+// Session serves the session of a node, opened with a hello
+func (s *NodeManagerV2) Session(stream grpc.BidiStreamingServer[v2Consensus.NodeMessage, v2Consensus.LBMessage]) error {
+	return s.manager.serveNode(v2Stream{stream})
+}
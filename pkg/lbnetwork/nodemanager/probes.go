@@ -0,0 +1,226 @@
+package nodemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	v1Consensus "github.com/yago-123/galelb/pkg/consensus/v1"
+	"github.com/yago-123/galelb/pkg/registry"
+	"github.com/yago-123/galelb/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelCodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// ProbeTimeout is the maximum time waited for the answer of a node to a probe, kept below the write timeout of the
+	// API so that probes requested through it can be answered
+	ProbeTimeout = 3 * time.Second
+
+	// ProbesBufferSize is the number of probes waiting to be sent to each node, further probes wait until the pending
+	// ones are sent or the probe times out
+	ProbesBufferSize = 8
+)
+
+var (
+	ErrNodeNotConnected   = errors.New("node is not connected")
+	ErrProbesNotSupported = errors.New("node does not support probes")
+	ErrProbeTimeout       = errors.New("node did not answer the probe in time")
+)
+
+// ProbeResult is the answer of a node to a probe
+type ProbeResult struct {
+	NodeID string
+	Status v1Consensus.ServiceStatus
+	// Checks contains the result of each local check of the node
+	Checks []*v1Consensus.CheckResult
+	// Duration is the time elapsed between sending the probe and receiving the answer
+	Duration time.Duration
+	// Err is set if the probe failed, in which case the rest of the fields except NodeID are not set
+	Err error
+}
+
+// pendingProbe is a probe sent to a node whose answer has not been received yet
+type pendingProbe struct {
+	session  *registry.Session
+	response chan *v1Consensus.ProbeResponse
+}
+
+// subscribeProbes returns the channel through which the probes are sent to the node of the session. If the node does
+// not support probes, the channel is nil and probing the node fails right away
+func (s *NodeManager) subscribeProbes(session *registry.Session, supported bool) <-chan *v1Consensus.ProbeRequest {
+	var requests chan *v1Consensus.ProbeRequest
+	if supported {
+		requests = make(chan *v1Consensus.ProbeRequest, ProbesBufferSize)
+	}
+
+	s.probeLock.Lock()
+	defer s.probeLock.Unlock()
+
+	s.probeRequests[session] = requests
+
+	return requests
+}
+
+func (s *NodeManager) unsubscribeProbes(session *registry.Session) {
+	s.probeLock.Lock()
+	defer s.probeLock.Unlock()
+
+	delete(s.probeRequests, session)
+}
+
+// probeStream returns the session of the node and the channel through which probes are sent to it. If the node has
+// reconnected, the stream being replaced is ignored
+func (s *NodeManager) probeStream(nodeKey string) (*registry.Session, chan<- *v1Consensus.ProbeRequest, bool) {
+	s.probeLock.Lock()
+	defer s.probeLock.Unlock()
+
+	for session, requests := range s.probeRequests {
+		if session.Key != nodeKey {
+			continue
+		}
+
+		select {
+		case <-session.Closed():
+			continue
+		default:
+			return session, requests, true
+		}
+	}
+
+	return nil, nil, false
+}
+
+// connectedNodes returns the keys of the nodes with an open health stream
+func (s *NodeManager) connectedNodes() []string {
+	s.probeLock.Lock()
+	defer s.probeLock.Unlock()
+
+	nodeKeys := make([]string, 0, len(s.probeRequests))
+	for session := range s.probeRequests {
+		if !slices.Contains(nodeKeys, session.Key) {
+			nodeKeys = append(nodeKeys, session.Key)
+		}
+	}
+
+	return nodeKeys
+}
+
+// deliverProbeResponse hands the answer of a node to the probe waiting for it. Answers to probes that timed out or
+// that were sent to other nodes are discarded
+func (s *NodeManager) deliverProbeResponse(session *registry.Session, response *v1Consensus.ProbeResponse) {
+	s.probeLock.Lock()
+	defer s.probeLock.Unlock()
+
+	pending, ok := s.pendingProbes[response.GetProbeId()]
+	if !ok || pending.session != session {
+		s.logger.Debugf("discarding answer of node %s to unknown probe %d", session.Key, response.GetProbeId())
+		return
+	}
+
+	delete(s.pendingProbes, response.GetProbeId())
+	pending.response <- response
+}
+
+// ProbeNode requests the node to run its local checks and waits for the result, outside the regular health reports.
+// Nodes answering that they are not serving are reported as failed to the registry, which stops routing traffic to
+// them until they pass enough health checks again
+func (s *NodeManager) ProbeNode(ctx context.Context, nodeKey string) (ProbeResult, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "nodemanager.ProbeNode", trace.WithAttributes(
+		attribute.String(tracing.AttrNodeID, nodeKey),
+	))
+	defer span.End()
+
+	result, err := s.probeNode(ctx, nodeKey)
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		return ProbeResult{NodeID: nodeKey, Err: err}, err
+	}
+
+	span.SetAttributes(attribute.String(tracing.AttrNodeStatus, v1Consensus.StatusString(result.Status)))
+
+	return result, nil
+}
+
+func (s *NodeManager) probeNode(ctx context.Context, nodeKey string) (ProbeResult, error) {
+	session, requests, ok := s.probeStream(nodeKey)
+	if !ok {
+		return ProbeResult{}, fmt.Errorf("%w: %s", ErrNodeNotConnected, nodeKey)
+	}
+	if requests == nil {
+		return ProbeResult{}, fmt.Errorf("%w: %s", ErrProbesNotSupported, nodeKey)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ProbeTimeout)
+	defer cancel()
+
+	probeID := s.nextProbeID.Add(1)
+	response := make(chan *v1Consensus.ProbeResponse, 1)
+
+	s.probeLock.Lock()
+	s.pendingProbes[probeID] = pendingProbe{session: session, response: response}
+	s.probeLock.Unlock()
+
+	defer func() {
+		s.probeLock.Lock()
+		delete(s.pendingProbes, probeID)
+		s.probeLock.Unlock()
+	}()
+
+	start := time.Now()
+	select {
+	case requests <- &v1Consensus.ProbeRequest{ProbeId: probeID}:
+	case <-ctx.Done():
+		return ProbeResult{}, fmt.Errorf("%w: %s", ErrProbeTimeout, nodeKey)
+	}
+
+	select {
+	case answer := <-response:
+		result := ProbeResult{
+			NodeID:   nodeKey,
+			Status:   v1Consensus.ServiceStatus(answer.GetStatus()),
+			Checks:   answer.GetChecks(),
+			Duration: time.Since(start),
+		}
+
+		if result.Status != v1Consensus.Serving {
+			s.logger.Warnf("node %s answered probe %d with status %s", nodeKey, probeID, v1Consensus.StatusString(result.Status))
+			s.registry.ReportNodeFailure(ctx, session)
+		}
+
+		return result, nil
+	case <-session.Closed():
+		return ProbeResult{}, fmt.Errorf("%w: %s", ErrNodeNotConnected, nodeKey)
+	case <-ctx.Done():
+		return ProbeResult{}, fmt.Errorf("%w: %s", ErrProbeTimeout, nodeKey)
+	}
+}
+
+// ProbeNodes probes all the connected nodes concurrently, the results are sorted by node ID
+func (s *NodeManager) ProbeNodes(ctx context.Context) []ProbeResult {
+	nodeKeys := s.connectedNodes()
+	results := make([]ProbeResult, len(nodeKeys))
+
+	var wg sync.WaitGroup
+	for idx, nodeKey := range nodeKeys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Failed probes are reported within their result
+			results[idx], _ = s.ProbeNode(ctx, nodeKey)
+		}()
+	}
+	wg.Wait()
+
+	slices.SortFunc(results, func(a, b ProbeResult) int {
+		return strings.Compare(a.NodeID, b.NodeID)
+	})
+
+	return results
+}
@@ -0,0 +1,187 @@
+package nodemanager
+
+import (
+	"context"
+
+	v1Consensus "github.com/yago-123/galelb/pkg/consensus/v1"
+	v2Consensus "github.com/yago-123/galelb/pkg/consensus/v2"
+	"github.com/yago-123/galelb/pkg/util"
+	"google.golang.org/grpc"
+)
+
+// supportedCapabilities contains the optional features of the protocol supported by the load balancer
+var supportedCapabilities = []v2Consensus.Capability{ //nolint:gochecknoglobals // read-only
+	v2Consensus.Capability_CAPABILITY_CONFIG_PUSH,
+	v2Consensus.Capability_CAPABILITY_PROBES,
+	v2Consensus.Capability_CAPABILITY_LOAD_METRICS,
+}
+
+// nodeMessage is a message received from a node, independent of the version of the protocol spoken by the node
+type nodeMessage struct {
+	status    v1Consensus.ServiceStatus
+	message   string
+	metrics   map[string]float64
+	joinToken string
+	// hello is only set in the first message of the nodes speaking the second version of the protocol, which is not a
+	// health report
+	hello *v2Consensus.Hello
+	// probeResponse is set if the message answers a probe, in which case it is not a health report either
+	probeResponse *v1Consensus.ProbeResponse
+}
+
+// nodeStream is the health stream of a node, it abstracts the version of the protocol spoken by the node so that all
+// nodes are served by the same logic during rolling upgrades
+type nodeStream interface {
+	Context() context.Context
+	// protocolVersion returns the version of the protocol spoken over the stream
+	protocolVersion() int
+	recv() (*nodeMessage, error)
+	// welcome confirms the registration of the node along with the capabilities negotiated for the session and the
+	// configuration in effect
+	welcome(capabilities []v2Consensus.Capability, config *v1Consensus.ConfigResponse) error
+	sendConfig(config *v1Consensus.ConfigResponse) error
+	sendProbe(probe *v1Consensus.ProbeRequest) error
+}
+
+// negotiateCapabilities returns the capabilities used in the session of the node. Nodes speaking the first version of
+// the protocol do not announce their capabilities, the features of the first version are used with them (nodes that
+// predate them ignore the configurations pushed and time out the probes)
+func negotiateCapabilities(first *nodeMessage) []v2Consensus.Capability {
+	if first.hello == nil {
+		return supportedCapabilities
+	}
+
+	return v2Consensus.Negotiate(supportedCapabilities, first.hello.GetCapabilities())
+}
+
+// v1Stream serves the nodes speaking the first version of the protocol
+type v1Stream struct {
+	grpc.BidiStreamingServer[v1Consensus.HealthStatus, v1Consensus.HealthStatus]
+}
+
+func (s v1Stream) protocolVersion() int {
+	return 1
+}
+
+func (s v1Stream) recv() (*nodeMessage, error) {
+	msg, err := s.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	return &nodeMessage{
+		status:        v1Consensus.ServiceStatus(msg.GetStatus()),
+		message:       msg.GetMessage(),
+		metrics:       msg.GetMetrics(),
+		joinToken:     msg.GetJoinToken(),
+		probeResponse: msg.GetProbeResponse(),
+	}, nil
+}
+
+// welcome is not part of the first version of the protocol, nodes consider themselves registered once the stream is
+// open
+func (s v1Stream) welcome(_ []v2Consensus.Capability, _ *v1Consensus.ConfigResponse) error {
+	return nil
+}
+
+func (s v1Stream) sendConfig(config *v1Consensus.ConfigResponse) error {
+	return s.Send(&v1Consensus.HealthStatus{Service: LoadBalancerService, Config: config})
+}
+
+func (s v1Stream) sendProbe(probe *v1Consensus.ProbeRequest) error {
+	return s.Send(&v1Consensus.HealthStatus{Service: LoadBalancerService, ProbeRequest: probe})
+}
+
+// v2Stream serves the nodes speaking the second version of the protocol
+type v2Stream struct {
+	grpc.BidiStreamingServer[v2Consensus.NodeMessage, v2Consensus.LBMessage]
+}
+
+func (s v2Stream) protocolVersion() int {
+	return v2Consensus.ProtocolVersion
+}
+
+func (s v2Stream) recv() (*nodeMessage, error) {
+	msg, err := s.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	switch payload := msg.GetPayload().(type) {
+	case *v2Consensus.NodeMessage_Hello:
+		return &nodeMessage{hello: payload.Hello, joinToken: payload.Hello.GetJoinToken()}, nil
+	case *v2Consensus.NodeMessage_ProbeResponse:
+		response := payload.ProbeResponse
+		return &nodeMessage{
+			status: fromServingStatus(response.GetStatus()),
+			probeResponse: &v1Consensus.ProbeResponse{
+				ProbeId: response.GetProbeId(),
+				Status:  uint32(fromServingStatus(response.GetStatus())),
+				Checks:  fromCheckResults(response.GetChecks()),
+			},
+		}, nil
+	default:
+		report := msg.GetHealthReport()
+		return &nodeMessage{
+			status:  fromServingStatus(report.GetStatus()),
+			message: report.GetMessage(),
+			metrics: report.GetMetrics(),
+		}, nil
+	}
+}
+
+func (s v2Stream) welcome(capabilities []v2Consensus.Capability, config *v1Consensus.ConfigResponse) error {
+	return s.Send(&v2Consensus.LBMessage{Payload: &v2Consensus.LBMessage_Welcome{Welcome: &v2Consensus.Welcome{
+		Version:      util.Version(),
+		Capabilities: capabilities,
+		Config:       toConfig(config),
+	}}})
+}
+
+func (s v2Stream) sendConfig(config *v1Consensus.ConfigResponse) error {
+	return s.Send(&v2Consensus.LBMessage{Payload: &v2Consensus.LBMessage_Config{Config: toConfig(config)}})
+}
+
+func (s v2Stream) sendProbe(probe *v1Consensus.ProbeRequest) error {
+	return s.Send(&v2Consensus.LBMessage{Payload: &v2Consensus.LBMessage_ProbeRequest{ProbeRequest: &v2Consensus.ProbeRequest{
+		ProbeId: probe.GetProbeId(),
+	}}})
+}
+
+// fromServingStatus translates the status of the second version of the protocol. Unspecified statuses are considered
+// not serving, as the node did not confirm that it can serve traffic
+func fromServingStatus(status v2Consensus.ServingStatus) v1Consensus.ServiceStatus {
+	switch status {
+	case v2Consensus.ServingStatus_SERVING_STATUS_SERVING:
+		return v1Consensus.Serving
+	case v2Consensus.ServingStatus_SERVING_STATUS_SHUTTING_DOWN:
+		return v1Consensus.ShuttingDown
+	case v2Consensus.ServingStatus_SERVING_STATUS_UNSPECIFIED, v2Consensus.ServingStatus_SERVING_STATUS_NOT_SERVING:
+		return v1Consensus.NotServing
+	default:
+		return v1Consensus.NotServing
+	}
+}
+
+func fromCheckResults(checks []*v2Consensus.CheckResult) []*v1Consensus.CheckResult {
+	results := make([]*v1Consensus.CheckResult, 0, len(checks))
+	for _, check := range checks {
+		results = append(results, &v1Consensus.CheckResult{
+			Name:     check.GetName(),
+			Passed:   check.GetPassed(),
+			Message:  check.GetMessage(),
+			Duration: check.GetDuration(),
+		})
+	}
+
+	return results
+}
+
+func toConfig(config *v1Consensus.ConfigResponse) *v2Consensus.Config {
+	return &v2Consensus.Config{
+		ChecksBeforeRouting: config.GetChecksBeforeRouting(),
+		HealthCheckTimeout:  config.GetHealthCheckTimeout(),
+		BlackListAfterFails: config.GetBlackListAfterFails(),
+		BlackListExpiry:     config.GetBlackListExpiry(),
+	}
+}
@@ -3,11 +3,20 @@ package v1
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io/fs"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	nodeConfig "github.com/yago-123/galelb/config/node"
+	"github.com/yago-123/galelb/pkg/auth"
 	nodeNet "github.com/yago-123/galelb/pkg/nodenetwork"
 )
 
@@ -20,43 +29,155 @@ const (
 	ServerShutdownTimeout = 5 * time.Second
 )
 
+const (
+	// UnixSocketMode restricts the access to the unix socket to the user and group of the node
+	UnixSocketMode = 0o660
+)
+
 type NodeNetworkAPI struct {
 	server *http.Server
+	// tlsEnabled is kept apart from the TLS configuration of the server, which is filled by the server once serving
+	tlsEnabled bool
 
 	cfg *nodeConfig.Config
 }
 
-func New(cfg *nodeConfig.Config, dispatcher *nodeNet.Dispatcher) *NodeNetworkAPI {
+// New creates the node API. The gatherer can be nil, in which case metrics are not exposed
+func New(cfg *nodeConfig.Config, dispatcher *nodeNet.Dispatcher, gatherer prometheus.Gatherer) *NodeNetworkAPI {
+	authenticator, err := auth.New(cfg.APIAuth, cfg.Logger)
+	if err != nil {
+		cfg.Logger.Fatalf("failed to configure API authentication: %v", err)
+	}
+
+	tlsCfg, err := auth.ServerTLSConfig(cfg.APIAuth)
+	if err != nil {
+		cfg.Logger.Fatalf("failed to configure API TLS: %v", err)
+	}
+
 	server := &http.Server{
-		Addr:           ":5555", // todo(): replace with cfg
-		Handler:        setupRouter(dispatcher),
+		Addr:           net.JoinHostPort(cfg.API.Bind, strconv.Itoa(cfg.API.Port)),
+		Handler:        setupRouter(dispatcher, gatherer, authenticator),
+		TLSConfig:      tlsCfg,
 		ReadTimeout:    ServerReadTimeout,
 		WriteTimeout:   ServerWriteTimeout,
 		IdleTimeout:    ServerIdleTimeout,
 		MaxHeaderBytes: MaxHeaderBytes,
 	}
 	return &NodeNetworkAPI{
-		cfg:    cfg,
-		server: server,
+		cfg:        cfg,
+		server:     server,
+		tlsEnabled: tlsCfg != nil,
 	}
 }
 
-// Start starts the HTTP API server in a BLOCKING manner
+// Start starts the HTTP API server in a BLOCKING manner, serving the TCP port and the unix socket if configured
 func (n *NodeNetworkAPI) Start() error {
-	err := n.server.ListenAndServe()
-	if errors.Is(err, http.ErrServerClosed) {
-		n.cfg.Logger.Infof("HTTP API server stopped successfully")
-		return nil
+	listeners, err := n.listen()
+	if err != nil {
+		return err
 	}
 
-	if err != nil {
+	if err = n.serveAll(listeners); err != nil {
 		return err
 	}
 
+	n.cfg.Logger.Infof("HTTP API server stopped successfully")
 	return nil
 }
 
-// Stop stops the HTTP API server
+// serveAll serves the API through all the listeners until the server is stopped. If any of the listeners fails the
+// server is shut down, so that the API is not left half reachable
+func (n *NodeNetworkAPI) serveAll(listeners []net.Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func() {
+			errs <- n.serve(listener)
+		}()
+	}
+
+	var errServe error
+	for range listeners {
+		err := <-errs
+		if err != nil && errServe == nil {
+			if errStop := n.Stop(); errStop != nil {
+				err = errors.Join(err, fmt.Errorf("failed to stop the rest of the listeners: %w", errStop))
+			}
+		}
+
+		errServe = errors.Join(errServe, err)
+	}
+
+	return errServe
+}
+
+// listen opens the TCP port and the unix socket of the API
+func (n *NodeNetworkAPI) listen() ([]net.Listener, error) {
+	listeners := []net.Listener{}
+
+	if n.cfg.API.Port != 0 {
+		listener, err := net.Listen("tcp", n.server.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", n.server.Addr, err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	if n.cfg.API.UnixSocket != "" {
+		listener, err := listenUnix(n.cfg.API.UnixSocket)
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// listenUnix opens the unix socket, replacing the socket left behind by a previous run of the node. The socket is
+// created with its final permissions, so that it is never reachable by other users
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("failed to listen on %s: file exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	}
+
+	// The umask is process wide, the node does not create any other files so it can be changed temporarily
+	umask := syscall.Umask(^UnixSocketMode & int(fs.ModePerm))
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+
+	return listener, nil
+}
+
+// serve serves the API through the listener until the server is stopped. TLS is only used over TCP, the socket is
+// protected by its permissions instead
+func (n *NodeNetworkAPI) serve(listener net.Listener) error {
+	var err error
+	if n.tlsEnabled && listener.Addr().Network() == "tcp" {
+		// Certificates are already loaded into the TLS configuration
+		err = n.server.ServeTLS(listener, "", "")
+	} else {
+		err = n.server.Serve(listener)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// Stop stops the HTTP API server, the unix socket is removed once closed
 func (n *NodeNetworkAPI) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), ServerShutdownTimeout)
 	defer cancel()
@@ -64,13 +185,19 @@ func (n *NodeNetworkAPI) Stop() error {
 	return n.server.Shutdown(ctx)
 }
 
-func setupRouter(dispatcher *nodeNet.Dispatcher) *gin.Engine {
+func setupRouter(dispatcher *nodeNet.Dispatcher, gatherer prometheus.Gatherer, authenticator *auth.Authenticator) *gin.Engine {
 	// todo(): replace with gin.New()
 	router := gin.Default()
 	handlr := newHandler(dispatcher)
 
+	// Read requests require at least the read-only role, the rest require the admin role
+	router.Use(authenticator.Middleware())
+
 	// GET requests
 	router.GET("/status", handlr.GetStatus)
+	if gatherer != nil {
+		router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})))
+	}
 
 	// POST requests
 	router.POST("/start", handlr.PostStart)
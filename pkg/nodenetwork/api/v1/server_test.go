@@ -0,0 +1,137 @@
+package v1
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	nodeConfig "github.com/yago-123/galelb/config/node"
+	nodeNet "github.com/yago-123/galelb/pkg/nodenetwork"
+)
+
+func TestNodeNetworkAPI_unixSocket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := nodeConfig.New()
+	cfg.API.Port = 0
+	cfg.API.UnixSocket = filepath.Join(t.TempDir(), "node.sock")
+
+	checker, err := nodeNet.NewChecker(cfg.HealthChecks)
+	if err != nil {
+		t.Fatalf("failed to create checker: %v", err)
+	}
+
+	// A socket left behind by a previous run is replaced
+	stale, err := net.Listen("unix", cfg.API.UnixSocket)
+	if err != nil {
+		t.Fatalf("failed to create stale socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	api := New(cfg, nodeNet.NewDispatcher(cfg, map[string]nodeNet.Target{}, checker), nil)
+	started := make(chan error, 1)
+	go func() {
+		started <- api.Start()
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", cfg.API.UnixSocket)
+		},
+	}}
+
+	var resp *http.Response
+	for range 50 {
+		if resp, err = client.Get("http://node/status"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to query the API through the socket: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	info, err := os.Stat(cfg.API.UnixSocket)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %v", err)
+	}
+	if info.Mode().Perm() != UnixSocketMode {
+		t.Fatalf("expected socket mode %o, got %o", UnixSocketMode, info.Mode().Perm())
+	}
+
+	if err = api.Stop(); err != nil {
+		t.Fatalf("failed to stop API: %v", err)
+	}
+	if err = <-started; err != nil {
+		t.Fatalf("expected API to stop cleanly, got %v", err)
+	}
+
+	if _, err = os.Stat(cfg.API.UnixSocket); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected socket to be removed once stopped, got %v", err)
+	}
+}
+
+// failingListener fails to accept connections, as a listener whose socket was closed underneath
+type failingListener struct {
+	net.Listener
+}
+
+func (l failingListener) Accept() (net.Conn, error) {
+	return nil, errAccept
+}
+
+var errAccept = errors.New("accept failed")
+
+func TestNodeNetworkAPI_listenerFails(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := nodeConfig.New()
+	checker, err := nodeNet.NewChecker(cfg.HealthChecks)
+	if err != nil {
+		t.Fatalf("failed to create checker: %v", err)
+	}
+	api := New(cfg, nodeNet.NewDispatcher(cfg, map[string]nodeNet.Target{}, checker), nil)
+
+	healthy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	failing, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer failing.Close()
+
+	// The healthy listener is stopped along with the failing one instead of serving alone
+	served := make(chan error, 1)
+	go func() {
+		served <- api.serveAll([]net.Listener{healthy, failingListener{failing}})
+	}()
+
+	select {
+	case err = <-served:
+		if !errors.Is(err, errAccept) {
+			t.Fatalf("expected accept error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the API to stop once a listener fails")
+	}
+
+	if _, err = net.Dial("tcp", healthy.Addr().String()); err == nil {
+		t.Fatalf("expected the healthy listener to be closed")
+	}
+}
@@ -0,0 +1,107 @@
+package nodenetwork
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	nodeConfig "github.com/yago-123/galelb/config/node"
+	v2Consensus "github.com/yago-123/galelb/pkg/consensus/v2"
+)
+
+// Checker runs the local checks of the node, which determine the health status reported to the load balancers
+type Checker struct {
+	checks []nodeConfig.HealthCheck
+	client *http.Client
+}
+
+func NewChecker(checks []nodeConfig.HealthCheck) (*Checker, error) {
+	for idx, check := range checks {
+		switch check.Type {
+		case nodeConfig.HealthCheckTypeTCP:
+			if check.Address == "" {
+				return nil, fmt.Errorf("health check %s at index %d has no address", check.Name, idx)
+			}
+		case nodeConfig.HealthCheckTypeHTTP:
+			if check.URL == "" {
+				return nil, fmt.Errorf("health check %s at index %d has no url", check.Name, idx)
+			}
+		default:
+			return nil, fmt.Errorf("health check %s at index %d has unknown type %q", check.Name, idx, check.Type)
+		}
+	}
+
+	return &Checker{
+		checks: checks,
+		client: &http.Client{
+			// Redirects are not followed, any response other than 2xx fails the check
+			CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+// Run runs all the checks and returns the resulting status, serving only if all of them passed
+func (c *Checker) Run(ctx context.Context) (v2Consensus.ServingStatus, []*v2Consensus.CheckResult) {
+	status := v2Consensus.ServingStatus_SERVING_STATUS_SERVING
+	results := make([]*v2Consensus.CheckResult, 0, len(c.checks))
+
+	for _, check := range c.checks {
+		start := time.Now()
+		err := c.run(ctx, check)
+
+		result := &v2Consensus.CheckResult{
+			Name:     check.Name,
+			Passed:   err == nil,
+			Duration: time.Since(start).Nanoseconds(),
+		}
+		if err != nil {
+			result.Message = err.Error()
+			status = v2Consensus.ServingStatus_SERVING_STATUS_NOT_SERVING
+		}
+
+		results = append(results, result)
+	}
+
+	return status, results
+}
+
+func (c *Checker) run(ctx context.Context, check nodeConfig.HealthCheck) error {
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = nodeConfig.DefaultHealthCheckTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if check.Type == nodeConfig.HealthCheckTypeTCP {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", check.Address)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", check.Address, err)
+		}
+
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.URL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request for %s: %w", check.URL, err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request %s: %w", check.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, check.URL)
+	}
+
+	return nil
+}
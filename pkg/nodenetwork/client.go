@@ -2,53 +2,102 @@ package nodenetwork
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
 
 	"google.golang.org/protobuf/types/known/emptypb"
 
-	v1Consensus "github.com/yago-123/galelb/pkg/consensus/v1"
+	v2Consensus "github.com/yago-123/galelb/pkg/consensus/v2"
 
 	"github.com/sirupsen/logrus"
+	"github.com/yago-123/galelb/pkg/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	tracerName = "github.com/yago-123/galelb/pkg/nodenetwork"
+
+	// ProbesBufferSize is the number of probes requested by the load balancer waiting to be answered, further probes
+	// are dropped until the pending ones are answered
+	ProbesBufferSize = 8
 )
 
 type Client struct {
 	conn   *grpc.ClientConn
-	client v1Consensus.LBNodeManagerClient
+	client v2Consensus.LBNodeManagerClient
+
+	// hello opens each health stream, registering the node in the load balancer
+	hello *v2Consensus.Hello
+
+	healthStream *healthStream
 
-	healthStream grpc.BidiStreamingClient[v1Consensus.HealthStatus, v1Consensus.HealthStatus]
+	// configs receives the configurations pushed by the load balancer, only the latest one not consumed is kept.
+	// configLock serializes the receivers of the streams, as the receiver of a stream being replaced can overlap with
+	// the receiver of the new one
+	configs    chan *v2Consensus.Config
+	configLock sync.Mutex
+	// probes receives the probes requested by the load balancer
+	probes chan *v2Consensus.ProbeRequest
 
 	logger *logrus.Logger
 }
 
-func NewClient(logger *logrus.Logger, ip string, port int) (*Client, error) {
-	remoteServer := fmt.Sprintf("%s:%d", ip, port)
+// healthStream is a health stream with the load balancer, along with the goroutine receiving the messages pushed by
+// the load balancer over it
+type healthStream struct {
+	stream grpc.BidiStreamingClient[v2Consensus.NodeMessage, v2Consensus.LBMessage]
+	// done is closed once the stream has been closed, err contains the status with which it was closed
+	done chan struct{}
+	err  error
+	// capabilities contains the features negotiated in the welcome of the load balancer, only accessed by the
+	// receiver of the stream
+	capabilities []v2Consensus.Capability
+}
+
+// NewClient connects to the load balancer and opens the health stream, presenting the hello to register the node
+func NewClient(logger *logrus.Logger, ip string, port int, creds credentials.TransportCredentials, hello *v2Consensus.Hello) (*Client, error) {
+	remoteServer := net.JoinHostPort(ip, strconv.Itoa(port))
 
 	// todo(): we must have an array of remove servers for multi-node load balancer
 	conn, err := grpc.NewClient(
 		remoteServer,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithTransportCredentials(creds),
+		// Traces the RPCs, propagating the trace context to the load balancer over the stream metadata
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to load balancer: %w", err)
 	}
 
-	client := v1Consensus.NewLBNodeManagerClient(conn)
-	healthStream, err := client.ReportHealthStatus(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("could not report health status: %w", err)
+	c := &Client{
+		conn:    conn,
+		client:  v2Consensus.NewLBNodeManagerClient(conn),
+		hello:   hello,
+		configs: make(chan *v2Consensus.Config, 1),
+		probes:  make(chan *v2Consensus.ProbeRequest, ProbesBufferSize),
+		logger:  logger,
 	}
 
-	return &Client{
-		conn:         conn,
-		client:       client,
-		healthStream: healthStream,
-		logger:       logger,
-	}, nil
+	if c.healthStream, err = c.openHealthStream(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
 }
 
-func (c *Client) GetConfig(ctx context.Context) (*v1Consensus.ConfigResponse, error) {
+func (c *Client) GetConfig(ctx context.Context) (*v2Consensus.Config, error) {
 	config, err := c.client.GetConfig(ctx, &emptypb.Empty{})
 	if err != nil {
 		c.logger.Errorf("failed to get config: %v", err)
@@ -56,7 +105,7 @@ func (c *Client) GetConfig(ctx context.Context) (*v1Consensus.ConfigResponse, er
 
 	if config == nil {
 		// This should never happen, adding here just in case to avoid panic
-		return &v1Consensus.ConfigResponse{}, fmt.Errorf("value retrieved in config is nil")
+		return &v2Consensus.Config{}, fmt.Errorf("value retrieved in config is nil")
 	}
 
 	c.logger.Debugf("received config: %v", config)
@@ -64,6 +113,183 @@ func (c *Client) GetConfig(ctx context.Context) (*v1Consensus.ConfigResponse, er
 	return config, nil
 }
 
-func (c *Client) ReportHealthStatus(_ context.Context, healthStatus *v1Consensus.HealthStatus) error {
-	return c.healthStream.Send(healthStatus)
+// Configs returns the channel that receives the configurations pushed by the load balancer
+func (c *Client) Configs() <-chan *v2Consensus.Config {
+	return c.configs
+}
+
+// Probes returns the channel that receives the probes requested by the load balancer, which must be answered with
+// SendProbeResponse
+func (c *Client) Probes() <-chan *v2Consensus.ProbeRequest {
+	return c.probes
+}
+
+// ResetHealthStream replaces the health stream with a new one, required once the load balancer closed the previous
+// stream (ex: the node has been evicted or the load balancer restarted). The node registers again with its hello
+func (c *Client) ResetHealthStream() error {
+	// The previous stream is already closed by the load balancer, closing our side only releases it
+	_ = c.healthStream.stream.CloseSend()
+
+	healthStream, err := c.openHealthStream()
+	if err != nil {
+		return err
+	}
+
+	c.healthStream = healthStream
+	return nil
+}
+
+// openHealthStream opens a new health stream with the hello of the node and starts receiving the messages pushed over
+// it
+func (c *Client) openHealthStream() (*healthStream, error) {
+	stream, err := c.client.Session(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not open session: %w", err)
+	}
+
+	hs := &healthStream{
+		stream: stream,
+		done:   make(chan struct{}),
+	}
+	go c.receive(hs)
+
+	// If the load balancer rejects the node, the reason is returned by the next health report
+	if err = stream.Send(&v2Consensus.NodeMessage{Payload: &v2Consensus.NodeMessage_Hello{Hello: c.hello}}); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("could not send hello: %w", err)
+	}
+
+	return hs, nil
+}
+
+// receive forwards the configurations and probes pushed by the load balancer until the stream is closed
+func (c *Client) receive(hs *healthStream) {
+	for {
+		msg, err := hs.stream.Recv()
+		if err != nil {
+			hs.err = err
+			close(hs.done)
+			return
+		}
+
+		if welcome := msg.GetWelcome(); welcome != nil {
+			c.logger.Infof("registered in load balancer %s (version %s) with capabilities %v", c.conn.Target(), welcome.GetVersion(), welcome.GetCapabilities())
+			hs.capabilities = welcome.GetCapabilities()
+
+			// The configuration in effect comes along with the welcome, in case it changed since it was fetched
+			if config := welcome.GetConfig(); config != nil {
+				c.pushConfig(config)
+			}
+		}
+
+		// Features not negotiated for the session are ignored
+		if config := msg.GetConfig(); config != nil {
+			if !hs.negotiated(v2Consensus.Capability_CAPABILITY_CONFIG_PUSH) {
+				c.logger.Warnf("ignoring configuration pushed by %s, configuration push has not been negotiated", c.conn.Target())
+				continue
+			}
+
+			c.pushConfig(config)
+		}
+
+		if probe := msg.GetProbeRequest(); probe != nil {
+			if !hs.negotiated(v2Consensus.Capability_CAPABILITY_PROBES) {
+				c.logger.Warnf("ignoring probe %d from %s, probes have not been negotiated", probe.GetProbeId(), c.conn.Target())
+				continue
+			}
+
+			select {
+			case c.probes <- probe:
+			default:
+				// The load balancer times out the probe, there is no need to answer it
+				c.logger.Warnf("dropping probe %d from %s, too many probes pending", probe.GetProbeId(), c.conn.Target())
+			}
+		}
+	}
+}
+
+// negotiated returns whether the feature has been negotiated in the welcome of the load balancer
+func (hs *healthStream) negotiated(capability v2Consensus.Capability) bool {
+	return slices.Contains(hs.capabilities, capability)
+}
+
+// pushConfig replaces the configuration not consumed yet, if any, as it is outdated
+func (c *Client) pushConfig(config *v2Consensus.Config) {
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+
+	select {
+	case <-c.configs:
+	default:
+	}
+	c.configs <- config
+}
+
+// Close closes the connection with the load balancer, along with the health stream
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// State returns the state of the connection with the load balancer
+func (c *Client) State() connectivity.State {
+	return c.conn.GetState()
+}
+
+// ReportHealthStatus sends the health status to the load balancer. If the load balancer closed the stream, the status
+// with which it was closed is returned (ex: the node has not been admitted)
+func (c *Client) ReportHealthStatus(_ context.Context, report *v2Consensus.HealthReport) error {
+	// Each report starts its own trace linked to the one of the stream, as streams last as long as the node runs
+	_, span := otel.Tracer(tracerName).Start(context.Background(), "node.ReportHealthStatus", c.streamSpanOptions(
+		attribute.String(tracing.AttrTarget, c.conn.Target()),
+		attribute.String(tracing.AttrNodeStatus, report.GetStatus().String()),
+	)...)
+	defer span.End()
+
+	err := c.send(&v2Consensus.NodeMessage{Payload: &v2Consensus.NodeMessage_HealthReport{HealthReport: report}})
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+// SendProbeResponse answers a probe requested by the load balancer. Must not be called concurrently with
+// ReportHealthStatus, as both send over the same stream
+func (c *Client) SendProbeResponse(_ context.Context, probe *v2Consensus.ProbeResponse) error {
+	_, span := otel.Tracer(tracerName).Start(context.Background(), "node.SendProbeResponse", c.streamSpanOptions(
+		attribute.String(tracing.AttrTarget, c.conn.Target()),
+		attribute.String(tracing.AttrNodeStatus, probe.GetStatus().String()),
+	)...)
+	defer span.End()
+
+	err := c.send(&v2Consensus.NodeMessage{Payload: &v2Consensus.NodeMessage_ProbeResponse{ProbeResponse: probe}})
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+// streamSpanOptions returns the options of the spans of the messages sent over the health stream: root spans linked to
+// the span of the stream
+func (c *Client) streamSpanOptions(attrs ...attribute.KeyValue) []trace.SpanStartOption {
+	return []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(c.healthStream.stream.Context())),
+		trace.WithAttributes(attrs...),
+	}
+}
+
+func (c *Client) send(msg *v2Consensus.NodeMessage) error {
+	err := c.healthStream.stream.Send(msg)
+	if !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	// Send does not return the reason of the closure, it is retrieved by the receiver of the stream
+	<-c.healthStream.done
+	if c.healthStream.err != nil && !errors.Is(c.healthStream.err, io.EOF) {
+		return c.healthStream.err
+	}
+
+	return err
 }
@@ -0,0 +1,218 @@
+package nodenetwork
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v2Consensus "github.com/yago-123/galelb/pkg/consensus/v2"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// fakeLoadBalancer closes the first sessions it receives and welcomes the rest, recording the hellos presented. The
+// messages pushed are sent right after the welcome. Rejected nodes are denied every session
+type fakeLoadBalancer struct {
+	v2Consensus.UnimplementedLBNodeManagerServer
+
+	failures int
+	rejected bool
+	hellos   chan *v2Consensus.Hello
+	welcome  *v2Consensus.Welcome
+	pushed   []*v2Consensus.LBMessage
+}
+
+func (lb *fakeLoadBalancer) Session(stream grpc.BidiStreamingServer[v2Consensus.NodeMessage, v2Consensus.LBMessage]) error {
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	lb.hellos <- msg.GetHello()
+
+	if lb.rejected {
+		return status.Error(codes.PermissionDenied, "join token rejected")
+	}
+	if lb.failures > 0 {
+		lb.failures--
+		return status.Error(codes.Unavailable, "load balancer restarting")
+	}
+
+	welcome := lb.welcome
+	if welcome == nil {
+		welcome = &v2Consensus.Welcome{}
+	}
+	if err = stream.Send(&v2Consensus.LBMessage{Payload: &v2Consensus.LBMessage_Welcome{Welcome: welcome}}); err != nil {
+		return err
+	}
+
+	for _, msg := range lb.pushed {
+		if err = stream.Send(msg); err != nil {
+			return err
+		}
+	}
+
+	for {
+		if _, err = stream.Recv(); err != nil {
+			return nil
+		}
+	}
+}
+
+func (lb *fakeLoadBalancer) GetConfig(_ context.Context, _ *emptypb.Empty) (*v2Consensus.Config, error) {
+	return &v2Consensus.Config{HealthCheckTimeout: int64(200 * time.Millisecond)}, nil
+}
+
+func startFakeLoadBalancer(t *testing.T, lb *fakeLoadBalancer) *net.TCPAddr {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	server := grpc.NewServer()
+	v2Consensus.RegisterLBNodeManagerServer(server, lb)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	return listener.Addr().(*net.TCPAddr)
+}
+
+func TestClient_joinTokenUntilAdmitted(t *testing.T) {
+	lb := &fakeLoadBalancer{failures: 1, hellos: make(chan *v2Consensus.Hello, 2)}
+	addr := startFakeLoadBalancer(t, lb)
+
+	client, err := NewClient(logrus.New(), addr.IP.String(), addr.Port, insecure.NewCredentials(), &v2Consensus.Hello{JoinToken: "s3cr3t"})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	if hello := <-lb.hellos; hello.GetJoinToken() != "s3cr3t" {
+		t.Fatalf("expected join token in the first hello, got %q", hello.GetJoinToken())
+	}
+
+	// The first stream is closed before the node is welcomed, the report returns the reason
+	<-client.healthStream.done
+	err = client.ReportHealthStatus(context.Background(), &v2Consensus.HealthReport{Status: v2Consensus.ServingStatus_SERVING_STATUS_SERVING})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected the stream to be closed by the load balancer, got %v", err)
+	}
+
+	// The token is presented again by the hello of the new stream
+	if err = client.ResetHealthStream(); err != nil {
+		t.Fatalf("failed to reset health stream: %v", err)
+	}
+	if hello := <-lb.hellos; hello.GetJoinToken() != "s3cr3t" {
+		t.Fatalf("expected join token in the hello after reconnecting, got %q", hello.GetJoinToken())
+	}
+
+	if err = client.ReportHealthStatus(context.Background(), &v2Consensus.HealthReport{Status: v2Consensus.ServingStatus_SERVING_STATUS_SERVING}); err != nil {
+		t.Fatalf("expected report to be accepted once admitted, got %v", err)
+	}
+}
+
+func TestClient_negotiatedCapabilities(t *testing.T) {
+	lb := &fakeLoadBalancer{
+		hellos: make(chan *v2Consensus.Hello, 1),
+		welcome: &v2Consensus.Welcome{
+			Capabilities: []v2Consensus.Capability{v2Consensus.Capability_CAPABILITY_PROBES},
+			Config:       &v2Consensus.Config{HealthCheckTimeout: int64(3 * time.Second)},
+		},
+		pushed: []*v2Consensus.LBMessage{
+			{Payload: &v2Consensus.LBMessage_Config{Config: &v2Consensus.Config{HealthCheckTimeout: int64(5 * time.Second)}}},
+			{Payload: &v2Consensus.LBMessage_ProbeRequest{ProbeRequest: &v2Consensus.ProbeRequest{ProbeId: 7}}},
+		},
+	}
+	addr := startFakeLoadBalancer(t, lb)
+
+	client, err := NewClient(logrus.New(), addr.IP.String(), addr.Port, insecure.NewCredentials(), &v2Consensus.Hello{Capabilities: supportedCapabilities})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	// The probe is received after the configuration pushed, which is ignored as configuration push was not negotiated
+	select {
+	case probe := <-client.Probes():
+		if probe.GetProbeId() != 7 {
+			t.Fatalf("expected probe 7, got %d", probe.GetProbeId())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected probe to be received")
+	}
+
+	select {
+	case config := <-client.Configs():
+		if time.Duration(config.GetHealthCheckTimeout()) != 3*time.Second {
+			t.Fatalf("expected only the configuration of the welcome, got %v", config)
+		}
+	default:
+		t.Fatalf("expected the configuration of the welcome")
+	}
+}
+
+func TestClient_reportSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+
+	lb := &fakeLoadBalancer{hellos: make(chan *v2Consensus.Hello, 1)}
+	addr := startFakeLoadBalancer(t, lb)
+
+	client, err := NewClient(logrus.New(), addr.IP.String(), addr.Port, insecure.NewCredentials(), &v2Consensus.Hello{})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+	<-lb.hellos
+
+	for range 2 {
+		if err = client.ReportHealthStatus(context.Background(), &v2Consensus.HealthReport{Status: v2Consensus.ServingStatus_SERVING_STATUS_SERVING}); err != nil {
+			t.Fatalf("failed to report health status: %v", err)
+		}
+	}
+
+	// The stream span is the one traced by the gRPC instrumentation, still open
+	stream := trace.SpanContextFromContext(client.healthStream.stream.Context())
+	if !stream.IsValid() {
+		t.Fatalf("expected the stream to be traced")
+	}
+
+	reports := []sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.Name() == "node.ReportHealthStatus" {
+			reports = append(reports, span)
+		}
+	}
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 report spans, got %d", len(reports))
+	}
+
+	// Each report starts its own trace, linked to the stream
+	for _, report := range reports {
+		if report.Parent().IsValid() || report.SpanContext().TraceID() == stream.TraceID() {
+			t.Fatalf("expected report to be a root span, got parent %v", report.Parent())
+		}
+		if links := report.Links(); len(links) != 1 || !links[0].SpanContext.Equal(stream) {
+			t.Fatalf("expected report to be linked to the stream span, got %v", links)
+		}
+	}
+	if reports[0].SpanContext().TraceID() == reports[1].SpanContext().TraceID() {
+		t.Fatalf("expected each report to start its own trace")
+	}
+}
@@ -0,0 +1,170 @@
+package nodenetwork
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	nodeConfig "github.com/yago-123/galelb/config/node"
+	"github.com/yago-123/galelb/pkg/util"
+)
+
+const (
+	// ResolveTimeout is the maximum time spent resolving each of the addresses of the load balancers
+	ResolveTimeout = 5 * time.Second
+)
+
+// Resolver resolves the addresses of the load balancers into targets. Addresses can resolve into several load
+// balancers and change over time when discovered via SRV records or multicast DNS
+type Resolver struct {
+	addresses []nodeConfig.Address
+	// resolved contains the targets of the last successful resolution of each address, indexed by address
+	resolved map[string][]Target
+
+	// browse returns the instances of a service announced via multicast DNS
+	browse func(ctx context.Context, service string) ([]util.ServiceInstance, error)
+}
+
+func NewResolver(cfg *nodeConfig.Config) *Resolver {
+	return &Resolver{
+		addresses: cfg.LoadBalancer.Addresses,
+		resolved:  map[string][]Target{},
+		browse:    util.BrowseMulticastDNS,
+	}
+}
+
+// Resolve returns the load balancers behind all the addresses, indexed by target. Each address is resolved on its own:
+// the addresses that cannot be resolved keep the load balancers of their last successful resolution, so that they are
+// not dropped because of a transient failure, and are returned joined in the error along with the rest of the targets.
+// Not safe for concurrent use
+func (r *Resolver) Resolve(ctx context.Context) (map[string]Target, error) {
+	targets := make(map[string]Target)
+
+	var errResolve error
+	for _, address := range r.addresses {
+		ctxResolve, cancel := context.WithTimeout(ctx, ResolveTimeout)
+		resolved, err := r.resolveAddress(ctxResolve, address)
+		cancel()
+
+		switch {
+		case err != nil:
+			errResolve = errors.Join(errResolve, fmt.Errorf("failed to resolve address %s: %w", address, err))
+			resolved = r.resolved[address.String()]
+		default:
+			r.resolved[address.String()] = resolved
+		}
+
+		for _, target := range resolved {
+			targets[target.String()] = target
+		}
+	}
+
+	return targets, errResolve
+}
+
+// resolveAddress returns the load balancers behind the address, the addresses are expected to be validated beforehand
+func (r *Resolver) resolveAddress(ctx context.Context, address nodeConfig.Address) ([]Target, error) {
+	if address.IP != "" {
+		return []Target{{IP: address.IP, Port: address.Port}}, nil
+	}
+
+	switch {
+	case address.Discovery == nodeConfig.AddressSchemeDNSSRV:
+		return resolveSRV(ctx, address.Hostname)
+	case address.IsService():
+		return r.browseService(ctx, address.Hostname)
+	}
+
+	// Hostnames in the .local domain are resolved via multicast DNS even without the mdns scheme
+	ips, err := resolveHostname(ctx, address.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no IP addresses found for hostname: %s", address.Hostname)
+	}
+
+	return []Target{{IP: util.PreferredIP(ips).String(), Port: address.Port}}, nil
+}
+
+// resolveSRV returns the targets of the SRV records of the name
+func resolveSRV(ctx context.Context, name string) ([]Target, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up SRV records: %w", err)
+	}
+
+	targets := []Target{}
+	for _, record := range records {
+		ips, errResolve := resolveHostname(ctx, strings.TrimSuffix(record.Target, "."))
+		if errResolve != nil {
+			return nil, fmt.Errorf("failed to resolve SRV target %s: %w", record.Target, errResolve)
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no IP addresses found for SRV target: %s", record.Target)
+		}
+
+		targets = append(targets, Target{IP: util.PreferredIP(ips).String(), Port: int(record.Port)})
+	}
+
+	return targets, nil
+}
+
+// browseService returns the instances of the service announced via multicast DNS
+func (r *Resolver) browseService(ctx context.Context, service string) ([]Target, error) {
+	instances, err := r.browse(ctx, service)
+	if err != nil {
+		return nil, fmt.Errorf("failed to browse multicast DNS service %s: %w", service, err)
+	}
+
+	targets := make([]Target, 0, len(instances))
+	for _, instance := range instances {
+		// Instances are only returned with addresses
+		targets = append(targets, Target{IP: util.PreferredIP(instance.IPs).String(), Port: instance.Port})
+	}
+
+	return targets, nil
+}
+
+// resolveHostname resolves the hostname via multicast DNS if in the .local domain, otherwise through the resolver of
+// the system, the same one that looks up the SRV records
+func resolveHostname(ctx context.Context, host string) ([]net.IP, error) {
+	if util.IsMultiCastDNS(host) {
+		ips, err := util.ResolveMulticastDNS(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve multicast DNS %s: %w", host, err)
+		}
+
+		return ips, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve hostname %s: %w", host, err)
+	}
+
+	return ips, nil
+}
+
+// diffTargets returns the targets present in next but not in current, and the keys of the targets present in current
+// but not in next
+func diffTargets(current, next map[string]Target) (map[string]Target, []string) {
+	added := map[string]Target{}
+	for key, target := range next {
+		if _, ok := current[key]; !ok {
+			added[key] = target
+		}
+	}
+
+	removed := []string{}
+	for key := range current {
+		if _, ok := next[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	return added, removed
+}
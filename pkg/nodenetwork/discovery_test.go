@@ -0,0 +1,301 @@
+package nodenetwork
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	nodeConfig "github.com/yago-123/galelb/config/node"
+	v2Consensus "github.com/yago-123/galelb/pkg/consensus/v2"
+	"github.com/yago-123/galelb/pkg/util"
+)
+
+// fakeServices contains the instances announced by each multicast DNS service, services without instances fail to
+// be browsed
+type fakeServices struct {
+	lock      sync.Mutex
+	instances map[string][]util.ServiceInstance
+}
+
+func (f *fakeServices) set(service string, targets ...Target) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.instances[service] = nil
+	for _, target := range targets {
+		f.instances[service] = append(f.instances[service], util.ServiceInstance{IPs: []net.IP{net.ParseIP(target.IP)}, Port: target.Port})
+	}
+}
+
+func (f *fakeServices) browse(_ context.Context, service string) ([]util.ServiceInstance, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(f.instances[service]) == 0 {
+		return nil, util.ErrNoInstances
+	}
+
+	return f.instances[service], nil
+}
+
+// newFakeResolver returns a resolver of the multicast DNS services, browsed through services
+func newFakeResolver(t *testing.T, services *fakeServices, names ...string) *Resolver {
+	t.Helper()
+
+	cfg := nodeConfig.New()
+	for _, name := range names {
+		address, err := nodeConfig.ParseAddress("mdns://" + name)
+		if err != nil {
+			t.Fatalf("failed to parse address: %v", err)
+		}
+		cfg.LoadBalancer.Addresses = append(cfg.LoadBalancer.Addresses, address)
+	}
+
+	resolver := NewResolver(cfg)
+	resolver.browse = services.browse
+
+	return resolver
+}
+
+func targetKeys(targets map[string]Target) []string {
+	keys := []string{}
+	for key := range targets {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+func TestResolver_browseService(t *testing.T) {
+	address, err := nodeConfig.ParseAddress("mdns://_galelb._tcp.local")
+	if err != nil {
+		t.Fatalf("failed to parse address: %v", err)
+	}
+
+	browsed := []string{}
+	resolver := &Resolver{
+		addresses: []nodeConfig.Address{address},
+		resolved:  map[string][]Target{},
+		browse: func(_ context.Context, service string) ([]util.ServiceInstance, error) {
+			browsed = append(browsed, service)
+			return []util.ServiceInstance{
+				{Name: "lb-0._galelb._tcp.local", Host: "lb-0.local", IPs: []net.IP{net.ParseIP("192.168.1.2")}, Port: 7070},
+				{Name: "lb-1._galelb._tcp.local", Host: "lb-1.local", IPs: []net.IP{net.ParseIP("192.168.1.3")}, Port: 7071},
+			}, nil
+		},
+	}
+
+	// Service names are browsed instead of resolved as hostnames
+	targets, err := resolver.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if len(browsed) != 1 || browsed[0] != "_galelb._tcp.local" {
+		t.Fatalf("expected service to be browsed once, got %v", browsed)
+	}
+
+	for _, expected := range []Target{{IP: "192.168.1.2", Port: 7070}, {IP: "192.168.1.3", Port: 7071}} {
+		if target, ok := targets[expected.String()]; !ok || target != expected {
+			t.Fatalf("expected target %+v in %v", expected, targets)
+		}
+	}
+}
+
+func TestResolver_failedAddresses(t *testing.T) {
+	services := &fakeServices{instances: map[string][]util.ServiceInstance{}}
+	resolver := newFakeResolver(t, services, "_lb-a._tcp.local", "_lb-b._tcp.local")
+
+	// The addresses resolved are returned even if others fail
+	services.set("_lb-a._tcp.local", Target{IP: "192.168.1.2", Port: 7070})
+	targets, err := resolver.Resolve(context.Background())
+	if !errors.Is(err, util.ErrNoInstances) {
+		t.Fatalf("expected failure of the second address, got %v", err)
+	}
+	if keys := targetKeys(targets); !slices.Equal(keys, []string{"192.168.1.2:7070"}) {
+		t.Fatalf("expected targets of the first address, got %v", keys)
+	}
+
+	services.set("_lb-b._tcp.local", Target{IP: "192.168.1.3", Port: 7070})
+	if targets, err = resolver.Resolve(context.Background()); err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if keys := targetKeys(targets); !slices.Equal(keys, []string{"192.168.1.2:7070", "192.168.1.3:7070"}) {
+		t.Fatalf("expected targets of both addresses, got %v", keys)
+	}
+
+	// An address that fails keeps the targets of its last resolution, the rest are updated
+	services.set("_lb-a._tcp.local")
+	services.set("_lb-b._tcp.local", Target{IP: "192.168.1.4", Port: 7070})
+	targets, err = resolver.Resolve(context.Background())
+	if !errors.Is(err, util.ErrNoInstances) {
+		t.Fatalf("expected failure of the first address, got %v", err)
+	}
+	if keys := targetKeys(targets); !slices.Equal(keys, []string{"192.168.1.2:7070", "192.168.1.4:7070"}) {
+		t.Fatalf("expected previous targets of the first address, got %v", keys)
+	}
+}
+
+func TestResolver_resolveHostname(t *testing.T) {
+	resolver := NewResolver(nodeConfig.New())
+
+	targets, err := resolver.resolveAddress(context.Background(), nodeConfig.Address{Hostname: "localhost", Port: 7070})
+	if err != nil {
+		t.Fatalf("failed to resolve localhost: %v", err)
+	}
+	if len(targets) != 1 || !net.ParseIP(targets[0].IP).IsLoopback() || targets[0].Port != 7070 {
+		t.Fatalf("expected loopback target, got %v", targets)
+	}
+}
+
+func TestDiffTargets(t *testing.T) {
+	a := Target{IP: "192.168.1.2", Port: 7070}
+	b := Target{IP: "192.168.1.3", Port: 7070}
+	c := Target{IP: "192.168.1.4", Port: 7070}
+
+	tests := []struct {
+		name    string
+		current []Target
+		next    []Target
+		added   []string
+		removed []string
+	}{
+		{name: "unchanged", current: []Target{a, b}, next: []Target{a, b}, added: []string{}, removed: []string{}},
+		{name: "added", current: []Target{a}, next: []Target{a, b}, added: []string{b.String()}, removed: []string{}},
+		{name: "removed", current: []Target{a, b}, next: []Target{b}, added: []string{}, removed: []string{a.String()}},
+		{name: "replaced", current: []Target{a, b}, next: []Target{b, c}, added: []string{c.String()}, removed: []string{a.String()}},
+		{name: "all removed", current: []Target{a}, next: []Target{}, added: []string{}, removed: []string{a.String()}},
+	}
+
+	index := func(targets []Target) map[string]Target {
+		indexed := map[string]Target{}
+		for _, target := range targets {
+			indexed[target.String()] = target
+		}
+		return indexed
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := diffTargets(index(tt.current), index(tt.next))
+			slices.Sort(removed)
+
+			if keys := targetKeys(added); !slices.Equal(keys, tt.added) {
+				t.Fatalf("expected added %v, got %v", tt.added, keys)
+			}
+			if !slices.Equal(removed, tt.removed) {
+				t.Fatalf("expected removed %v, got %v", tt.removed, removed)
+			}
+		})
+	}
+}
+
+// newDiscoveringDispatcher returns a dispatcher discovering the load balancers every interval, started until the test
+// finishes
+func newDiscoveringDispatcher(t *testing.T, resolver *Resolver, interval time.Duration) *Dispatcher {
+	t.Helper()
+
+	cfg := nodeConfig.New()
+	cfg.LoadBalancer.DiscoveryInterval = interval
+
+	checker, err := NewChecker(cfg.HealthChecks)
+	if err != nil {
+		t.Fatalf("failed to create checker: %v", err)
+	}
+
+	targets, err := resolver.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+
+	dispatcher := NewDispatcher(cfg, targets, checker)
+	dispatcher.Discover(resolver)
+
+	started := make(chan error, 1)
+	go func() {
+		started <- dispatcher.Start()
+	}()
+	t.Cleanup(func() {
+		if dispatcher.Status() != StatusRunning {
+			t.Errorf("expected dispatcher to be running, got %v", <-started)
+			return
+		}
+		if errStop := dispatcher.Stop(); errStop != nil {
+			t.Errorf("failed to stop dispatcher: %v", errStop)
+		}
+		if errStart := <-started; errStart != nil {
+			t.Errorf("expected dispatcher to stop cleanly, got %v", errStart)
+		}
+	})
+
+	return dispatcher
+}
+
+// waitTargets waits until the dispatcher tracks the expected targets
+func waitTargets(t *testing.T, dispatcher *Dispatcher, expected ...string) {
+	t.Helper()
+
+	slices.Sort(expected)
+	keys := []string{}
+	for range 100 {
+		dispatcher.lock.RLock()
+		keys = targetKeys(dispatcher.targets)
+		dispatcher.lock.RUnlock()
+
+		if slices.Equal(keys, expected) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("expected targets %v, got %v", expected, keys)
+}
+
+func fakeTarget(addr *net.TCPAddr) Target {
+	return Target{IP: addr.IP.String(), Port: addr.Port}
+}
+
+func TestDispatcher_discoveryLoop(t *testing.T) {
+	lbA := startFakeLoadBalancer(t, &fakeLoadBalancer{hellos: make(chan *v2Consensus.Hello, 100)})
+	lbB := startFakeLoadBalancer(t, &fakeLoadBalancer{hellos: make(chan *v2Consensus.Hello, 100)})
+	targetA, targetB := fakeTarget(lbA), fakeTarget(lbB)
+
+	services := &fakeServices{instances: map[string][]util.ServiceInstance{}}
+	services.set("_galelb._tcp.local", targetA)
+	dispatcher := newDiscoveringDispatcher(t, newFakeResolver(t, services, "_galelb._tcp.local"), 50*time.Millisecond)
+	waitTargets(t, dispatcher, targetA.String())
+
+	// Load balancers discovered are started and the ones no longer announced are stopped
+	services.set("_galelb._tcp.local", targetA, targetB)
+	waitTargets(t, dispatcher, targetA.String(), targetB.String())
+
+	services.set("_galelb._tcp.local", targetB)
+	waitTargets(t, dispatcher, targetB.String())
+
+	// Failed resolutions keep the current load balancers
+	services.set("_galelb._tcp.local")
+	time.Sleep(3 * dispatcher.cfg.LoadBalancer.DiscoveryInterval)
+	waitTargets(t, dispatcher, targetB.String())
+}
+
+func TestDispatcher_rejectedTarget(t *testing.T) {
+	lb := &fakeLoadBalancer{rejected: true, hellos: make(chan *v2Consensus.Hello, 1000)}
+	target := fakeTarget(startFakeLoadBalancer(t, lb))
+
+	services := &fakeServices{instances: map[string][]util.ServiceInstance{}}
+	services.set("_galelb._tcp.local", target)
+
+	// The rejected target is forgotten, so that the next discovery starts it again
+	dispatcher := newDiscoveringDispatcher(t, newFakeResolver(t, services, "_galelb._tcp.local"), time.Hour)
+	waitTargets(t, dispatcher)
+
+	dispatcher.lock.RLock()
+	defer dispatcher.lock.RUnlock()
+	if len(dispatcher.clients) != 0 || len(dispatcher.cancels) != 0 {
+		t.Fatalf("expected client of rejected target to be forgotten, got %v", dispatcher.clients)
+	}
+}
@@ -2,14 +2,23 @@ package nodenetwork
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	nodeConfig "github.com/yago-123/galelb/config/node"
-	v1Consensus "github.com/yago-123/galelb/pkg/consensus/v1"
+	"github.com/yago-123/galelb/pkg/auth"
+	v2Consensus "github.com/yago-123/galelb/pkg/consensus/v2"
+	"github.com/yago-123/galelb/pkg/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -17,6 +26,12 @@ const (
 	HealthCheckIntervalDivisor = 2
 )
 
+// supportedCapabilities contains the optional features of the protocol supported by the node
+var supportedCapabilities = []v2Consensus.Capability{ //nolint:gochecknoglobals // read-only
+	v2Consensus.Capability_CAPABILITY_CONFIG_PUSH,
+	v2Consensus.Capability_CAPABILITY_PROBES,
+}
+
 type Status string
 
 const (
@@ -30,7 +45,7 @@ type Target struct {
 }
 
 func (t *Target) String() string {
-	return fmt.Sprintf("%s:%d", t.IP, t.Port)
+	return net.JoinHostPort(t.IP, strconv.Itoa(t.Port))
 }
 
 // Dispatcher contains the logic that determines how and when to dispatch messages to the load balancers. Dispatcher
@@ -40,20 +55,40 @@ type Dispatcher struct {
 	status  Status
 	lock    sync.RWMutex
 
+	// clients contains the client of each target once the dispatchers have been started, and cancels stops the health
+	// loop of each target. Both protected by lock
+	clients map[string]*Client
+	cancels map[string]context.CancelFunc
+	metrics *dispatcherMetrics
+	// checker runs the local checks that determine the health status reported, both periodically and on probes
+	checker *Checker
+	// resolver discovers the load balancers periodically if set, adding and removing targets as they change
+	resolver *Resolver
+
 	generalCtx    context.Context
 	generalCancel context.CancelFunc
 
 	cfg *nodeConfig.Config
 }
 
-func NewDispatcher(cfg *nodeConfig.Config, targets map[string]Target) *Dispatcher {
+func NewDispatcher(cfg *nodeConfig.Config, targets map[string]Target, checker *Checker) *Dispatcher {
 	return &Dispatcher{
 		targets: targets,
 		status:  StatusStopped,
+		clients: map[string]*Client{},
+		cancels: map[string]context.CancelFunc{},
+		metrics: newDispatcherMetrics(),
+		checker: checker,
 		cfg:     cfg,
 	}
 }
 
+// Discover makes the dispatcher resolve the addresses of the load balancers again every discovery interval once
+// started, so that the load balancers added or removed are picked up. Must be called before Start
+func (d *Dispatcher) Discover(resolver *Resolver) {
+	d.resolver = resolver
+}
+
 func (d *Dispatcher) Start() error {
 	var wg sync.WaitGroup
 
@@ -78,11 +113,22 @@ func (d *Dispatcher) Start() error {
 	// Stop method anytime and update the status accordingly
 	d.generalCtx, d.generalCancel = context.WithCancel(context.Background())
 
+	creds, err := d.transportCredentials()
+	if err != nil {
+		return err
+	}
+
 	// Start a new goroutine for each target
-	if err := d.startDispatchers(&wg); err != nil {
+	if err = d.startDispatchers(&wg, creds); err != nil {
 		return err
 	}
 
+	// The dispatcher keeps running while discovering load balancers, even if none of the current ones is reachable
+	if d.resolver != nil && d.cfg.LoadBalancer.DiscoveryInterval > 0 {
+		wg.Add(1)
+		go d.discoveryLoop(&wg, creds)
+	}
+
 	wg.Wait()
 
 	return nil
@@ -109,37 +155,182 @@ func (d *Dispatcher) Status() Status {
 	return d.status
 }
 
+// connectionStates returns the state of the connection with each target
+func (d *Dispatcher) connectionStates() map[string]connectivity.State {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	states := make(map[string]connectivity.State, len(d.clients))
+	for target, client := range d.clients {
+		states[target] = client.State()
+	}
+
+	return states
+}
+
 // startDispatchers starts a goroutine for each target in the dispatcher
-func (d *Dispatcher) startDispatchers(wg *sync.WaitGroup) error {
-	for k, target := range d.targets {
-		d.cfg.Logger.Infof("starting dispatcher for %s", k)
+func (d *Dispatcher) startDispatchers(wg *sync.WaitGroup, creds credentials.TransportCredentials) error {
+	d.lock.RLock()
+	targets := make([]Target, 0, len(d.targets))
+	for _, target := range d.targets {
+		targets = append(targets, target)
+	}
+	d.lock.RUnlock()
 
-		client, err := NewClient(d.cfg.Logger, target.IP, target.Port)
-		if err != nil {
-			// todo(): if we don't want to keep tracking of failed report health loops, we should return this with an
-			// todo(): error so that we can ensure that once startDispatchers returns, all health loops are running "forever"
-			return fmt.Errorf("failed to create client for target %s:%d: %w", target.IP, target.Port, err)
+	for _, target := range targets {
+		// todo(): if we don't want to keep tracking of failed report health loops, we should return this with an
+		// todo(): error so that we can ensure that once startDispatchers returns, all health loops are running "forever"
+		if err := d.startTarget(wg, creds, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startTarget connects to the target and starts the goroutine reporting the health status to it
+func (d *Dispatcher) startTarget(wg *sync.WaitGroup, creds credentials.TransportCredentials, target Target) error {
+	d.cfg.Logger.Infof("starting dispatcher for %s", target.String())
+
+	client, err := NewClient(d.cfg.Logger, target.IP, target.Port, creds, d.hello())
+	if err != nil {
+		return fmt.Errorf("failed to create client for target %s: %w", target.String(), err)
+	}
+
+	executionCfg, err := d.fetchConfig(client)
+	if err != nil {
+		_ = client.Close()
+		return fmt.Errorf("failed to fetch config for target %s: %w", target.String(), err)
+	}
+
+	ctx, cancel := context.WithCancel(d.generalCtx)
+
+	d.lock.Lock()
+	d.targets[target.String()] = target
+	d.clients[target.String()] = client
+	d.cancels[target.String()] = cancel
+	d.lock.Unlock()
+
+	d.metrics.observeConfig(target.String(), executionCfg)
+	timeout, period := healthTimings(executionCfg)
+
+	wg.Add(1)
+	go d.reportHealthLoop(ctx, wg, client, target, timeout, period)
+
+	return nil
+}
+
+// stopTarget stops reporting the health status to the target, its goroutine closes the connection once it returns
+func (d *Dispatcher) stopTarget(key string) {
+	d.cfg.Logger.Infof("stopping dispatcher for %s", key)
+
+	d.lock.Lock()
+	if cancel, ok := d.cancels[key]; ok {
+		cancel()
+	}
+	delete(d.targets, key)
+	delete(d.clients, key)
+	delete(d.cancels, key)
+	d.lock.Unlock()
+
+	d.metrics.forget(key)
+}
+
+// untrackTarget forgets the target once its goroutine gives up on it, so that the next discovery starts it again. The
+// target is only forgotten if still served by the client, it may have been replaced meanwhile
+func (d *Dispatcher) untrackTarget(key string, client *Client) {
+	d.lock.Lock()
+	if d.clients[key] != client {
+		d.lock.Unlock()
+		return
+	}
+
+	d.cancels[key]()
+	delete(d.targets, key)
+	delete(d.clients, key)
+	delete(d.cancels, key)
+	d.lock.Unlock()
+
+	d.metrics.forget(key)
+}
+
+// discoveryLoop resolves the addresses of the load balancers every discovery interval, starting the dispatchers of
+// the targets added and stopping the ones of the targets removed. The addresses that fail to resolve keep their
+// current targets
+func (d *Dispatcher) discoveryLoop(wg *sync.WaitGroup, creds credentials.TransportCredentials) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(d.cfg.LoadBalancer.DiscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.generalCtx.Done():
+			return
+		case <-ticker.C:
 		}
 
-		executionCfg, err := d.fetchConfig(client)
+		targets, err := d.resolver.Resolve(d.generalCtx)
 		if err != nil {
-			// todo(): if we don't want to keep tracking of failed report health loops, we should return this with an
-			// todo(): error so that we can ensure that once startDispatchers returns, all health loops are running "forever"
-			return fmt.Errorf("failed to fetch config for target %s:%d: %w", target.IP, target.Port, err)
+			d.cfg.Logger.Errorf("failed to discover some load balancers, keeping their current ones: %v", err)
 		}
 
-		normalizedTime := time.Duration(executionCfg.GetHealthCheckTimeout()) * time.Nanosecond
-		healthPeriod := normalizedTime / HealthCheckIntervalDivisor
+		d.lock.RLock()
+		added, removed := diffTargets(d.targets, targets)
+		d.lock.RUnlock()
 
-		wg.Add(1)
-		go d.reportHealthLoop(wg, client, target, normalizedTime, healthPeriod)
+		for _, key := range removed {
+			d.stopTarget(key)
+		}
+
+		for _, target := range added {
+			// Targets that cannot be started are retried on the next discovery, as they are not tracked
+			if errStart := d.startTarget(wg, creds, target); errStart != nil {
+				d.cfg.Logger.Errorf("failed to start dispatcher for discovered load balancer: %v", errStart)
+			}
+		}
 	}
+}
 
-	return nil
+// hello returns the message with which the node registers in the load balancers. The join token is presented in the
+// hello of every health stream, as the load balancers admit each stream on their own: a stream that fails before the
+// node is welcomed, or a load balancer restarted, requires the token again
+func (d *Dispatcher) hello() *v2Consensus.Hello {
+	name := d.cfg.Node.Name
+	if name == "" {
+		// The name is informative, the load balancers do not rely on it
+		name, _ = os.Hostname()
+	}
+
+	return &v2Consensus.Hello{
+		NodeId:          name,
+		ServiceEndpoint: d.cfg.Node.ServiceEndpoint,
+		Weight:          d.cfg.Node.Weight,
+		Labels:          d.cfg.Node.Labels,
+		Version:         util.Version(),
+		Capabilities:    supportedCapabilities,
+		JoinToken:       d.cfg.LoadBalancer.JoinToken,
+	}
+}
+
+// transportCredentials returns the credentials used for connecting to the load balancers. With TLS enabled, the node
+// authenticates with its certificate and the identity of the certificate becomes the node ID in the load balancers
+func (d *Dispatcher) transportCredentials() (credentials.TransportCredentials, error) {
+	if !d.cfg.LoadBalancerTLS.Enabled() {
+		d.cfg.Logger.Warnf("TLS towards load balancers is disabled")
+		return insecure.NewCredentials(), nil
+	}
+
+	reloader, err := auth.NewCertReloader(d.cfg.LoadBalancerTLS, d.cfg.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure TLS towards load balancers: %w", err)
+	}
+
+	return credentials.NewTLS(reloader.ClientConfig()), nil
 }
 
 // fetchConfig fetches the configuration from the load balancer
-func (d *Dispatcher) fetchConfig(client *Client) (*v1Consensus.ConfigResponse, error) {
+func (d *Dispatcher) fetchConfig(client *Client) (*v2Consensus.Config, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), GetConfigTimeout)
 	defer cancel()
 
@@ -152,36 +343,143 @@ func (d *Dispatcher) fetchConfig(client *Client) (*v1Consensus.ConfigResponse, e
 	return executionCfg, nil
 }
 
-// reportHealthLoop is a goroutine that reports the health status of the node to the load balancer target
-func (d *Dispatcher) reportHealthLoop(wg *sync.WaitGroup, client *Client, t Target, timeout, period time.Duration) {
+// applyConfig returns the timeout and period of the health reports adapted to a configuration pushed by the load
+// balancer
+func (d *Dispatcher) applyConfig(t Target, executionCfg *v2Consensus.Config, timeout, period time.Duration) (time.Duration, time.Duration) {
+	newTimeout, newPeriod := healthTimings(executionCfg)
+	if newPeriod <= 0 {
+		d.cfg.Logger.Warnf("ignoring configuration pushed by %s with health check timeout %s", t.String(), newTimeout)
+		return timeout, period
+	}
+
+	d.metrics.observeConfig(t.String(), executionCfg)
+	if newTimeout != timeout {
+		d.cfg.Logger.Infof("load balancer %s changed health check timeout from %s to %s", t.String(), timeout, newTimeout)
+	}
+
+	return newTimeout, newPeriod
+}
+
+// healthTimings returns the timeout of the health reports and the period at which they must be sent according to the
+// configuration of the load balancer
+func healthTimings(executionCfg *v2Consensus.Config) (time.Duration, time.Duration) {
+	timeout := time.Duration(executionCfg.GetHealthCheckTimeout()) * time.Nanosecond
+	return timeout, timeout / HealthCheckIntervalDivisor
+}
+
+// reportHealthLoop is a goroutine that reports the health status of the node to the load balancer target until the
+// context is done, either because the dispatcher is stopped or the target is no longer discovered. The reporting
+// period adapts to the configurations pushed by the load balancer
+func (d *Dispatcher) reportHealthLoop(ctx context.Context, wg *sync.WaitGroup, client *Client, t Target, timeout, period time.Duration) {
 	defer wg.Done()
+	defer client.Close()
 
 	for {
 		select {
-		case <-d.generalCtx.Done():
+		case <-ctx.Done():
 			// If the dispatcher is stopped, return
 			return
-		// todo(): handle reconnection to the lb if the connection is lost
 		default:
 			// Otherwise, report health status
-			ctxTimeout, cancel := context.WithTimeout(context.Background(), timeout)
-			err := client.ReportHealthStatus(ctxTimeout, &v1Consensus.HealthStatus{
-				Service: "gale-node",
-				Status:  uint32(v1Consensus.Serving),
-				Message: "Serving requests goes brrrrr",
-			})
-
-			if errors.Is(err, io.EOF) {
-				// todo(): handle reconnection to the lb if the connection is lost
-				d.cfg.Logger.Errorf("disconnected from %s:%d: %v", t.IP, t.Port, err)
-			} else if err != nil {
-				d.cfg.Logger.Errorf("failed to report health status: %v", err)
+			serviceStatus, results := d.checker.Run(ctx)
+			report := &v2Consensus.HealthReport{
+				Status:  serviceStatus,
+				Message: statusMessage(results),
 			}
 
+			ctxTimeout, cancel := context.WithTimeout(context.Background(), timeout)
+			start := time.Now()
+			err := client.ReportHealthStatus(ctxTimeout, report)
+			latency := time.Since(start)
 			cancel()
 
-			d.cfg.Logger.Debugf("reported health status to %s:%d", t.IP, t.Port)
-			<-time.NewTimer(period).C
+			// The metrics of the targets removed must not be recreated
+			if ctx.Err() != nil {
+				return
+			}
+			d.metrics.observeReport(t.String(), report.GetStatus(), latency, err)
+
+			switch code := status.Code(err); {
+			case code == codes.PermissionDenied || code == codes.Unauthenticated:
+				// Retrying right away will not change the outcome, the configuration of the node must be fixed. The
+				// target is tried again on the next discovery
+				d.cfg.Logger.Errorf("rejected by load balancer %s: %v", t.String(), status.Convert(err).Message())
+				d.untrackTarget(t.String(), client)
+				return
+			case err != nil:
+				// The stream has been closed by the load balancer, open a new one and register again
+				d.cfg.Logger.Errorf("disconnected from %s: %v, reconnecting", t.String(), err)
+				d.metrics.reconnects.WithLabelValues(t.String()).Inc()
+				if errReset := client.ResetHealthStream(); errReset != nil {
+					d.cfg.Logger.Errorf("failed to reconnect to %s: %v", t.String(), errReset)
+					break
+				}
+			default:
+				d.cfg.Logger.Debugf("reported health status to %s", t.String())
+			}
+
+			var stopped bool
+			if timeout, period, stopped = d.waitNextReport(ctx, client, t, timeout, period); stopped {
+				return
+			}
 		}
 	}
 }
+
+// waitNextReport waits until the next health report is due, answering the probes requested meanwhile. Returns the
+// timings of the health reports, which change if the load balancer pushes a new configuration, and whether the
+// dispatcher has been stopped
+func (d *Dispatcher) waitNextReport(ctx context.Context, client *Client, t Target, timeout, period time.Duration) (time.Duration, time.Duration, bool) {
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return timeout, period, true
+		case executionCfg := <-client.Configs():
+			// Report right away, the load balancer restarts its timeout once it pushes the configuration
+			timeout, period = d.applyConfig(t, executionCfg, timeout, period)
+			return timeout, period, false
+		case probe := <-client.Probes():
+			// Probes are answered from this goroutine so that the stream is never sent concurrently. If the answer fails
+			// the stream is reset by the next health report
+			if err := d.answerProbe(ctx, client, probe, timeout); err != nil {
+				d.cfg.Logger.Errorf("failed to answer probe %d from %s: %v", probe.GetProbeId(), t.String(), err)
+				return timeout, period, false
+			}
+		case <-timer.C:
+			return timeout, period, false
+		}
+	}
+}
+
+// answerProbe runs the local checks and sends the result to the load balancer that requested the probe
+func (d *Dispatcher) answerProbe(ctx context.Context, client *Client, probe *v2Consensus.ProbeRequest, timeout time.Duration) error {
+	serviceStatus, results := d.checker.Run(ctx)
+
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return client.SendProbeResponse(ctxTimeout, &v2Consensus.ProbeResponse{
+		ProbeId: probe.GetProbeId(),
+		Status:  serviceStatus,
+		Checks:  results,
+	})
+}
+
+// statusMessage summarizes the result of the local checks for the health reports
+func statusMessage(results []*v2Consensus.CheckResult) string {
+	failed := []string{}
+	for _, result := range results {
+		if !result.GetPassed() {
+			failed = append(failed, fmt.Sprintf("%s: %s", result.GetName(), result.GetMessage()))
+		}
+	}
+
+	if len(failed) == 0 {
+		return "Serving requests goes brrrrr"
+	}
+
+	return "failed checks: " + strings.Join(failed, "; ")
+}
@@ -0,0 +1,161 @@
+package nodenetwork
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v2Consensus "github.com/yago-123/galelb/pkg/consensus/v2"
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	metricsNamespace = "galelb"
+	metricsSubsystem = "node"
+
+	// Buckets of the health report latency, from 1ms up to ~4s
+	reportLatencyStart  = 0.001
+	reportLatencyFactor = 2
+	reportLatencyCount  = 13
+)
+
+// connectionStates are exported as one gauge per state, set to 1 for the current state of the connection
+var connectionStates = []connectivity.State{ //nolint:gochecknoglobals // states exported as labels
+	connectivity.Idle,
+	connectivity.Connecting,
+	connectivity.Ready,
+	connectivity.TransientFailure,
+	connectivity.Shutdown,
+}
+
+// dispatcherMetrics contains the metrics of the dispatcher, labeled by load balancer target
+type dispatcherMetrics struct {
+	reconnects     *prometheus.CounterVec
+	reportLatency  *prometheus.HistogramVec
+	reportFailures *prometheus.CounterVec
+	lastReport     *prometheus.GaugeVec
+	reportedStatus *prometheus.GaugeVec
+	lbConfig       *prometheus.GaugeVec
+
+	connectionState *prometheus.Desc
+}
+
+func newDispatcherMetrics() *dispatcherMetrics {
+	return &dispatcherMetrics{
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "reconnect_attempts_total",
+			Help:      "Number of times the health stream towards the load balancer has been reopened.",
+		}, []string{"target"}),
+		reportLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "health_report_duration_seconds",
+			Help:      "Time spent sending each health report to the load balancer.",
+			Buckets:   prometheus.ExponentialBuckets(reportLatencyStart, reportLatencyFactor, reportLatencyCount),
+		}, []string{"target"}),
+		reportFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "health_report_failures_total",
+			Help:      "Number of health reports that could not be sent to the load balancer.",
+		}, []string{"target"}),
+		lastReport: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "last_health_report_timestamp_seconds",
+			Help:      "Unix time of the last health report successfully sent to the load balancer.",
+		}, []string{"target"}),
+		reportedStatus: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "reported_status",
+			Help:      "Result of the local checks last reported to the load balancer: 1 serving, 2 not serving, 3 shutting down.",
+		}, []string{"target"}),
+		lbConfig: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "load_balancer_config",
+			Help:      "Configuration received from the load balancer, durations in seconds.",
+		}, []string{"target", "parameter"}),
+		connectionState: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "connection_state"),
+			"State of the connection with the load balancer, 1 for the current state.",
+			[]string{"target", "state"}, nil,
+		),
+	}
+}
+
+// observeReport records the outcome of a health report sent to the target
+func (m *dispatcherMetrics) observeReport(target string, serviceStatus v2Consensus.ServingStatus, latency time.Duration, err error) {
+	m.reportLatency.WithLabelValues(target).Observe(latency.Seconds())
+	if err != nil {
+		m.reportFailures.WithLabelValues(target).Inc()
+		return
+	}
+
+	m.lastReport.WithLabelValues(target).Set(float64(time.Now().Unix()))
+	m.reportedStatus.WithLabelValues(target).Set(float64(serviceStatus))
+}
+
+// observeConfig records the configuration received from the target
+func (m *dispatcherMetrics) observeConfig(target string, cfg *v2Consensus.Config) {
+	m.lbConfig.WithLabelValues(target, "checks_before_routing").Set(float64(cfg.GetChecksBeforeRouting()))
+	m.lbConfig.WithLabelValues(target, "health_check_timeout_seconds").Set(time.Duration(cfg.GetHealthCheckTimeout()).Seconds())
+	m.lbConfig.WithLabelValues(target, "black_list_after_fails").Set(float64(cfg.GetBlackListAfterFails()))
+	m.lbConfig.WithLabelValues(target, "black_list_expiry_seconds").Set(time.Duration(cfg.GetBlackListExpiry()).Seconds())
+}
+
+// forget removes the metrics of a target no longer discovered
+func (m *dispatcherMetrics) forget(target string) {
+	m.reconnects.DeleteLabelValues(target)
+	m.reportLatency.DeleteLabelValues(target)
+	m.reportFailures.DeleteLabelValues(target)
+	m.lastReport.DeleteLabelValues(target)
+	m.reportedStatus.DeleteLabelValues(target)
+	m.lbConfig.DeletePartialMatch(prometheus.Labels{"target": target})
+}
+
+// Collector returns the collector of the dispatcher metrics
+func (d *Dispatcher) Collector() prometheus.Collector {
+	return &dispatcherCollector{dispatcher: d}
+}
+
+type dispatcherCollector struct {
+	dispatcher *Dispatcher
+}
+
+func (c *dispatcherCollector) collectors() []prometheus.Collector {
+	metrics := c.dispatcher.metrics
+	return []prometheus.Collector{
+		metrics.reconnects,
+		metrics.reportLatency,
+		metrics.reportFailures,
+		metrics.lastReport,
+		metrics.reportedStatus,
+		metrics.lbConfig,
+	}
+}
+
+func (c *dispatcherCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors() {
+		collector.Describe(ch)
+	}
+	ch <- c.dispatcher.metrics.connectionState
+}
+
+func (c *dispatcherCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors() {
+		collector.Collect(ch)
+	}
+
+	for target, state := range c.dispatcher.connectionStates() {
+		for _, candidate := range connectionStates {
+			value := 0.0
+			if candidate == state {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.dispatcher.metrics.connectionState, prometheus.GaugeValue, value, target, candidate.String())
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package nodenetwork
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	nodeConfig "github.com/yago-123/galelb/config/node"
+	v2Consensus "github.com/yago-123/galelb/pkg/consensus/v2"
+)
+
+// gatherTarget returns the metrics of the target gathered from the registry, indexed by family name
+func gatherTarget(t *testing.T, gatherer prometheus.Gatherer, target string) map[string]*dto.Metric {
+	t.Helper()
+
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	metrics := map[string]*dto.Metric{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "target" && label.GetValue() == target {
+					metrics[family.GetName()] = metric
+				}
+			}
+		}
+	}
+
+	return metrics
+}
+
+func TestDispatcher_metrics(t *testing.T) {
+	const target = "10.0.0.1:7070"
+
+	dispatcher := NewDispatcher(nodeConfig.New(), map[string]Target{}, nil)
+	gatherer := prometheus.NewRegistry()
+	gatherer.MustRegister(dispatcher.Collector())
+
+	before := time.Now().Unix()
+	dispatcher.metrics.observeReport(target, v2Consensus.ServingStatus_SERVING_STATUS_SERVING, 3*time.Millisecond, nil)
+	dispatcher.metrics.observeReport(target, v2Consensus.ServingStatus_SERVING_STATUS_NOT_SERVING, 5*time.Millisecond, errors.New("stream closed"))
+	dispatcher.metrics.reconnects.WithLabelValues(target).Inc()
+
+	metrics := gatherTarget(t, gatherer, target)
+
+	if reconnects := metrics["galelb_node_reconnect_attempts_total"]; reconnects.GetCounter().GetValue() != 1 {
+		t.Fatalf("expected 1 reconnect attempt, got %v", reconnects)
+	}
+	if failures := metrics["galelb_node_health_report_failures_total"]; failures.GetCounter().GetValue() != 1 {
+		t.Fatalf("expected 1 report failure, got %v", failures)
+	}
+
+	// Failed reports are timed as well
+	latency := metrics["galelb_node_health_report_duration_seconds"].GetHistogram()
+	if latency.GetSampleCount() != 2 || latency.GetSampleSum() < 0.008 {
+		t.Fatalf("expected the latency of both reports, got %v", latency)
+	}
+
+	// Only the successful report updates the last report and the status reported
+	if last := metrics["galelb_node_last_health_report_timestamp_seconds"].GetGauge().GetValue(); last < float64(before) {
+		t.Fatalf("expected last report timestamp after %d, got %v", before, last)
+	}
+	if reported := metrics["galelb_node_reported_status"].GetGauge().GetValue(); reported != float64(v2Consensus.ServingStatus_SERVING_STATUS_SERVING) {
+		t.Fatalf("expected serving status to be reported, got %v", reported)
+	}
+
+	// The series of targets no longer discovered are removed
+	dispatcher.metrics.forget(target)
+	if metrics = gatherTarget(t, gatherer, target); len(metrics) != 0 {
+		t.Fatalf("expected no metrics once the target is forgotten, got %v", metrics)
+	}
+}
@@ -0,0 +1,181 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EventLogSize is the number of events kept by the registry so that consumers can resume their stream after a
+	// reconnection. Consumers that fall further behind must resynchronize from the list of nodes
+	EventLogSize = 1024
+
+	resumeTokenSeparator = "."
+)
+
+var (
+	ErrInvalidResumeToken = errors.New("invalid resume token")
+	ErrResumeTokenExpired = errors.New("resume token expired")
+)
+
+// EventType is the type of transition of a node in the registry
+type EventType string
+
+const (
+	// EventRegistered is emitted each time that a node connects, including reconnections of nodes already registered
+	EventRegistered EventType = "registered"
+	// EventEligible and EventIneligible are emitted when the node starts or stops being eligible for routing
+	EventEligible   EventType = "eligible"
+	EventIneligible EventType = "ineligible"
+	// EventBlacklisted and EventUnbanned are emitted when the node IP is banned or the ban is lifted, either by an
+	// operator or because it expired
+	EventBlacklisted EventType = "blacklisted"
+	EventUnbanned    EventType = "unbanned"
+	// EventDrained is emitted once a draining node no longer serves any client
+	EventDrained EventType = "drained"
+	// EventRemoved is emitted when the node is removed from the registry
+	EventRemoved EventType = "removed"
+)
+
+// Event is a transition of a node in the registry
+type Event struct {
+	// Sequence orders the events emitted by the registry, starting at 1
+	Sequence uint64
+	// ResumeToken identifies the event, consumers resume their stream right after it
+	ResumeToken string
+	Type        EventType
+	// NodeID is empty for the events of a node IP that is not registered (ex: unbanned)
+	NodeID string
+	Addr   netip.Addr
+	Time   time.Time
+}
+
+// eventLog keeps the latest events emitted by the registry and wakes up the watchers on each new event
+type eventLog struct {
+	// epoch identifies the lifetime of the log, tokens issued before a restart of the load balancer are expired
+	epoch  string
+	events []Event
+	// nextSequence is the sequence of the next event emitted
+	nextSequence uint64
+	// notify is closed and replaced each time that an event is emitted
+	notify chan struct{}
+	lock   sync.Mutex
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{
+		epoch:        strconv.FormatInt(time.Now().UnixNano(), 36),
+		nextSequence: 1,
+		notify:       make(chan struct{}),
+	}
+}
+
+// emit appends a new event to the log, discarding the oldest one if the log is full
+func (l *eventLog) emit(eventType EventType, nodeID string, addr netip.Addr) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	sequence := l.nextSequence
+	l.nextSequence++
+
+	l.events = append(l.events, Event{
+		Sequence:    sequence,
+		ResumeToken: l.epoch + resumeTokenSeparator + strconv.FormatUint(sequence, 10),
+		Type:        eventType,
+		NodeID:      nodeID,
+		Addr:        addr,
+		Time:        time.Now(),
+	})
+	if len(l.events) > EventLogSize {
+		l.events = l.events[len(l.events)-EventLogSize:]
+	}
+
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// watch returns a watcher that starts right after the event identified by the resume token, or with the next event
+// emitted if the token is empty
+func (l *eventLog) watch(resumeToken string) (*EventWatcher, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if resumeToken == "" {
+		return &EventWatcher{log: l, next: l.nextSequence}, nil
+	}
+
+	epoch, rawSequence, found := strings.Cut(resumeToken, resumeTokenSeparator)
+	sequence, err := strconv.ParseUint(rawSequence, 10, 64)
+	if !found || err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidResumeToken, resumeToken)
+	}
+
+	// Tokens from a previous lifetime of the load balancer refer to events that are gone
+	if epoch != l.epoch {
+		return nil, fmt.Errorf("%w: issued by a previous instance of the load balancer", ErrResumeTokenExpired)
+	}
+
+	if sequence >= l.nextSequence {
+		return nil, fmt.Errorf("%w: %s has not been emitted yet", ErrInvalidResumeToken, resumeToken)
+	}
+
+	watcher := &EventWatcher{log: l, next: sequence + 1}
+	if !watcher.available() {
+		return nil, fmt.Errorf("%w: events after %s have been discarded", ErrResumeTokenExpired, resumeToken)
+	}
+
+	return watcher, nil
+}
+
+// EventWatcher streams the events of the registry in order
+type EventWatcher struct {
+	log *eventLog
+	// next is the sequence of the next event returned
+	next uint64
+}
+
+// Next blocks until there are new events and returns them. Returns ErrResumeTokenExpired if the watcher fell so far
+// behind that some of its events have been discarded
+func (w *EventWatcher) Next(ctx context.Context) ([]Event, error) {
+	for {
+		w.log.lock.Lock()
+		if !w.available() {
+			w.log.lock.Unlock()
+			return nil, fmt.Errorf("%w: events after sequence %d have been discarded", ErrResumeTokenExpired, w.next-1)
+		}
+
+		if w.next < w.log.nextSequence {
+			// Events are contiguous, the position of the next one is given by its distance to the oldest
+			start := len(w.log.events) - int(w.log.nextSequence-w.next) //nolint:gosec // bounded by the log size
+			events := append([]Event(nil), w.log.events[start:]...)
+			w.next = w.log.nextSequence
+			w.log.lock.Unlock()
+
+			return events, nil
+		}
+
+		notify := w.log.notify
+		w.log.lock.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// available returns whether the next event of the watcher is still in the log, must be called with the log lock held
+func (w *EventWatcher) available() bool {
+	if len(w.log.events) == 0 {
+		return true
+	}
+
+	return w.next >= w.log.events[0].Sequence
+}
@@ -0,0 +1,213 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	lbConfig "github.com/yago-123/galelb/config/lb"
+)
+
+func nextEvents(t *testing.T, watcher *EventWatcher) []EventType {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	events, err := watcher.Next(ctx)
+	if err != nil {
+		t.Fatalf("failed to watch events: %v", err)
+	}
+
+	types := make([]EventType, 0, len(events))
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+
+	return types
+}
+
+func TestRegistry_events(t *testing.T) {
+	nodeRegistry := New(&lbConfig.Config{
+		NodeHealth: lbConfig.NodeHealth{ChecksBeforeRouting: 1, BlackListAfterFails: lbConfig.BlackListDisabled, BlackListExpiry: time.Hour},
+		Logger:     logrus.New(),
+	})
+
+	watcher, err := nodeRegistry.WatchEvents("")
+	if err != nil {
+		t.Fatalf("failed to watch events: %v", err)
+	}
+
+	session, err := nodeRegistry.RegisterNode(context.Background(), "node-0", netip.MustParseAddrPort("10.0.0.1:4000"), "", Metadata{})
+	if err != nil {
+		t.Fatalf("failed to register node: %v", err)
+	}
+	nodeRegistry.ReportNewHealthCheck(context.Background(), session, nil)
+	nodeRegistry.ReportNodeFailure(context.Background(), session)
+
+	expected := []EventType{EventRegistered, EventEligible, EventIneligible}
+	if types := nextEvents(t, watcher); !slices.Equal(types, expected) {
+		t.Fatalf("expected events %v, got %v", expected, types)
+	}
+
+	nodeRegistry.ReportNewHealthCheck(context.Background(), session, nil)
+	if _, err = nodeRegistry.EvictNode(context.Background(), "node-0"); err != nil {
+		t.Fatalf("failed to evict node: %v", err)
+	}
+	if err = nodeRegistry.UnbanNode(netip.MustParseAddr("10.0.0.1")); err != nil {
+		t.Fatalf("failed to unban node: %v", err)
+	}
+
+	expected = []EventType{EventEligible, EventIneligible, EventRemoved, EventBlacklisted, EventUnbanned}
+	if types := nextEvents(t, watcher); !slices.Equal(types, expected) {
+		t.Fatalf("expected events %v, got %v", expected, types)
+	}
+}
+
+func TestRegistry_unregisterNode(t *testing.T) {
+	nodeRegistry := New(&lbConfig.Config{
+		NodeHealth: lbConfig.NodeHealth{ChecksBeforeRouting: 1, BlackListAfterFails: lbConfig.BlackListDisabled},
+		Logger:     logrus.New(),
+	})
+
+	previous, err := nodeRegistry.RegisterNode(context.Background(), "node-0", netip.MustParseAddrPort("10.0.0.1:4000"), "", Metadata{})
+	if err != nil {
+		t.Fatalf("failed to register node: %v", err)
+	}
+	current, err := nodeRegistry.RegisterNode(context.Background(), "node-0", netip.MustParseAddrPort("10.0.0.1:4001"), "", Metadata{})
+	if err != nil {
+		t.Fatalf("failed to register node: %v", err)
+	}
+	nodeRegistry.ReportNewHealthCheck(context.Background(), current, nil)
+
+	watcher, err := nodeRegistry.WatchEvents("")
+	if err != nil {
+		t.Fatalf("failed to watch events: %v", err)
+	}
+
+	// The end of a session replaced by a newer connection does not remove the node
+	nodeRegistry.UnregisterNode(context.Background(), previous)
+	if _, err = nodeRegistry.Node("node-0"); err != nil {
+		t.Fatalf("expected node to remain registered: %v", err)
+	}
+
+	nodeRegistry.UnregisterNode(context.Background(), current)
+	if _, err = nodeRegistry.Node("node-0"); !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("expected node to be removed once its session ended, got %v", err)
+	}
+	if eligible := nodeRegistry.EligibleNodes(); len(eligible) != 0 {
+		t.Fatalf("expected no eligible nodes, got %v", eligible)
+	}
+
+	select {
+	case <-current.Closed():
+	default:
+		t.Fatalf("expected session to be closed")
+	}
+
+	expected := []EventType{EventIneligible, EventRemoved}
+	if types := nextEvents(t, watcher); !slices.Equal(types, expected) {
+		t.Fatalf("expected events %v, got %v", expected, types)
+	}
+}
+
+func TestRegistry_blacklistAfterFails(t *testing.T) {
+	nodeRegistry := New(&lbConfig.Config{
+		NodeHealth: lbConfig.NodeHealth{ChecksBeforeRouting: 1, BlackListAfterFails: 2, BlackListExpiry: time.Hour},
+		Logger:     logrus.New(),
+	})
+	addr := netip.MustParseAddrPort("10.0.0.1:4000")
+
+	session, err := nodeRegistry.RegisterNode(context.Background(), "node-0", addr, "", Metadata{})
+	if err != nil {
+		t.Fatalf("failed to register node: %v", err)
+	}
+
+	watcher, err := nodeRegistry.WatchEvents("")
+	if err != nil {
+		t.Fatalf("failed to watch events: %v", err)
+	}
+
+	// Failures of nodes already out of the routing are not counted
+	nodeRegistry.ReportNodeFailure(context.Background(), session)
+
+	// The first time that the node is taken out of the routing is allowed
+	nodeRegistry.ReportNewHealthCheck(context.Background(), session, nil)
+	nodeRegistry.ReportNodeFailure(context.Background(), session)
+	if _, err = nodeRegistry.Node("node-0"); err != nil {
+		t.Fatalf("expected node to remain registered after the first failure: %v", err)
+	}
+
+	nodeRegistry.ReportNewHealthCheck(context.Background(), session, nil)
+	nodeRegistry.ReportNodeFailure(context.Background(), session)
+
+	expected := []EventType{EventEligible, EventIneligible, EventEligible, EventIneligible, EventRemoved, EventBlacklisted}
+	if types := nextEvents(t, watcher); !slices.Equal(types, expected) {
+		t.Fatalf("expected events %v, got %v", expected, types)
+	}
+
+	select {
+	case <-session.Closed():
+	default:
+		t.Fatalf("expected session of the blacklisted node to be closed")
+	}
+
+	if _, err = nodeRegistry.RegisterNode(context.Background(), "node-0", addr, "", Metadata{}); !errors.Is(err, ErrNodeBlacklisted) {
+		t.Fatalf("expected blacklisted node to be rejected, got %v", err)
+	}
+}
+
+func TestRegistry_watchEventsResume(t *testing.T) {
+	nodeRegistry := New(&lbConfig.Config{Logger: logrus.New()})
+
+	watcher, err := nodeRegistry.WatchEvents("")
+	if err != nil {
+		t.Fatalf("failed to watch events: %v", err)
+	}
+
+	// Emit more events than the log keeps, the first ones are discarded
+	for range EventLogSize + 1 {
+		if _, err = nodeRegistry.RegisterNode(context.Background(), "node-0", netip.MustParseAddrPort("10.0.0.1:4000"), "", Metadata{}); err != nil {
+			t.Fatalf("failed to register node: %v", err)
+		}
+	}
+
+	if _, err = watcher.Next(context.Background()); !errors.Is(err, ErrResumeTokenExpired) {
+		t.Fatalf("expected watcher to fall behind, got %v", err)
+	}
+
+	events := nodeRegistry.events.events
+	if _, err = nodeRegistry.WatchEvents(events[0].ResumeToken); err != nil {
+		t.Fatalf("expected to resume after the oldest event, got %v", err)
+	}
+
+	resumed, err := nodeRegistry.WatchEvents(events[len(events)-2].ResumeToken)
+	if err != nil {
+		t.Fatalf("failed to resume events: %v", err)
+	}
+	if types := nextEvents(t, resumed); len(types) != 1 {
+		t.Fatalf("expected only the last event, got %v", types)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{name: "malformed", token: "malformed", err: ErrInvalidResumeToken},
+		{name: "not emitted yet", token: nodeRegistry.events.epoch + ".999999", err: ErrInvalidResumeToken},
+		{name: "previous instance", token: "0.1", err: ErrResumeTokenExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, errWatch := nodeRegistry.WatchEvents(tt.token); !errors.Is(errWatch, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, errWatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "galelb"
+
+	// Buckets of the interval between health checks, from 250ms up to 32s
+	healthCheckIntervalStart  = 0.25
+	healthCheckIntervalFactor = 2
+	healthCheckIntervalCount  = 8
+)
+
+// Node states exported as labels of the node gauge. States are not exclusive, an eligible node is registered too
+const (
+	stateRegistered  = "registered"
+	stateEligible    = "eligible"
+	stateCordoned    = "cordoned"
+	stateDraining    = "draining"
+	stateDrained     = "drained"
+	stateBlacklisted = "blacklisted"
+)
+
+type registryMetrics struct {
+	healthCheckInterval prometheus.Histogram
+	healthCheckFailures prometheus.Counter
+	nodes               *prometheus.Desc
+}
+
+func newRegistryMetrics() *registryMetrics {
+	return &registryMetrics{
+		healthCheckInterval: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "health_check_interval_seconds",
+			Help:      "Time elapsed between consecutive health checks of the same node.",
+			Buckets:   prometheus.ExponentialBuckets(healthCheckIntervalStart, healthCheckIntervalFactor, healthCheckIntervalCount),
+		}),
+		healthCheckFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "health_check_failures_total",
+			Help:      "Number of times a node failed to report its health checks, either timing out or losing the connection.",
+		}),
+		nodes: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "nodes"),
+			"Number of nodes in each state. Blacklisted counts the IPs banned, whether they are connected or not.",
+			[]string{"state"}, nil,
+		),
+	}
+}
+
+// Collector returns the collector of the registry metrics
+func (n *NodeRegistry) Collector() prometheus.Collector {
+	return &registryCollector{registry: n}
+}
+
+type registryCollector struct {
+	registry *NodeRegistry
+}
+
+func (c *registryCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.registry.metrics.healthCheckInterval.Describe(ch)
+	c.registry.metrics.healthCheckFailures.Describe(ch)
+	ch <- c.registry.metrics.nodes
+}
+
+func (c *registryCollector) Collect(ch chan<- prometheus.Metric) {
+	metrics := c.registry.metrics
+	metrics.healthCheckInterval.Collect(ch)
+	metrics.healthCheckFailures.Collect(ch)
+
+	for state, count := range c.registry.stateCounts(time.Now()) {
+		ch <- prometheus.MustNewConstMetric(metrics.nodes, prometheus.GaugeValue, float64(count), state)
+	}
+}
+
+// stateCounts returns the number of nodes in each state
+func (n *NodeRegistry) stateCounts(now time.Time) map[string]int {
+	n.globalLock.RLock()
+	defer n.globalLock.RUnlock()
+
+	counts := map[string]int{
+		stateRegistered:  len(n.registry),
+		stateEligible:    0,
+		stateCordoned:    0,
+		stateDraining:    0,
+		stateDrained:     0,
+		stateBlacklisted: 0,
+	}
+
+	for _, nodeInfo := range n.registry {
+		if n.isEligible(nodeInfo) {
+			counts[stateEligible]++
+		}
+
+		if state, ok := n.maintenance[nodeInfo.addr.Addr()]; ok {
+			counts[stateCordoned]++
+			if state.draining {
+				counts[stateDraining]++
+			}
+			if state.drained {
+				counts[stateDrained]++
+			}
+		}
+	}
+
+	for _, expiry := range n.blackList {
+		if now.Before(expiry) {
+			counts[stateBlacklisted]++
+		}
+	}
+
+	return counts
+}
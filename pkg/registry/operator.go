@@ -0,0 +1,198 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	// DrainCheckInterval is the period at which draining nodes are checked for clients left
+	DrainCheckInterval = 5 * time.Second
+)
+
+// DrainChecker returns whether the node IP still serves clients, so that draining nodes are only considered drained
+// once all of them are gone
+type DrainChecker func(ctx context.Context, addr netip.Addr) (bool, error)
+
+// maintenance is the state of a node IP taken out of the routing by an operator
+type maintenance struct {
+	// draining is set if the clients already served by the node are allowed to finish, since the given time. Once
+	// none of them is left, drained is set
+	draining bool
+	since    time.Time
+	drained  bool
+}
+
+// SetDrainChecker sets the checker of the clients left on draining nodes. Without checker, draining nodes are
+// considered drained on the first check
+func (n *NodeRegistry) SetDrainChecker(checker DrainChecker) {
+	n.globalLock.Lock()
+	defer n.globalLock.Unlock()
+
+	n.drainChecker = checker
+}
+
+// CordonNode keeps the node registered but out of the routing until it is uncordoned. Clients kept on the node by
+// the affinity table are not moved, only new clients are routed to other nodes. Unlike draining, the node is never
+// considered drained
+func (n *NodeRegistry) CordonNode(ctx context.Context, nodeKey string) error {
+	_, _, err := n.setMaintenance(ctx, nodeKey, maintenance{})
+	return err
+}
+
+// DrainNode stops routing new clients to the node while the clients already served by it are allowed to finish.
+// The node is marked as drained once no clients are left, and remains out of the routing until it is uncordoned
+// todo(): replicate the maintenance state to the peer load balancers, so that they stop routing to the node too
+func (n *NodeRegistry) DrainNode(ctx context.Context, nodeKey string) error {
+	state := maintenance{draining: true, since: time.Now()}
+	addr, alreadyDraining, err := n.setMaintenance(ctx, nodeKey, state)
+	if err != nil {
+		return err
+	}
+
+	// Draining an already draining node does not start over
+	if !alreadyDraining {
+		go n.watchDrain(nodeKey, addr, state.since)
+	}
+
+	return nil
+}
+
+// UncordonNode returns a cordoned or drained node to the routing
+func (n *NodeRegistry) UncordonNode(ctx context.Context, nodeKey string) error {
+	n.globalLock.Lock()
+
+	nodeInfo, ok := n.registry[nodeKey]
+	if !ok {
+		n.globalLock.Unlock()
+		return fmt.Errorf("%w: %s", ErrNodeNotFound, nodeKey)
+	}
+
+	previous := n.eligibilityByAddr(nodeInfo.addr.Addr())
+	delete(n.maintenance, nodeInfo.addr.Addr())
+	n.emitEligibilityChanges(nodeInfo.addr.Addr(), previous)
+	n.globalLock.Unlock()
+
+	n.logger.Infof("node %s returned to routing by operator", nodeInfo.addr.Addr())
+	n.notifyEligibilityChange(ctx)
+
+	return nil
+}
+
+// EvictNode forcibly removes all the connections of the node IP from the registry and bans the IP during the
+// blacklist expiry, so that it cannot join back right away. Returns the IP of the evicted node
+func (n *NodeRegistry) EvictNode(ctx context.Context, nodeKey string) (netip.Addr, error) {
+	n.globalLock.Lock()
+
+	nodeInfo, ok := n.registry[nodeKey]
+	if !ok {
+		n.globalLock.Unlock()
+		return netip.Addr{}, fmt.Errorf("%w: %s", ErrNodeNotFound, nodeKey)
+	}
+
+	addr := nodeInfo.addr.Addr()
+	n.removeAddr(addr)
+	if n.health.BlackListExpiry > 0 {
+		n.blacklist(nodeKey, addr)
+	}
+	n.globalLock.Unlock()
+
+	n.logger.Infof("node %s evicted by operator", addr)
+	n.notifyEligibilityChange(ctx)
+
+	return addr, nil
+}
+
+// UnbanNode lifts the blacklist ban of the node IP before it expires
+func (n *NodeRegistry) UnbanNode(addr netip.Addr) error {
+	n.globalLock.Lock()
+	defer n.globalLock.Unlock()
+
+	if expiry, ok := n.blackList[addr]; !ok || time.Now().After(expiry) {
+		return fmt.Errorf("%w: %s", ErrNodeNotBlacklisted, addr)
+	}
+
+	delete(n.blackList, addr)
+	n.events.emit(EventUnbanned, "", addr)
+	n.logger.Infof("node %s unbanned by operator", addr)
+
+	return nil
+}
+
+// setMaintenance takes the node IP out of the routing. Returns the IP of the node and whether it was already draining,
+// in which case its state is kept as it was
+func (n *NodeRegistry) setMaintenance(ctx context.Context, nodeKey string, state maintenance) (netip.Addr, bool, error) {
+	n.globalLock.Lock()
+
+	nodeInfo, ok := n.registry[nodeKey]
+	if !ok {
+		n.globalLock.Unlock()
+		return netip.Addr{}, false, fmt.Errorf("%w: %s", ErrNodeNotFound, nodeKey)
+	}
+
+	// Draining an already draining node keeps the original start time
+	addr := nodeInfo.addr.Addr()
+	current, exists := n.maintenance[addr]
+	alreadyDraining := exists && current.draining && state.draining
+	if alreadyDraining {
+		state = current
+	}
+
+	previous := n.eligibilityByAddr(addr)
+	n.maintenance[addr] = state
+	n.emitEligibilityChanges(addr, previous)
+	n.globalLock.Unlock()
+
+	n.logger.Infof("node %s taken out of routing by operator (draining: %t)", addr, state.draining)
+	n.notifyEligibilityChange(ctx)
+
+	return addr, alreadyDraining, nil
+}
+
+// watchDrain checks periodically the clients left on the draining node IP, until none is left or the node stops
+// draining (ex: uncordoned or evicted)
+func (n *NodeRegistry) watchDrain(nodeKey string, addr netip.Addr, since time.Time) {
+	ticker := time.NewTicker(n.drainCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n.globalLock.RLock()
+		stillDraining := n.isDraining(addr, since)
+		checker := n.drainChecker
+		n.globalLock.RUnlock()
+
+		if !stillDraining {
+			return
+		}
+
+		if checker != nil {
+			serving, err := checker(context.Background(), addr)
+			if err != nil {
+				n.logger.Warnf("failed to check clients left on draining node %s: %v", addr, err)
+				continue
+			}
+
+			if serving {
+				continue
+			}
+		}
+
+		n.globalLock.Lock()
+		if n.isDraining(addr, since) {
+			n.maintenance[addr] = maintenance{draining: true, since: since, drained: true}
+			n.events.emit(EventDrained, nodeKey, addr)
+		}
+		n.globalLock.Unlock()
+
+		n.logger.Infof("node %s drained, draining since %s", addr, since.Format(time.RFC3339))
+		return
+	}
+}
+
+// isDraining returns whether the node IP is still draining since the given time, must be called with the lock held
+func (n *NodeRegistry) isDraining(addr netip.Addr, since time.Time) bool {
+	current, ok := n.maintenance[addr]
+	return ok && current.draining && !current.drained && current.since.Equal(since)
+}
@@ -1,25 +1,129 @@
 package registry
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
 	"sync"
 	"time"
 
+	lbConfig "github.com/yago-123/galelb/config/lb"
+
 	"github.com/sirupsen/logrus"
+	"github.com/yago-123/galelb/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/yago-123/galelb/pkg/registry"
+)
+
+var (
+	ErrNodeNotFound       = errors.New("node not found")
+	ErrNodeBlacklisted    = errors.New("node is blacklisted")
+	ErrNodeNotBlacklisted = errors.New("node is not blacklisted")
 )
 
 type node struct {
+	addr                   netip.AddrPort
+	mac                    string
 	continuousHealthChecks uint
 	lastHealthCheck        time.Time
+	// metrics contains the last metrics reported by the node along with the health checks
+	metrics map[string]float64
+	// session identifies the connection that registered the node, closed once the node is evicted by an operator or
+	// replaced by a newer connection of the same node
+	session *Session
+	// metadata is announced by the node when it registers
+	metadata Metadata
+}
+
+// Metadata describes a node as announced by itself when it registers. Nodes speaking the first version of the protocol
+// only announce the protocol version
+type Metadata struct {
+	// ProtocolVersion is the version of the protocol spoken by the node with the load balancer
+	ProtocolVersion int
+	// Name is the name announced by the node, informative only as nodes are identified by their certificate or
+	// connection
+	Name string
+	// Version is the version of the node software
+	Version string
+	// ServiceEndpoint is the endpoint of the node serving the traffic routed to it
+	ServiceEndpoint string
+	// Weight is the relative share of traffic requested by the node, 0 if not announced. Informative only, all the
+	// nodes of a ring own the same number of virtual nodes
+	Weight uint32
+	Labels map[string]string
+	// Capabilities contains the optional features of the protocol negotiated with the node
+	Capabilities []string
+}
+
+// Session identifies the connection of a node with the load balancer. Reports coming from a session that has been
+// replaced by a newer connection of the same node are ignored
+type Session struct {
+	// Key identifies the node in the registry
+	Key string
+	// closed is closed once the session ends, either because the node has been evicted or reconnected
+	closed chan struct{}
 }
 
+// Closed returns a channel that is closed once the session ends, after which the connection must be closed
+func (s *Session) Closed() <-chan struct{} {
+	return s.closed
+}
+
+// NodeInfo is a snapshot of the state of a node in the registry
+type NodeInfo struct {
+	// ID identifies the node, either the identity of its certificate or its connection with the load balancer
+	ID                     string
+	Addr                   netip.AddrPort
+	MAC                    string
+	ContinuousHealthChecks uint
+	LastHealthCheck        time.Time
+	Eligible               bool
+	// Cordoned is set while the node IP is kept out of the routing by an operator, Draining if existing clients
+	// are still allowed to finish since DrainingSince and Drained once none of them is left
+	Cordoned      bool
+	Draining      bool
+	DrainingSince time.Time
+	Drained       bool
+	// Blacklisted is set while the node IP is banned, until BlacklistExpiry
+	Blacklisted     bool
+	BlacklistExpiry time.Time
+	Metrics         map[string]float64
+	Metadata        Metadata
+}
+
+// EligibilityListener is invoked with the nodes eligible for routing each time that the set changes. The context
+// carries the trace of the change
+type EligibilityListener func(ctx context.Context, eligible []netip.Addr)
+
 // NodeRegistry is a struct that keeps track of all nodes that are connected to the load balancer
 type NodeRegistry struct {
 	// registry is used to keep track of all nodes that are connected to the load balancer. This is used to keep
 	// track of nodes to which we should route traffic.
 	registry map[string]*node
 
-	// blackList is used to keep track of nodes that have failed health checks.
-	blackList map[string]time.Time
+	// blackList is used to keep track of nodes that have failed health checks. Indexed by node IP, contains the time
+	// at which the ban expires
+	blackList map[netip.Addr]time.Time
+	// failures counts, indexed by node IP, the times that nodes have been taken out of the routing because of failed
+	// health checks. Once it reaches the black list threshold, the IP is blacklisted
+	failures map[netip.Addr]int
+
+	// maintenance contains the node IPs kept out of the routing by operators. Indexed by IP so that the state
+	// survives reconnections of the node
+	maintenance map[netip.Addr]maintenance
+	// drainChecker finds out whether draining nodes still serve clients, checked every drainCheckInterval. Protected
+	// by globalLock
+	drainChecker       DrainChecker
+	drainCheckInterval time.Duration
 
 	// globalLock is used to prevent race conditions when writing to the node registry. In theory, this lock is
 	// not required given that the nodeKey + the nature of gRPC connections makes it impossible for a node struct to
@@ -28,55 +132,420 @@ type NodeRegistry struct {
 	// and replaced with a more fine-grained lock (that still, would not be needed at all in theory).
 	globalLock sync.RWMutex
 
+	// listeners are notified when the set of nodes eligible for routing changes. notifyLock serializes the
+	// notifications so that listeners always receive the latest set last
+	listeners  []EligibilityListener
+	notifyLock sync.Mutex
+
+	// health contains the health parameters in effect, updated on configuration reloads. Protected by globalLock
+	health lbConfig.NodeHealth
+
+	// events contains the latest transitions of the nodes, streamed to the consumers of the API
+	events *eventLog
+
+	metrics *registryMetrics
+
+	cfg    *lbConfig.Config
 	logger *logrus.Logger
 }
 
-func New(logger *logrus.Logger) *NodeRegistry {
+func New(cfg *lbConfig.Config) *NodeRegistry {
 	return &NodeRegistry{
-		registry:  map[string]*node{},
-		blackList: map[string]time.Time{},
-		logger:    logger,
+		registry:           map[string]*node{},
+		blackList:          map[netip.Addr]time.Time{},
+		failures:           map[netip.Addr]int{},
+		maintenance:        map[netip.Addr]maintenance{},
+		drainCheckInterval: DrainCheckInterval,
+		health:             cfg.NodeHealth,
+		events:             newEventLog(),
+		metrics:            newRegistryMetrics(),
+		cfg:                cfg,
+		logger:             cfg.Logger,
 	}
 }
 
-// RegisterNode adds a node to the registry
-func (n *NodeRegistry) RegisterNode(nodeKey string) {
+// Subscribe registers a listener that will be notified each time that the set of nodes eligible for routing changes
+func (n *NodeRegistry) Subscribe(listener EligibilityListener) {
+	n.notifyLock.Lock()
+	defer n.notifyLock.Unlock()
+
+	n.listeners = append(n.listeners, listener)
+}
+
+// ApplyConfig applies the health parameters of a reloaded configuration. Nodes become eligible or ineligible right
+// away if the number of health checks required before routing changed
+func (n *NodeRegistry) ApplyConfig(cfg *lbConfig.Config) {
 	n.globalLock.Lock()
-	defer n.globalLock.Unlock()
 
-	if _, ok := n.registry[nodeKey]; !ok {
-		n.registry[nodeKey] = &node{}
+	previous := map[string]bool{}
+	for nodeKey, nodeInfo := range n.registry {
+		previous[nodeKey] = n.isEligible(nodeInfo)
+	}
+
+	n.health = cfg.NodeHealth
+
+	changed := false
+	for _, nodeKey := range slices.Sorted(maps.Keys(previous)) {
+		nodeInfo := n.registry[nodeKey]
+		eligible := n.isEligible(nodeInfo)
+		n.emitEligibility(nodeKey, nodeInfo.addr.Addr(), previous[nodeKey], eligible)
+		changed = changed || previous[nodeKey] != eligible
+	}
+	n.globalLock.Unlock()
+
+	if changed {
+		n.notifyEligibilityChange(context.Background())
+	}
+}
+
+// WatchEvents returns a watcher of the transitions of the nodes, starting right after the event identified by the
+// resume token. If the token is empty, the watcher starts with the next event emitted
+func (n *NodeRegistry) WatchEvents(resumeToken string) (*EventWatcher, error) {
+	return n.events.watch(resumeToken)
+}
+
+// RegisterNode adds a node to the registry along with the metadata announced by it, replacing the previous connection of
+// the node if any. Returns the session of the connection, or an error if the node is blacklisted
+func (n *NodeRegistry) RegisterNode(ctx context.Context, nodeKey string, addr netip.AddrPort, mac string, metadata Metadata) (*Session, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "registry.RegisterNode", trace.WithAttributes(
+		attribute.String(tracing.AttrNodeID, nodeKey),
+		attribute.String(tracing.AttrNodeAddr, addr.String()),
+	))
+	defer span.End()
+
+	n.globalLock.Lock()
+
+	if expiry, banned := n.blackList[addr.Addr()]; banned {
+		if time.Now().Before(expiry) {
+			n.globalLock.Unlock()
+			err := fmt.Errorf("%w: %s until %s", ErrNodeBlacklisted, addr.Addr(), expiry.Format(time.RFC3339))
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+
+		delete(n.blackList, addr.Addr())
+		n.events.emit(EventUnbanned, nodeKey, addr.Addr())
+	}
+
+	// The previous connection of the node is closed, the node starts over with the new one
+	wasEligible := false
+	if previous, ok := n.registry[nodeKey]; ok {
+		n.logger.Infof("node %s reconnected from %s, replacing connection from %s", nodeKey, addr, previous.addr)
+		wasEligible = n.isEligible(previous)
+		close(previous.session.closed)
 	}
+
+	nodeInfo := &node{
+		addr:     addr,
+		mac:      mac,
+		session:  &Session{Key: nodeKey, closed: make(chan struct{})},
+		metadata: metadata,
+	}
+	n.registry[nodeKey] = nodeInfo
+	n.events.emit(EventRegistered, nodeKey, addr.Addr())
+
+	// Nodes can be eligible right away if no health checks are required before routing
+	changed := wasEligible || n.isEligible(nodeInfo)
+	n.emitEligibility(nodeKey, addr.Addr(), wasEligible, n.isEligible(nodeInfo))
+	n.globalLock.Unlock()
+
+	if changed {
+		n.notifyEligibilityChange(ctx)
+	}
+
+	return nodeInfo.session, nil
 }
 
-// ReportNewHealthCheck updates the last health check time for a node. Updates info such as todo()
-func (n *NodeRegistry) ReportNewHealthCheck(nodeKey string) {
+// ReportNewHealthCheck updates the last health check time for a node along with the metrics reported by it
+func (n *NodeRegistry) ReportNewHealthCheck(ctx context.Context, session *Session, metrics map[string]float64) {
 	n.globalLock.Lock()
-	defer n.globalLock.Unlock()
 
-	nodeInfo, ok := n.registry[nodeKey]
+	nodeKey := session.Key
+	nodeInfo, ok := n.lookupSession(session)
 	if !ok {
-		// This case should never happen as we are only calling this function after checking if the node is present
-		n.logger.Errorf("unable to load node %s from registry ", nodeKey)
+		n.globalLock.Unlock()
 		return
 	}
 
-	nodeInfo.lastHealthCheck = time.Now()
+	wasEligible := n.isEligible(nodeInfo)
+
+	now := time.Now()
+	if !nodeInfo.lastHealthCheck.IsZero() {
+		n.metrics.healthCheckInterval.Observe(now.Sub(nodeInfo.lastHealthCheck).Seconds())
+	}
+
+	nodeInfo.lastHealthCheck = now
 	nodeInfo.continuousHealthChecks++
+	nodeInfo.metrics = maps.Clone(metrics)
+
+	changed := wasEligible != n.isEligible(nodeInfo)
+	n.emitEligibility(nodeKey, nodeInfo.addr.Addr(), wasEligible, n.isEligible(nodeInfo))
+	n.globalLock.Unlock()
+
+	if changed {
+		n.logger.Infof("node %s is eligible for routing", nodeKey)
+		n.notifyEligibilityChange(ctx)
+	}
 }
 
-func (n *NodeRegistry) ReportNodeFailure(nodeKey string) {
+// ReportNodeFailure resets the health checks of the node. Nodes taken out of the routing by failures more times than
+// allowed by the black list threshold are removed from the registry and their IP is blacklisted
+func (n *NodeRegistry) ReportNodeFailure(ctx context.Context, session *Session) {
 	n.globalLock.Lock()
-	defer n.globalLock.Unlock()
 
+	nodeKey := session.Key
 	n.logger.Debugf("node %s failed to report health check", nodeKey)
 
-	nodeInfo, ok := n.registry[nodeKey]
+	nodeInfo, ok := n.lookupSession(session)
 	if !ok {
-		// This case should never happen as we are only calling this function after checking if the node is present
-		n.logger.Errorf("unable to load node %s from registry ", nodeKey)
+		n.globalLock.Unlock()
 		return
 	}
 
+	addr := nodeInfo.addr.Addr()
+	wasEligible := n.isEligible(nodeInfo)
+
+	n.metrics.healthCheckFailures.Inc()
 	nodeInfo.continuousHealthChecks = 0
+
+	changed := wasEligible != n.isEligible(nodeInfo)
+	n.emitEligibility(nodeKey, addr, wasEligible, n.isEligible(nodeInfo))
+
+	// The threshold is read while holding the lock, as reloads replace it
+	blacklisted := changed && n.countFailure(addr)
+	afterFails := n.health.BlackListAfterFails
+	if blacklisted {
+		n.removeAddr(addr)
+		n.blacklist(nodeKey, addr)
+	}
+	n.globalLock.Unlock()
+
+	if blacklisted {
+		n.logger.Warnf("node %s blacklisted after failing %d times", addr, afterFails)
+	}
+
+	if changed {
+		n.logger.Infof("node %s is no longer eligible for routing", nodeKey)
+		n.notifyEligibilityChange(ctx)
+	}
+}
+
+// UnregisterNode removes the node from the registry once its session ends (ex: the connection has been lost or the
+// node timed out). Sessions already replaced by a newer connection or evicted are ignored
+func (n *NodeRegistry) UnregisterNode(ctx context.Context, session *Session) {
+	n.globalLock.Lock()
+
+	nodeInfo, ok := n.lookupSession(session)
+	if !ok {
+		n.globalLock.Unlock()
+		return
+	}
+
+	addr := nodeInfo.addr.Addr()
+	wasEligible := n.isEligible(nodeInfo)
+
+	close(nodeInfo.session.closed)
+	delete(n.registry, session.Key)
+	n.emitEligibility(session.Key, addr, wasEligible, false)
+	n.events.emit(EventRemoved, session.Key, addr)
+	n.globalLock.Unlock()
+
+	n.logger.Infof("node %s unregistered, session ended", session.Key)
+
+	if wasEligible {
+		n.notifyEligibilityChange(ctx)
+	}
+}
+
+// EligibleNodes returns the addresses of the nodes eligible for routing. Nodes with more than one connection to the
+// load balancer are only returned once
+func (n *NodeRegistry) EligibleNodes() []netip.Addr {
+	n.globalLock.RLock()
+	defer n.globalLock.RUnlock()
+
+	unique := map[netip.Addr]struct{}{}
+	eligible := []netip.Addr{}
+	for _, nodeInfo := range n.registry {
+		if !n.isEligible(nodeInfo) {
+			continue
+		}
+
+		addr := nodeInfo.addr.Addr()
+		if _, ok := unique[addr]; ok {
+			continue
+		}
+
+		unique[addr] = struct{}{}
+		eligible = append(eligible, addr)
+	}
+
+	return eligible
+}
+
+// Nodes returns a snapshot of all the nodes in the registry sorted by ID
+func (n *NodeRegistry) Nodes() []NodeInfo {
+	n.globalLock.RLock()
+	defer n.globalLock.RUnlock()
+
+	now := time.Now()
+	nodes := make([]NodeInfo, 0, len(n.registry))
+	for _, nodeKey := range slices.Sorted(maps.Keys(n.registry)) {
+		nodes = append(nodes, n.nodeInfo(nodeKey, now))
+	}
+
+	return nodes
+}
+
+// Node returns a snapshot of the node identified by nodeKey
+func (n *NodeRegistry) Node(nodeKey string) (NodeInfo, error) {
+	n.globalLock.RLock()
+	defer n.globalLock.RUnlock()
+
+	if _, ok := n.registry[nodeKey]; !ok {
+		return NodeInfo{}, fmt.Errorf("%w: %s", ErrNodeNotFound, nodeKey)
+	}
+
+	return n.nodeInfo(nodeKey, time.Now()), nil
+}
+
+// countFailure counts a node taken out of the routing because of failed health checks. Returns whether the node IP
+// must be blacklisted, must be called with the lock held
+func (n *NodeRegistry) countFailure(addr netip.Addr) bool {
+	if n.health.BlackListAfterFails == lbConfig.BlackListDisabled {
+		return false
+	}
+
+	n.failures[addr]++
+	if n.failures[addr] < max(n.health.BlackListAfterFails, 1) {
+		return false
+	}
+
+	delete(n.failures, addr)
+	return true
+}
+
+// removeAddr removes all the connections of the node IP from the registry, closing their sessions, must be called with
+// the lock held
+func (n *NodeRegistry) removeAddr(addr netip.Addr) {
+	eligibility := n.eligibilityByAddr(addr)
+	for _, key := range slices.Sorted(maps.Keys(eligibility)) {
+		close(n.registry[key].session.closed)
+		delete(n.registry, key)
+
+		n.emitEligibility(key, addr, eligibility[key], false)
+		n.events.emit(EventRemoved, key, addr)
+	}
+
+	delete(n.maintenance, addr)
+}
+
+// blacklist bans the node IP during the blacklist expiry, must be called with the lock held
+func (n *NodeRegistry) blacklist(nodeKey string, addr netip.Addr) {
+	n.blackList[addr] = time.Now().Add(n.health.BlackListExpiry)
+	n.events.emit(EventBlacklisted, nodeKey, addr)
+}
+
+// nodeInfo builds the snapshot of a node, must be called with the lock held
+func (n *NodeRegistry) nodeInfo(nodeKey string, now time.Time) NodeInfo {
+	nodeInfo := n.registry[nodeKey]
+
+	info := NodeInfo{
+		ID:                     nodeKey,
+		Addr:                   nodeInfo.addr,
+		MAC:                    nodeInfo.mac,
+		ContinuousHealthChecks: nodeInfo.continuousHealthChecks,
+		LastHealthCheck:        nodeInfo.lastHealthCheck,
+		Eligible:               n.isEligible(nodeInfo),
+		Metrics:                maps.Clone(nodeInfo.metrics),
+		Metadata:               nodeInfo.metadata,
+	}
+	info.Metadata.Labels = maps.Clone(nodeInfo.metadata.Labels)
+	info.Metadata.Capabilities = slices.Clone(nodeInfo.metadata.Capabilities)
+
+	if state, ok := n.maintenance[nodeInfo.addr.Addr()]; ok {
+		info.Cordoned = true
+		info.Draining = state.draining
+		info.DrainingSince = state.since
+		info.Drained = state.drained
+	}
+
+	if expiry, ok := n.blackList[nodeInfo.addr.Addr()]; ok && now.Before(expiry) {
+		info.Blacklisted = true
+		info.BlacklistExpiry = expiry
+	}
+
+	return info
+}
+
+// lookupSession returns the node registered by the session, must be called with the lock held. Sessions replaced by
+// a newer connection or evicted are ignored
+func (n *NodeRegistry) lookupSession(session *Session) (*node, bool) {
+	nodeInfo, ok := n.registry[session.Key]
+	if !ok || nodeInfo.session != session {
+		n.logger.Debugf("ignoring report from closed session of node %s", session.Key)
+		return nil, false
+	}
+
+	return nodeInfo, true
+}
+
+// isEligible returns whether the node has passed enough continuous health checks to receive traffic and has not been
+// taken out of the routing by an operator
+func (n *NodeRegistry) isEligible(nodeInfo *node) bool {
+	if _, ok := n.maintenance[nodeInfo.addr.Addr()]; ok {
+		return false
+	}
+
+	return nodeInfo.addr.IsValid() && nodeInfo.continuousHealthChecks >= n.health.ChecksBeforeRouting
+}
+
+// eligibilityByAddr returns whether each of the connections of the node IP is eligible for routing, must be called
+// with the lock held
+func (n *NodeRegistry) eligibilityByAddr(addr netip.Addr) map[string]bool {
+	eligibility := map[string]bool{}
+	for nodeKey, nodeInfo := range n.registry {
+		if nodeInfo.addr.Addr() == addr {
+			eligibility[nodeKey] = n.isEligible(nodeInfo)
+		}
+	}
+
+	return eligibility
+}
+
+// emitEligibilityChanges emits the eligibility events of the connections of the node IP whose eligibility differs
+// from the previous snapshot, must be called with the lock held
+func (n *NodeRegistry) emitEligibilityChanges(addr netip.Addr, previous map[string]bool) {
+	for _, nodeKey := range slices.Sorted(maps.Keys(previous)) {
+		if nodeInfo, ok := n.registry[nodeKey]; ok {
+			n.emitEligibility(nodeKey, addr, previous[nodeKey], n.isEligible(nodeInfo))
+		}
+	}
+}
+
+// emitEligibility emits the eligibility event of the node if it changed, must be called with the lock held
+func (n *NodeRegistry) emitEligibility(nodeKey string, addr netip.Addr, wasEligible, eligible bool) {
+	switch {
+	case !wasEligible && eligible:
+		n.events.emit(EventEligible, nodeKey, addr)
+	case wasEligible && !eligible:
+		n.events.emit(EventIneligible, nodeKey, addr)
+	}
+}
+
+// notifyEligibilityChange notifies the listeners with the latest set of nodes eligible for routing
+func (n *NodeRegistry) notifyEligibilityChange(ctx context.Context) {
+	n.notifyLock.Lock()
+	defer n.notifyLock.Unlock()
+
+	// The set is retrieved after acquiring the lock, so that concurrent notifications never deliver an older set last
+	eligible := n.EligibleNodes()
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "registry.EligibilityChange", trace.WithAttributes(
+		attribute.Int(tracing.AttrEligible, len(eligible)),
+	))
+	defer span.End()
+
+	for _, listener := range n.listeners {
+		listener(ctx, eligible)
+	}
 }
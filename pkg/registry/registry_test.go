@@ -0,0 +1,194 @@
+package registry
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	lbConfig "github.com/yago-123/galelb/config/lb"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRegistry_reconnectReplacesSession(t *testing.T) {
+	nodeRegistry := New(&lbConfig.Config{
+		NodeHealth: lbConfig.NodeHealth{ChecksBeforeRouting: 1},
+		Logger:     logrus.New(),
+	})
+
+	previous, err := nodeRegistry.RegisterNode(context.Background(), "node-0", netip.MustParseAddrPort("10.0.0.1:4000"), "", Metadata{})
+	if err != nil {
+		t.Fatalf("failed to register node: %v", err)
+	}
+	nodeRegistry.ReportNewHealthCheck(context.Background(), previous, nil)
+
+	// The node reconnects from another port, the previous session ends
+	current, err := nodeRegistry.RegisterNode(context.Background(), "node-0", netip.MustParseAddrPort("10.0.0.1:4001"), "", Metadata{})
+	if err != nil {
+		t.Fatalf("failed to register node: %v", err)
+	}
+
+	select {
+	case <-previous.Closed():
+	default:
+		t.Fatalf("expected previous session to be closed")
+	}
+
+	nodeRegistry.ReportNewHealthCheck(context.Background(), current, nil)
+	if eligible := nodeRegistry.EligibleNodes(); len(eligible) != 1 {
+		t.Fatalf("expected node to be eligible, got %v", eligible)
+	}
+
+	// Reports from the previous connection do not affect the current one
+	nodeRegistry.ReportNodeFailure(context.Background(), previous)
+	if eligible := nodeRegistry.EligibleNodes(); len(eligible) != 1 {
+		t.Fatalf("expected stale failure to be ignored, got %v", eligible)
+	}
+
+	info, err := nodeRegistry.Node("node-0")
+	if err != nil {
+		t.Fatalf("failed to get node: %v", err)
+	}
+	if info.Addr.Port() != 4001 {
+		t.Fatalf("expected address of current connection, got %s", info.Addr)
+	}
+}
+
+func TestRegistry_drainVersusCordon(t *testing.T) {
+	nodeRegistry := New(&lbConfig.Config{
+		NodeHealth: lbConfig.NodeHealth{ChecksBeforeRouting: 1},
+		Logger:     logrus.New(),
+	})
+	nodeRegistry.drainCheckInterval = 10 * time.Millisecond
+
+	// The node being drained serves clients until told otherwise, the cordoned one always does
+	var serving atomic.Bool
+	serving.Store(true)
+	nodeRegistry.SetDrainChecker(func(_ context.Context, addr netip.Addr) (bool, error) {
+		return addr == netip.MustParseAddr("10.0.0.2") || serving.Load(), nil
+	})
+
+	for _, nodeKey := range []string{"10.0.0.1:4000", "10.0.0.2:4000"} {
+		session, err := nodeRegistry.RegisterNode(context.Background(), nodeKey, netip.MustParseAddrPort(nodeKey), "", Metadata{})
+		if err != nil {
+			t.Fatalf("failed to register node: %v", err)
+		}
+		nodeRegistry.ReportNewHealthCheck(context.Background(), session, nil)
+	}
+
+	watcher, err := nodeRegistry.WatchEvents("")
+	if err != nil {
+		t.Fatalf("failed to watch events: %v", err)
+	}
+
+	if err = nodeRegistry.DrainNode(context.Background(), "10.0.0.1:4000"); err != nil {
+		t.Fatalf("failed to drain node: %v", err)
+	}
+	if err = nodeRegistry.CordonNode(context.Background(), "10.0.0.2:4000"); err != nil {
+		t.Fatalf("failed to cordon node: %v", err)
+	}
+
+	// Neither node receives new clients
+	if eligible := nodeRegistry.EligibleNodes(); len(eligible) != 0 {
+		t.Fatalf("expected no eligible nodes, got %v", eligible)
+	}
+
+	// The drain does not complete while clients are left
+	time.Sleep(5 * nodeRegistry.drainCheckInterval)
+	if info, _ := nodeRegistry.Node("10.0.0.1:4000"); !info.Draining || info.Drained {
+		t.Fatalf("expected node to be draining while serving clients, got %+v", info)
+	}
+
+	serving.Store(false)
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, _ := nodeRegistry.Node("10.0.0.1:4000")
+		if info.Drained {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected node to be drained once no clients are left, got %+v", info)
+		}
+		time.Sleep(nodeRegistry.drainCheckInterval)
+	}
+
+	// Cordoned nodes are never drained, regardless of their clients
+	if info, _ := nodeRegistry.Node("10.0.0.2:4000"); !info.Cordoned || info.Draining || info.Drained {
+		t.Fatalf("expected node to stay cordoned, got %+v", info)
+	}
+
+	events, err := watcher.Next(context.Background())
+	if err != nil {
+		t.Fatalf("failed to watch events: %v", err)
+	}
+	drained := []string{}
+	for _, event := range events {
+		if event.Type == EventDrained {
+			drained = append(drained, event.NodeID)
+		}
+	}
+	if len(drained) != 1 || drained[0] != "10.0.0.1:4000" {
+		t.Fatalf("expected a single drained event of the drained node, got %v", events)
+	}
+
+	// Uncordoned nodes receive new clients again
+	if err = nodeRegistry.UncordonNode(context.Background(), "10.0.0.1:4000"); err != nil {
+		t.Fatalf("failed to uncordon node: %v", err)
+	}
+	if eligible := nodeRegistry.EligibleNodes(); len(eligible) != 1 {
+		t.Fatalf("expected drained node to be eligible once uncordoned, got %v", eligible)
+	}
+}
+
+func TestRegistry_spans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+
+	nodeRegistry := New(&lbConfig.Config{
+		NodeHealth: lbConfig.NodeHealth{ChecksBeforeRouting: 1},
+		Logger:     logrus.New(),
+	})
+
+	// The listeners continue the trace of the eligibility change
+	var listenerSpan trace.SpanContext
+	nodeRegistry.Subscribe(func(ctx context.Context, _ []netip.Addr) {
+		listenerSpan = trace.SpanContextFromContext(ctx)
+	})
+
+	ctx, report := provider.Tracer("test").Start(context.Background(), "report")
+	session, err := nodeRegistry.RegisterNode(ctx, "node-0", netip.MustParseAddrPort("10.0.0.1:4000"), "", Metadata{})
+	if err != nil {
+		t.Fatalf("failed to register node: %v", err)
+	}
+	nodeRegistry.ReportNewHealthCheck(ctx, session, nil)
+	report.End()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	for _, name := range []string{"registry.RegisterNode", "registry.EligibilityChange"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("expected span %s, got %v", name, spans)
+		}
+		if span.Parent().SpanID() != report.SpanContext().SpanID() {
+			t.Fatalf("expected span %s to be a child of the report, got parent %v", name, span.Parent())
+		}
+	}
+
+	if listenerSpan.SpanID() != spans["registry.EligibilityChange"].SpanContext().SpanID() {
+		t.Fatalf("expected listeners to be notified within the eligibility change span")
+	}
+}
@@ -0,0 +1,140 @@
+package routing
+
+/*
+#cgo CFLAGS: -I./pkg/routing
+#include "constants.h"
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	lbConfig "github.com/yago-123/galelb/config/lb"
+)
+
+const (
+	MaxServices = C.MAX_NUMBER_SERVICES
+
+	sourceSubnetMask = C.AFFINITY_SOURCE_SUBNET_MASK
+
+	conntrackIdleTimeoutNs    = C.CONNTRACK_IDLE_TIMEOUT_NS
+	conntrackClosingTimeoutNs = C.CONNTRACK_CLOSING_TIMEOUT_NS
+
+	NumberStats = C.NUMBER_STATS
+)
+
+// Indexes of the datapath counters
+const (
+	statsIngressRouted    = C.STATS_INGRESS_ROUTED
+	statsIngressIgnored   = C.STATS_INGRESS_IGNORED
+	statsAffinityHits     = C.STATS_AFFINITY_HITS
+	statsAffinityMisses   = C.STATS_AFFINITY_MISSES
+	statsEgressRestored   = C.STATS_EGRESS_RESTORED
+	statsIngressNoBackend = C.STATS_INGRESS_NO_BACKEND
+	statsConntrackHits    = C.STATS_CONNTRACK_HITS
+)
+
+// AffinityPolicy defines which part of the client connection is used as key for selecting the backend
+type AffinityPolicy uint32
+
+const (
+	// AffinityNone selects the backend per connection, clients are not kept on the same backend across reconnects
+	AffinityNone AffinityPolicy = C.AFFINITY_NONE
+	// AffinitySourceIP keeps all the connections from the same source IP on the same backend
+	AffinitySourceIP AffinityPolicy = C.AFFINITY_SOURCE_IP
+	// AffinitySourceIPPort keeps all the connections from the same source IP and port on the same backend
+	AffinitySourceIPPort AffinityPolicy = C.AFFINITY_SOURCE_IP_PORT
+	// AffinitySourceSubnet keeps all the connections from the same source /24 subnet on the same backend
+	AffinitySourceSubnet AffinityPolicy = C.AFFINITY_SOURCE_SUBNET
+)
+
+const (
+	AffinityNoneName         = lbConfig.AffinityNone
+	AffinitySourceIPName     = lbConfig.AffinitySourceIP
+	AffinitySourceIPPortName = lbConfig.AffinitySourceIPPort
+	AffinitySourceSubnetName = lbConfig.AffinitySourceSubnet
+)
+
+// ParseAffinityPolicy converts the name of the policy used in the configuration into an AffinityPolicy
+func ParseAffinityPolicy(name string) (AffinityPolicy, error) {
+	switch name {
+	case AffinityNoneName:
+		return AffinityNone, nil
+	case AffinitySourceIPName:
+		return AffinitySourceIP, nil
+	case AffinitySourceIPPortName:
+		return AffinitySourceIPPort, nil
+	case AffinitySourceSubnetName:
+		return AffinitySourceSubnet, nil
+	default:
+		return AffinityNone, fmt.Errorf("unknown affinity policy %q", name)
+	}
+}
+
+func (p AffinityPolicy) String() string {
+	switch p {
+	case AffinityNone:
+		return AffinityNoneName
+	case AffinitySourceIP:
+		return AffinitySourceIPName
+	case AffinitySourceIPPort:
+		return AffinitySourceIPPortName
+	case AffinitySourceSubnet:
+		return AffinitySourceSubnetName
+	default:
+		return "unknown"
+	}
+}
+
+// Flow identifies a client connection towards one of the services of the load balancer
+type Flow struct {
+	SrcIP       netip.Addr
+	SrcPort     uint16
+	ServicePort uint16
+}
+
+// affinityKey identifies a client according to the affinity policy of the service. Fields not used by the policy are
+// left to zero. Fields are stored in network byte order (must match C struct)
+type affinityKey struct {
+	SrcIP       uint32
+	SrcPort     uint16
+	ServicePort uint16
+}
+
+// newAffinityKey derives the affinity key of the flow according to the policy
+func newAffinityKey(policy AffinityPolicy, flow Flow) affinityKey {
+	key := affinityKey{
+		ServicePort: networkOrder16(flow.ServicePort),
+	}
+
+	ip := flow.SrcIP.As4()
+	switch policy {
+	case AffinityNone, AffinitySourceIPPort:
+		key.SrcIP = binary.NativeEndian.Uint32(ip[:])
+		key.SrcPort = networkOrder16(flow.SrcPort)
+	case AffinitySourceIP:
+		key.SrcIP = binary.NativeEndian.Uint32(ip[:])
+	case AffinitySourceSubnet:
+		binary.BigEndian.PutUint32(ip[:], binary.BigEndian.Uint32(ip[:])&sourceSubnetMask)
+		key.SrcIP = binary.NativeEndian.Uint32(ip[:])
+	}
+
+	return key
+}
+
+// bytes serializes the key so that it can be hashed into the ring
+func (k affinityKey) bytes() []byte {
+	buf := make([]byte, 0, 8) //nolint:mnd // size of the struct
+	buf = binary.NativeEndian.AppendUint32(buf, k.SrcIP)
+	buf = binary.NativeEndian.AppendUint16(buf, k.SrcPort)
+	buf = binary.NativeEndian.AppendUint16(buf, k.ServicePort)
+	return buf
+}
+
+// networkOrder16 returns the value that, once stored in memory, contains v in network byte order
+func networkOrder16(v uint16) uint16 {
+	buf := binary.BigEndian.AppendUint16(nil, v)
+	return binary.NativeEndian.Uint16(buf)
+}
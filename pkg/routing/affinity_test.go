@@ -0,0 +1,60 @@
+package routing
+
+import (
+	"net/netip"
+	"testing"
+
+	lbConfig "github.com/yago-123/galelb/config/lb"
+)
+
+func TestAffinity_maxServices(t *testing.T) {
+	if MaxServices != lbConfig.MaxServices {
+		t.Fatalf("expected configuration bound %d to match the datapath one %d", lbConfig.MaxServices, MaxServices)
+	}
+}
+
+func TestAffinity_parsePolicy(t *testing.T) {
+	for _, policy := range []AffinityPolicy{AffinityNone, AffinitySourceIP, AffinitySourceIPPort, AffinitySourceSubnet} {
+		parsed, err := ParseAffinityPolicy(policy.String())
+		if err != nil {
+			t.Fatalf("failed to parse policy %s: %v", policy, err)
+		}
+		if parsed != policy {
+			t.Fatalf("expected policy %s, got %s", policy, parsed)
+		}
+	}
+
+	if _, err := ParseAffinityPolicy("round_robin"); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+}
+
+func TestAffinity_keys(t *testing.T) {
+	flow := Flow{SrcIP: netip.MustParseAddr("10.1.2.3"), SrcPort: 40000, ServicePort: 8080}
+
+	tests := []struct {
+		name string
+		// other flow that must share (or not) the key with flow
+		other    Flow
+		policy   AffinityPolicy
+		expected bool
+	}{
+		{"same ip different port with source ip", Flow{netip.MustParseAddr("10.1.2.3"), 40001, 8080}, AffinitySourceIP, true},
+		{"different ip with source ip", Flow{netip.MustParseAddr("10.1.2.4"), 40000, 8080}, AffinitySourceIP, false},
+		{"same ip different port with source ip port", Flow{netip.MustParseAddr("10.1.2.3"), 40001, 8080}, AffinitySourceIPPort, false},
+		{"same ip and port with source ip port", Flow{netip.MustParseAddr("10.1.2.3"), 40000, 8080}, AffinitySourceIPPort, true},
+		{"same subnet with source subnet", Flow{netip.MustParseAddr("10.1.2.200"), 40001, 8080}, AffinitySourceSubnet, true},
+		{"different subnet with source subnet", Flow{netip.MustParseAddr("10.1.3.3"), 40000, 8080}, AffinitySourceSubnet, false},
+		{"different port with none", Flow{netip.MustParseAddr("10.1.2.3"), 40001, 8080}, AffinityNone, false},
+		{"different service with source ip", Flow{netip.MustParseAddr("10.1.2.3"), 40000, 9090}, AffinitySourceIP, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			equal := newAffinityKey(tt.policy, flow) == newAffinityKey(tt.policy, tt.other)
+			if equal != tt.expected {
+				t.Fatalf("expected keys to be equal: %t, got %t", tt.expected, equal)
+			}
+		})
+	}
+}
@@ -2,6 +2,37 @@
 #define CONSTANTS_H
 
 #define MAX_NUMBER_VIRTUAL_NODE_ENTRIES 8192
+// Number of steps of the binary search over the ring of a service, log2(MAX_NUMBER_VIRTUAL_NODE_ENTRIES) + 1
+#define RING_SEARCH_STEPS               14
+// Each service has two sets of ring entries, user space fills the inactive one and then flips the generation so that
+// the datapath never reads a ring that is half written
+#define NUMBER_RING_GENERATIONS         2
 
-#endif // CONSTANTS_H
+#define MAX_NUMBER_SERVICES          64
+#define MAX_NUMBER_AFFINITY_ENTRIES  65536
+
+// Affinity policies, define which part of the client connection is used as key for selecting the backend
+#define AFFINITY_NONE           0 // per connection, clients are not kept on the same backend across reconnects
+#define AFFINITY_SOURCE_IP      1 // source IP
+#define AFFINITY_SOURCE_IP_PORT 2 // source IP + source port
+#define AFFINITY_SOURCE_SUBNET  3 // source /24 subnet
+
+#define AFFINITY_SOURCE_SUBNET_MASK 0xFFFFFF00
+
+// Tracked connections keep their backend while idle for less than the timeout, once closed (FIN or RST) for less
+// than the closing timeout
+#define CONNTRACK_IDLE_TIMEOUT_NS    300000000000ULL // 5 minutes
+#define CONNTRACK_CLOSING_TIMEOUT_NS 10000000000ULL  // 10 seconds
 
+// Datapath counters, indexes of stats_map
+#define STATS_INGRESS_ROUTED     0 // client packets addressed to a service and routed to a backend
+#define STATS_INGRESS_IGNORED    1 // client packets not addressed to any service
+#define STATS_AFFINITY_HITS      2 // clients kept on their backend by the affinity table
+#define STATS_AFFINITY_MISSES    3 // clients without a live entry in the affinity table
+#define STATS_EGRESS_RESTORED    4 // backend replies whose destination has been restored to the client
+#define STATS_INGRESS_NO_BACKEND 5 // client packets dropped because the ring of the service is empty
+#define STATS_CONNTRACK_HITS     6 // client packets routed to the backend of their tracked connection
+
+#define NUMBER_STATS 7
+
+#endif // CONSTANTS_H
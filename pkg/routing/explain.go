@@ -0,0 +1,139 @@
+package routing
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+
+	"github.com/yago-123/galelb/pkg/common"
+)
+
+// Explanation describes how a flow is routed, intended for debugging the placement of clients
+type Explanation struct {
+	ServiceName string
+	ServicePort uint16
+	Affinity    AffinityPolicy
+
+	// KeyHash is the hash of the affinity key of the flow, RingIndex the position of the virtual node that owns it
+	// and VirtualNodeHash the hash of that virtual node
+	KeyHash         uint32
+	RingIndex       int
+	VirtualNodeHash uint32
+
+	// RingNode is the node selected by the ring and Fallbacks the nodes that would be selected (in order) if it left.
+	// RingEmpty is set when the ring has no nodes, in which case the flow is only routed by the datapath tables
+	RingNode  common.AddrKey
+	Fallbacks []common.AddrKey
+	RingEmpty bool
+
+	// AffinityOverride is set when a live entry in the affinity table of the datapath overrides the ring selection,
+	// in which case the client is routed to AffinityNode
+	AffinityOverride bool
+	AffinityNode     common.AddrKey
+
+	// ConntrackOverride is set when the connection is live in the conntrack table of the datapath, in which case it
+	// keeps being routed to ConntrackNode. Takes precedence over the ring and the affinity table, as the datapath
+	// only reads them for new connections
+	ConntrackOverride bool
+	ConntrackNode     common.AddrKey
+
+	// Node is the node that will finally serve the flow
+	Node common.AddrKey
+}
+
+// Explain returns how the flow is routed, including up to maxFallbacks alternative nodes. The node is read from the
+// conntrack and affinity tables of the datapath when they contain the flow, and calculated from the ring otherwise.
+// Returns ErrRingEmpty only if neither the tables nor the ring route the flow
+func (r *Router) Explain(flow Flow, maxFallbacks int) (Explanation, error) {
+	svc, ok := r.service(flow.ServicePort)
+	if !ok {
+		return Explanation{}, fmt.Errorf("%w: no service listening on port %d", ErrUnknownService, flow.ServicePort)
+	}
+
+	explanation := Explanation{
+		ServiceName: svc.name,
+		ServicePort: svc.port,
+		Affinity:    svc.affinity,
+		Fallbacks:   []common.AddrKey{},
+	}
+
+	// The datapath tables are read first, as they keep routing the flow even if the ring of the service is empty
+	key := newAffinityKey(svc.affinity, flow)
+	if svc.affinity != AffinityNone && svc.affinityTimeout > 0 {
+		node, found, err := r.xdp.lookupAffinity(key, svc.affinityTimeout)
+		if err != nil {
+			return Explanation{}, err
+		}
+
+		explanation.AffinityOverride = found
+		explanation.AffinityNode = node
+	}
+
+	// The connections are tracked by the whole source address, regardless of the affinity policy
+	client := nodeKey(flow.SrcIP, flow.SrcPort)
+	backend, found, err := r.xdp.lookupConntrack(client.IP, client.Port, key.ServicePort)
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	if found {
+		explanation.ConntrackOverride = true
+		explanation.ConntrackNode = common.AddrKey{IP: backend, Port: key.ServicePort}
+	}
+
+	placement, err := svc.ring.locate(key.bytes(), maxFallbacks)
+	switch {
+	case err == nil:
+		explanation.KeyHash = placement.keyHash
+		explanation.RingIndex = placement.index
+		explanation.VirtualNodeHash = placement.virtualNodeHash
+		explanation.RingNode = placement.owner
+		explanation.Fallbacks = placement.fallbacks
+	case errors.Is(err, ErrRingEmpty) && (explanation.AffinityOverride || explanation.ConntrackOverride):
+		explanation.RingEmpty = true
+	default:
+		return Explanation{}, err
+	}
+
+	switch {
+	case explanation.ConntrackOverride:
+		explanation.Node = explanation.ConntrackNode
+	case explanation.AffinityOverride:
+		explanation.Node = explanation.AffinityNode
+	default:
+		explanation.Node = explanation.RingNode
+	}
+
+	return explanation, nil
+}
+
+// LookupServicePort returns the port of the service identified either by name or by port
+func (r *Router) LookupServicePort(service string) (uint16, error) {
+	if port, err := strconv.ParseUint(service, 10, 16); err == nil {
+		if _, ok := r.service(uint16(port)); ok {
+			return uint16(port), nil
+		}
+	}
+
+	r.servicesLock.RLock()
+	defer r.servicesLock.RUnlock()
+
+	for port, svc := range r.services {
+		if svc.name == service {
+			return port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrUnknownService, service)
+}
+
+// AddrKeyToAddrPort converts the datapath representation of a node (network byte order) into an address
+func AddrKeyToAddrPort(key common.AddrKey) netip.AddrPort {
+	var ip [4]byte
+	binary.NativeEndian.PutUint32(ip[:], key.IP)
+
+	// Converting to network byte order is its own inverse
+	return netip.AddrPortFrom(netip.AddrFrom4(ip), networkOrder16(key.Port))
+}
@@ -0,0 +1,119 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	lbConfig "github.com/yago-123/galelb/config/lb"
+)
+
+func TestRouter_explain(t *testing.T) {
+	services, err := parseServices([]lbConfig.Service{
+		{Name: "web", Port: 8080, Affinity: AffinitySourceIPName},
+		{Name: "api", Port: 9090, Affinity: AffinitySourceIPName},
+	}, testVirtualNodes)
+	if err != nil {
+		t.Fatalf("failed to parse services: %v", err)
+	}
+
+	// The datapath maps are not loaded, so flows are explained from the ring alone
+	router := &Router{
+		xdp:      newXDP(logrus.New(), "", "", 0),
+		services: services,
+		logger:   logrus.New(),
+	}
+
+	if err = router.syncService(context.Background(), services[8080], addrs("10.0.0.1", "10.0.0.2", "10.0.0.3")); err != nil {
+		t.Fatalf("failed to sync service: %v", err)
+	}
+
+	flow := Flow{SrcIP: netip.MustParseAddr("203.0.113.7"), SrcPort: 40000, ServicePort: 8080}
+	explanation, err := router.Explain(flow, 2)
+	if err != nil {
+		t.Fatalf("failed to explain flow: %v", err)
+	}
+
+	node, err := router.GetNode(flow)
+	if err != nil {
+		t.Fatalf("failed to get node: %v", err)
+	}
+
+	if explanation.ServiceName != "web" || explanation.Affinity != AffinitySourceIP {
+		t.Fatalf("unexpected service in explanation %+v", explanation)
+	}
+	if explanation.RingNode != node || explanation.Node != node || explanation.AffinityOverride || explanation.ConntrackOverride {
+		t.Fatalf("expected the flow to be routed by the ring to %v, got %+v", node, explanation)
+	}
+	if explanation.KeyHash != Crc32Hasher(newAffinityKey(AffinitySourceIP, flow).bytes()) {
+		t.Fatalf("expected the hash of the affinity key, got %d", explanation.KeyHash)
+	}
+
+	// Fallbacks are distinct nodes other than the one selected
+	if len(explanation.Fallbacks) != 2 || explanation.Fallbacks[0] == node || explanation.Fallbacks[1] == node || explanation.Fallbacks[0] == explanation.Fallbacks[1] {
+		t.Fatalf("expected 2 distinct fallbacks, got %v", explanation.Fallbacks)
+	}
+
+	// Clients from the same source IP are explained the same way, regardless of their port
+	flow.SrcPort = 40001
+	if other, _ := router.Explain(flow, 2); other.Node != node {
+		t.Fatalf("expected source IP affinity to keep the client on %v, got %v", node, other.Node)
+	}
+
+	if _, err = router.Explain(Flow{SrcIP: flow.SrcIP, SrcPort: 40000, ServicePort: 9090}, 2); !errors.Is(err, ErrRingEmpty) {
+		t.Fatalf("expected empty ring error, got %v", err)
+	}
+	if _, err = router.Explain(Flow{SrcIP: flow.SrcIP, SrcPort: 40000, ServicePort: 7070}, 2); !errors.Is(err, ErrUnknownService) {
+		t.Fatalf("expected unknown service error, got %v", err)
+	}
+
+	if port, errLookup := router.LookupServicePort("api"); errLookup != nil || port != 9090 {
+		t.Fatalf("expected api service on port 9090, got %d (%v)", port, errLookup)
+	}
+}
+
+func TestRouter_explainDatapath(t *testing.T) {
+	datapath, prog := loadTestDatapath(t)
+	ctx := context.Background()
+
+	services, err := parseServices([]lbConfig.Service{{Name: "web", Port: 8080, Affinity: AffinityNoneName}}, testVirtualNodes)
+	if err != nil {
+		t.Fatalf("failed to parse services: %v", err)
+	}
+	router := &Router{
+		xdp:      datapath,
+		services: services,
+		logger:   logrus.New(),
+	}
+	if err = datapath.updateServices(ctx, services); err != nil {
+		t.Fatalf("failed to update services: %v", err)
+	}
+	if err = router.syncService(ctx, services[8080], addrs("10.0.0.1")); err != nil {
+		t.Fatalf("failed to sync service: %v", err)
+	}
+
+	client, lb := netip.MustParseAddrPort("203.0.113.7:40000"), netip.MustParseAddrPort("192.168.0.242:8080")
+	routeTo(t, prog, tcpPacket(client, lb, 0x02))
+
+	// Open connections keep being routed by the conntrack table once the ring is empty
+	if err = router.syncService(ctx, services[8080], addrs()); err != nil {
+		t.Fatalf("failed to sync service: %v", err)
+	}
+
+	flow := Flow{SrcIP: client.Addr(), SrcPort: client.Port(), ServicePort: 8080}
+	explanation, err := router.Explain(flow, 2)
+	if err != nil {
+		t.Fatalf("failed to explain flow: %v", err)
+	}
+	if !explanation.RingEmpty || !explanation.ConntrackOverride || AddrKeyToAddrPort(explanation.Node).String() != "10.0.0.1:8080" {
+		t.Fatalf("expected open connection routed to 10.0.0.1:8080 by the conntrack table, got %+v", explanation)
+	}
+
+	// New connections are not routed by anything
+	flow.SrcPort++
+	if _, err = router.Explain(flow, 2); !errors.Is(err, ErrRingEmpty) {
+		t.Fatalf("expected empty ring error, got %v", err)
+	}
+}
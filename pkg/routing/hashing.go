@@ -2,8 +2,30 @@ package routing
 
 import "hash/crc32"
 
+const (
+	// Constants of the murmur3 finalizer
+	fmix32Shift1 = 16
+	fmix32Mult1  = 0x85ebca6b
+	fmix32Shift2 = 13
+	fmix32Mult2  = 0xc2b2ae35
+	fmix32Shift3 = 16
+)
+
 type Hasher func([]byte) uint32
 
+// Crc32Hasher hashes the key with CRC32 and spreads the result with the murmur3 finalizer. CRC32 alone is linear, so
+// keys that only differ in a few characters (such as the virtual nodes of the same node) end up clustered together in
+// the ring, which skews the distribution of the traffic
 func Crc32Hasher(key []byte) uint32 {
-	return crc32.ChecksumIEEE(key)
+	return fmix32(crc32.ChecksumIEEE(key))
+}
+
+// fmix32 is the finalizer of murmur3, forces all bits of the hash to avalanche
+func fmix32(h uint32) uint32 {
+	h ^= h >> fmix32Shift1
+	h *= fmix32Mult1
+	h ^= h >> fmix32Shift2
+	h *= fmix32Mult2
+	h ^= h >> fmix32Shift3
+	return h
 }
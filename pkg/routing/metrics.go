@@ -0,0 +1,110 @@
+package routing
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "galelb"
+)
+
+// datapathStats contains the names of the datapath counters, indexed as in the stats map of the datapath
+var datapathStats = [NumberStats]string{ //nolint:gochecknoglobals // mirrors the datapath constants
+	statsIngressRouted:    "ingress_routed",
+	statsIngressIgnored:   "ingress_ignored",
+	statsAffinityHits:     "affinity_hits",
+	statsAffinityMisses:   "affinity_misses",
+	statsEgressRestored:   "egress_restored",
+	statsIngressNoBackend: "ingress_no_backend",
+	statsConntrackHits:    "conntrack_hits",
+}
+
+// routerMetrics contains the metrics recorded while routing, safe to use on a nil receiver so that routers created
+// without metrics keep working
+type routerMetrics struct {
+	ringChanges  *prometheus.CounterVec
+	poolSwitches *prometheus.CounterVec
+
+	ringNodes *prometheus.Desc
+	datapath  *prometheus.Desc
+}
+
+func newRouterMetrics() *routerMetrics {
+	return &routerMetrics{
+		ringChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ring_membership_changes_total",
+			Help:      "Number of nodes added to or removed from the ring of each service.",
+		}, []string{"service", "change"}),
+		poolSwitches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "pool_switches_total",
+			Help:      "Number of times the active pools of each service changed, either failovers or failbacks.",
+		}, []string{"service"}),
+		ringNodes: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "ring_nodes"),
+			"Number of nodes in the ring of each service.",
+			[]string{"service"}, nil,
+		),
+		datapath: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "datapath", "packets_total"),
+			"Datapath counters added up across all the CPUs.",
+			[]string{"counter"}, nil,
+		),
+	}
+}
+
+func (m *routerMetrics) ringChanged(svc string, added, removed int) {
+	if m == nil {
+		return
+	}
+
+	m.ringChanges.WithLabelValues(svc, "added").Add(float64(added))
+	m.ringChanges.WithLabelValues(svc, "removed").Add(float64(removed))
+}
+
+func (m *routerMetrics) poolSwitched(svc string) {
+	if m == nil {
+		return
+	}
+
+	m.poolSwitches.WithLabelValues(svc).Inc()
+}
+
+// Collector returns the collector of the routing metrics, including the counters of the datapath
+func (r *Router) Collector() prometheus.Collector {
+	return &routerCollector{router: r}
+}
+
+type routerCollector struct {
+	router *Router
+}
+
+func (c *routerCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.router.metrics.ringChanges.Describe(ch)
+	c.router.metrics.poolSwitches.Describe(ch)
+	ch <- c.router.metrics.ringNodes
+	ch <- c.router.metrics.datapath
+}
+
+func (c *routerCollector) Collect(ch chan<- prometheus.Metric) {
+	metrics := c.router.metrics
+	metrics.ringChanges.Collect(ch)
+	metrics.poolSwitches.Collect(ch)
+
+	c.router.servicesLock.RLock()
+	for _, svc := range c.router.services {
+		ch <- prometheus.MustNewConstMetric(metrics.ringNodes, prometheus.GaugeValue, float64(svc.ring.size()), svc.name)
+	}
+	c.router.servicesLock.RUnlock()
+
+	counters, err := c.router.xdp.stats()
+	if err != nil {
+		c.router.logger.Warnf("failed to collect datapath counters: %v", err)
+		return
+	}
+
+	for name, value := range counters {
+		ch <- prometheus.MustNewConstMetric(metrics.datapath, prometheus.CounterValue, float64(value), name)
+	}
+}
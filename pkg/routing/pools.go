@@ -0,0 +1,158 @@
+package routing
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	lbConfig "github.com/yago-123/galelb/config/lb"
+)
+
+const (
+	// defaultPoolName is the name of the pool used by services that do not define any pool
+	defaultPoolName = "default"
+)
+
+// pool is a group of nodes that serve a service
+type pool struct {
+	name       string
+	prefixes   []netip.Prefix
+	minHealthy int
+}
+
+// contains returns whether the node belongs to the pool
+func (p *pool) contains(addr netip.Addr) bool {
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// poolSelector decides which pools of a service are active. Pools are ordered by priority, once the number of
+// eligible nodes of a pool drops below its minimum, the next pool is activated on top of it (failover). The traffic
+// only switches back (failback) once the higher priority pool has remained above its minimum during failbackDelay,
+// so that a flapping pool does not move the clients back and forth
+type poolSelector struct {
+	pools         []pool
+	failbackDelay time.Duration
+
+	// active is the index of the lowest priority pool active, all pools up to it serve traffic
+	active int
+	// recoveredSince is the time since a higher priority pool is above its minimum, zero if there is no failback
+	// pending
+	recoveredSince time.Time
+}
+
+func newPoolSelector(cfgPools []lbConfig.Pool, failbackDelay time.Duration) (*poolSelector, error) {
+	// Services without pools are served by all the eligible nodes
+	if len(cfgPools) == 0 {
+		return &poolSelector{
+			pools: []pool{
+				{
+					name:     defaultPoolName,
+					prefixes: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+				},
+			},
+			failbackDelay: failbackDelay,
+		}, nil
+	}
+
+	pools := make([]pool, 0, len(cfgPools))
+	for _, cfgPool := range cfgPools {
+		if cfgPool.MinHealthy < 0 {
+			return nil, fmt.Errorf("minimum of healthy nodes of pool %s cannot be negative", cfgPool.Name)
+		}
+
+		prefixes := make([]netip.Prefix, 0, len(cfgPool.Nodes))
+		for _, cidr := range cfgPool.Nodes {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid nodes of pool %s: %w", cfgPool.Name, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+
+		pools = append(pools, pool{
+			name:       cfgPool.Name,
+			prefixes:   prefixes,
+			minHealthy: cfgPool.MinHealthy,
+		})
+	}
+
+	return &poolSelector{
+		pools:         pools,
+		failbackDelay: failbackDelay,
+	}, nil
+}
+
+// update recomputes the active pools based on the nodes eligible for routing. Returns whether the active pools
+// changed and, if a failback is pending, the time left until it can happen
+func (s *poolSelector) update(eligible []netip.Addr, now time.Time) (bool, time.Duration) {
+	// The target is the first pool that satisfies its minimum, if none does all pools are activated
+	target := len(s.pools) - 1
+	for i := range s.pools {
+		if s.countEligible(i, eligible) >= s.pools[i].minHealthy {
+			target = i
+			break
+		}
+	}
+
+	switch {
+	case target > s.active:
+		// Failover happens right away
+		s.active = target
+		s.recoveredSince = time.Time{}
+		return true, 0
+	case target == s.active:
+		s.recoveredSince = time.Time{}
+		return false, 0
+	}
+
+	// Failback only happens once the higher priority pool has been healthy during the delay
+	if s.recoveredSince.IsZero() {
+		s.recoveredSince = now
+	}
+
+	if elapsed := now.Sub(s.recoveredSince); elapsed < s.failbackDelay {
+		return false, s.failbackDelay - elapsed
+	}
+
+	s.active = target
+	s.recoveredSince = time.Time{}
+	return true, 0
+}
+
+// members returns the eligible nodes that belong to the active pools
+func (s *poolSelector) members(eligible []netip.Addr) []netip.Addr {
+	members := []netip.Addr{}
+	for _, addr := range eligible {
+		for i := 0; i <= s.active; i++ {
+			if s.pools[i].contains(addr) {
+				members = append(members, addr)
+				break
+			}
+		}
+	}
+
+	return members
+}
+
+// activePool returns the name of the lowest priority pool active
+func (s *poolSelector) activePool() string {
+	return s.pools[s.active].name
+}
+
+// countEligible returns the number of eligible nodes in the pool
+func (s *poolSelector) countEligible(idx int, eligible []netip.Addr) int {
+	count := 0
+	for _, addr := range eligible {
+		if s.pools[idx].contains(addr) {
+			count++
+		}
+	}
+
+	return count
+}
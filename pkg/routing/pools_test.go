@@ -0,0 +1,272 @@
+package routing
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	lbConfig "github.com/yago-123/galelb/config/lb"
+	"github.com/yago-123/galelb/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testFailbackDelay = 30 * time.Second
+)
+
+func testPools() []lbConfig.Pool {
+	return []lbConfig.Pool{
+		{Name: "primary", Nodes: []string{"10.0.1.0/24"}, MinHealthy: 2},
+		{Name: "overflow", Nodes: []string{"10.0.2.0/24"}, MinHealthy: 1},
+	}
+}
+
+func addrs(ips ...string) []netip.Addr {
+	parsed := []netip.Addr{}
+	for _, ip := range ips {
+		parsed = append(parsed, netip.MustParseAddr(ip))
+	}
+	return parsed
+}
+
+func TestPools_failoverAndFailback(t *testing.T) {
+	selector, err := newPoolSelector(testPools(), testFailbackDelay)
+	if err != nil {
+		t.Fatalf("failed to create pool selector: %v", err)
+	}
+
+	now := time.Now()
+	healthy := addrs("10.0.1.1", "10.0.1.2", "10.0.2.1")
+	degraded := addrs("10.0.1.1", "10.0.2.1")
+
+	// Primary pool satisfies its minimum, overflow nodes do not receive traffic
+	if changed, _ := selector.update(healthy, now); changed || selector.activePool() != "primary" {
+		t.Fatalf("expected primary pool to remain active, got %s", selector.activePool())
+	}
+	if members := selector.members(healthy); len(members) != 2 {
+		t.Fatalf("expected 2 members, got %v", members)
+	}
+
+	// Primary drops below its minimum, failover happens right away and both pools serve traffic
+	if changed, _ := selector.update(degraded, now); !changed || selector.activePool() != "overflow" {
+		t.Fatalf("expected failover to overflow pool, got %s", selector.activePool())
+	}
+	if members := selector.members(degraded); len(members) != 2 {
+		t.Fatalf("expected remaining primary and overflow nodes, got %v", members)
+	}
+
+	// Primary recovers, but failback waits for the delay
+	changed, failbackIn := selector.update(healthy, now)
+	if changed || failbackIn != testFailbackDelay {
+		t.Fatalf("expected failback to be delayed %s, got changed %t and %s", testFailbackDelay, changed, failbackIn)
+	}
+
+	// Flapping during the delay restarts it
+	selector.update(degraded, now.Add(testFailbackDelay/2))
+	if changed, _ = selector.update(healthy, now.Add(testFailbackDelay)); changed {
+		t.Fatalf("expected failback delay to restart after flapping")
+	}
+
+	if changed, _ = selector.update(healthy, now.Add(2*testFailbackDelay)); !changed || selector.activePool() != "primary" {
+		t.Fatalf("expected failback to primary pool, got %s", selector.activePool())
+	}
+}
+
+func TestPools_allPoolsBelowMinimum(t *testing.T) {
+	selector, err := newPoolSelector(testPools(), testFailbackDelay)
+	if err != nil {
+		t.Fatalf("failed to create pool selector: %v", err)
+	}
+
+	// No pool satisfies its minimum, so every pool serves traffic with whatever nodes are left
+	eligible := addrs("10.0.1.1", "10.0.3.1")
+	selector.update(eligible, time.Now())
+	if selector.activePool() != "overflow" {
+		t.Fatalf("expected all pools to be active, got %s", selector.activePool())
+	}
+
+	// Nodes outside the pools never receive traffic
+	if members := selector.members(eligible); len(members) != 1 || members[0] != eligible[0] {
+		t.Fatalf("expected only nodes from pools, got %v", members)
+	}
+}
+
+func TestPools_invalidConfig(t *testing.T) {
+	if _, err := newPoolSelector([]lbConfig.Pool{{Name: "primary", Nodes: []string{"10.0.1.0"}}}, 0); err == nil {
+		t.Fatalf("expected error for invalid CIDR")
+	}
+
+	if _, err := newPoolSelector([]lbConfig.Pool{{Name: "primary", MinHealthy: -1}}, 0); err == nil {
+		t.Fatalf("expected error for negative minimum")
+	}
+}
+
+func TestRouter_syncEligibleNodes(t *testing.T) {
+	services, err := parseServices([]lbConfig.Service{
+		{Name: "web", Port: 8080, Affinity: AffinitySourceIPName, Pools: testPools(), FailbackDelay: testFailbackDelay},
+		{Name: "api", Port: 9090, Affinity: AffinitySourceIPName},
+	}, testVirtualNodes)
+	if err != nil {
+		t.Fatalf("failed to parse services: %v", err)
+	}
+
+	// The datapath maps are not loaded, so updates only affect the user space rings
+	router := &Router{
+		xdp:      newXDP(logrus.New(), "", "", 0),
+		services: services,
+		logger:   logrus.New(),
+	}
+
+	if err = router.SyncEligibleNodes(context.Background(), addrs("10.0.1.1", "10.0.1.2", "10.0.2.1")); err != nil {
+		t.Fatalf("failed to sync eligible nodes: %v", err)
+	}
+
+	// Services without pools are served by all the nodes
+	if size := services[8080].ring.size(); size != 2 {
+		t.Fatalf("expected 2 nodes in web ring, got %d", size)
+	}
+	if size := services[9090].ring.size(); size != 3 {
+		t.Fatalf("expected 3 nodes in api ring, got %d", size)
+	}
+
+	if err = router.SyncEligibleNodes(context.Background(), addrs("10.0.1.1", "10.0.2.1")); err != nil {
+		t.Fatalf("failed to sync eligible nodes: %v", err)
+	}
+
+	if size := services[8080].ring.size(); size != 2 {
+		t.Fatalf("expected failover to keep 2 nodes in web ring, got %d", size)
+	}
+
+	node, err := router.GetNode(Flow{SrcIP: netip.MustParseAddr("203.0.113.7"), SrcPort: 40000, ServicePort: 8080})
+	if err != nil {
+		t.Fatalf("failed to get node: %v", err)
+	}
+	if addr := AddrKeyToAddrPort(node); addr.Port() != 8080 {
+		t.Fatalf("expected node serving port 8080, got %s", addr)
+	}
+
+	// Once the primary pool recovers, a sync is scheduled for when the failback can happen
+	if err = router.SyncEligibleNodes(context.Background(), addrs("10.0.1.1", "10.0.1.2", "10.0.2.1")); err != nil {
+		t.Fatalf("failed to sync eligible nodes: %v", err)
+	}
+
+	router.syncLock.Lock()
+	defer router.syncLock.Unlock()
+	if router.failbackTimer == nil {
+		t.Fatalf("expected failback to be scheduled")
+	}
+	router.failbackTimer.Stop()
+}
+
+func TestRouter_updateServices(t *testing.T) {
+	cfgServices := []lbConfig.Service{
+		{Name: "web", Port: 8080, Affinity: AffinitySourceIPName, Pools: testPools(), FailbackDelay: testFailbackDelay},
+		{Name: "api", Port: 9090, Affinity: AffinitySourceIPName},
+	}
+
+	services, err := parseServices(cfgServices, testVirtualNodes)
+	if err != nil {
+		t.Fatalf("failed to parse services: %v", err)
+	}
+
+	router := &Router{
+		xdp:             newXDP(logrus.New(), "", "", 0),
+		services:        services,
+		numVirtualNodes: testVirtualNodes,
+		logger:          logrus.New(),
+	}
+
+	if err = router.SyncEligibleNodes(context.Background(), addrs("10.0.1.1", "10.0.2.1")); err != nil {
+		t.Fatalf("failed to sync eligible nodes: %v", err)
+	}
+	web := services[8080]
+
+	// The api service is removed and a new one is added, the web service is not changed
+	reloaded := []lbConfig.Service{cfgServices[0], {Name: "grpc", Port: 9091, Affinity: AffinitySourceIPName}}
+	if err = router.UpdateServices(context.Background(), reloaded); err != nil {
+		t.Fatalf("failed to update services: %v", err)
+	}
+
+	if svc, ok := router.service(8080); !ok || svc != web {
+		t.Fatalf("expected unchanged service to keep its ring and pools")
+	}
+	if _, ok := router.service(9090); ok {
+		t.Fatalf("expected removed service to stop being routed")
+	}
+
+	// New services are filled with the nodes eligible from the last sync
+	svc, ok := router.service(9091)
+	if !ok {
+		t.Fatalf("expected new service to be routed")
+	}
+	if size := svc.ring.size(); size != 2 {
+		t.Fatalf("expected 2 nodes in the ring of the new service, got %d", size)
+	}
+
+	router.syncLock.Lock()
+	defer router.syncLock.Unlock()
+	if router.failbackTimer != nil {
+		router.failbackTimer.Stop()
+	}
+}
+
+func TestRouter_syncSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+
+	services, err := parseServices([]lbConfig.Service{
+		{Name: "web", Port: 8080, Affinity: AffinitySourceIPName},
+		{Name: "api", Port: 9090, Affinity: AffinitySourceIPName},
+	}, testVirtualNodes)
+	if err != nil {
+		t.Fatalf("failed to parse services: %v", err)
+	}
+
+	router := &Router{
+		xdp:      newXDP(logrus.New(), "", "", 0),
+		services: services,
+		logger:   logrus.New(),
+	}
+
+	for _, eligible := range [][]netip.Addr{addrs("10.0.1.1", "10.0.1.2"), addrs("10.0.1.1", "10.0.1.2")} {
+		if err = router.SyncEligibleNodes(context.Background(), eligible); err != nil {
+			t.Fatalf("failed to sync eligible nodes: %v", err)
+		}
+	}
+
+	syncs := map[trace.SpanID]bool{}
+	rings := []sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "routing.SyncEligibleNodes":
+			syncs[span.SpanContext().SpanID()] = true
+		case "routing.UpdateRing":
+			rings = append(rings, span)
+		}
+	}
+
+	// Only the first sync changes the rings, once per service
+	if len(syncs) != 2 || len(rings) != 2 {
+		t.Fatalf("expected 2 syncs and 2 ring updates, got %d and %d", len(syncs), len(rings))
+	}
+
+	for _, ring := range rings {
+		if !syncs[ring.Parent().SpanID()] {
+			t.Fatalf("expected ring update to be a child of a sync, got parent %v", ring.Parent())
+		}
+		if !slices.Contains(ring.Attributes(), attribute.Int(tracing.AttrNodesAdded, 2)) {
+			t.Fatalf("expected ring update to record the nodes added, got %v", ring.Attributes())
+		}
+	}
+}
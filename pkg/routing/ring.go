@@ -7,82 +7,384 @@ package routing
 import "C"
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/yago-123/galelb/pkg/common"
 )
 
+const (
+	// MaxRingEntries is the maximum number of virtual node entries that the ring can hold. It must match the size of
+	// the datapath maps, that is why it's sourced from the C constants
+	MaxRingEntries = C.MAX_NUMBER_VIRTUAL_NODE_ENTRIES
+	// RingGenerations is the number of sets of ring entries that each service has in the datapath
+	RingGenerations = C.NUMBER_RING_GENERATIONS
+)
+
+var (
+	ErrRingCapacityExceeded = errors.New("ring capacity exceeded")
+	ErrRingEmpty            = errors.New("ring does not contain any node")
+)
+
+// ringSnapshot is an immutable view of the ring. Once published, snapshots are never modified so that readers can
+// use them without any lock
+type ringSnapshot struct {
+	// hashes contains the sorted and unique hashes of the virtual nodes
+	hashes []uint32
+	// owners contains the node that owns each of the hashes (owners[i] owns hashes[i])
+	owners []common.AddrKey
+}
+
 type ring struct {
-	ring            []uint32
-	nodes           map[uint32]common.AddrKey
+	// snapshot is the latest version of the ring, replaced atomically on each membership change
+	snapshot atomic.Pointer[ringSnapshot]
+
+	// claimants maps each hash of the ring to the nodes that claim it. In case of collision between virtual nodes of
+	// different nodes, the claimants are kept sorted and the first one owns the hash. This makes the resolution
+	// independent of the order in which nodes were added, so different load balancers end up with the same ring
+	claimants map[uint32][]common.AddrKey
+	// members keeps track of the nodes currently present in the ring
+	members         map[common.AddrKey]struct{}
 	numVirtualNodes int
 
-	lock   sync.RWMutex
+	// lock serializes writers, readers only load the snapshot
+	lock   sync.Mutex
 	hasher Hasher
 }
 
 func newRing(hasher Hasher, numVirtualNodes int) *ring {
-	return &ring{
-		ring:            make([]uint32, C.MAX_NUMBER_VIRTUAL_NODE_ENTRIES),
-		nodes:           make(map[uint32]common.AddrKey),
+	r := &ring{
+		claimants:       make(map[uint32][]common.AddrKey),
+		members:         make(map[common.AddrKey]struct{}),
 		numVirtualNodes: numVirtualNodes,
 		hasher:          hasher,
 	}
+	r.snapshot.Store(&ringSnapshot{})
+
+	return r
+}
+
+// addNode adds the virtual nodes of node into the ring. Adding a node that is already present is a no-op. Returns
+// ErrRingCapacityExceeded if there is not enough room left in the ring for the virtual nodes
+func (ch *ring) addNode(node common.AddrKey) error {
+	_, _, err := ch.apply([]common.AddrKey{node}, nil)
+	return err
+}
+
+// removeNode removes the virtual nodes of node from the ring. Removing a node that is not present is a no-op
+func (ch *ring) removeNode(node common.AddrKey) {
+	// Removals alone can't exceed the capacity of the ring
+	_, _, _ = ch.apply(nil, []common.AddrKey{node})
 }
 
-func (ch *ring) addNode(node common.AddrKey) {
+// apply adds and removes a batch of nodes and publishes the resulting ring as a single snapshot. Nodes that appear in
+// both lists end up in the ring. Returns the snapshot published and whether the ring changed at all. If the batch
+// does not fit in the ring, ErrRingCapacityExceeded is returned and nothing is applied
+func (ch *ring) apply(add, remove []common.AddrKey) (*ringSnapshot, bool, error) {
 	ch.lock.Lock()
 	defer ch.lock.Unlock()
 
-	// todo(): check that is not already present?
-	// todo(): make sure that does not overflow the ring nor the nodes map
+	current := ch.snapshot.Load()
+	added, removed := ch.membershipDelta(add, remove)
+	if len(added) == 0 && len(removed) == 0 {
+		return current, false, nil
+	}
 
-	// Hash the virtual node and persist into the ring
-	for i := range ch.numVirtualNodes {
-		virtualNode := fmt.Sprintf("%s-%d", addrToString(node), i)
-		hash := ch.hasher([]byte(virtualNode))
+	// Check the capacity in advance so that the ring is never left with a partial batch
+	size := ch.sizeAfter(len(current.hashes), added, removed)
+	if size > MaxRingEntries {
+		return current, false, fmt.Errorf("%w: batch requires %d/%d entries",
+			ErrRingCapacityExceeded, size, MaxRingEntries)
+	}
+
+	// Update claimants and keep track of the hashes whose owner changed (including hashes created or deleted)
+	touched := map[uint32]struct{}{}
+	for _, node := range removed {
+		delete(ch.members, node)
+		for _, hash := range ch.virtualNodeHashes(node) {
+			touched[hash] = struct{}{}
+			if claimants := removeClaimant(ch.claimants[hash], node); len(claimants) > 0 {
+				ch.claimants[hash] = claimants
+				continue
+			}
+			delete(ch.claimants, hash)
+		}
+	}
 
-		ch.ring = append(ch.ring, hash)
-		ch.nodes[hash] = node
+	for _, node := range added {
+		ch.members[node] = struct{}{}
+		for _, hash := range ch.virtualNodeHashes(node) {
+			touched[hash] = struct{}{}
+			ch.claimants[hash] = insertClaimant(ch.claimants[hash], node)
+		}
 	}
 
-	// Make sure that the ring remains in order
-	sort.Slice(ch.ring, func(i, j int) bool { return ch.ring[i] < ch.ring[j] })
+	next := ch.mergeSnapshot(current, touched)
+	ch.snapshot.Store(next)
+
+	return next, true, nil
 }
 
-func (ch *ring) removeNode(node common.AddrKey) {
+// membershipDelta computes which nodes must be actually added and removed from the ring for a batch
+func (ch *ring) membershipDelta(add, remove []common.AddrKey) ([]common.AddrKey, []common.AddrKey) {
+	final := map[common.AddrKey]struct{}{}
+	for _, node := range remove {
+		final[node] = struct{}{}
+	}
+	for _, node := range add {
+		delete(final, node)
+	}
+
+	var added, removed []common.AddrKey
+	for node := range final {
+		if _, ok := ch.members[node]; ok {
+			removed = append(removed, node)
+		}
+	}
+
+	unique := map[common.AddrKey]struct{}{}
+	for _, node := range add {
+		if _, ok := ch.members[node]; ok {
+			continue
+		}
+		if _, ok := unique[node]; ok {
+			continue
+		}
+
+		unique[node] = struct{}{}
+		added = append(added, node)
+	}
+
+	return added, removed
+}
+
+// sizeAfter computes the number of entries that the ring would contain after applying the batch
+func (ch *ring) sizeAfter(size int, added, removed []common.AddrKey) int {
+	delta := map[uint32]int{}
+	for _, node := range removed {
+		for _, hash := range ch.virtualNodeHashes(node) {
+			delta[hash]--
+		}
+	}
+	for _, node := range added {
+		for _, hash := range ch.virtualNodeHashes(node) {
+			delta[hash]++
+		}
+	}
+
+	for hash, diff := range delta {
+		before := len(ch.claimants[hash])
+		after := before + diff
+		if before == 0 && after > 0 {
+			size++
+		}
+		if before > 0 && after == 0 {
+			size--
+		}
+	}
+
+	return size
+}
+
+// mergeSnapshot creates a new snapshot from current by updating only the touched hashes. The hashes inserted are
+// merged into the existing sorted slice instead of sorting the whole ring again
+func (ch *ring) mergeSnapshot(current *ringSnapshot, touched map[uint32]struct{}) *ringSnapshot {
+	inserted := []uint32{}
+	for hash := range touched {
+		if _, found := ch.claimants[hash]; !found {
+			continue
+		}
+		if i, found := current.search(hash); found && current.hashes[i] == hash {
+			continue
+		}
+		inserted = append(inserted, hash)
+	}
+	sort.Slice(inserted, func(i, j int) bool { return inserted[i] < inserted[j] })
+
+	next := &ringSnapshot{
+		hashes: make([]uint32, 0, len(current.hashes)+len(inserted)),
+		owners: make([]common.AddrKey, 0, len(current.hashes)+len(inserted)),
+	}
+
+	appendHash := func(hash uint32) {
+		next.hashes = append(next.hashes, hash)
+		next.owners = append(next.owners, ch.claimants[hash][0])
+	}
+
+	j := 0
+	for i, hash := range current.hashes {
+		for j < len(inserted) && inserted[j] < hash {
+			appendHash(inserted[j])
+			j++
+		}
+
+		if _, ok := touched[hash]; !ok {
+			next.hashes = append(next.hashes, hash)
+			next.owners = append(next.owners, current.owners[i])
+			continue
+		}
+
+		// The hash was touched, it either changed owner or it's no longer part of the ring
+		if _, found := ch.claimants[hash]; found {
+			appendHash(hash)
+		}
+	}
+
+	for ; j < len(inserted); j++ {
+		appendHash(inserted[j])
+	}
+
+	return next
+}
+
+// getNode returns the node that owns the requestKey. Returns ErrRingEmpty if there are no nodes in the ring
+func (ch *ring) getNode(requestKey []byte) (common.AddrKey, error) {
+	placement, err := ch.locate(requestKey, 0)
+	if err != nil {
+		return common.AddrKey{}, err
+	}
+
+	return placement.owner, nil
+}
+
+// ringPlacement describes where a key lands in the ring
+type ringPlacement struct {
+	// keyHash is the hash of the key and index the position of the first virtual node after it
+	keyHash uint32
+	index   int
+	// virtualNodeHash is the hash of the virtual node that owns the key
+	virtualNodeHash uint32
+	owner           common.AddrKey
+	// fallbacks are the next distinct nodes found walking the ring clockwise, the key would land on them (in order)
+	// if the owner left the ring
+	fallbacks []common.AddrKey
+}
+
+// locate returns the placement of requestKey in the ring including up to maxFallbacks alternative nodes. Returns
+// ErrRingEmpty if there are no nodes in the ring
+func (ch *ring) locate(requestKey []byte, maxFallbacks int) (ringPlacement, error) {
+	snapshot := ch.snapshot.Load()
+	if len(snapshot.hashes) == 0 {
+		return ringPlacement{}, ErrRingEmpty
+	}
+
+	hash := ch.hasher(requestKey)
+	i, found := snapshot.search(hash)
+	if !found {
+		i = 0
+	}
+
+	placement := ringPlacement{
+		keyHash:         hash,
+		index:           i,
+		virtualNodeHash: snapshot.hashes[i],
+		owner:           snapshot.owners[i],
+		fallbacks:       []common.AddrKey{},
+	}
+
+	seen := map[common.AddrKey]struct{}{placement.owner: {}}
+	for step := 1; step < len(snapshot.hashes) && len(placement.fallbacks) < maxFallbacks; step++ {
+		owner := snapshot.owners[(i+step)%len(snapshot.hashes)]
+		if _, ok := seen[owner]; ok {
+			continue
+		}
+
+		seen[owner] = struct{}{}
+		placement.fallbacks = append(placement.fallbacks, owner)
+	}
+
+	return placement, nil
+}
+
+// size returns the number of nodes present in the ring
+func (ch *ring) size() int {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	return len(ch.members)
+}
+
+// nodes returns the nodes present in the ring
+func (ch *ring) nodes() []common.AddrKey {
 	ch.lock.Lock()
 	defer ch.lock.Unlock()
 
-	// Remove the virtual nodes from the map
+	nodes := make([]common.AddrKey, 0, len(ch.members))
+	for node := range ch.members {
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+// search returns the index of the first hash that is greater or equal than hash. Returns false if there is no such
+// hash, in which case the ring wraps around
+func (s *ringSnapshot) search(hash uint32) (int, bool) {
+	i := sort.Search(len(s.hashes), func(i int) bool {
+		return s.hashes[i] >= hash
+	})
+
+	return i, i < len(s.hashes)
+}
+
+// virtualNodeHashes returns the unique hashes of the virtual nodes that belong to node
+func (ch *ring) virtualNodeHashes(node common.AddrKey) []uint32 {
+	hashes := make([]uint32, 0, ch.numVirtualNodes)
+	seen := make(map[uint32]struct{}, ch.numVirtualNodes)
+
 	for i := range ch.numVirtualNodes {
 		virtualNode := fmt.Sprintf("%s-%d", addrToString(node), i)
 		hash := ch.hasher([]byte(virtualNode))
-		delete(ch.nodes, hash)
-	}
 
-	// Rebuild the ring
-	ch.ring = []uint32{}
-	for hash := range ch.nodes {
-		ch.ring = append(ch.ring, hash)
+		// Virtual nodes of the same node can collide too, only keep one of them
+		if _, ok := seen[hash]; ok {
+			continue
+		}
+
+		seen[hash] = struct{}{}
+		hashes = append(hashes, hash)
 	}
-	sort.Slice(ch.ring, func(i, j int) bool { return ch.ring[i] < ch.ring[j] })
-}
 
-func (ch *ring) getNode(requestKey []byte) string {
-	ch.lock.RLock()
-	defer ch.lock.RUnlock()
+	return hashes
+}
 
-	hash := ch.hasher(requestKey)
-	i := sort.Search(len(ch.ring), func(i int) bool {
-		return ch.ring[i] >= hash
+// insertClaimant inserts node into the sorted list of claimants of a hash. The list is copied so that the previous
+// version is never modified
+func insertClaimant(claimants []common.AddrKey, node common.AddrKey) []common.AddrKey {
+	i := sort.Search(len(claimants), func(i int) bool {
+		return !addrLess(claimants[i], node)
 	})
-	if i == len(ch.ring) {
-		i = 0
+
+	updated := make([]common.AddrKey, 0, len(claimants)+1)
+	updated = append(updated, claimants[:i]...)
+	updated = append(updated, node)
+	updated = append(updated, claimants[i:]...)
+
+	return updated
+}
+
+// removeClaimant removes node from the list of claimants of a hash. The list is copied so that the previous version is
+// never modified
+func removeClaimant(claimants []common.AddrKey, node common.AddrKey) []common.AddrKey {
+	updated := make([]common.AddrKey, 0, len(claimants))
+	for _, claimant := range claimants {
+		if claimant != node {
+			updated = append(updated, claimant)
+		}
+	}
+
+	return updated
+}
+
+// addrLess defines the total order used for resolving collisions between virtual nodes
+func addrLess(a, b common.AddrKey) bool {
+	if a.IP != b.IP {
+		return a.IP < b.IP
 	}
-	return addrToString(ch.nodes[ch.ring[i]])
+	return a.Port < b.Port
 }
 
 func addrToString(addr common.AddrKey) string {
@@ -0,0 +1,389 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"testing/quick"
+
+	"github.com/yago-123/galelb/pkg/common"
+)
+
+const (
+	testVirtualNodes = 100
+	testRequestKeys  = 10000
+	testMaxNodes     = 20
+
+	// testDistributionTolerance is the maximum deviation allowed from the ideal share of keys of each node
+	testDistributionTolerance = 0.5
+
+	testQuickSeed = 1
+)
+
+// quickConfig returns a deterministic configuration for the property-based tests so that failures are reproducible
+func quickConfig() *quick.Config {
+	return &quick.Config{Rand: rand.New(rand.NewSource(testQuickSeed))} //nolint:gosec // weak random is fine for tests
+}
+
+// randomNodes generates between 1 and testMaxNodes unique nodes from the seed
+func randomNodes(seed int64) []common.AddrKey {
+	rnd := rand.New(rand.NewSource(seed)) //nolint:gosec // weak random is fine for tests
+
+	unique := map[common.AddrKey]struct{}{}
+	nodes := []common.AddrKey{}
+	for range rnd.Intn(testMaxNodes) + 1 {
+		node := common.AddrKey{IP: rnd.Uint32(), Port: uint16(rnd.Intn(1 << 16))} //nolint:gosec // fits in uint16
+		if _, ok := unique[node]; ok {
+			continue
+		}
+
+		unique[node] = struct{}{}
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+// ringAssignments returns the node that owns each of the request keys
+func ringAssignments(t *testing.T, r *ring) map[string]common.AddrKey {
+	t.Helper()
+
+	assignments := make(map[string]common.AddrKey, testRequestKeys)
+	for i := range testRequestKeys {
+		key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		node, err := r.getNode([]byte(key))
+		if err != nil {
+			t.Fatalf("failed to get node for key %s: %v", key, err)
+		}
+		assignments[key] = node
+	}
+
+	return assignments
+}
+
+func newTestRing(t *testing.T, hasher Hasher, nodes []common.AddrKey) *ring {
+	t.Helper()
+
+	r := newRing(hasher, testVirtualNodes)
+	for _, node := range nodes {
+		if err := r.addNode(node); err != nil {
+			t.Fatalf("failed to add node %v: %v", node, err)
+		}
+	}
+
+	return r
+}
+
+func TestRing_emptyRing(t *testing.T) {
+	r := newRing(Crc32Hasher, testVirtualNodes)
+
+	if _, err := r.getNode([]byte("10.0.0.1")); !errors.Is(err, ErrRingEmpty) {
+		t.Fatalf("expected ErrRingEmpty, got %v", err)
+	}
+}
+
+func TestRing_duplicateNodes(t *testing.T) {
+	node := common.AddrKey{IP: 1, Port: 8080}
+	r := newTestRing(t, Crc32Hasher, []common.AddrKey{node, node})
+
+	if r.size() != 1 {
+		t.Fatalf("expected 1 node in the ring, got %d", r.size())
+	}
+
+	if len(r.snapshot.Load().hashes) != testVirtualNodes {
+		t.Fatalf("expected %d entries in the ring, got %d", testVirtualNodes, len(r.snapshot.Load().hashes))
+	}
+
+	// Removing twice must not corrupt the ring either
+	r.removeNode(node)
+	r.removeNode(node)
+	if len(r.snapshot.Load().hashes) != 0 || len(r.claimants) != 0 {
+		t.Fatalf("expected empty ring, got %d entries and %d hashes", len(r.snapshot.Load().hashes), len(r.claimants))
+	}
+}
+
+func TestRing_capacityExceeded(t *testing.T) {
+	r := newRing(Crc32Hasher, MaxRingEntries/2+1)
+
+	if err := r.addNode(common.AddrKey{IP: 1, Port: 8080}); err != nil {
+		t.Fatalf("failed to add first node: %v", err)
+	}
+
+	err := r.addNode(common.AddrKey{IP: 2, Port: 8080})
+	if !errors.Is(err, ErrRingCapacityExceeded) {
+		t.Fatalf("expected ErrRingCapacityExceeded, got %v", err)
+	}
+
+	// The failed node must not leave any trace in the ring
+	if r.size() != 1 || len(r.snapshot.Load().hashes) != MaxRingEntries/2+1 {
+		t.Fatalf("ring modified after capacity error: %d nodes, %d entries", r.size(), len(r.snapshot.Load().hashes))
+	}
+}
+
+func TestRing_hashCollisions(t *testing.T) {
+	// Every virtual node lands in the same hash, so all nodes collide with each other
+	collisionHasher := func(_ []byte) uint32 { return 42 }
+
+	nodeA := common.AddrKey{IP: 1, Port: 8080}
+	nodeB := common.AddrKey{IP: 2, Port: 8080}
+
+	for _, order := range [][]common.AddrKey{{nodeA, nodeB}, {nodeB, nodeA}} {
+		r := newTestRing(t, collisionHasher, order)
+
+		node, err := r.getNode([]byte("10.0.0.1"))
+		if err != nil {
+			t.Fatalf("failed to get node: %v", err)
+		}
+		if node != nodeA {
+			t.Fatalf("expected collision to be resolved in favor of %v, got %v", nodeA, node)
+		}
+
+		// Once the owner leaves, the other claimant takes over the hash
+		r.removeNode(nodeA)
+		node, err = r.getNode([]byte("10.0.0.1"))
+		if err != nil {
+			t.Fatalf("failed to get node: %v", err)
+		}
+		if node != nodeB {
+			t.Fatalf("expected %v to own the hash after removal, got %v", nodeB, node)
+		}
+	}
+}
+
+func TestRing_insertionOrderIndependence(t *testing.T) {
+	property := func(seed int64) bool {
+		nodes := randomNodes(seed)
+
+		reversed := make([]common.AddrKey, len(nodes))
+		for i, node := range nodes {
+			reversed[len(nodes)-1-i] = node
+		}
+
+		a := ringAssignments(t, newTestRing(t, Crc32Hasher, nodes))
+		b := ringAssignments(t, newTestRing(t, Crc32Hasher, reversed))
+		for key, node := range a {
+			if b[key] != node {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(property, quickConfig()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRing_distribution(t *testing.T) {
+	property := func(seed int64) bool {
+		nodes := randomNodes(seed)
+		assignments := ringAssignments(t, newTestRing(t, Crc32Hasher, nodes))
+
+		counts := map[common.AddrKey]int{}
+		for _, node := range assignments {
+			counts[node]++
+		}
+
+		ideal := float64(testRequestKeys) / float64(len(nodes))
+		for _, node := range nodes {
+			deviation := (float64(counts[node]) - ideal) / ideal
+			if deviation > testDistributionTolerance || deviation < -testDistributionTolerance {
+				t.Logf("node %v received %d keys, ideal is %.0f", node, counts[node], ideal)
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(property, quickConfig()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRing_minimalDisruptionOnAdd(t *testing.T) {
+	property := func(seed int64, ip uint32, port uint16) bool {
+		nodes := randomNodes(seed)
+		newNode := common.AddrKey{IP: ip, Port: port}
+		for _, node := range nodes {
+			if node == newNode {
+				return true
+			}
+		}
+
+		r := newTestRing(t, Crc32Hasher, nodes)
+		before := ringAssignments(t, r)
+		if err := r.addNode(newNode); err != nil {
+			t.Fatalf("failed to add node: %v", err)
+		}
+		after := ringAssignments(t, r)
+
+		// Keys can only move towards the new node
+		for key, node := range after {
+			if node != before[key] && node != newNode {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(property, quickConfig()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRing_minimalDisruptionOnRemove(t *testing.T) {
+	property := func(seed int64, idx uint8) bool {
+		nodes := randomNodes(seed)
+		if len(nodes) < 2 {
+			return true
+		}
+		removed := nodes[int(idx)%len(nodes)]
+
+		r := newTestRing(t, Crc32Hasher, nodes)
+		before := ringAssignments(t, r)
+		r.removeNode(removed)
+		after := ringAssignments(t, r)
+
+		// Only the keys owned by the removed node can move
+		for key, node := range after {
+			if node == removed {
+				return false
+			}
+			if before[key] != removed && node != before[key] {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(property, quickConfig()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRing_batchMatchesSequential(t *testing.T) {
+	property := func(seed int64, split uint8) bool {
+		nodes := randomNodes(seed)
+		cut := int(split) % len(nodes)
+
+		// Sequentially add all nodes and remove the first ones
+		sequential := newTestRing(t, Crc32Hasher, nodes)
+		for _, node := range nodes[:cut] {
+			sequential.removeNode(node)
+		}
+
+		// Apply the same changes in batches
+		batched := newRing(Crc32Hasher, testVirtualNodes)
+		if _, _, err := batched.apply(nodes, nil); err != nil {
+			t.Fatalf("failed to apply batch: %v", err)
+		}
+		if _, _, err := batched.apply(nil, nodes[:cut]); err != nil {
+			t.Fatalf("failed to apply batch: %v", err)
+		}
+
+		return reflect.DeepEqual(sequential.snapshot.Load(), batched.snapshot.Load())
+	}
+
+	if err := quick.Check(property, quickConfig()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRing_batchNoChanges(t *testing.T) {
+	node := common.AddrKey{IP: 1, Port: 8080}
+	r := newTestRing(t, Crc32Hasher, []common.AddrKey{node})
+
+	// Re-adding a member and removing a non-member must not publish a new snapshot
+	before := r.snapshot.Load()
+	_, changed, err := r.apply([]common.AddrKey{node}, []common.AddrKey{{IP: 2, Port: 8080}})
+	if err != nil {
+		t.Fatalf("failed to apply batch: %v", err)
+	}
+	if changed || r.snapshot.Load() != before {
+		t.Fatalf("expected ring to remain unchanged")
+	}
+}
+
+func TestRing_snapshotsAreImmutable(t *testing.T) {
+	nodes := randomNodes(testQuickSeed)
+	r := newTestRing(t, Crc32Hasher, nodes)
+
+	before := r.snapshot.Load()
+	hashes := append([]uint32{}, before.hashes...)
+	owners := append([]common.AddrKey{}, before.owners...)
+
+	r.removeNode(nodes[0])
+	if err := r.addNode(common.AddrKey{IP: 1, Port: 8080}); err != nil {
+		t.Fatalf("failed to add node: %v", err)
+	}
+
+	if !reflect.DeepEqual(before.hashes, hashes) || !reflect.DeepEqual(before.owners, owners) {
+		t.Fatalf("published snapshot was modified by a later update")
+	}
+}
+
+func TestRing_concurrentReadersAndWriters(t *testing.T) {
+	nodes := randomNodes(testQuickSeed)
+	r := newTestRing(t, Crc32Hasher, nodes[:1])
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, node := range nodes[1:] {
+			if err := r.addNode(node); err != nil {
+				t.Errorf("failed to add node: %v", err)
+			}
+		}
+	}()
+
+	// The first node is never removed so readers must always find an owner
+	for i := range testRequestKeys {
+		if _, err := r.getNode([]byte(fmt.Sprintf("10.0.%d.%d", i/256, i%256))); err != nil {
+			t.Fatalf("failed to get node: %v", err)
+		}
+	}
+
+	wg.Wait()
+}
+
+func TestRing_fallbacksTakeOver(t *testing.T) {
+	property := func(seed int64, key uint32) bool {
+		nodes := randomNodes(seed)
+		if len(nodes) < 2 {
+			return true
+		}
+
+		requestKey := []byte(fmt.Sprint(key))
+		r := newTestRing(t, Crc32Hasher, nodes)
+		placement, err := r.locate(requestKey, len(nodes))
+		if err != nil {
+			t.Fatalf("failed to locate key: %v", err)
+		}
+
+		// Every other node must show up exactly once as fallback
+		if len(placement.fallbacks) != len(nodes)-1 {
+			return false
+		}
+
+		// Once the owner leaves, the key lands on the first fallback
+		r.removeNode(placement.owner)
+		node, err := r.getNode(requestKey)
+		if err != nil {
+			t.Fatalf("failed to get node: %v", err)
+		}
+
+		return node == placement.fallbacks[0]
+	}
+
+	if err := quick.Check(property, quickConfig()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,4 +1,5 @@
-// +build ignore
+//go:build ignore
+
 #include <linux/bpf.h>
 #include <linux/pkt_cls.h>
 #include <linux/if_ether.h>
@@ -6,10 +7,20 @@
 #include <linux/tcp.h>
 #include <bpf/bpf_helpers.h>
 
-#define BACKEND_IP 0xC0A80070  // 192.168.0.112
+#include "common.h"
+#include "constants.h"
+
 #define LB_IP      0xC0A800F2  // 192.168.0.242
 #define IPPROTO_TCP 6
-#define TARGET_PORT 8080
+
+// CRC32 (IEEE) and murmur3 finalizer constants, must match the hasher of the ring in user space
+#define CRC32_POLY   0xEDB88320
+#define FMIX32_MULT1 0x85ebca6b
+#define FMIX32_MULT2 0xc2b2ae35
+
+// Offsets of the checksums from the start of the packet, IP options are not supported as in parse_headers
+#define IP_CSUM_OFF  (ETH_HLEN + offsetof(struct iphdr, check))
+#define TCP_CSUM_OFF (ETH_HLEN + sizeof(struct iphdr) + offsetof(struct tcphdr, check))
 
 struct conn_tuple {
     __u32 src_ip;
@@ -19,13 +30,108 @@ struct conn_tuple {
     __u8  protocol;
 };
 
+// conn_state contains the original source IP of the connection, restored on the replies, and the backend (network
+// byte order) to which its packets are routed for as long as the connection is live
+struct conn_state {
+    __u32 orig_ip;
+    __u32 backend;
+    __u64 last_seen_ns;
+    __u32 closing; // set once the client sends FIN or RST
+    __u32 pad;
+};
+
 struct {
     __uint(type, BPF_MAP_TYPE_LRU_HASH);
     __uint(max_entries, 65536);
     __type(key, struct conn_tuple);
-    __type(value, __u32); // original source IP
+    __type(value, struct conn_state);
 } conntrack_map SEC(".maps");
 
+// ring_entry is a virtual node of the consistent hashing ring, entries are sorted by hash
+struct ring_entry {
+    __u32 hash;
+    ip_port_key node;
+};
+
+// ring_map contains the consistent hashing rings of the services, populated from user space in a single batch on each
+// membership change. Each service has one set of entries per generation, the set of generation G of the service in
+// slot N starts at (G * MAX_NUMBER_SERVICES + N) * MAX_NUMBER_VIRTUAL_NODE_ENTRIES
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, NUMBER_RING_GENERATIONS * MAX_NUMBER_SERVICES * MAX_NUMBER_VIRTUAL_NODE_ENTRIES);
+    __type(key, __u32);
+    __type(value, struct ring_entry);
+} ring_map SEC(".maps");
+
+// ring_size_map contains the number of valid entries of each set of ring_map, indexed by G * MAX_NUMBER_SERVICES + N
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, NUMBER_RING_GENERATIONS * MAX_NUMBER_SERVICES);
+    __type(key, __u32);
+    __type(value, __u32);
+} ring_size_map SEC(".maps");
+
+// ring_generation_map contains the generation of the ring used by the service in each slot. Written by user space
+// once the entries and the size of the generation are in place
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, MAX_NUMBER_SERVICES);
+    __type(key, __u32);
+    __type(value, __u32);
+} ring_generation_map SEC(".maps");
+
+// service_config contains the routing parameters of a service, populated from user space
+struct service_config {
+    __u32 slot;            // index of the service in the ring maps
+    __u32 affinity_policy;
+    __u64 affinity_timeout_ns; // 0 disables the affinity table for the service
+};
+
+// service_map contains the services exposed by the load balancer indexed by port (network byte order)
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_NUMBER_SERVICES);
+    __type(key, __u16);
+    __type(value, struct service_config);
+} service_map SEC(".maps");
+
+// affinity_key identifies a client according to the affinity policy of the service. Fields not used by the policy
+// are left to zero
+struct affinity_key {
+    __u32 src_ip;
+    __u16 src_port;
+    __u16 service_port;
+};
+
+struct affinity_value {
+    ip_port_key node;
+    __u64 last_seen_ns;
+};
+
+// affinity_map keeps clients on the same backend across reconnects, even if the ring changes in the meantime
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_NUMBER_AFFINITY_ENTRIES);
+    __type(key, struct affinity_key);
+    __type(value, struct affinity_value);
+} affinity_map SEC(".maps");
+
+// stats_map contains the datapath counters indexed by STATS_*, one value per CPU so that no atomic operations are
+// required. User space adds up the values of all the CPUs
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, NUMBER_STATS);
+    __type(key, __u32);
+    __type(value, __u64);
+} stats_map SEC(".maps");
+
+// count increments the datapath counter
+static __always_inline void count(__u32 stat) {
+    __u64 *value = bpf_map_lookup_elem(&stats_map, &stat);
+    if (value)
+        *value += 1;
+}
+
 // parse_headers parses the Ethernet, IP, and TCP headers from the skb
 static __always_inline int parse_headers(struct __sk_buff *skb, struct ethhdr **eth, struct iphdr **ip, struct tcphdr **tcp) {
     void *data = (void *)(long)skb->data;
@@ -45,6 +151,143 @@ static __always_inline int parse_headers(struct __sk_buff *skb, struct ethhdr **
     return 1;
 }
 
+// build_affinity_key derives the affinity key of the client according to the policy of the service
+static __always_inline struct affinity_key build_affinity_key(__u32 policy, struct iphdr *ip, struct tcphdr *tcp) {
+    struct affinity_key key = {
+        .service_port = tcp->dest,
+    };
+
+    switch (policy) {
+    case AFFINITY_SOURCE_IP:
+        key.src_ip = ip->saddr;
+        break;
+    case AFFINITY_NONE:
+    case AFFINITY_SOURCE_IP_PORT:
+        key.src_ip = ip->saddr;
+        key.src_port = tcp->source;
+        break;
+    case AFFINITY_SOURCE_SUBNET:
+        key.src_ip = ip->saddr & __constant_htonl(AFFINITY_SOURCE_SUBNET_MASK);
+        break;
+    }
+
+    return key;
+}
+
+// hash_key hashes the affinity key with CRC32 spread by the murmur3 finalizer, as Crc32Hasher does in user space
+static __always_inline __u32 hash_key(struct affinity_key *key) {
+    __u8 *data = (__u8 *)key;
+    __u32 hash = 0xFFFFFFFF;
+
+#pragma unroll
+    for (int i = 0; i < sizeof(*key); i++) {
+        hash ^= data[i];
+        // Multiplied rather than masked with -(hash & 1), the verifier forks its state on each 0/-1 mask
+#pragma unroll
+        for (int bit = 0; bit < 8; bit++)
+            hash = (hash >> 1) ^ ((hash & 1) * CRC32_POLY);
+    }
+    hash = ~hash;
+
+    hash ^= hash >> 16;
+    hash *= FMIX32_MULT1;
+    hash ^= hash >> 13;
+    hash *= FMIX32_MULT2;
+    hash ^= hash >> 16;
+
+    return hash;
+}
+
+// ring_lookup returns the node owning the hash in the ring of the service, that is, the first virtual node whose hash
+// is greater or equal than the hash, wrapping around the ring. Returns NULL if the ring is empty
+static __always_inline struct ring_entry *ring_lookup(__u32 slot, __u32 hash) {
+    __u32 *generation = bpf_map_lookup_elem(&ring_generation_map, &slot);
+    if (!generation)
+        return NULL;
+
+    __u32 set = (*generation % NUMBER_RING_GENERATIONS) * MAX_NUMBER_SERVICES + slot;
+    __u32 *size = bpf_map_lookup_elem(&ring_size_map, &set);
+    if (!size || *size == 0 || *size > MAX_NUMBER_VIRTUAL_NODE_ENTRIES)
+        return NULL;
+
+    __u32 base = set * MAX_NUMBER_VIRTUAL_NODE_ENTRIES;
+    __u32 low = 0, high = *size;
+
+    for (int step = 0; step < RING_SEARCH_STEPS && low < high; step++) {
+        __u32 mid = low + (high - low) / 2;
+        __u32 idx = base + mid;
+
+        struct ring_entry *entry = bpf_map_lookup_elem(&ring_map, &idx);
+        if (!entry)
+            return NULL;
+
+        if (entry->hash < hash)
+            low = mid + 1;
+        else
+            high = mid;
+    }
+
+    if (low >= *size)
+        low = 0;
+
+    __u32 idx = base + low;
+    return bpf_map_lookup_elem(&ring_map, &idx);
+}
+
+// conn_live returns whether the connection is still routed to its backend, that is, it has been seen within the idle
+// timeout, or the closing timeout once the client closed it
+static __always_inline int conn_live(struct conn_state *state, __u64 now) {
+    __u64 timeout = state->closing ? CONNTRACK_CLOSING_TIMEOUT_NS : CONNTRACK_IDLE_TIMEOUT_NS;
+    return now - state->last_seen_ns < timeout;
+}
+
+// touch_affinity refreshes the affinity entry of the client, so that clients active on long lived connections are
+// kept on their backend across reconnects
+static __always_inline void touch_affinity(struct service_config *svc, struct iphdr *ip, struct tcphdr *tcp, __u64 now) {
+    if (svc->affinity_policy == AFFINITY_NONE || svc->affinity_timeout_ns == 0)
+        return;
+
+    struct affinity_key key = build_affinity_key(svc->affinity_policy, ip, tcp);
+    struct affinity_value *entry = bpf_map_lookup_elem(&affinity_map, &key);
+    if (entry && now - entry->last_seen_ns < svc->affinity_timeout_ns)
+        entry->last_seen_ns = now;
+}
+
+// select_backend returns the backend IP (network byte order) for the connection, or 0 if the service has no backend.
+// Clients with a live entry in the affinity table are kept on the same backend, otherwise the backend is selected
+// from the ring of the service and recorded for the client
+static __always_inline __u32 select_backend(struct service_config *svc, struct iphdr *ip, struct tcphdr *tcp) {
+    struct affinity_key key = build_affinity_key(svc->affinity_policy, ip, tcp);
+    int affinity = svc->affinity_policy != AFFINITY_NONE && svc->affinity_timeout_ns != 0;
+    __u64 now = bpf_ktime_get_ns();
+
+    if (affinity) {
+        struct affinity_value *entry = bpf_map_lookup_elem(&affinity_map, &key);
+        if (entry && now - entry->last_seen_ns < svc->affinity_timeout_ns) {
+            entry->last_seen_ns = now;
+            count(STATS_AFFINITY_HITS);
+            return entry->node.ip;
+        }
+
+        count(STATS_AFFINITY_MISSES);
+    }
+
+    struct ring_entry *owner = ring_lookup(svc->slot, hash_key(&key));
+    if (!owner)
+        return 0;
+
+    // Record the backend selected by the ring, so that the client stays on it even if the ring changes
+    if (affinity) {
+        struct affinity_value value = {
+            .node = owner->node,
+            .last_seen_ns = now,
+        };
+        bpf_map_update_elem(&affinity_map, &key, &value, BPF_ANY);
+    }
+
+    return owner->node.ip;
+}
+
 SEC("tc_ingress")
 int dnat_prog(struct __sk_buff *skb) {
     struct ethhdr *eth;
@@ -54,35 +297,69 @@ int dnat_prog(struct __sk_buff *skb) {
     if (!parse_headers(skb, &eth, &ip, &tcp))
         return TC_ACT_OK;
 
-    if (tcp->dest != __constant_htons(TARGET_PORT))
+    __u16 service_port = tcp->dest;
+    struct service_config *svc = bpf_map_lookup_elem(&service_map, &service_port);
+    if (!svc) {
+        count(STATS_INGRESS_IGNORED);
         return TC_ACT_OK;
+    }
 
-    // Build connection tuple
-    struct conn_tuple tuple = {
-        .src_ip = ip->saddr,
-        .dst_ip = ip->daddr,
-        .src_port = tcp->source,
-        .dst_port = tcp->dest,
-        .protocol = ip->protocol,
-    };
+    // Build connection tuple, zeroed first as the padding is part of the key
+    struct conn_tuple tuple;
+    __builtin_memset(&tuple, 0, sizeof(tuple));
+    tuple.src_ip = ip->saddr;
+    tuple.dst_ip = ip->daddr;
+    tuple.src_port = tcp->source;
+    tuple.dst_port = tcp->dest;
+    tuple.protocol = ip->protocol;
 
-    // Save original source IP to keep track of the connection
-    __u32 orig_ip = ip->saddr;
-    bpf_map_update_elem(&conntrack_map, &tuple, &orig_ip, BPF_ANY);
+    __u64 now = bpf_ktime_get_ns();
+    __u32 backend;
+
+    // Packets of live connections keep going to their backend, even if the ring or the affinity table changed since
+    // the connection was opened. A SYN on a closed connection opens a new one, as clients reuse their source ports
+    struct conn_state *tracked = bpf_map_lookup_elem(&conntrack_map, &tuple);
+    if (tracked && conn_live(tracked, now) && !(tcp->syn && tracked->closing)) {
+        backend = tracked->backend;
+        tracked->last_seen_ns = now;
+        if (tcp->fin || tcp->rst)
+            tracked->closing = 1;
+        touch_affinity(svc, ip, tcp, now);
+        count(STATS_CONNTRACK_HITS);
+    } else {
+        // Packets of services without backends (ex: all the nodes are down) are dropped
+        backend = select_backend(svc, ip, tcp);
+        if (!backend) {
+            count(STATS_INGRESS_NO_BACKEND);
+            return TC_ACT_SHOT;
+        }
+
+        // Save original source IP and the backend to keep track of the connection
+        struct conn_state state = {
+            .orig_ip = ip->saddr,
+            .backend = backend,
+            .last_seen_ns = now,
+            .closing = tcp->fin || tcp->rst,
+        };
+        bpf_map_update_elem(&conntrack_map, &tuple, &state, BPF_ANY);
+    }
 
     // DNAT + SNAT
     __u32 old_daddr = ip->daddr;
     __u32 old_saddr = ip->saddr;
+    __u32 new_saddr = __constant_htonl(LB_IP);
 
-    ip->daddr = __constant_htonl(BACKEND_IP);
-    ip->saddr = __constant_htonl(LB_IP);
+    ip->daddr = backend;
+    ip->saddr = new_saddr;
 
-    // Checksums
-    bpf_l3_csum_replace(skb, offsetof(struct iphdr, check), old_daddr, ip->daddr, sizeof(__u32));
-    bpf_l4_csum_replace(skb, offsetof(struct tcphdr, check), old_daddr, ip->daddr, sizeof(__u32));
+    // Checksums, the packet must not be read past the first helper call as it invalidates the packet pointers
+    bpf_l3_csum_replace(skb, IP_CSUM_OFF, old_daddr, backend, sizeof(__u32));
+    bpf_l4_csum_replace(skb, TCP_CSUM_OFF, old_daddr, backend, BPF_F_PSEUDO_HDR | sizeof(__u32));
 
-    bpf_l3_csum_replace(skb, offsetof(struct iphdr, check), old_saddr, ip->saddr, sizeof(__u32));
-    bpf_l4_csum_replace(skb, offsetof(struct tcphdr, check), old_saddr, ip->saddr, sizeof(__u32));
+    bpf_l3_csum_replace(skb, IP_CSUM_OFF, old_saddr, new_saddr, sizeof(__u32));
+    bpf_l4_csum_replace(skb, TCP_CSUM_OFF, old_saddr, new_saddr, BPF_F_PSEUDO_HDR | sizeof(__u32));
+
+    count(STATS_INGRESS_ROUTED);
 
     return TC_ACT_OK;
 }
@@ -106,15 +383,18 @@ int snat_prog(struct __sk_buff *skb) {
     };
 
     // Check if we have a mapping for the reverse tuple in order to restore the original source IP
-    __u32 *orig_ip = bpf_map_lookup_elem(&conntrack_map, &rev_tuple);
-    if (!orig_ip)
+    struct conn_state *state = bpf_map_lookup_elem(&conntrack_map, &rev_tuple);
+    if (!state)
         return TC_ACT_OK;
 
     __u32 old_saddr = ip->saddr;
-    ip->saddr = *orig_ip;
+    __u32 new_saddr = state->orig_ip;
+    ip->saddr = new_saddr;
+
+    bpf_l3_csum_replace(skb, IP_CSUM_OFF, old_saddr, new_saddr, sizeof(__u32));
+    bpf_l4_csum_replace(skb, TCP_CSUM_OFF, old_saddr, new_saddr, BPF_F_PSEUDO_HDR | sizeof(__u32));
 
-    bpf_l3_csum_replace(skb, offsetof(struct iphdr, check), old_saddr, ip->saddr, sizeof(__u32));
-    bpf_l4_csum_replace(skb, offsetof(struct tcphdr, check), old_saddr, ip->saddr, sizeof(__u32));
+    count(STATS_EGRESS_RESTORED);
 
     return TC_ACT_OK;
 }
@@ -1,16 +1,73 @@
 package routing
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	"net/netip"
+	"reflect"
+	"sync"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/yago-123/galelb/pkg/common"
+	"github.com/yago-123/galelb/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	lbConfig "github.com/yago-123/galelb/config/lb"
 )
 
+const (
+	tracerName = "github.com/yago-123/galelb/pkg/routing"
+)
+
+var (
+	ErrUnknownService = errors.New("unknown service")
+)
+
+// service contains the routing parameters of a service
+type service struct {
+	name string
+	port uint16
+	// slot is the index of the service in the datapath maps
+	slot     uint32
+	affinity AffinityPolicy
+	// affinityTimeout is the time that clients are kept on the same backend since their last packet. Zero disables
+	// the affinity table, so only the open connections of the clients are kept on their backend
+	affinityTimeout time.Duration
+
+	// ring contains the nodes of the active pools of the service
+	ring  *ring
+	pools *poolSelector
+
+	// cfg is the configuration from which the service was created, services whose configuration does not change on
+	// reloads are kept as they are
+	cfg lbConfig.Service
+}
+
 type Router struct {
-	ring *ring
-	xdp  *xdp
+	xdp *xdp
+
+	// services contains the routing parameters of each service indexed by port. Replaced on configuration reloads
+	// while holding both syncLock and servicesLock, so reading it requires either of them
+	services        map[uint16]*service
+	servicesLock    sync.RWMutex
+	numVirtualNodes int
+
+	// eligible contains the nodes eligible for routing from the last sync, failbackTimer triggers a new sync once a
+	// pending failback can happen. Both protected by syncLock
+	eligible      []netip.Addr
+	failbackTimer *time.Timer
+	syncLock      sync.Mutex
+
+	metrics *routerMetrics
+
+	logger *logrus.Logger
 }
 
 func New(cfg *lbConfig.Config, numVirtualNodes int) (*Router, error) {
@@ -18,22 +75,318 @@ func New(cfg *lbConfig.Config, numVirtualNodes int) (*Router, error) {
 		return nil, fmt.Errorf("number of virtual nodes cannot be less than 1")
 	}
 
-	routerProg := newXDP(cfg.Logger, cfg.Local.NetIfacePublic, cfg.Local.NetIfacePrivate, cfg.Local.ClientsPort)
-	if err := routerProg.loadProgram(); err != nil {
+	if numVirtualNodes > MaxRingEntries {
+		return nil, fmt.Errorf("number of virtual nodes cannot be greater than %d", MaxRingEntries)
+	}
+
+	// todo(): add num virtual nodes to load balancer configuration
+	services, err := parseServices(cfg.Services, numVirtualNodes)
+	if err != nil {
+		return nil, err
+	}
+
+	routerProg := newXDP(cfg.Logger, cfg.PublicInterface.NetIfacePublic, cfg.PrivateInterface.NetIfacePrivate, cfg.PublicInterface.ClientsPort)
+	if err = routerProg.loadProgram(); err != nil {
 		return nil, fmt.Errorf("failed to load XDP program: %w", err)
 	}
 
+	if err = routerProg.updateServices(context.Background(), services); err != nil {
+		return nil, fmt.Errorf("failed to load services into XDP program: %w", err)
+	}
+
 	return &Router{
-		// todo(): add num virtual nodes to load balancer configuration
-		ring: newRing(Crc32Hasher, numVirtualNodes),
-		xdp:  routerProg,
+		xdp:             routerProg,
+		services:        services,
+		numVirtualNodes: numVirtualNodes,
+		eligible:        []netip.Addr{},
+		metrics:         newRouterMetrics(),
+		logger:          cfg.Logger,
 	}, nil
 }
 
-func (r *Router) AddNode(nodeKey common.AddrKey) {
-	r.ring.addNode(nodeKey)
+// GetNode returns the node that serves the flow. Clients with a live entry in the affinity table of the datapath are
+// kept on the same node, otherwise the node is selected from the ring based on the affinity policy of the service
+func (r *Router) GetNode(flow Flow) (common.AddrKey, error) {
+	svc, ok := r.service(flow.ServicePort)
+	if !ok {
+		return common.AddrKey{}, fmt.Errorf("%w: no service listening on port %d", ErrUnknownService, flow.ServicePort)
+	}
+
+	key := newAffinityKey(svc.affinity, flow)
+	if svc.affinity != AffinityNone && svc.affinityTimeout > 0 {
+		node, found, err := r.xdp.lookupAffinity(key, svc.affinityTimeout)
+		if err != nil {
+			return common.AddrKey{}, err
+		}
+
+		if found {
+			return node, nil
+		}
+	}
+
+	return svc.ring.getNode(key.bytes())
+}
+
+// ValidateConfig checks that the services of a reloaded configuration are valid
+func (r *Router) ValidateConfig(cfg *lbConfig.Config) error {
+	if _, err := parseServices(cfg.Services, r.numVirtualNodes); err != nil {
+		return fmt.Errorf("invalid services: %w", err)
+	}
+
+	return nil
+}
+
+// ApplyConfig applies the services of a reloaded configuration. Services whose configuration did not change keep their
+// ring and active pools, so their clients are not moved
+func (r *Router) ApplyConfig(cfg *lbConfig.Config) {
+	if err := r.UpdateServices(context.Background(), cfg.Services); err != nil {
+		r.logger.Errorf("failed to apply reloaded services: %v", err)
+	}
+}
+
+// UpdateServices replaces the services routed by the load balancer. New and changed services start with a new ring
+// filled with the nodes eligible from the last sync, services removed stop being routed
+func (r *Router) UpdateServices(ctx context.Context, cfgServices []lbConfig.Service) error {
+	services, err := parseServices(cfgServices, r.numVirtualNodes)
+	if err != nil {
+		return err
+	}
+
+	r.syncLock.Lock()
+	defer r.syncLock.Unlock()
+
+	r.servicesLock.Lock()
+	removed := []uint16{}
+	for port, svc := range r.services {
+		next, ok := services[port]
+		if !ok {
+			removed = append(removed, port)
+			continue
+		}
+
+		if svc.slot == next.slot && reflect.DeepEqual(svc.cfg, next.cfg) {
+			services[port] = svc
+		}
+	}
+	r.services = services
+	r.servicesLock.Unlock()
+
+	// Fill the rings before pointing the services to them, so that packets are never routed with an empty ring
+	if err = r.sync(ctx); err != nil {
+		return err
+	}
+
+	if err = r.xdp.updateServices(ctx, services); err != nil {
+		return fmt.Errorf("failed to load services into XDP program: %w", err)
+	}
+
+	if err = r.xdp.deleteServices(ctx, removed); err != nil {
+		return err
+	}
+
+	r.logger.Infof("updated routing with %d services, %d removed", len(services), len(removed))
+
+	return nil
+}
+
+// service returns the service listening on the port
+func (r *Router) service(port uint16) (*service, bool) {
+	r.servicesLock.RLock()
+	defer r.servicesLock.RUnlock()
+
+	svc, ok := r.services[port]
+	return svc, ok
+}
+
+// PurgeAffinity moves the clients kept on the node by the affinity table back to the ring selection. The connections
+// tracked to the node are forgotten too, otherwise the datapath keeps routing them to it until they go idle
+func (r *Router) PurgeAffinity(ctx context.Context, addr netip.Addr) error {
+	purged, err := r.xdp.purgeAffinity(ctx, nodeKey(addr, 0).IP)
+	if err != nil {
+		return err
+	}
+
+	forgotten, err := r.xdp.purgeConntrack(nodeKey(addr, 0).IP)
+	if err != nil {
+		return err
+	}
+
+	r.logger.Infof("purged %d affinity entries and %d tracked connections of node %s", purged, forgotten, addr)
+	return nil
+}
+
+// ServesClients returns whether any client is kept on the node by the affinity table of the datapath or by an open
+// connection to it, so that draining nodes are considered drained once all of them expire or close. The datapath keeps
+// routing the open connections to draining nodes, even of services without affinity
+func (r *Router) ServesClients(_ context.Context, addr netip.Addr) (bool, error) {
+	r.servicesLock.RLock()
+	timeouts := map[uint16]time.Duration{}
+	for port, svc := range r.services {
+		if svc.affinity != AffinityNone && svc.affinityTimeout > 0 {
+			timeouts[networkOrder16(port)] = svc.affinityTimeout
+		}
+	}
+	r.servicesLock.RUnlock()
+
+	return r.xdp.servesClients(nodeKey(addr, 0).IP, timeouts)
+}
+
+// SyncEligibleNodes updates the rings of the services with the nodes eligible for routing. For each service, only the
+// nodes of its active pools are added to the ring. All the changes of a service result in a single update of the
+// datapath, so that events such as a mass node failure do not trigger one update per node
+func (r *Router) SyncEligibleNodes(ctx context.Context, eligible []netip.Addr) error {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "routing.SyncEligibleNodes", trace.WithAttributes(
+		attribute.Int(tracing.AttrEligible, len(eligible)),
+	))
+	defer span.End()
+
+	r.syncLock.Lock()
+	defer r.syncLock.Unlock()
+
+	r.eligible = eligible
+
+	if err := r.sync(ctx); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// sync recomputes the active pools and the rings of all services. Must be called with syncLock held
+func (r *Router) sync(ctx context.Context) error {
+	var errs []error
+	nextFailback := time.Duration(0)
+
+	for _, svc := range r.services {
+		previousPool := svc.pools.activePool()
+		changed, failbackIn := svc.pools.update(r.eligible, time.Now())
+		if changed {
+			r.logger.Infof("service %s switched active pools from %s to %s", svc.name, previousPool, svc.pools.activePool())
+			r.metrics.poolSwitched(svc.name)
+		}
+
+		if failbackIn > 0 && (nextFailback == 0 || failbackIn < nextFailback) {
+			nextFailback = failbackIn
+		}
+
+		if err := r.syncService(ctx, svc, svc.pools.members(r.eligible)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to sync service %s: %w", svc.name, err))
+		}
+	}
+
+	// Failbacks depend on time passing, not only on membership changes, so schedule a new sync for them
+	if r.failbackTimer != nil {
+		r.failbackTimer.Stop()
+		r.failbackTimer = nil
+	}
+
+	if nextFailback > 0 {
+		r.failbackTimer = time.AfterFunc(nextFailback, func() {
+			r.syncLock.Lock()
+			defer r.syncLock.Unlock()
+
+			// Failbacks are not triggered by any change of the registry, so they start their own trace
+			if err := r.sync(context.Background()); err != nil {
+				r.logger.Errorf("failed to sync routing after failback delay: %v", err)
+			}
+		})
+	}
+
+	return errors.Join(errs...)
 }
 
-func (r *Router) RemoveNode(nodeKey common.AddrKey) {
-	r.ring.removeNode(nodeKey)
+// syncService replaces the nodes of the ring of the service with members in a single batch
+func (r *Router) syncService(ctx context.Context, svc *service, members []netip.Addr) error {
+	desired := make(map[common.AddrKey]struct{}, len(members))
+	for _, addr := range members {
+		desired[nodeKey(addr, svc.port)] = struct{}{}
+	}
+
+	current := map[common.AddrKey]struct{}{}
+	remove := []common.AddrKey{}
+	for _, node := range svc.ring.nodes() {
+		current[node] = struct{}{}
+		if _, ok := desired[node]; !ok {
+			remove = append(remove, node)
+		}
+	}
+
+	add := []common.AddrKey{}
+	for node := range desired {
+		if _, ok := current[node]; !ok {
+			add = append(add, node)
+		}
+	}
+
+	snapshot, changed, err := svc.ring.apply(add, remove)
+	if err != nil {
+		return fmt.Errorf("failed to update ring: %w", err)
+	}
+
+	if !changed {
+		return nil
+	}
+
+	r.metrics.ringChanged(svc.name, len(add), len(remove))
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "routing.UpdateRing", trace.WithAttributes(
+		attribute.String(tracing.AttrService, svc.name),
+		attribute.Int(tracing.AttrNodesAdded, len(add)),
+		attribute.Int(tracing.AttrNodesRemoved, len(remove)),
+	))
+	defer span.End()
+
+	return r.xdp.updateRing(ctx, svc.slot, snapshot)
+}
+
+// nodeKey returns the datapath representation (network byte order) of a node serving a service
+func nodeKey(addr netip.Addr, port uint16) common.AddrKey {
+	ip := addr.As4()
+	return common.AddrKey{
+		IP:   binary.NativeEndian.Uint32(ip[:]),
+		Port: networkOrder16(port),
+	}
+}
+
+// parseServices converts the services from the configuration into their routing parameters
+func parseServices(cfgServices []lbConfig.Service, numVirtualNodes int) (map[uint16]*service, error) {
+	if len(cfgServices) > MaxServices {
+		return nil, fmt.Errorf("number of services cannot be greater than %d", MaxServices)
+	}
+
+	services := make(map[uint16]*service, len(cfgServices))
+	for slot, cfgService := range cfgServices {
+		if cfgService.Port < 1 || cfgService.Port > math.MaxUint16 {
+			return nil, fmt.Errorf("invalid port %d for service %s", cfgService.Port, cfgService.Name)
+		}
+		port := uint16(cfgService.Port)
+
+		if _, ok := services[port]; ok {
+			return nil, fmt.Errorf("port %d is used by more than one service", port)
+		}
+
+		affinity, err := ParseAffinityPolicy(cfgService.Affinity)
+		if err != nil {
+			return nil, fmt.Errorf("invalid affinity for service %s: %w", cfgService.Name, err)
+		}
+
+		pools, err := newPoolSelector(cfgService.Pools, cfgService.FailbackDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pools for service %s: %w", cfgService.Name, err)
+		}
+
+		services[port] = &service{
+			name:            cfgService.Name,
+			port:            port,
+			slot:            uint32(slot), //nolint:gosec // bounded by MaxServices
+			affinity:        affinity,
+			affinityTimeout: cfgService.AffinityTimeout,
+			ring:            newRing(Crc32Hasher, numVirtualNodes),
+			pools:           pools,
+			cfg:             cfgService,
+		}
+	}
+
+	return services, nil
 }
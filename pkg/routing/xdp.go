@@ -2,11 +2,22 @@ package routing
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
 
 	"github.com/cilium/ebpf/rlimit"
+	"github.com/yago-123/galelb/pkg/common"
+	"github.com/yago-123/galelb/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/sirupsen/logrus"
 
@@ -17,17 +28,98 @@ import (
 //go:embed xdp_obj/xdp_router.o
 var xdpProg []byte
 
+var ErrMissingMap = errors.New("XDP object does not contain map")
+
 const (
 	RouterXDPProgPath = "pkg/routing/xdp_obj/xdp_router.o"
 	DNATXDPProgName   = "dnat_prog"
 	SNATXDPProgName   = "snat_prog"
+
+	RingMapName           = "ring_map"
+	RingSizeMapName       = "ring_size_map"
+	RingGenerationMapName = "ring_generation_map"
+	ServiceMapName        = "service_map"
+	AffinityMapName       = "affinity_map"
+	ConntrackMapName      = "conntrack_map"
+	StatsMapName          = "stats_map"
 )
 
+// ringEntry is the user space representation of the ring entries in the datapath (must match C struct)
+type ringEntry struct {
+	Hash uint32
+	Node common.AddrKey
+}
+
+// serviceConfig is the user space representation of the service config in the datapath (must match C struct)
+type serviceConfig struct {
+	Slot              uint32
+	AffinityPolicy    uint32
+	AffinityTimeoutNs uint64
+}
+
+// affinityValue is the user space representation of the affinity entries in the datapath (must match C struct)
+type affinityValue struct {
+	Node       common.AddrKey
+	LastSeenNs uint64
+}
+
+// connTuple and connState are the user space representation of the conntrack entries in the datapath (must match C
+// structs)
+type connTuple struct {
+	SrcIP    uint32
+	DstIP    uint32
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+	Pad      [3]uint8
+}
+
+type connState struct {
+	OrigIP     uint32
+	Backend    uint32
+	LastSeenNs uint64
+	Closing    uint32
+	Pad        uint32
+}
+
+// live returns whether the client has been seen within the timeout, now being read from the monotonic clock
+func (v affinityValue) live(now uint64, timeout time.Duration) bool {
+	return now-v.LastSeenNs < uint64(timeout.Nanoseconds()) //nolint:gosec // durations are positive
+}
+
+// live returns whether the datapath keeps routing the connection to its backend, now being read from the monotonic
+// clock
+func (s connState) live(now uint64) bool {
+	timeout := uint64(conntrackIdleTimeoutNs)
+	if s.Closing != 0 {
+		timeout = conntrackClosingTimeoutNs
+	}
+
+	return now-s.LastSeenNs < timeout
+}
+
 type xdp struct {
 	pubNetInterface  string
 	privNetInterface string
 	port             int
-	logger           *logrus.Logger
+
+	// ringMap and ringSizeMap contain the consistent hashing rings used by the datapath, two generations per service.
+	// ringGenerationMap contains the generation used by each service
+	ringMap           *ebpf.Map
+	ringSizeMap       *ebpf.Map
+	ringGenerationMap *ebpf.Map
+
+	// serviceMap contains the routing parameters of each service, affinityMap keeps clients on the same backend
+	serviceMap  *ebpf.Map
+	affinityMap *ebpf.Map
+
+	// conntrackMap contains the connections routed by the datapath, kept on their backend while live
+	conntrackMap *ebpf.Map
+
+	// statsMap contains the datapath counters, one value per CPU
+	statsMap *ebpf.Map
+
+	logger *logrus.Logger
 }
 
 func newXDP(logger *logrus.Logger, pubNetInterface, privNetInterface string, incomingReqPort int) *xdp {
@@ -57,6 +149,23 @@ func (r *xdp) loadProgram() error {
 	}
 	defer collection.Close()
 
+	// Detach the maps from the collection so that they outlive it and can be updated from user space. The datapath
+	// cannot route traffic without any of them, objects built from older sources are rejected
+	maps := map[string]**ebpf.Map{
+		RingMapName:           &r.ringMap,
+		RingSizeMapName:       &r.ringSizeMap,
+		RingGenerationMapName: &r.ringGenerationMap,
+		ServiceMapName:        &r.serviceMap,
+		AffinityMapName:       &r.affinityMap,
+		ConntrackMapName:      &r.conntrackMap,
+		StatsMapName:          &r.statsMap,
+	}
+	for name, m := range maps {
+		if *m = collection.DetachMap(name); *m == nil {
+			return fmt.Errorf("%w: %s", ErrMissingMap, name)
+		}
+	}
+
 	// Retrieve DNAT as SNAT programs from the collection
 	progDNAT, found := collection.Programs[DNATXDPProgName]
 	if !found {
@@ -104,10 +213,310 @@ func (r *xdp) loadProgram() error {
 	return nil
 }
 
+// updateRing writes the ring snapshot of the service in the slot into the datapath. The entries and the size are
+// written into the generation not used by the datapath, after that, the generation of the service is flipped with a
+// single write so that the datapath never reads a ring that is half written
+func (r *xdp) updateRing(ctx context.Context, slot uint32, snapshot *ringSnapshot) error {
+	if r.ringMap == nil || r.ringSizeMap == nil || r.ringGenerationMap == nil {
+		return nil
+	}
+
+	_, span := otel.Tracer(tracerName).Start(ctx, "datapath.UpdateRing", trace.WithAttributes(
+		attribute.Int64(tracing.AttrRingSlot, int64(slot)),
+		attribute.Int(tracing.AttrRingEntries, len(snapshot.hashes)),
+	))
+	defer span.End()
+
+	var generation uint32
+	if err := r.ringGenerationMap.Lookup(slot, &generation); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("failed to lookup ring generation: %w", err)
+	}
+	next := (generation + 1) % RingGenerations
+
+	// Each generation of each service owns MaxRingEntries consecutive entries of the ring map
+	set := next*MaxServices + slot
+	offset := set * MaxRingEntries
+
+	keys := make([]uint32, len(snapshot.hashes))
+	values := make([]ringEntry, len(snapshot.hashes))
+	for i, hash := range snapshot.hashes {
+		keys[i] = offset + uint32(i) //nolint:gosec // bounded by MaxRingEntries
+		values[i] = ringEntry{Hash: hash, Node: snapshot.owners[i]}
+	}
+
+	if len(keys) > 0 {
+		if _, err := r.ringMap.BatchUpdate(keys, values, nil); err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return fmt.Errorf("failed to update ring map: %w", err)
+		}
+	}
+
+	if err := r.ringSizeMap.Put(set, uint32(len(keys))); err != nil { //nolint:gosec // bounded by MaxRingEntries
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("failed to update ring size map: %w", err)
+	}
+
+	if err := r.ringGenerationMap.Put(slot, next); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("failed to update ring generation map: %w", err)
+	}
+
+	r.logger.Debugf("updated datapath ring of slot %d with %d entries (generation %d)", slot, len(keys), next)
+
+	return nil
+}
+
+// updateServices writes the routing parameters of the services into the datapath
+func (r *xdp) updateServices(ctx context.Context, services map[uint16]*service) error {
+	if r.serviceMap == nil {
+		return nil
+	}
+
+	_, span := otel.Tracer(tracerName).Start(ctx, "datapath.UpdateServices")
+	defer span.End()
+
+	for port, svc := range services {
+		cfg := serviceConfig{
+			Slot:              svc.slot,
+			AffinityPolicy:    uint32(svc.affinity),
+			AffinityTimeoutNs: uint64(svc.affinityTimeout.Nanoseconds()), //nolint:gosec // durations are positive
+		}
+
+		if err := r.serviceMap.Put(networkOrder16(port), cfg); err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return fmt.Errorf("failed to update service %s: %w", svc.name, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteServices removes the services listening on the ports from the datapath, their packets are no longer routed
+func (r *xdp) deleteServices(ctx context.Context, ports []uint16) error {
+	if r.serviceMap == nil || len(ports) == 0 {
+		return nil
+	}
+
+	_, span := otel.Tracer(tracerName).Start(ctx, "datapath.DeleteServices")
+	defer span.End()
+
+	for _, port := range ports {
+		if err := r.serviceMap.Delete(networkOrder16(port)); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			span.SetStatus(codes.Error, err.Error())
+			return fmt.Errorf("failed to delete service on port %d: %w", port, err)
+		}
+	}
+
+	return nil
+}
+
+// lookupAffinity returns the node assigned to the client in the affinity table of the datapath, as long as the client
+// has been seen within the timeout
+func (r *xdp) lookupAffinity(key affinityKey, timeout time.Duration) (common.AddrKey, bool, error) {
+	if r.affinityMap == nil {
+		return common.AddrKey{}, false, nil
+	}
+
+	var value affinityValue
+	if err := r.affinityMap.Lookup(key, &value); err != nil {
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			return common.AddrKey{}, false, nil
+		}
+		return common.AddrKey{}, false, fmt.Errorf("failed to lookup affinity table: %w", err)
+	}
+
+	now, err := monotonicNow()
+	if err != nil {
+		return common.AddrKey{}, false, err
+	}
+
+	if !value.live(now, timeout) {
+		return common.AddrKey{}, false, nil
+	}
+
+	return value.Node, true, nil
+}
+
+// servesClients returns whether any client is kept on the node IP (network byte order) by the affinity table or by a
+// live connection tracked by the datapath. Affinity entries are live within the timeout of the service port (network
+// byte order) they belong to
+func (r *xdp) servesClients(ip uint32, timeouts map[uint16]time.Duration) (bool, error) {
+	now, err := monotonicNow()
+	if err != nil {
+		return false, err
+	}
+
+	if r.affinityMap != nil {
+		var key affinityKey
+		var value affinityValue
+		entries := r.affinityMap.Iterate()
+		for entries.Next(&key, &value) {
+			if timeout, ok := timeouts[key.ServicePort]; ok && value.Node.IP == ip && value.live(now, timeout) {
+				return true, nil
+			}
+		}
+		if err = entries.Err(); err != nil {
+			return false, fmt.Errorf("failed to iterate affinity table: %w", err)
+		}
+	}
+
+	if r.conntrackMap != nil {
+		var tuple connTuple
+		var state connState
+		entries := r.conntrackMap.Iterate()
+		for entries.Next(&tuple, &state) {
+			if state.Backend == ip && state.live(now) {
+				return true, nil
+			}
+		}
+		if err = entries.Err(); err != nil {
+			return false, fmt.Errorf("failed to iterate conntrack table: %w", err)
+		}
+	}
+
+	return false, nil
+}
+
+// lookupConntrack returns the backend IP (network byte order) to which the datapath keeps routing the live connection
+// from the client source IP and port (network byte order) towards the service port (network byte order). The
+// connections are tracked by their destination address too, which is not known by the clients, so the entries are
+// walked instead of looked up
+func (r *xdp) lookupConntrack(srcIP uint32, srcPort, servicePort uint16) (uint32, bool, error) {
+	if r.conntrackMap == nil {
+		return 0, false, nil
+	}
+
+	now, err := monotonicNow()
+	if err != nil {
+		return 0, false, err
+	}
+
+	var tuple connTuple
+	var state connState
+	entries := r.conntrackMap.Iterate()
+	for entries.Next(&tuple, &state) {
+		if tuple.SrcIP == srcIP && tuple.SrcPort == srcPort && tuple.DstPort == servicePort &&
+			tuple.Protocol == unix.IPPROTO_TCP && state.live(now) {
+			return state.Backend, true, nil
+		}
+	}
+	if err = entries.Err(); err != nil {
+		return 0, false, fmt.Errorf("failed to iterate conntrack table: %w", err)
+	}
+
+	return 0, false, nil
+}
+
+// purgeAffinity removes the entries of the affinity table that point to the node IP (network byte order), so that
+// its clients are routed by the ring again. Returns the number of entries removed
+func (r *xdp) purgeAffinity(ctx context.Context, ip uint32) (int, error) {
+	if r.affinityMap == nil {
+		return 0, nil
+	}
+
+	_, span := otel.Tracer(tracerName).Start(ctx, "datapath.PurgeAffinity")
+	defer span.End()
+
+	// Collect the keys first, deleting while iterating could make the iterator restart
+	var key affinityKey
+	var value affinityValue
+	stale := []affinityKey{}
+	entries := r.affinityMap.Iterate()
+	for entries.Next(&key, &value) {
+		if value.Node.IP == ip {
+			stale = append(stale, key)
+		}
+	}
+	if err := entries.Err(); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return 0, fmt.Errorf("failed to iterate affinity table: %w", err)
+	}
+
+	purged := 0
+	for _, staleKey := range stale {
+		if err := r.affinityMap.Delete(staleKey); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			span.SetStatus(codes.Error, err.Error())
+			return purged, fmt.Errorf("failed to delete affinity entry: %w", err)
+		}
+		purged++
+	}
+
+	span.SetAttributes(attribute.Int(tracing.AttrAffinityPurged, purged))
+	return purged, nil
+}
+
+// purgeConntrack removes the connections tracked to the node IP (network byte order), so that their next packets are
+// routed as new connections. Returns the number of entries removed
+func (r *xdp) purgeConntrack(ip uint32) (int, error) {
+	if r.conntrackMap == nil {
+		return 0, nil
+	}
+
+	// Collect the keys first, deleting while iterating could make the iterator restart
+	var tuple connTuple
+	var state connState
+	stale := []connTuple{}
+	entries := r.conntrackMap.Iterate()
+	for entries.Next(&tuple, &state) {
+		if state.Backend == ip {
+			stale = append(stale, tuple)
+		}
+	}
+	if err := entries.Err(); err != nil {
+		return 0, fmt.Errorf("failed to iterate conntrack table: %w", err)
+	}
+
+	purged := 0
+	for _, staleTuple := range stale {
+		if err := r.conntrackMap.Delete(staleTuple); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return purged, fmt.Errorf("failed to delete conntrack entry: %w", err)
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// stats returns the datapath counters added up across all the CPUs, indexed by name. Returns no counters if the
+// datapath has not been loaded
+func (r *xdp) stats() (map[string]uint64, error) {
+	counters := map[string]uint64{}
+	if r.statsMap == nil {
+		return counters, nil
+	}
+
+	for idx, name := range datapathStats {
+		var perCPU []uint64
+		if err := r.statsMap.Lookup(uint32(idx), &perCPU); err != nil { //nolint:gosec // bounded by NumberStats
+			return nil, fmt.Errorf("failed to lookup datapath counter %s: %w", name, err)
+		}
+
+		total := uint64(0)
+		for _, value := range perCPU {
+			total += value
+		}
+		counters[name] = total
+	}
+
+	return counters, nil
+}
+
 // func (r *xdp) unloadProgram() error {
 // 	return nil
 // }
 
+// monotonicNow returns the time of the monotonic clock, used by the datapath for timestamping entries
+// (bpf_ktime_get_ns)
+func monotonicNow() (uint64, error) {
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		return 0, fmt.Errorf("failed to read monotonic clock: %w", err)
+	}
+
+	return uint64(now.Nano()), nil //nolint:gosec // clocks are positive
+}
+
 func getInterfaceIndex(netInterface string) (int, error) {
 	iface, err := net.InterfaceByName(netInterface)
 	if err != nil {
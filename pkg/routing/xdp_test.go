@@ -0,0 +1,259 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/sirupsen/logrus"
+	"github.com/yago-123/galelb/pkg/common"
+)
+
+func TestXDP_embeddedObject(t *testing.T) {
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(xdpProg))
+	if err != nil {
+		t.Fatalf("failed to load XDP collection spec: %v", err)
+	}
+
+	// The embedded object must be built from the current sources, with maps matching the user space structs
+	maps := []struct {
+		name  string
+		key   uintptr
+		value uintptr
+	}{
+		{name: RingMapName, key: unsafe.Sizeof(uint32(0)), value: unsafe.Sizeof(ringEntry{})},
+		{name: RingSizeMapName, key: unsafe.Sizeof(uint32(0)), value: unsafe.Sizeof(uint32(0))},
+		{name: RingGenerationMapName, key: unsafe.Sizeof(uint32(0)), value: unsafe.Sizeof(uint32(0))},
+		{name: ServiceMapName, key: unsafe.Sizeof(uint16(0)), value: unsafe.Sizeof(serviceConfig{})},
+		{name: AffinityMapName, key: unsafe.Sizeof(affinityKey{}), value: unsafe.Sizeof(affinityValue{})},
+		{name: ConntrackMapName, key: unsafe.Sizeof(connTuple{}), value: unsafe.Sizeof(connState{})},
+		{name: StatsMapName, key: unsafe.Sizeof(uint32(0)), value: unsafe.Sizeof(uint64(0))},
+	}
+	for _, expected := range maps {
+		m, ok := spec.Maps[expected.name]
+		if !ok {
+			t.Fatalf("expected map %s in the XDP object", expected.name)
+		}
+		if uintptr(m.KeySize) != expected.key || uintptr(m.ValueSize) != expected.value {
+			t.Fatalf("expected map %s with key size %d and value size %d, got %d and %d",
+				expected.name, expected.key, expected.value, m.KeySize, m.ValueSize)
+		}
+	}
+
+	if m := spec.Maps[StatsMapName]; m.MaxEntries != NumberStats {
+		t.Fatalf("expected %d datapath counters, got %d", NumberStats, m.MaxEntries)
+	}
+
+	for _, name := range []string{DNATXDPProgName, SNATXDPProgName} {
+		if _, ok := spec.Programs[name]; !ok {
+			t.Fatalf("expected program %s in the XDP object", name)
+		}
+	}
+}
+
+// loadTestDatapath loads the embedded XDP object without attaching it, skipping the test if it cannot be loaded for
+// any reason other than the verifier rejecting the programs (ex: missing privileges)
+func loadTestDatapath(t *testing.T) (*xdp, *ebpf.Program) {
+	t.Helper()
+
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(xdpProg))
+	if err != nil {
+		t.Fatalf("failed to load XDP collection spec: %v", err)
+	}
+
+	if err = rlimit.RemoveMemlock(); err != nil {
+		t.Skipf("unable to remove memlock: %v", err)
+	}
+	collection, err := ebpf.NewCollection(spec)
+	var verifierErr *ebpf.VerifierError
+	if errors.As(err, &verifierErr) {
+		t.Fatalf("expected XDP programs to pass the verifier, got %+v", verifierErr)
+	}
+	if err != nil {
+		t.Skipf("unable to load XDP collection: %v", err)
+	}
+	t.Cleanup(func() {
+		collection.Close()
+	})
+
+	datapath := &xdp{
+		ringMap:           collection.Maps[RingMapName],
+		ringSizeMap:       collection.Maps[RingSizeMapName],
+		ringGenerationMap: collection.Maps[RingGenerationMapName],
+		serviceMap:        collection.Maps[ServiceMapName],
+		affinityMap:       collection.Maps[AffinityMapName],
+		conntrackMap:      collection.Maps[ConntrackMapName],
+		statsMap:          collection.Maps[StatsMapName],
+		logger:            logrus.New(),
+	}
+
+	return datapath, collection.Programs[DNATXDPProgName]
+}
+
+// tcpPacket returns an Ethernet frame carrying a TCP segment with the flags (byte 13 of the TCP header)
+func tcpPacket(src netip.AddrPort, dst netip.AddrPort, flags uint8) []byte {
+	packet := make([]byte, 14+20+20)
+	binary.BigEndian.PutUint16(packet[12:], 0x0800)
+
+	ip := packet[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], 40)
+	ip[8] = 64
+	ip[9] = 6
+	src4, dst4 := src.Addr().As4(), dst.Addr().As4()
+	copy(ip[12:], src4[:])
+	copy(ip[16:], dst4[:])
+
+	tcp := ip[20:]
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+
+	return packet
+}
+
+// routeTo runs the DNAT program over the packet and returns the backend to which it was routed
+func routeTo(t *testing.T, prog *ebpf.Program, packet []byte) netip.Addr {
+	t.Helper()
+
+	out := make([]byte, len(packet))
+	if _, err := prog.Run(&ebpf.RunOptions{Data: packet, DataOut: out}); err != nil {
+		t.Fatalf("failed to run DNAT program: %v", err)
+	}
+
+	return netip.AddrFrom4([4]byte(out[14+16 : 14+20]))
+}
+
+func TestXDP_conntrack(t *testing.T) {
+	datapath, prog := loadTestDatapath(t)
+	ctx := context.Background()
+
+	nodeA, nodeB := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	owned := func(node netip.Addr) *ringSnapshot {
+		return &ringSnapshot{hashes: []uint32{math.MaxUint32}, owners: []common.AddrKey{nodeKey(node, 0)}}
+	}
+
+	services := map[uint16]*service{8080: {name: "web", port: 8080, affinity: AffinityNone}}
+	if err := datapath.updateServices(ctx, services); err != nil {
+		t.Fatalf("failed to update services: %v", err)
+	}
+	if err := datapath.updateRing(ctx, 0, owned(nodeA)); err != nil {
+		t.Fatalf("failed to update ring: %v", err)
+	}
+
+	const syn, ack, fin = 0x02, 0x10, 0x01
+	client := netip.MustParseAddrPort("192.168.1.20:40000")
+	other := netip.MustParseAddrPort("192.168.1.20:40001")
+	lb := netip.MustParseAddrPort("192.168.0.242:8080")
+
+	if backend := routeTo(t, prog, tcpPacket(client, lb, syn)); backend != nodeA {
+		t.Fatalf("expected new connection routed to %s, got %s", nodeA, backend)
+	}
+
+	// Open connections stay on their backend once the ring changes, new connections follow the ring
+	if err := datapath.updateRing(ctx, 0, owned(nodeB)); err != nil {
+		t.Fatalf("failed to update ring: %v", err)
+	}
+	if backend := routeTo(t, prog, tcpPacket(client, lb, ack)); backend != nodeA {
+		t.Fatalf("expected open connection kept on %s, got %s", nodeA, backend)
+	}
+	if backend := routeTo(t, prog, tcpPacket(other, lb, syn)); backend != nodeB {
+		t.Fatalf("expected new connection routed to %s, got %s", nodeB, backend)
+	}
+
+	// Closing connections keep their backend, a new connection reusing the source port is routed afresh
+	if backend := routeTo(t, prog, tcpPacket(client, lb, fin|ack)); backend != nodeA {
+		t.Fatalf("expected closing connection kept on %s, got %s", nodeA, backend)
+	}
+	if backend := routeTo(t, prog, tcpPacket(client, lb, syn)); backend != nodeB {
+		t.Fatalf("expected reused source port routed to %s, got %s", nodeB, backend)
+	}
+
+	// Connections of purged nodes are routed as new ones
+	if _, err := datapath.purgeConntrack(nodeKey(nodeB, 0).IP); err != nil {
+		t.Fatalf("failed to purge conntrack: %v", err)
+	}
+	if err := datapath.updateRing(ctx, 0, owned(nodeA)); err != nil {
+		t.Fatalf("failed to update ring: %v", err)
+	}
+	if backend := routeTo(t, prog, tcpPacket(other, lb, ack)); backend != nodeA {
+		t.Fatalf("expected connection of purged node routed to %s, got %s", nodeA, backend)
+	}
+
+	counters, err := datapath.stats()
+	if err != nil {
+		t.Fatalf("failed to read counters: %v", err)
+	}
+	if counters[datapathStats[statsConntrackHits]] != 2 {
+		t.Fatalf("expected 2 conntrack hits, got %d", counters[datapathStats[statsConntrackHits]])
+	}
+}
+
+func TestXDP_connStateLive(t *testing.T) {
+	now := uint64(conntrackIdleTimeoutNs) * 2
+
+	tests := []struct {
+		name     string
+		state    connState
+		expected bool
+	}{
+		{name: "active", state: connState{LastSeenNs: now - 1}, expected: true},
+		{name: "idle", state: connState{LastSeenNs: now - conntrackIdleTimeoutNs}, expected: false},
+		{name: "closing", state: connState{LastSeenNs: now - conntrackClosingTimeoutNs + 1, Closing: 1}, expected: true},
+		{name: "closed", state: connState{LastSeenNs: now - conntrackClosingTimeoutNs, Closing: 1}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if live := tt.state.live(now); live != tt.expected {
+				t.Fatalf("expected live %t, got %t", tt.expected, live)
+			}
+		})
+	}
+}
+
+func TestXDP_servesClients(t *testing.T) {
+	datapath, prog := loadTestDatapath(t)
+	ctx := context.Background()
+
+	node := netip.MustParseAddr("10.0.0.1")
+	snapshot := &ringSnapshot{hashes: []uint32{math.MaxUint32}, owners: []common.AddrKey{nodeKey(node, 0)}}
+
+	// Services without affinity are only served through the open connections
+	services := map[uint16]*service{8080: {name: "web", port: 8080, affinity: AffinityNone}}
+	if err := datapath.updateServices(ctx, services); err != nil {
+		t.Fatalf("failed to update services: %v", err)
+	}
+	if err := datapath.updateRing(ctx, 0, snapshot); err != nil {
+		t.Fatalf("failed to update ring: %v", err)
+	}
+
+	serves, err := datapath.servesClients(nodeKey(node, 0).IP, map[uint16]time.Duration{})
+	if err != nil || serves {
+		t.Fatalf("expected node without connections to serve no clients, got %t (%v)", serves, err)
+	}
+
+	client, lb := netip.MustParseAddrPort("192.168.1.20:40000"), netip.MustParseAddrPort("192.168.0.242:8080")
+	routeTo(t, prog, tcpPacket(client, lb, 0x02))
+	serves, err = datapath.servesClients(nodeKey(node, 0).IP, map[uint16]time.Duration{})
+	if err != nil || !serves {
+		t.Fatalf("expected node with an open connection to serve clients, got %t (%v)", serves, err)
+	}
+
+	if _, err = datapath.purgeConntrack(nodeKey(node, 0).IP); err != nil {
+		t.Fatalf("failed to purge conntrack: %v", err)
+	}
+	serves, err = datapath.servesClients(nodeKey(node, 0).IP, map[uint16]time.Duration{})
+	if err != nil || serves {
+		t.Fatalf("expected node without connections to serve no clients, got %t (%v)", serves, err)
+	}
+}
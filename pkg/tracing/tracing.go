@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	common "github.com/yago-123/galelb/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Span attributes shared by the load balancer and the nodes
+const (
+	AttrNodeID         = "galelb.node.id"
+	AttrNodeAddr       = "galelb.node.addr"
+	AttrNodeStatus     = "galelb.node.status"
+	AttrTarget         = "galelb.target"
+	AttrService        = "galelb.service"
+	AttrEligible       = "galelb.eligible"
+	AttrNodesAdded     = "galelb.ring.added"
+	AttrNodesRemoved   = "galelb.ring.removed"
+	AttrRingSlot       = "galelb.ring.slot"
+	AttrRingEntries    = "galelb.ring.entries"
+	AttrAffinityPurged = "galelb.affinity.purged"
+)
+
+// ShutdownFunc flushes the pending spans and stops exporting them
+type ShutdownFunc func(ctx context.Context) error
+
+// Setup installs the global tracer provider, exporting spans to the OTLP collector of the configuration. The trace
+// context is propagated (ex: over gRPC metadata) even if tracing is disabled, so that nodes and load balancers with
+// tracing enabled can still be correlated
+func Setup(ctx context.Context, cfg common.Tracing, serviceName string) (ShutdownFunc, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !cfg.Enabled() {
+		return func(_ context.Context) error { return nil }, nil
+	}
+
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio must be between 0 and 1, got %f", cfg.SampleRatio)
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,35 @@
+package tracing
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	common "github.com/yago-123/galelb/config"
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup(t *testing.T) {
+	previous := otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTextMapPropagator(previous)
+	})
+
+	// The trace context is propagated even if the spans are not exported
+	shutdown, err := Setup(context.Background(), common.Tracing{}, "galelb-test")
+	if err != nil {
+		t.Fatalf("failed to set up disabled tracing: %v", err)
+	}
+	if err = shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down disabled tracing: %v", err)
+	}
+	if fields := otel.GetTextMapPropagator().Fields(); !slices.Contains(fields, "traceparent") {
+		t.Fatalf("expected trace context to be propagated, got fields %v", fields)
+	}
+
+	for _, ratio := range []float64{-0.1, 1.5} {
+		if _, err = Setup(context.Background(), common.Tracing{Endpoint: "localhost:4317", SampleRatio: ratio}, "galelb-test"); err == nil {
+			t.Fatalf("expected error for sample ratio %f", ratio)
+		}
+	}
+}
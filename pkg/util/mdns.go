@@ -0,0 +1,314 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DefaultMDNSService is the service announced by the load balancers and browsed by the nodes
+	DefaultMDNSService = "_galelb._tcp.local"
+
+	// MDNSBrowseWindow is the time spent collecting the answers of the instances of a service, as each one answers
+	// on its own
+	MDNSBrowseWindow = time.Second
+	// MaxMDNSMessageSize is the maximum size of the multicast DNS messages (RFC 6762, section 17)
+	MaxMDNSMessageSize = 9000
+
+	// mdnsUnicastResponse is the top bit of the class of the questions, requesting the responders to answer to the
+	// port that sent the query instead of the multicast group (RFC 6762, section 5.4)
+	mdnsUnicastResponse dnsmessage.Class = 1 << 15
+)
+
+var ErrNoInstances = errors.New("no instances found")
+
+// ServiceInstance is an instance of a service discovered via multicast DNS
+type ServiceInstance struct {
+	// Name is the name of the instance (ex: "lb-0._galelb._tcp.local")
+	Name string
+	// Host is the host serving the instance (ex: "lb-0.local")
+	Host string
+	IPs  []net.IP
+	Port int
+}
+
+// ResolveMulticastDNS resolves a hostname using the multicast DNS protocol, returning the addresses of all the A
+// records answered for it. Hostnames must be suffixed with ".local"
+func ResolveMulticastDNS(ctx context.Context, hostname string) ([]net.IP, error) {
+	if !IsMultiCastDNS(hostname) {
+		return nil, fmt.Errorf("domains in mDNS must use .%s top level domain", DefaultMDNSTopLevelDomain)
+	}
+	if _, err := dnsmessage.NewName(fqdn(hostname)); err != nil {
+		return nil, fmt.Errorf("invalid hostname %s: %w", hostname, err)
+	}
+
+	// Responders answer with all the addresses of the host at once, the first response answering the hostname is
+	// enough. Answers for other names (ex: from responders answering queries of other hosts) are ignored
+	records, err := queryMulticastDNS(ctx, []dnsmessage.Question{question(hostname, dnsmessage.TypeA)}, MaxMDNSReadTimeout,
+		func(records []dnsmessage.Resource) bool {
+			return len(findIPs(hostname, records)) > 0
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	ips := findIPs(hostname, records)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no mDNS answer received for %s", hostname)
+	}
+
+	return ips, nil
+}
+
+// BrowseMulticastDNS discovers the instances of a service (ex: "_galelb._tcp.local") using multicast DNS service
+// discovery (RFC 6763). The instances are collected during MDNSBrowseWindow, the SRV and A records not included by the
+// responders as additional records are queried afterward
+func BrowseMulticastDNS(ctx context.Context, service string) ([]ServiceInstance, error) {
+	if !IsMultiCastDNS(service) {
+		return nil, fmt.Errorf("services in mDNS must use .%s top level domain", DefaultMDNSTopLevelDomain)
+	}
+	if _, err := dnsmessage.NewName(fqdn(service)); err != nil {
+		return nil, fmt.Errorf("invalid service name %s: %w", service, err)
+	}
+
+	records, err := queryMulticastDNS(ctx, []dnsmessage.Question{question(service, dnsmessage.TypePTR)}, MDNSBrowseWindow, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Query the records missing, instances without SRV records first and then hosts without A records
+	if missing := missingRecords(service, records, dnsmessage.TypeSRV); len(missing) > 0 {
+		extra, errQuery := queryMulticastDNS(ctx, missing, MDNSBrowseWindow, nil)
+		if errQuery != nil {
+			return nil, errQuery
+		}
+		records = append(records, extra...)
+	}
+
+	if missing := missingRecords(service, records, dnsmessage.TypeA); len(missing) > 0 {
+		extra, errQuery := queryMulticastDNS(ctx, missing, MDNSBrowseWindow, nil)
+		if errQuery != nil {
+			return nil, errQuery
+		}
+		records = append(records, extra...)
+	}
+
+	instances := serviceInstances(service, records)
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("%w for service %s", ErrNoInstances, service)
+	}
+
+	return instances, nil
+}
+
+// serviceInstances assembles the instances of the service from the records received, instances whose host or
+// addresses are unknown are left out
+func serviceInstances(service string, records []dnsmessage.Resource) []ServiceInstance {
+	instances := []ServiceInstance{}
+	for _, name := range instanceNames(service, records) {
+		srv, ok := findSRV(name, records)
+		if !ok {
+			continue
+		}
+
+		host := trimDot(srv.Target.String())
+		ips := findIPs(host, records)
+		if len(ips) == 0 {
+			continue
+		}
+
+		instances = append(instances, ServiceInstance{Name: name, Host: host, IPs: ips, Port: int(srv.Port)})
+	}
+
+	return instances
+}
+
+// missingRecords returns the questions for the records of the given type missing to assemble the instances of the
+// service: the SRV records of the instances or the A records of their hosts
+func missingRecords(service string, records []dnsmessage.Resource, typ dnsmessage.Type) []dnsmessage.Question {
+	questions := []dnsmessage.Question{}
+	for _, name := range instanceNames(service, records) {
+		srv, ok := findSRV(name, records)
+		switch {
+		case typ == dnsmessage.TypeSRV && !ok:
+			questions = append(questions, question(name, dnsmessage.TypeSRV))
+		case typ == dnsmessage.TypeA && ok && len(findIPs(srv.Target.String(), records)) == 0:
+			questions = append(questions, question(srv.Target.String(), dnsmessage.TypeA))
+		}
+	}
+
+	return questions
+}
+
+// instanceNames returns the names of the instances pointed by the PTR records of the service, without duplicates
+func instanceNames(service string, records []dnsmessage.Resource) []string {
+	names := []string{}
+	for _, record := range records {
+		ptr, ok := record.Body.(*dnsmessage.PTRResource)
+		if !ok || !sameName(record.Header.Name.String(), service) {
+			continue
+		}
+
+		name := trimDot(ptr.PTR.String())
+		if !containsName(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func findSRV(name string, records []dnsmessage.Resource) (*dnsmessage.SRVResource, bool) {
+	for _, record := range records {
+		if srv, ok := record.Body.(*dnsmessage.SRVResource); ok && sameName(record.Header.Name.String(), name) {
+			return srv, true
+		}
+	}
+
+	return nil, false
+}
+
+// findIPs returns the addresses of the A and AAAA records of the host, without duplicates
+func findIPs(host string, records []dnsmessage.Resource) []net.IP {
+	ips := []net.IP{}
+	for _, record := range records {
+		if !sameName(record.Header.Name.String(), host) {
+			continue
+		}
+
+		var ip net.IP
+		switch body := record.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+
+		if !containsIP(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips
+}
+
+// queryMulticastDNS sends the questions to the multicast DNS group and returns the answers and additional records of
+// the responses received during the window, until the context is done or until done returns true for the records
+// collected so far if set
+func queryMulticastDNS(ctx context.Context, questions []dnsmessage.Question, window time.Duration, done func([]dnsmessage.Resource) bool) ([]dnsmessage.Resource, error) {
+	conn, err := net.ListenPacket(DefaultMDNSProtocol, DefaultMDNSAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dst, err := net.ResolveUDPAddr(DefaultMDNSProtocol, DefaultMDNSResolver)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := (&dnsmessage.Message{Questions: questions}).Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack mDNS query: %w", err)
+	}
+
+	if _, err = conn.WriteTo(query, dst); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %w", err)
+	}
+
+	deadline := time.Now().Add(window)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err = conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// Unblock the read once the context is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	records := []dnsmessage.Resource{}
+	buffer := make([]byte, MaxMDNSMessageSize)
+	for {
+		n, _, errRead := conn.ReadFrom(buffer)
+		if errRead != nil {
+			var netErr net.Error
+			if errors.As(errRead, &netErr) && netErr.Timeout() {
+				// The records collected are kept if the deadline of the context is reached before the window ends
+				if errors.Is(ctx.Err(), context.Canceled) {
+					return nil, ctx.Err()
+				}
+
+				return records, nil
+			}
+
+			return nil, fmt.Errorf("failed to read mDNS response: %w", errRead)
+		}
+
+		var msg dnsmessage.Message
+		// Malformed packets and queries of other hosts are ignored
+		if errUnpack := msg.Unpack(buffer[:n]); errUnpack != nil || !msg.Response {
+			continue
+		}
+
+		records = append(records, msg.Answers...)
+		records = append(records, msg.Additionals...)
+
+		if done != nil && done(records) {
+			return records, nil
+		}
+	}
+}
+
+// question returns a question requesting a unicast response, as the queries are not sent from the mDNS port
+func question(name string, typ dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(fqdn(name)),
+		Type:  typ,
+		Class: dnsmessage.ClassINET | mdnsUnicastResponse,
+	}
+}
+
+func fqdn(name string) string {
+	return trimDot(name) + "."
+}
+
+func trimDot(name string) string {
+	return strings.TrimSuffix(name, ".")
+}
+
+// sameName compares domain names, which are case-insensitive
+func sameName(a, b string) bool {
+	return strings.EqualFold(trimDot(a), trimDot(b))
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if sameName(n, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
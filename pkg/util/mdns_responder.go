@@ -0,0 +1,355 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// MDNSPort is the port of the multicast DNS group. Queries sent from other ports are legacy unicast queries, which
+	// are answered directly to the sender (RFC 6762, section 6.7)
+	MDNSPort = 5353
+
+	// MDNSHostTTL is the TTL of the records of the host and its service instance, MDNSServiceTTL the one of the PTR
+	// records of the service (RFC 6762, section 10) and MDNSLegacyTTL the maximum TTL of the legacy unicast responses
+	MDNSHostTTL    = 120
+	MDNSServiceTTL = 4500
+	MDNSLegacyTTL  = 10
+
+	// MDNSAnnouncements is the number of times the host is announced once started, MDNSAnnounceInterval the time
+	// between announcements (RFC 6762, section 8.3)
+	MDNSAnnouncements    = 2
+	MDNSAnnounceInterval = 1 * time.Second
+
+	// mdnsCacheFlush is the top bit of the class of the unique records, so that caches replace the records of the
+	// host instead of appending them (RFC 6762, section 10.2)
+	mdnsCacheFlush dnsmessage.Class = 1 << 15
+
+	// mdnsHostLabels is the number of labels of the hostnames announced: host.local
+	mdnsHostLabels = 2
+)
+
+// MulticastDNSResponder answers the multicast DNS queries for a hostname with the addresses of an interface, and
+// announces the host as an instance of DefaultMDNSService, so that it can be found without running a responder such
+// as Avahi
+type MulticastDNSResponder struct {
+	// hostname is the name announced (ex: "lb-0.local"), instance the name of its service instance (ex:
+	// "lb-0._galelb._tcp.local") and port the port announced by the instance
+	hostname string
+	instance string
+	port     int
+
+	iface *net.Interface
+	group *net.UDPAddr
+	conn  *net.UDPConn
+	// done is closed once stopped, so that the pending announcements are not sent
+	done chan struct{}
+
+	logger *logrus.Logger
+}
+
+// NewMulticastDNSResponder joins the multicast DNS group in the interface, the queries are answered once started
+func NewMulticastDNSResponder(logger *logrus.Logger, ifaceName, hostname string, port int) (*MulticastDNSResponder, error) {
+	if !IsMultiCastDNS(hostname) || len(strings.Split(trimDot(hostname), ".")) != mdnsHostLabels {
+		return nil, fmt.Errorf("hostname %s must be a single label in the .%s domain", hostname, DefaultMDNSTopLevelDomain)
+	}
+
+	hostname = trimDot(hostname)
+	instance := strings.TrimSuffix(hostname, "."+DefaultMDNSTopLevelDomain) + "." + DefaultMDNSService
+	if _, err := dnsmessage.NewName(fqdn(instance)); err != nil {
+		return nil, fmt.Errorf("invalid hostname %s: %w", hostname, err)
+	}
+
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("interface not found: %w", err)
+	}
+
+	group, err := net.ResolveUDPAddr(DefaultMDNSProtocol, DefaultMDNSResolver)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket is shared with other responders running in the host, if any
+	conn, err := net.ListenMulticastUDP(DefaultMDNSProtocol, iface, group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join mDNS group in %s: %w", ifaceName, err)
+	}
+
+	return &MulticastDNSResponder{
+		hostname: hostname,
+		instance: instance,
+		port:     port,
+		iface:    iface,
+		group:    group,
+		conn:     conn,
+		done:     make(chan struct{}),
+		logger:   logger,
+	}, nil
+}
+
+// Start announces the host and answers the queries until stopped, in a BLOCKING manner. The responses of other hosts
+// claiming the hostname with other addresses are reported as conflicts, as the nodes would reach either of them
+func (r *MulticastDNSResponder) Start() error {
+	go r.announceLoop()
+
+	buffer := make([]byte, MaxMDNSMessageSize)
+	for {
+		n, src, err := r.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read mDNS query: %w", err)
+		}
+
+		var msg dnsmessage.Message
+		// Malformed packets are ignored
+		if errUnpack := msg.Unpack(buffer[:n]); errUnpack != nil {
+			continue
+		}
+
+		// The addresses can be missing temporarily (ex: interface being reconfigured), the next messages are handled
+		// once they are back
+		ips, errAddrs := r.addresses()
+		if errAddrs != nil {
+			r.logger.Warnf("failed to handle mDNS message from %s: %v", src, errAddrs)
+			continue
+		}
+
+		if msg.Response {
+			if conflicting := r.conflicts(msg, ips); len(conflicting) > 0 {
+				r.logger.Errorf("mDNS hostname %s also claimed by %s with addresses %v, it must be unique",
+					r.hostname, src.IP, conflicting)
+			}
+			continue
+		}
+
+		response, dst, ok := r.answer(msg, src, ips)
+		if !ok {
+			continue
+		}
+
+		// A response that cannot be sent (ex: the querier is unreachable) does not prevent answering the next queries,
+		// queriers retry on their own
+		_ = r.send(response, dst)
+	}
+}
+
+// Stop sends a goodbye, so that the records of the host are removed from the caches, and leaves the group
+func (r *MulticastDNSResponder) Stop() error {
+	close(r.done)
+
+	// The records are removed from the caches after a second anyway
+	_ = r.announce(0)
+
+	return r.conn.Close()
+}
+
+// announceLoop announces the host MDNSAnnouncements times, so that the caches that miss an announcement are filled by
+// the next one
+func (r *MulticastDNSResponder) announceLoop() {
+	for idx := range MDNSAnnouncements {
+		if idx > 0 {
+			select {
+			case <-r.done:
+				return
+			case <-time.After(MDNSAnnounceInterval):
+			}
+		}
+
+		if err := r.announce(MDNSHostTTL); err != nil {
+			r.logger.Warnf("failed to announce %s via mDNS: %v", r.hostname, err)
+		}
+	}
+}
+
+// announce sends all the records of the host to the group with the given TTL, zero removes them from the caches
+func (r *MulticastDNSResponder) announce(ttl uint32) error {
+	ips, err := r.addresses()
+	if err != nil {
+		return err
+	}
+
+	answers := r.hostRecords(ips, dnsmessage.TypeALL, ttl, true)
+	answers = append(answers, r.serviceRecord(min(ttl, MDNSServiceTTL)))
+	answers = append(answers, r.instanceRecords(dnsmessage.TypeALL, ttl, true)...)
+
+	return r.send(dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: answers,
+	}, r.group)
+}
+
+// answer returns the response to the query and where it must be sent, or false if none of the questions is about the
+// host or its service
+func (r *MulticastDNSResponder) answer(query dnsmessage.Message, src *net.UDPAddr, ips []net.IP) (dnsmessage.Message, *net.UDPAddr, bool) {
+	// Legacy unicast queries are answered as a regular DNS server would, with the ID and the questions of the query
+	legacy := src.Port != MDNSPort
+	ttl := uint32(MDNSHostTTL)
+	if legacy {
+		ttl = MDNSLegacyTTL
+	}
+
+	unicast := legacy
+	answers := []dnsmessage.Resource{}
+	additionals := []dnsmessage.Resource{}
+	for _, q := range query.Questions {
+		name := q.Name.String()
+
+		switch {
+		case sameName(name, r.hostname):
+			answers = append(answers, r.hostRecords(ips, q.Type, ttl, !legacy)...)
+		case sameName(name, DefaultMDNSService) && (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL):
+			answers = append(answers, r.serviceRecord(min(ttl, MDNSServiceTTL)))
+			additionals = append(additionals, r.instanceRecords(dnsmessage.TypeALL, ttl, !legacy)...)
+			additionals = append(additionals, r.hostRecords(ips, dnsmessage.TypeALL, ttl, !legacy)...)
+		case sameName(name, r.instance):
+			answers = append(answers, r.instanceRecords(q.Type, ttl, !legacy)...)
+			additionals = append(additionals, r.hostRecords(ips, dnsmessage.TypeALL, ttl, !legacy)...)
+		default:
+			continue
+		}
+
+		unicast = unicast || q.Class&mdnsUnicastResponse != 0
+	}
+
+	if len(answers) == 0 {
+		return dnsmessage.Message{}, nil, false
+	}
+
+	response := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: additionals,
+	}
+	if legacy {
+		response.ID = query.ID
+		response.Questions = query.Questions
+	}
+
+	if unicast {
+		return response, src, true
+	}
+
+	return response, r.group, true
+}
+
+// conflicts returns the addresses that a response claims for the hostname other than the ones of the host, either
+// because another host uses the same hostname or because the addresses of the host changed (RFC 6762, section 9)
+func (r *MulticastDNSResponder) conflicts(response dnsmessage.Message, ips []net.IP) []net.IP {
+	conflicting := []net.IP{}
+	for _, ip := range findIPs(r.hostname, slices.Concat(response.Answers, response.Additionals)) {
+		if !containsIP(ips, ip) {
+			conflicting = append(conflicting, ip)
+		}
+	}
+
+	return conflicting
+}
+
+// hostRecords returns the A and AAAA records of the host matching the type
+func (r *MulticastDNSResponder) hostRecords(ips []net.IP, typ dnsmessage.Type, ttl uint32, flush bool) []dnsmessage.Resource {
+	records := []dnsmessage.Resource{}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && (typ == dnsmessage.TypeA || typ == dnsmessage.TypeALL) {
+			records = append(records, dnsmessage.Resource{
+				Header: resourceHeader(r.hostname, ttl, flush),
+				Body:   &dnsmessage.AResource{A: [4]byte(ip4)},
+			})
+		} else if ip4 == nil && (typ == dnsmessage.TypeAAAA || typ == dnsmessage.TypeALL) {
+			records = append(records, dnsmessage.Resource{
+				Header: resourceHeader(r.hostname, ttl, flush),
+				Body:   &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())},
+			})
+		}
+	}
+
+	return records
+}
+
+// serviceRecord returns the PTR record pointing the service to the instance of the host. Shared by all the instances
+// of the service, so it is never flushed
+func (r *MulticastDNSResponder) serviceRecord(ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: resourceHeader(DefaultMDNSService, ttl, false),
+		Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(fqdn(r.instance))},
+	}
+}
+
+// instanceRecords returns the SRV and TXT records of the instance of the host matching the type. The TXT record is
+// empty, but required by DNS service discovery (RFC 6763, section 6)
+func (r *MulticastDNSResponder) instanceRecords(typ dnsmessage.Type, ttl uint32, flush bool) []dnsmessage.Resource {
+	records := []dnsmessage.Resource{}
+	if typ == dnsmessage.TypeSRV || typ == dnsmessage.TypeALL {
+		records = append(records, dnsmessage.Resource{
+			Header: resourceHeader(r.instance, ttl, flush),
+			Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(fqdn(r.hostname)), Port: uint16(r.port)}, //nolint:gosec // ports are validated
+		})
+	}
+	if typ == dnsmessage.TypeTXT || typ == dnsmessage.TypeALL {
+		records = append(records, dnsmessage.Resource{
+			Header: resourceHeader(r.instance, ttl, flush),
+			Body:   &dnsmessage.TXTResource{TXT: []string{""}},
+		})
+	}
+
+	return records
+}
+
+// addresses returns the addresses of the interface announced, retrieved on each query as they can change
+func (r *MulticastDNSResponder) addresses() ([]net.IP, error) {
+	addrs, err := r.iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve addresses of %s: %w", r.iface.Name, err)
+	}
+
+	return announcedIPs(addrs), nil
+}
+
+// announcedIPs returns the addresses announced out of the ones of the interface, sorted by preference. Link-local IPv6
+// addresses are left out, as AAAA records cannot carry the zone required to reach them
+func announcedIPs(addrs []net.Addr) []net.IP {
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || (ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast()) {
+			continue
+		}
+
+		ips = append(ips, ipNet.IP)
+	}
+	SortIPs(ips)
+
+	return ips
+}
+
+func (r *MulticastDNSResponder) send(msg dnsmessage.Message, dst *net.UDPAddr) error {
+	packet, err := msg.Pack()
+	if err != nil {
+		return fmt.Errorf("failed to pack mDNS response: %w", err)
+	}
+
+	if _, err = r.conn.WriteToUDP(packet, dst); err != nil {
+		return fmt.Errorf("failed to send mDNS response to %s: %w", dst, err)
+	}
+
+	return nil
+}
+
+func resourceHeader(name string, ttl uint32, flush bool) dnsmessage.ResourceHeader {
+	class := dnsmessage.ClassINET
+	if flush {
+		class |= mdnsCacheFlush
+	}
+
+	return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(fqdn(name)), Class: class, TTL: ttl}
+}
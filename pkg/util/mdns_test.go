@@ -0,0 +1,203 @@
+package util
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func resource(name string, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET},
+		Body:   body,
+	}
+}
+
+func TestServiceInstances(t *testing.T) {
+	records := []dnsmessage.Resource{
+		resource("_galelb._tcp.local.", &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("lb-0._galelb._tcp.local.")}),
+		resource("_galelb._tcp.local.", &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("lb-1._galelb._tcp.local.")}),
+		// Instances of other services are ignored
+		resource("_http._tcp.local.", &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("web._http._tcp.local.")}),
+		resource("lb-0._galelb._tcp.local.", &dnsmessage.SRVResource{Target: dnsmessage.MustNewName("lb-0.local."), Port: 7070}),
+		// Names are case-insensitive
+		resource("LB-0.local.", &dnsmessage.AResource{A: [4]byte{192, 168, 1, 2}}),
+		resource("lb-0.local.", &dnsmessage.AResource{A: [4]byte{192, 168, 1, 2}}),
+		resource("lb-0.local.", &dnsmessage.AResource{A: [4]byte{192, 168, 1, 3}}),
+		resource("lb-1._galelb._tcp.local.", &dnsmessage.SRVResource{Target: dnsmessage.MustNewName("lb-1.local."), Port: 7071}),
+	}
+
+	// The address of lb-1 is missing
+	missing := missingRecords("_galelb._tcp.local", records, dnsmessage.TypeA)
+	if len(missing) != 1 || missing[0].Name.String() != "lb-1.local." || missing[0].Type != dnsmessage.TypeA {
+		t.Fatalf("expected the A record of lb-1.local to be missing, got %v", missing)
+	}
+	if missing[0].Class&mdnsUnicastResponse == 0 {
+		t.Fatalf("expected questions to request unicast responses")
+	}
+	if missing = missingRecords("_galelb._tcp.local", records, dnsmessage.TypeSRV); len(missing) != 0 {
+		t.Fatalf("expected no SRV records missing, got %v", missing)
+	}
+
+	instances := serviceInstances("_galelb._tcp.local", records)
+	if len(instances) != 1 {
+		t.Fatalf("expected only lb-0 to be complete, got %+v", instances)
+	}
+
+	instance := instances[0]
+	if instance.Name != "lb-0._galelb._tcp.local" || instance.Host != "lb-0.local" || instance.Port != 7070 {
+		t.Fatalf("unexpected instance %+v", instance)
+	}
+	if len(instance.IPs) != 2 || !instance.IPs[0].Equal(net.IPv4(192, 168, 1, 2)) || !instance.IPs[1].Equal(net.IPv4(192, 168, 1, 3)) {
+		t.Fatalf("expected both addresses of lb-0 without duplicates, got %v", instance.IPs)
+	}
+
+	records = append(records, resource("lb-1.local.", &dnsmessage.AResource{A: [4]byte{192, 168, 1, 4}}))
+	if instances = serviceInstances("_galelb._tcp.local", records); len(instances) != 2 {
+		t.Fatalf("expected both instances once the address of lb-1 is known, got %+v", instances)
+	}
+}
+
+func TestMulticastDNSResponder_answer(t *testing.T) {
+	group := &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: MDNSPort}
+	responder := &MulticastDNSResponder{
+		hostname: "lb-0.local",
+		instance: "lb-0._galelb._tcp.local",
+		port:     7070,
+		group:    group,
+	}
+	ips := []net.IP{net.IPv4(192, 168, 1, 2), net.ParseIP("fd00::2")}
+
+	// Responses are packed and parsed again as the queriers would do
+	answer := func(query dnsmessage.Message, src *net.UDPAddr) (dnsmessage.Message, *net.UDPAddr, bool) {
+		t.Helper()
+
+		response, dst, ok := responder.answer(query, src, ips)
+		if !ok {
+			return response, dst, ok
+		}
+
+		packet, err := response.Pack()
+		if err != nil {
+			t.Fatalf("failed to pack response: %v", err)
+		}
+
+		var parsed dnsmessage.Message
+		if err = parsed.Unpack(packet); err != nil {
+			t.Fatalf("failed to parse response: %v", err)
+		}
+
+		return parsed, dst, ok
+	}
+
+	t.Run("multicast query", func(t *testing.T) {
+		query := dnsmessage.Message{Questions: []dnsmessage.Question{{
+			Name: dnsmessage.MustNewName("LB-0.local."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET,
+		}}}
+
+		response, dst, ok := answer(query, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: MDNSPort})
+		if !ok || dst != group {
+			t.Fatalf("expected response to be sent to the group, got %v", dst)
+		}
+		if len(response.Questions) != 0 || len(response.Answers) != 1 {
+			t.Fatalf("expected a single A record without questions, got %+v", response)
+		}
+		if response.Answers[0].Header.Class&mdnsCacheFlush == 0 || response.Answers[0].Header.TTL != MDNSHostTTL {
+			t.Fatalf("expected a unique record with the TTL of the host, got %+v", response.Answers[0].Header)
+		}
+		if ips := findIPs("lb-0.local", response.Answers); len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 168, 1, 2)) {
+			t.Fatalf("expected the IPv4 address of the host, got %v", ips)
+		}
+	})
+
+	t.Run("legacy unicast query", func(t *testing.T) {
+		src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 40000}
+		query := dnsmessage.Message{
+			Header: dnsmessage.Header{ID: 7},
+			Questions: []dnsmessage.Question{{
+				Name: dnsmessage.MustNewName("lb-0.local."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET,
+			}},
+		}
+
+		response, dst, ok := answer(query, src)
+		if !ok || dst != src {
+			t.Fatalf("expected response to be sent to the querier, got %v", dst)
+		}
+		if response.ID != 7 || len(response.Questions) != 1 || len(response.Answers) != 1 {
+			t.Fatalf("expected the ID and question of the query along with an AAAA record, got %+v", response)
+		}
+		if response.Answers[0].Header.Class != dnsmessage.ClassINET || response.Answers[0].Header.TTL != MDNSLegacyTTL {
+			t.Fatalf("expected a legacy record, got %+v", response.Answers[0].Header)
+		}
+	})
+
+	t.Run("service browsing", func(t *testing.T) {
+		src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: MDNSPort}
+		query := dnsmessage.Message{Questions: []dnsmessage.Question{question(DefaultMDNSService, dnsmessage.TypePTR)}}
+
+		response, dst, ok := answer(query, src)
+		if !ok || dst != src {
+			t.Fatalf("expected unicast response to be sent to the querier, got %v", dst)
+		}
+
+		// The additional records are enough to assemble the instance
+		records := append(response.Answers, response.Additionals...)
+		instances := serviceInstances(DefaultMDNSService, records)
+		if len(instances) != 1 || instances[0].Host != "lb-0.local" || instances[0].Port != 7070 || len(instances[0].IPs) != 2 {
+			t.Fatalf("expected the instance of the load balancer, got %+v", instances)
+		}
+	})
+
+	t.Run("query for other hosts", func(t *testing.T) {
+		query := dnsmessage.Message{Questions: []dnsmessage.Question{question("lb-1.local", dnsmessage.TypeA)}}
+
+		if _, _, ok := answer(query, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: MDNSPort}); ok {
+			t.Fatalf("expected queries for other hosts to be ignored")
+		}
+	})
+}
+
+func TestMulticastDNSResponder_conflicts(t *testing.T) {
+	responder := &MulticastDNSResponder{hostname: "lb-0.local", instance: "lb-0._galelb._tcp.local", port: 7070}
+	ips := []net.IP{net.IPv4(192, 168, 1, 2)}
+
+	// The announcements of the host itself, looped back by the group, are not conflicts
+	own := dnsmessage.Message{Answers: responder.hostRecords(ips, dnsmessage.TypeALL, MDNSHostTTL, true)}
+	if conflicting := responder.conflicts(own, ips); len(conflicting) != 0 {
+		t.Fatalf("expected no conflicts for the records of the host, got %v", conflicting)
+	}
+
+	other := &MulticastDNSResponder{hostname: "lb-0.local", instance: "lb-0._galelb._tcp.local", port: 7070}
+	response := dnsmessage.Message{
+		Answers:     other.instanceRecords(dnsmessage.TypeSRV, MDNSHostTTL, true),
+		Additionals: other.hostRecords([]net.IP{net.IPv4(192, 168, 1, 2), net.IPv4(192, 168, 1, 3)}, dnsmessage.TypeALL, MDNSHostTTL, true),
+	}
+	if conflicting := responder.conflicts(response, ips); len(conflicting) != 1 || !conflicting[0].Equal(net.IPv4(192, 168, 1, 3)) {
+		t.Fatalf("expected the address claimed by the other host, got %v", conflicting)
+	}
+
+	// Responses for other hostnames are not conflicts
+	neighbour := &MulticastDNSResponder{hostname: "lb-1.local"}
+	response = dnsmessage.Message{Answers: neighbour.hostRecords([]net.IP{net.IPv4(192, 168, 1, 3)}, dnsmessage.TypeALL, MDNSHostTTL, true)}
+	if conflicting := responder.conflicts(response, ips); len(conflicting) != 0 {
+		t.Fatalf("expected no conflicts for other hostnames, got %v", conflicting)
+	}
+}
+
+func TestAnnouncedIPs(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.IPv4(169, 254, 1, 2), Mask: net.CIDRMask(16, 32)},
+		&net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.IPv4(192, 168, 1, 2), Mask: net.CIDRMask(24, 32)},
+	}
+
+	ips := announcedIPs(addrs)
+	expected := []net.IP{net.IPv4(192, 168, 1, 2), net.ParseIP("fd00::2"), net.IPv4(169, 254, 1, 2)}
+	if !slices.EqualFunc(ips, expected, net.IP.Equal) {
+		t.Fatalf("expected %v, got %v", expected, ips)
+	}
+}
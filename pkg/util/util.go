@@ -3,6 +3,7 @@ package util
 import (
 	"errors"
 	"net"
+	"slices"
 )
 
 func IsValidIP(input string) bool {
@@ -35,3 +36,35 @@ func GetIPv4FromInterface(ifaceName string) (string, error) {
 	}
 	return "", errors.New("no valid IPv4 address found")
 }
+
+// SortIPs sorts the addresses by preference: IPv4 before IPv6, and routable addresses before link-local ones
+func SortIPs(ips []net.IP) {
+	slices.SortStableFunc(ips, func(a, b net.IP) int {
+		return ipPreference(a) - ipPreference(b)
+	})
+}
+
+// PreferredIP returns the most preferred of the addresses according to SortIPs, or nil if there are none
+func PreferredIP(ips []net.IP) net.IP {
+	if len(ips) == 0 {
+		return nil
+	}
+
+	return slices.MinFunc(ips, func(a, b net.IP) int {
+		return ipPreference(a) - ipPreference(b)
+	})
+}
+
+// ipPreference ranks the address, the lower the more likely to be reachable by other hosts
+func ipPreference(ip net.IP) int {
+	switch ipv4 := ip.To4() != nil; {
+	case ipv4 && !ip.IsLinkLocalUnicast():
+		return 0
+	case !ipv4 && !ip.IsLinkLocalUnicast():
+		return 1
+	case ipv4:
+		return 2
+	default:
+		return 3
+	}
+}
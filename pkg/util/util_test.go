@@ -0,0 +1,28 @@
+package util
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPreferredIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		ips      []net.IP
+		expected net.IP
+	}{
+		{name: "no addresses", ips: []net.IP{}, expected: nil},
+		{name: "IPv4 before IPv6", ips: []net.IP{net.ParseIP("fd00::2"), net.IPv4(192, 168, 1, 2)}, expected: net.IPv4(192, 168, 1, 2)},
+		{name: "routable IPv6 before link-local IPv4", ips: []net.IP{net.IPv4(169, 254, 1, 2), net.ParseIP("fd00::2")}, expected: net.ParseIP("fd00::2")},
+		{name: "link-local IPv4 before link-local IPv6", ips: []net.IP{net.ParseIP("fe80::1"), net.IPv4(169, 254, 1, 2)}, expected: net.IPv4(169, 254, 1, 2)},
+		{name: "first of the same preference", ips: []net.IP{net.IPv4(10, 0, 0, 2), net.IPv4(192, 168, 1, 2)}, expected: net.IPv4(10, 0, 0, 2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ip := PreferredIP(tt.ips); !ip.Equal(tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, ip)
+			}
+		})
+	}
+}
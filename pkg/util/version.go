@@ -0,0 +1,14 @@
+package util
+
+import "runtime/debug"
+
+// Version returns the version of the running binary as recorded by the Go toolchain, "(devel)" for binaries built
+// from a checkout of the repository
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	return info.Main.Version
+}